@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLog is where access log lines go, nil when disabled.
+var accessLog struct {
+	sync.Mutex
+	out io.Writer
+}
+
+// openAccessLog opens config.AccessLog for appending. "-" logs to stdout.
+func openAccessLog() error {
+	switch config.AccessLogFormat {
+	case "common", "combined":
+	default:
+		return fmt.Errorf("Invalid accessLogFormat %q: must be common or combined", config.AccessLogFormat)
+	}
+	switch config.AccessLog {
+	case "":
+		return nil
+	case "-":
+		accessLog.out = os.Stdout
+		return nil
+	}
+	f, err := os.OpenFile(config.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	accessLog.out = f
+	return nil
+}
+
+// accessLogWriter records the status and size of a response for the access
+// log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessLogWriter) WriteHeader(code int) {
+	if aw.status == 0 {
+		aw.status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessLogWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile working for downloads. Every writer wrapping the
+// response on the way to the handler passes src on the same way.
+func (aw *accessLogWriter) ReadFrom(src io.Reader) (int64, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := io.Copy(aw.ResponseWriter, src)
+	aw.bytes += n
+	return n, err
+}
+
+func (aw *accessLogWriter) Flush() {
+	http.NewResponseController(aw.ResponseWriter).Flush()
+}
+
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// logAccess writes a line in the Apache common or combined log format for
+// every request, so existing log analysis tools can read it.
+func logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLog.out == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		size := "-"
+		if aw.bytes > 0 {
+			size = strconv.FormatInt(aw.bytes, 10)
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		// The user field holds the client certificate's common name.
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+			host, logFieldOrDash(clientCertName(r)), start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, escapeLogField(r.RequestURI), r.Proto, status, size)
+		if config.AccessLogFormat == "combined" {
+			line += fmt.Sprintf(" \"%s\" \"%s\"", logFieldOrDash(r.Referer()), logFieldOrDash(r.UserAgent()))
+		}
+
+		accessLog.Lock()
+		defer accessLog.Unlock()
+		io.WriteString(accessLog.out, line+"\n")
+	})
+}
+
+var logFieldEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+func escapeLogField(s string) string {
+	return logFieldEscaper.Replace(s)
+}
+
+func logFieldOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return escapeLogField(s)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ACLRule allows a principal the listed kinds of operation below a path
+// prefix. Once any rule exists, requests no rule allows are refused.
+type ACLRule struct {
+	// Principal is an API key name, token subject, client certificate
+	// common name or, for unauthenticated clients, an address. "*" matches
+	// every caller.
+	Principal string `json:"principal"`
+	// Prefix is the path the rule covers, along with everything below it.
+	// Empty covers every path.
+	Prefix string `json:"prefix"`
+	// Ops are the kinds of operation allowed: read, write, delete, generate,
+	// coordinate and admin.
+	Ops []string `json:"ops"`
+}
+
+func (rule ACLRule) validate() error {
+	if rule.Principal == "" {
+		return errors.New("principal is required")
+	}
+	if len(rule.Ops) == 0 {
+		return errors.New("ops is required")
+	}
+	for _, op := range rule.Ops {
+		switch op {
+		case opRead, opWrite, opDelete, opGenerate, opCoordinate, opAdmin:
+		default:
+			return fmt.Errorf("invalid op %q", op)
+		}
+	}
+	return nil
+}
+
+func validateACL(rules []ACLRule) error {
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (rule ACLRule) grants(principal string, op string) bool {
+	return (rule.Principal == "*" || rule.Principal == principal) && containsString(rule.Ops, op)
+}
+
+// acl holds the rules in effect. enabled stays set once there have been
+// rules, so removing the last one denies everything instead of allowing it.
+var acl struct {
+	sync.Mutex
+	rules   []ACLRule
+	enabled bool
+}
+
+func loadACL() {
+	acl.Lock()
+	defer acl.Unlock()
+	acl.rules = append([]ACLRule{}, config.ACL...)
+	acl.enabled = len(acl.rules) > 0
+}
+
+func aclEnabled() bool {
+	acl.Lock()
+	defer acl.Unlock()
+	return acl.enabled
+}
+
+func aclRules() []ACLRule {
+	acl.Lock()
+	defer acl.Unlock()
+	return append([]ACLRule{}, acl.rules...)
+}
+
+// aclAllows reports whether a rule allows principal op on the resolved path
+// of r.
+func aclAllows(r *http.Request, principal string, op string, resolved string) bool {
+	for _, rule := range aclRules() {
+		if rule.grants(principal, op) && withinAny(r, []string{rule.Prefix}, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclAllowsOp reports whether a rule allows principal op anywhere, for
+// requests that don't name a path.
+func aclAllowsOp(principal string, op string) bool {
+	for _, rule := range aclRules() {
+		if rule.grants(principal, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathParam is a request parameter holding a path, checked by authorize
+// before the handler runs.
+type pathParam struct {
+	name string
+	// ops are the operations the caller must be allowed on the path for
+	// routes that don't need the request's own: the source of a copy is
+	// only read, while that of a move goes away.
+	ops map[string]string
+}
+
+var pathParams = []pathParam{
+	{name: "filePath"},
+	{name: "dirPath"},
+	{name: "goldenPath"},
+	{name: "otherPath"},
+	{name: "templatePath"},
+	{name: "destPath"},
+	{name: "linkPath"},
+	// Writing through a hard link changes its source, so linkFile needs
+	// write access to it. Whether concatFiles removes its sources depends
+	// on another parameter, so it checks the delete itself.
+	{name: "sourcePath", ops: map[string]string{"/copyFile": opRead, "/concatFiles": opRead, "/moveFile": opDelete}},
+	{name: "archivePath", ops: map[string]string{"/extract": opRead}},
+	// Reading through a link reads its target.
+	{name: "target", ops: map[string]string{"/symlink": opRead}},
+	// Only the part before the first action of the template is known
+	// before it is rendered; generateFromTemplate checks each rendered path.
+	{name: "outputPath"},
+}
+
+// streamingRoutes take file content in multipart bodies. authorize only
+// checks the paths in their query strings, so the body isn't read, let
+// alone spooled to disk, before the request is rate limited and queued;
+// authorizeBody checks the paths in the body once it gets to the handler.
+var streamingRoutes = map[string]bool{
+	"/writeFile":  true,
+	"/appendFile": true,
+	"/writeAt":    true,
+	"/upload":     true,
+	"/extract":    true,
+}
+
+// restrictsCaller reports whether what r's caller may do is restricted, by
+// the ACL or the scopes and path prefixes of its API key or token.
+func restrictsCaller(r *http.Request) bool {
+	return aclEnabled() || requestPrincipal(r) != nil
+}
+
+// checkPathParams checks the paths in the parameters values of r against
+// what its caller may do, and reports whether there were any.
+func checkPathParams(r *http.Request, values url.Values) (bool, error) {
+	named := false
+	for _, param := range pathParams {
+		op, ok := param.ops[r.URL.Path]
+		if !ok {
+			op = requestOp(r)
+		}
+		for _, value := range values[param.name] {
+			switch param.name {
+			case "target":
+				// A relative target is relative to the link.
+				if !filepath.IsAbs(cleanPath(value)) {
+					value = filepath.Join(filepath.Dir(values.Get("linkPath")), value)
+				}
+			case "outputPath":
+				value, _, _ = strings.Cut(value, "{{")
+			}
+			resolved, err := resolvePath(r, value)
+			if err != nil {
+				// Left for the handler to report.
+				continue
+			}
+			named = true
+			if err := checkPathScopeFor(r, op, resolved); err != nil {
+				return named, fmt.Errorf("Invalid %s: %w", param.name, err)
+			}
+		}
+	}
+	return named, nil
+}
+
+// isMultipart reports whether the body of r is multipart/form-data.
+func isMultipart(r *http.Request) bool {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return contentType == "multipart/form-data"
+}
+
+// authorize refuses requests the caller's path prefixes or the ACL don't
+// allow with 403. Paths in parameters are checked here; handlers taking
+// paths from the body check them with checkPathScope.
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := requestOp(r)
+		if op == "" || !restrictsCaller(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		values := r.URL.Query()
+		if !(streamingRoutes[r.URL.Path] && isMultipart(r)) {
+			// Parse the query and body the way FormValue in the handlers
+			// will.
+			r.ParseMultipartForm(32 << 20)
+			values = r.Form
+		}
+		named, err := checkPathParams(r, values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !named && aclEnabled() && !aclAllowsOp(requestActor(r), op) {
+			http.Error(w, fmt.Sprintf("%s may not perform %s requests", requestActor(r), op), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeBody checks the paths in the multipart bodies of streaming routes
+// authorize and routeGateway left unread, right before the handler would
+// read them.
+func authorizeBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !streamingRoutes[r.URL.Path] || !isMultipart(r) || (!restrictsCaller(r) && len(config.Gateway) == 0) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid multipart form: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if err := checkGatewayBody(r.PostForm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !restrictsCaller(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, err := checkPathParams(r, r.PostForm); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// aclHandler lists the ACL rules, or adds one.
+func aclHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, "ACL rules listed successfully", requestId, aclRules())
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	rule := ACLRule{
+		Principal: r.FormValue("principal"),
+		Prefix:    r.FormValue("prefix"),
+		Ops:       r.Form["ops"],
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid rule: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	acl.Lock()
+	acl.rules = append(acl.rules, rule)
+	acl.enabled = true
+	acl.Unlock()
+	recordAudit(auditEvent{
+		Actor:  requestActor(r),
+		Action: "aclRuleAdded",
+		Path:   rule.Prefix,
+		Detail: fmt.Sprintf("%s: %v", rule.Principal, rule.Ops),
+	})
+	writeJSON(w, "ACL rule added successfully", requestId, aclRules())
+}
+
+// removeACLRuleHandler removes the ACL rule at the given index, as listed by
+// GET /admin/acl.
+func removeACLRuleHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	index, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil {
+		http.Error(w, "Invalid index value", http.StatusBadRequest)
+		return
+	}
+	acl.Lock()
+	if index < 0 || index >= len(acl.rules) {
+		acl.Unlock()
+		http.Error(w, fmt.Sprintf("No ACL rule at index %d", index), http.StatusNotFound)
+		return
+	}
+	rule := acl.rules[index]
+	acl.rules = append(acl.rules[:index], acl.rules[index+1:]...)
+	acl.Unlock()
+	recordAudit(auditEvent{
+		Actor:  requestActor(r),
+		Action: "aclRuleRemoved",
+		Path:   rule.Prefix,
+		Detail: fmt.Sprintf("%s: %v", rule.Principal, rule.Ops),
+	})
+	writeJSON(w, "ACL rule removed successfully", requestId, aclRules())
+}
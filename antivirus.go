@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AntivirusConfig has uploaded content scanned by a ClamAV daemon before it
+// is stored.
+type AntivirusConfig struct {
+	// Clamd is the address of clamd: the path of its unix socket or a
+	// host:port. Empty disables scanning.
+	Clamd string `json:"clamd"`
+	// Action is what becomes of infected content: reject drops it and
+	// quarantine keeps it in QuarantineDir. Either way the write fails.
+	Action        string `json:"action"`
+	QuarantineDir string `json:"quarantineDir"`
+	// FailOpen stores content unscanned when clamd can't be reached or
+	// fails to scan it, instead of refusing the write.
+	FailOpen bool `json:"failOpen"`
+	// Timeout bounds each exchange with clamd.
+	Timeout Duration `json:"timeout"`
+}
+
+func (c AntivirusConfig) enabled() bool {
+	return c.Clamd != ""
+}
+
+func (c AntivirusConfig) validate() error {
+	switch c.Action {
+	case "reject":
+	case "quarantine":
+		if c.QuarantineDir == "" {
+			return errors.New("quarantineDir is required to quarantine")
+		}
+	default:
+		return fmt.Errorf("unknown action %q: must be reject or quarantine", c.Action)
+	}
+	if c.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	return nil
+}
+
+// clamdChunkSize is the most content sent to clamd in one INSTREAM chunk.
+const clamdChunkSize = 64 << 10
+
+var (
+	errInfected   = errors.New("Content is infected")
+	errScanFailed = errors.New("Unable to scan content for viruses")
+)
+
+var virusScans = newMetric("counter", "frw_virus_scans_total",
+	"Uploads scanned for viruses, by verdict.", "verdict")
+
+// scanReader passes the content of src through while streaming it to clamd,
+// and fails with errInfected instead of reaching EOF if clamd finds a
+// virus, so the content is never committed. With the quarantine action the
+// content is also spooled to be kept.
+type scanReader struct {
+	src   io.Reader
+	path  string
+	actor string
+	conn  net.Conn
+	spool *os.File
+	// sendErr is the first error sending content to clamd. Reading goes
+	// on, and the scan fails at the end.
+	sendErr error
+	header  [4]byte
+	done    bool
+}
+
+// scanUpload returns src as read while it is scanned for viruses, or src
+// itself if scanning is disabled. path is the file the content is written
+// to and actor who writes it, for the audit log. Closing the reader gives
+// up a scan the write didn't finish.
+func scanUpload(src io.Reader, path string, actor string) io.ReadCloser {
+	cfg := config.Antivirus
+	if !cfg.enabled() {
+		return io.NopCloser(src)
+	}
+	s := &scanReader{src: src, path: path, actor: actor}
+	network := "tcp"
+	if strings.HasPrefix(cfg.Clamd, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, cfg.Clamd, time.Duration(cfg.Timeout))
+	if err == nil {
+		s.conn = conn
+		err = s.send([]byte("zINSTREAM\x00"))
+	}
+	if err != nil {
+		s.sendErr = err
+	}
+	if cfg.Action == "quarantine" {
+		if err := os.MkdirAll(cfg.QuarantineDir, 0700); err != nil {
+			s.sendErr = err
+		} else if s.spool, err = os.CreateTemp(cfg.QuarantineDir, ".frw-scan-"); err != nil {
+			s.sendErr = err
+		}
+	}
+	return s
+}
+
+func (s *scanReader) send(p []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(config.Antivirus.Timeout)))
+	_, err := s.conn.Write(p)
+	return err
+}
+
+func (s *scanReader) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+	n, err := s.src.Read(p)
+	for data := p[:n]; len(data) > 0 && s.sendErr == nil && s.conn != nil; {
+		chunk := data[:min(len(data), clamdChunkSize)]
+		data = data[len(chunk):]
+		binary.BigEndian.PutUint32(s.header[:], uint32(len(chunk)))
+		if s.sendErr = s.send(s.header[:]); s.sendErr == nil {
+			s.sendErr = s.send(chunk)
+		}
+	}
+	if s.spool != nil && n > 0 {
+		if _, werr := s.spool.Write(p[:n]); werr != nil && s.sendErr == nil {
+			s.sendErr = werr
+		}
+	}
+	if err == io.EOF {
+		s.done = true
+		if verr := s.finish(); verr != nil {
+			return n, verr
+		}
+	} else if err != nil {
+		s.discard()
+	}
+	return n, err
+}
+
+// finish ends the stream, waits for clamd's verdict and records it. It
+// returns the error the content is refused with, if it is.
+func (s *scanReader) finish() error {
+	defer s.discard()
+	event := auditEvent{Actor: s.actor, Action: "virusScan", Path: s.path}
+	verdict, err := s.verdict()
+	switch {
+	case err != nil:
+		event.Error = err.Error()
+		if config.Antivirus.FailOpen {
+			event.Detail = "stored unscanned"
+			virusScans.inc("unscanned")
+			recordAudit(event)
+			return nil
+		}
+		virusScans.inc("error")
+		recordAudit(event)
+		return fmt.Errorf("%w: %s", errScanFailed, err.Error())
+	case verdict == "OK":
+		event.Detail = "clean"
+		virusScans.inc("clean")
+		recordAudit(event)
+		return nil
+	}
+	event.Detail = "infected: " + verdict
+	if s.spool != nil {
+		kept := filepath.Join(config.Antivirus.QuarantineDir,
+			time.Now().UTC().Format("20060102T150405Z")+"-"+generateUUID()+"-"+filepath.Base(s.path))
+		if err := s.spool.Close(); err == nil {
+			err = os.Rename(s.spool.Name(), kept)
+		}
+		if err != nil {
+			event.Error = err.Error()
+		} else {
+			s.spool = nil
+			event.Detail += ", quarantined to " + kept
+		}
+	}
+	virusScans.inc("infected")
+	recordAudit(event)
+	return fmt.Errorf("%w: %s", errInfected, verdict)
+}
+
+// verdict ends the stream and returns what clamd found: OK or the name of
+// the virus.
+func (s *scanReader) verdict() (string, error) {
+	if s.sendErr != nil {
+		return "", s.sendErr
+	}
+	if err := s.send([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	s.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Antivirus.Timeout)))
+	reply, err := bufio.NewReader(s.conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return reply, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd answered %q", reply)
+}
+
+func (s *scanReader) Close() error {
+	s.discard()
+	return nil
+}
+
+// discard closes the connection to clamd and removes the spooled content.
+func (s *scanReader) discard() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.spool != nil {
+		s.spool.Close()
+		os.Remove(s.spool.Name())
+		s.spool = nil
+	}
+}
+
+// scanStatus returns the status code to answer a write refused by the
+// virus scan with, or 500 for other failures.
+func scanStatus(err error) int {
+	switch {
+	case errors.Is(err, errInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errScanFailed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requestContentReader returns the content of a request given like for
+// writeFile, with its size or -1 if unknown, and newline=true adding a
+// newline after it.
+func requestContentReader(r *http.Request) (io.ReadCloser, int64, error) {
+	body, size, err := streamedContent(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to read fileContent: %s", err.Error())
+	}
+	encoding, err := formEncoding(r)
+	if err == nil && body != nil && encoding != "" {
+		err = errors.New("encoding only applies to the fileContent form value; streamed content is written as is")
+	}
+	newline, newlineErr := formBool(r, "newline")
+	if err == nil {
+		err = newlineErr
+	}
+	if err == nil && body == nil {
+		var fileContent string
+		fileContent, err = formFileContent(r, encoding)
+		body = io.NopCloser(strings.NewReader(fileContent))
+		size = int64(len(fileContent))
+	}
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, 0, err
+	}
+	if newline {
+		body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(body, strings.NewReader("\n")), body}
+		if size >= 0 {
+			size++
+		}
+	}
+	return body, size, nil
+}
+
+// appendFile adds content to the end of a file, creating it if needed, and
+// returns the new size. The content is given like for writeFile, and
+// newline=true adds a trailing newline, for log-style workloads.
+func appendFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	body, size, err := requestContentReader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"size":      size,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Appending to file")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if err := checkPathNotClientEncrypted(filePath); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+	var current int64
+	fileInfo, err := statFile(filePath)
+	if err == nil {
+		current = fileInfo.Size()
+	} else if !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// Encrypted content can't be added to in place, and rewriting the file
+	// for each append would make a log written line by line cost the square
+	// of its size.
+	if fileInfo != nil && atRestEnabled() {
+		http.Error(w, errAtRestAppend.Error(), http.StatusNotImplemented)
+		return
+	}
+	if size >= 0 {
+		if err := checkFileSize(r, filePath, current+size); err != nil {
+			http.Error(w, fmt.Sprintf("File %s", err.Error()), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		var entries []dryRunEntry
+		if fileInfo != nil {
+			entries = append(entries, dryRunEntry{Path: filePath, Action: "append", Size: current})
+		}
+		writeJSON(w, "Dry run: file not appended to", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := ensureParentDir(filePath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// Content added in place is undone by cutting the file back to its
+	// size, only a rewritten file needs its previous version saved.
+	inPlace := appendsInPlace()
+	var existed bool
+	var backup string
+	if !inPlace {
+		existed, backup, err = backupFile(filePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	newSize, err := appendTo(filePath, body, requestActor(r))
+	if err == nil && fileInfo == nil {
+		err = chownCreated(filePath)
+	}
+	if err != nil {
+		discardBackup(backup)
+		http.Error(w, fmt.Sprintf("Unable to append to file: %s", err.Error()), scanStatus(err))
+		return
+	}
+	if inPlace && fileInfo != nil {
+		recordInPlace(requestActor(r), requestId, "append", filePath, current, 0, "")
+	} else {
+		recordOperation(requestActor(r), requestId, "append", filePath, existed, backup)
+	}
+	writeJSON(w, "File appended to successfully", requestId, map[string]interface{}{
+		"size": newSize,
+	})
+}
+
+// appendsInPlace reports whether appendTo adds to the end of files in
+// place. A virus can span the old content and the new, so with a virus scan
+// files are rewritten with the new content after what they hold, each append
+// costing as much as writing the whole file. With encryption at rest only new
+// files are appended to, which means storing them encrypted.
+func appendsInPlace() bool {
+	return !atRestEnabled() && !config.Antivirus.enabled()
+}
+
+// appendTo adds the content of src to the end of filePath and returns the
+// size of the file afterwards. actor is who appends, for the virus scan.
+func appendTo(filePath string, src io.Reader, actor string) (int64, error) {
+	if !appendsInPlace() {
+		var content io.Reader = strings.NewReader("")
+		if f, err := openFile(filePath); err == nil {
+			defer f.Close()
+			content = f
+		} else if !os.IsNotExist(err) {
+			return 0, err
+		}
+		scanned := scanUpload(io.MultiReader(content, src), filePath, actor)
+		defer scanned.Close()
+		return storeFileFrom(filePath, scanned)
+	}
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, src); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), f.Close()
+}
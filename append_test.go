@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// postForm calls handler with a url-encoded POST of form to target.
+func postForm(handler func(w http.ResponseWriter, r *http.Request), target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestAppendUndoneByTruncation(t *testing.T) {
+	_, trashDir := withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	filePath := filepath.Join(root, "app.log")
+	if err := os.WriteFile(filePath, []byte("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"second", "third"} {
+		w := postForm(appendFile, "/appendFile", url.Values{"filePath": {"app.log"}, "fileContent": {line}, "newline": {"true"}})
+		if w.Code != 200 {
+			t.Fatalf("append: %d %s", w.Code, w.Body.String())
+		}
+	}
+	if files, _ := os.ReadDir(trashDir); len(files) != 0 {
+		t.Errorf("appends saved %d copies of the file in the trash", len(files))
+	}
+
+	for _, want := range []string{"first\nsecond\n", "first\n"} {
+		w := postForm(undo, "/undo", url.Values{"filePath": {"app.log"}})
+		if w.Code != 200 {
+			t.Fatalf("undo: %d %s", w.Code, w.Body.String())
+		}
+		if got, _ := os.ReadFile(filePath); string(got) != want {
+			t.Errorf("after undo the file holds %q, want %q", got, want)
+		}
+	}
+}
+
+func TestAppendToNewFileUndone(t *testing.T) {
+	withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+
+	if w := postForm(appendFile, "/appendFile", url.Values{"filePath": {"new.log"}, "fileContent": {"x"}}); w.Code != 200 {
+		t.Fatalf("append: %d %s", w.Code, w.Body.String())
+	}
+	if w := postForm(undo, "/undo", url.Values{"filePath": {"new.log"}}); w.Code != 200 {
+		t.Fatalf("undo: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(root, "new.log")); !os.IsNotExist(err) {
+		t.Errorf("undo left the file the append created: %v", err)
+	}
+}
+
+func TestAppendRefusedWhenEncrypted(t *testing.T) {
+	withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withMasterKeys(t, testMasterKey(t, "current"))
+
+	form := url.Values{"filePath": {"app.log"}, "fileContent": {"first"}}
+	if w := postForm(appendFile, "/appendFile", form); w.Code != 200 {
+		t.Fatalf("append to a new file: %d %s", w.Code, w.Body.String())
+	}
+	if w := postForm(appendFile, "/appendFile", form); w.Code != http.StatusNotImplemented {
+		t.Fatalf("append to an encrypted file: %d, want 501", w.Code)
+	}
+	content, release, err := readFileContent(filepath.Join(root, "app.log"))
+	if err != nil || string(content) != "first" {
+		t.Errorf("file holds %q, %v, want the first append only", content, err)
+	}
+	if release != nil {
+		release()
+	}
+}
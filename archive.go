@@ -0,0 +1,407 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveFormats map the formats /archive writes to their content type and
+// extension.
+var archiveFormats = map[string]struct {
+	contentType string
+	ext         string
+}{
+	"zip":     {"application/zip", ".zip"},
+	"tar":     {"application/x-tar", ".tar"},
+	"tar.gz":  {"application/gzip", ".tar.gz"},
+	"tar.zst": {"application/zstd", ".tar.zst"},
+}
+
+// archiveEntry is a file, directory or symbolic link put into an archive.
+type archiveEntry struct {
+	relPath string
+	info    fs.FileInfo
+}
+
+// collectArchiveEntries returns the entries below root to archive, sorted
+// by path. Entries matching an exclude pattern are left out, directories
+// with everything below them. With include patterns only the files
+// matching one are kept, and directories are only created for them.
+// skip, a resolved path, is never archived.
+func collectArchiveEntries(r *http.Request, root string, includes, excludes []string, skip string) ([]archiveEntry, error) {
+	var mu sync.Mutex
+	var entries []archiveEntry
+	err := walkTree(r.Context(), root, 0, func(relPath string, d fs.DirEntry) error {
+		for _, pattern := range excludes {
+			if matchPathGlob(pattern, relPath) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if filepath.Join(root, filepath.FromSlash(relPath)) == skip {
+			return nil
+		}
+		if d.IsDir() && len(includes) > 0 {
+			return nil
+		}
+		if !d.IsDir() && len(includes) > 0 {
+			included := false
+			for _, pattern := range includes {
+				if matchPathGlob(pattern, relPath) {
+					included = true
+					break
+				}
+			}
+			if !included {
+				return nil
+			}
+		}
+		// Devices, sockets and pipes have no content to archive.
+		if !d.IsDir() && !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed since the directory was read.
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		entries = append(entries, archiveEntry{relPath: relPath, info: info})
+		mu.Unlock()
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].relPath < entries[j].relPath })
+	return entries, err
+}
+
+// writeArchive writes the entries below root to dst as an archive of
+// format.
+func writeArchive(dst io.Writer, format string, root string, entries []archiveEntry) error {
+	if format == "zip" {
+		zw := zip.NewWriter(dst)
+		for _, entry := range entries {
+			if err := writeZipEntry(zw, root, entry); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+
+	var compressor io.WriteCloser
+	switch format {
+	case "tar.gz":
+		compressor = gzip.NewWriter(dst)
+	case "tar.zst":
+		enc, err := zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		compressor = enc
+	}
+	out := dst
+	if compressor != nil {
+		out = compressor
+	}
+	tw := tar.NewWriter(out)
+	for _, entry := range entries {
+		if err := writeTarEntry(tw, root, entry); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if compressor != nil {
+		return compressor.Close()
+	}
+	return nil
+}
+
+// openArchived opens the regular file of entry, returning its current info
+// for the header, as it may have changed since the walk. It returns nil
+// when the file is gone.
+func openArchived(root string, entry archiveEntry) (contentFile, fs.FileInfo, error) {
+	f, err := openFile(filepath.Join(root, filepath.FromSlash(entry.relPath)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func writeTarEntry(tw *tar.Writer, root string, entry archiveEntry) error {
+	info := entry.info
+	var link string
+	var f contentFile
+	var err error
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		if link, err = os.Readlink(filepath.Join(root, filepath.FromSlash(entry.relPath))); err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		if f, info, err = openArchived(root, entry); err != nil || f == nil {
+			return err
+		}
+		defer f.Close()
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = entry.relPath
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if f != nil {
+		// A file growing while it is archived is cut at the size in its
+		// header.
+		_, err = io.CopyN(tw, f, hdr.Size)
+	}
+	return err
+}
+
+func writeZipEntry(zw *zip.Writer, root string, entry archiveEntry) error {
+	info := entry.info
+	var content io.Reader
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		// Zip stores the target of a link as its content.
+		link, err := os.Readlink(filepath.Join(root, filepath.FromSlash(entry.relPath)))
+		if err != nil {
+			return err
+		}
+		content = strings.NewReader(link)
+	case info.Mode().IsRegular():
+		f, current, err := openArchived(root, entry)
+		if err != nil || f == nil {
+			return err
+		}
+		defer f.Close()
+		info, content = current, f
+	}
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = entry.relPath
+	if info.IsDir() {
+		hdr.Name += "/"
+	} else if info.Mode().IsRegular() {
+		hdr.Method = zip.Deflate
+	}
+	w, err := zw.CreateHeader(hdr)
+	if err != nil || content == nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+// archive packages the tree below dirPath into a zip, tar, tar.gz or
+// tar.zst archive, zip by default, for downloading a directory in one
+// request. includePatterns keeps only the files matching one of its globs
+// and excludePatterns leaves entries out, both matched like for listFiles.
+// The archive is streamed as the response, or with a POST giving destPath
+// saved there instead. Symbolic links are stored as links.
+func archive(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dirPath := r.FormValue("dirPath")
+	destPath := r.FormValue("destPath")
+	format := r.FormValue("format")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"destPath":  destPath,
+		"format":    format,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Archiving directory")
+
+	if dirPath == "" {
+		http.Error(w, "dirPath is required", http.StatusBadRequest)
+		return
+	}
+	if format == "" {
+		format = "zip"
+	}
+	kind, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported format %q: use zip, tar, tar.gz or tar.zst", format), http.StatusBadRequest)
+		return
+	}
+	includes, err := formGlobs(r, "includePatterns")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	excludes, err := formGlobs(r, "excludePatterns")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dirPath, err = resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	info, err := statFile(dirPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "dirPath is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	if destPath == "" {
+		entries, err := collectArchiveEntries(r, dirPath, includes, excludes, "")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read directory: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		name := filepath.Base(dirPath) + kind.ext
+		w.Header().Set("Content-Type", kind.contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		w.Header().Set("X-Request-Id", requestId)
+		w.Header().Set("X-Server-Id", serverId)
+		if err := writeArchive(w, format, dirPath, entries); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"dirPath":   dirPath,
+				"requestId": requestId,
+				"serverId":  serverId,
+			}).Errorf("Unable to archive directory: %s", err.Error())
+			// The status is sent already; breaking off the response keeps
+			// the client from taking a truncated archive for a whole one.
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	// Saving the archive writes, which this read endpoint otherwise doesn't.
+	if r.Method != http.MethodPost {
+		http.Error(w, "Saving the archive to destPath needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if isReadOnly() {
+		http.Error(w, "Server is in read-only mode", http.StatusForbidden)
+		return
+	}
+	if !beginWrite() {
+		refuseMaintenance(w)
+		return
+	}
+	defer endWrite()
+	destPath, err = resolvePath(r, destPath)
+	if err == nil {
+		err = checkPathScopeFor(r, opWrite, destPath)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	unlock := lockWrites(destPath)
+	defer unlock()
+	destInfo, err := statFile(destPath)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", destPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if destInfo != nil {
+		if destInfo.IsDir() {
+			http.Error(w, "destPath is a directory", http.StatusBadRequest)
+			return
+		}
+		if !overwrite {
+			http.Error(w, "destPath already exists; set overwrite=true to replace it", http.StatusConflict)
+			return
+		}
+	}
+	entries, err := collectArchiveEntries(r, dirPath, includes, excludes, destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := writeArchive(pw, format, dirPath, entries)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	size, err := storeFileFrom(destPath, &cappedReader{r: pr, limit: sizeLimit(r, destPath)})
+	// Stops the archiving if storing failed before reading it all.
+	pr.Close()
+	if archiveErr := <-written; archiveErr != nil && !errors.Is(archiveErr, io.ErrClosedPipe) {
+		err = archiveErr
+	}
+	if err != nil {
+		discardBackup(backup)
+		if errors.Is(err, errTooLarge) {
+			http.Error(w, fmt.Sprintf("Archive %s", err.Error()), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to archive directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "archive", destPath, existed, backup)
+	writeJSON(w, "Directory archived successfully", requestId, map[string]interface{}{
+		"format":  format,
+		"size":    size,
+		"entries": len(entries),
+	})
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// With encryption at rest every file the server writes is encrypted on disk
+// with a random data key of its own, which is stored in the file's header
+// wrapped (encrypted) by a master key, and decrypted when it is opened.
+// Rotating the master key only rewrites the headers.
+//
+// A file encrypted at rest starts with atRestMagic, the id of the master
+// key, the wrapped data key with the nonce it was wrapped under, and the
+// nonce of the content, which follows in the chunks of client-key encrypted
+// files, sealed with the data key.
+const (
+	masterKeyIdSize  = 8
+	wrappedKeySize   = 12 + 32 + 16
+	atRestHeaderSize = 8 + masterKeyIdSize + wrappedKeySize + 12
+)
+
+var atRestMagic = []byte("FRWATR1\n")
+
+var (
+	errNoMasterKey   = errors.New("File is encrypted with a master key that is not loaded")
+	errAtRestWriteAt = errors.New("Files encrypted at rest can't be written at an offset")
+	errAtRestAppend  = errors.New("Files encrypted at rest can't be appended to")
+)
+
+// EncryptionConfig enables encryption at rest.
+type EncryptionConfig struct {
+	// KeyFile holds the master keys, one "<name> <base64 256-bit key>" per
+	// line. The first encrypts new files; the others only decrypt files
+	// not yet rotated to it. Empty stores files in the clear. With KMS
+	// set, each key is given as ciphertext the service decrypts.
+	KeyFile string `json:"keyFile"`
+	// KMS keeps the master keys wrapped by an external key management
+	// service.
+	KMS KMSConfig `json:"kms"`
+}
+
+// masterKey is a key data keys are wrapped with.
+type masterKey struct {
+	name string
+	id   [masterKeyIdSize]byte
+	aead cipher.AEAD
+}
+
+// masterKeys holds the loaded master keys, the current one first.
+var masterKeys struct {
+	sync.RWMutex
+	keys []*masterKey
+}
+
+// atRestEnabled reports whether files are encrypted at rest.
+func atRestEnabled() bool {
+	masterKeys.RLock()
+	defer masterKeys.RUnlock()
+	return len(masterKeys.keys) > 0
+}
+
+// setupEncryption loads the master keys from config.Encryption.KeyFile,
+// unwrapping them with the key management service if one is configured.
+func setupEncryption() error {
+	if config.Encryption.KeyFile == "" {
+		return nil
+	}
+	if err := setupKMS(); err != nil {
+		return err
+	}
+	keys, err := readMasterKeys(config.Encryption.KeyFile)
+	if err != nil {
+		return err
+	}
+	masterKeys.Lock()
+	masterKeys.keys = keys
+	masterKeys.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"masterKey": keys[0].name,
+		"keys":      len(keys),
+		"kms":       config.Encryption.KMS.Provider,
+		"serverId":  serverId,
+	}).Info("Encrypting files at rest")
+	startKMSRefresh()
+	return nil
+}
+
+// readMasterKeys parses the master key file at keyFile, having kms unwrap
+// the keys if it is set.
+func readMasterKeys(keyFile string) ([]*masterKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*masterKey
+	names := map[string]bool{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, encoded, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected a name and a key", keyFile, i+1)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("%s:%d: key %s is given twice", keyFile, i+1, name)
+		}
+		names[name] = true
+		var key []byte
+		if kms != nil {
+			if key, err = kms.decrypt(strings.TrimSpace(encoded)); err != nil {
+				return nil, fmt.Errorf("%s:%d: unable to unwrap key %s: %w", keyFile, i+1, name, err)
+			}
+		} else if key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded)); err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key %s is not a base64-encoded 256-bit key", keyFile, i+1, name)
+		}
+		k, err := newMasterKey(name, key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no keys", keyFile)
+	}
+	return keys, nil
+}
+
+// newMasterKey returns the master key name holding key.
+func newMasterKey(name string, key []byte) (*masterKey, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	k := &masterKey{name: name, aead: aead}
+	sum := sha256.Sum256(key)
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// currentMasterKey returns the key new files are encrypted with.
+func currentMasterKey() *masterKey {
+	masterKeys.RLock()
+	defer masterKeys.RUnlock()
+	return masterKeys.keys[0]
+}
+
+// findMasterKey returns the loaded key with id, or nil.
+func findMasterKey(id []byte) *masterKey {
+	masterKeys.RLock()
+	defer masterKeys.RUnlock()
+	for _, k := range masterKeys.keys {
+		if bytes.Equal(k.id[:], id) {
+			return k
+		}
+	}
+	return nil
+}
+
+// wrapKey returns dataKey wrapped with the master key k, under a new nonce.
+func (k *masterKey) wrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, append(bytes.Clone(atRestMagic), k.id[:]...)), nil
+}
+
+// unwrapKey returns the data key wrapped with k.
+func (k *masterKey) unwrapKey(wrapped []byte) ([]byte, error) {
+	dataKey, err := k.aead.Open(nil, wrapped[:12], wrapped[12:], append(bytes.Clone(atRestMagic), k.id[:]...))
+	if err != nil {
+		return nil, errCorruptEncrypted
+	}
+	return dataKey, nil
+}
+
+// encryptAtRest returns a reader of src encrypted at rest with a new data
+// key wrapped by the current master key.
+func encryptAtRest(src io.Reader) (io.Reader, error) {
+	k := currentMasterKey()
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := k.wrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, atRestHeaderSize)
+	header = append(header, atRestMagic...)
+	header = append(header, k.id[:]...)
+	header = append(header, wrapped...)
+	header = append(header, nonce...)
+	return newChunkEncryptReader(src, aead, nonce, header), nil
+}
+
+// readAtRestHeader reads the header of f, returning nil if f is not
+// encrypted at rest.
+func readAtRestHeader(f *os.File) ([]byte, error) {
+	header := make([]byte, atRestHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(atRestMagic)], atRestMagic) {
+		return nil, nil
+	}
+	return header, nil
+}
+
+// contentFile is a file opened for reading its content. Files encrypted at
+// rest are decrypted as they are read.
+type contentFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// openContent returns f, or a reader decrypting it if it is encrypted at
+// rest. It takes over f.
+func openContent(f *os.File) (contentFile, error) {
+	if !atRestEnabled() {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		// Left for the caller to report.
+		return f, nil
+	}
+	header, err := readAtRestHeader(f)
+	if err == nil && header == nil {
+		// Files written before encryption was enabled, or created empty,
+		// are read as they are.
+		return f, nil
+	}
+	var dataKey []byte
+	if err == nil {
+		k := findMasterKey(header[8 : 8+masterKeyIdSize])
+		if k == nil {
+			err = errNoMasterKey
+		} else {
+			dataKey, err = k.unwrapKey(header[8+masterKeyIdSize : 8+masterKeyIdSize+wrappedKeySize])
+		}
+	}
+	var aead cipher.AEAD
+	if err == nil {
+		aead, err = newGCM(dataKey)
+	}
+	size := int64(-1)
+	if err == nil {
+		if size = atRestPlainSize(info.Size()); size < 0 {
+			err = errCorruptEncrypted
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &atRestFile{
+		f:     f,
+		info:  atRestInfo{FileInfo: info, size: size},
+		aead:  aead,
+		nonce: header[atRestHeaderSize-12:],
+		index: -1,
+	}, nil
+}
+
+// atRestPlainSize returns the size of the content of a file encrypted at
+// rest that is size bytes on disk, or -1 if no such file is that size.
+func atRestPlainSize(size int64) int64 {
+	const sealed = encryptedChunkSize + 16
+	body := size - atRestHeaderSize
+	chunks := (body + sealed - 1) / sealed
+	if body < 16 || body-(chunks-1)*sealed < 16 {
+		return -1
+	}
+	return body - chunks*16
+}
+
+// atRestInfo is the info of a file encrypted at rest, giving the size of its
+// content.
+type atRestInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i atRestInfo) Size() int64 {
+	return i.size
+}
+
+// sameFile is os.SameFile for infos of files opened with openFile too.
+func sameFile(a, b os.FileInfo) bool {
+	if i, ok := a.(atRestInfo); ok {
+		a = i.FileInfo
+	}
+	if i, ok := b.(atRestInfo); ok {
+		b = i.FileInfo
+	}
+	return os.SameFile(a, b)
+}
+
+// atRestFile reads the content of a file encrypted at rest, decrypting the
+// chunks it is asked for.
+type atRestFile struct {
+	f      *os.File
+	info   atRestInfo
+	aead   cipher.AEAD
+	nonce  []byte
+	offset int64
+
+	mu    sync.Mutex
+	index int64
+	chunk []byte
+	plain []byte
+}
+
+func (a *atRestFile) ReadAt(p []byte, off int64) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		if off >= a.info.size {
+			return n, io.EOF
+		}
+		index := off / encryptedChunkSize
+		if err := a.load(index); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], a.plain[off-index*encryptedChunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// load decrypts chunk index into a.plain.
+func (a *atRestFile) load(index int64) error {
+	if a.index == index {
+		return nil
+	}
+	const sealed = encryptedChunkSize + 16
+	start := index * encryptedChunkSize
+	length := min(encryptedChunkSize, a.info.size-start) + 16
+	if a.chunk == nil {
+		a.chunk = make([]byte, sealed)
+	}
+	if _, err := a.f.ReadAt(a.chunk[:length], atRestHeaderSize+index*sealed); err != nil {
+		if err == io.EOF {
+			return errCorruptEncrypted
+		}
+		return err
+	}
+	last := start+encryptedChunkSize >= a.info.size
+	plain, err := a.aead.Open(a.plain[:0], chunkNonce(a.nonce, uint64(index)), a.chunk[:length], chunkAD(last))
+	if err != nil {
+		a.index = -1
+		return errCorruptEncrypted
+	}
+	a.plain, a.index = plain, index
+	return nil
+}
+
+func (a *atRestFile) Read(p []byte) (int, error) {
+	n, err := a.ReadAt(p, a.offset)
+	a.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (a *atRestFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += a.offset
+	case io.SeekEnd:
+		offset += a.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	a.offset = offset
+	return offset, nil
+}
+
+func (a *atRestFile) Stat() (os.FileInfo, error) {
+	return a.info, nil
+}
+
+func (a *atRestFile) Close() error {
+	return a.f.Close()
+}
+
+// rewrapFile wraps the data key of the file at filePath with the current
+// master key, rewriting only its header. It reports whether the file needed
+// it.
+func rewrapFile(filePath string) (bool, error) {
+	unlock := lockWrites(filePath)
+	defer unlock()
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	header, err := readAtRestHeader(f)
+	if err != nil || header == nil {
+		return false, err
+	}
+	current := currentMasterKey()
+	id := header[8 : 8+masterKeyIdSize]
+	if bytes.Equal(id, current.id[:]) {
+		return false, nil
+	}
+	k := findMasterKey(id)
+	if k == nil {
+		return false, errNoMasterKey
+	}
+	dataKey, err := k.unwrapKey(header[8+masterKeyIdSize : 8+masterKeyIdSize+wrappedKeySize])
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := current.wrapKey(dataKey)
+	if err != nil {
+		return false, err
+	}
+	update := append(bytes.Clone(current.id[:]), wrapped...)
+	if _, err := f.WriteAt(update, 8); err != nil {
+		return false, err
+	}
+	if err := f.Sync(); err != nil {
+		return false, err
+	}
+	// The content is unchanged, and so should its ETag be.
+	return true, os.Chtimes(filePath, time.Time{}, info.ModTime())
+}
+
+// rotationRoots returns the directories holding files encrypted at rest:
+// besides the stored files, the copies kept in the trash for undo and the
+// uploads being assembled. Those below another are left out, so no file is
+// visited twice.
+func rotationRoots() []string {
+	var dirs []string
+	for _, dir := range []string{config.RootDir, config.Tenants.Dir, config.TrashDir, uploadDir()} {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	var roots []string
+	for i, dir := range dirs {
+		nested := false
+		for j, other := range dirs {
+			// Of two equal directories the first is kept.
+			if i != j && isWithin(other, dir) && (j < i || !isWithin(dir, other)) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
+
+// rotateKeys rewraps the data keys of every file below roots with the
+// current master key. Roots that don't exist yet hold nothing to rewrap.
+func rotateKeys(ctx context.Context, j *job, roots []string) error {
+	var rewrapped, failed atomic.Int64
+	// Files are rewrapped one at a time, so the job can pause between them
+	// while maintenance mode is enabled.
+	var mu sync.Mutex
+	for _, root := range roots {
+		if _, err := os.Stat(root); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		err := walkTree(ctx, root, 0, func(relPath string, entry fs.DirEntry) error {
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err := j.pauseForMaintenance(ctx); err != nil {
+				return err
+			}
+			filePath := filepath.Join(root, filepath.FromSlash(relPath))
+			done, err := rewrapFile(filePath)
+			switch {
+			case err != nil:
+				failed.Add(1)
+				j.logf("%s failed: %s", filePath, err.Error())
+			case done:
+				rewrapped.Add(1)
+				j.setProgress(rewrapped.Load(), 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	j.logf("%d files rewrapped, %d failed", rewrapped.Load(), failed.Load())
+	if failed.Load() > 0 {
+		return fmt.Errorf("%d files could not be rewrapped", failed.Load())
+	}
+	return nil
+}
+
+// rotateKeysHandler reloads the master key file and, as a background job,
+// rewraps the data keys of every stored file, including those in the trash
+// and upload directories, with the key now first in it, so older keys can
+// then be retired from the file. GET lists the loaded keys.
+func rotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"method":    r.Method,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Rotating master keys")
+
+	if !atRestEnabled() {
+		http.Error(w, "Encryption at rest is not enabled", http.StatusConflict)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if isReadOnly() {
+			http.Error(w, "Server is in read-only mode", http.StatusForbidden)
+			return
+		}
+		if refuseInMaintenance(w) {
+			return
+		}
+		if config.RootDir == "" && config.Tenants.Dir == "" {
+			http.Error(w, "Rotating keys needs rootDir or tenantsDir to know which files to rewrap", http.StatusConflict)
+			return
+		}
+		roots := rotationRoots()
+		keys, err := readMasterKeys(config.Encryption.KeyFile)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to load master keys: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		masterKeys.Lock()
+		masterKeys.keys = keys
+		masterKeys.Unlock()
+		j := startJob("rotateKeys", "Rewrap data keys with master key "+keys[0].name, func(ctx context.Context, j *job) error {
+			return rotateKeys(ctx, j, roots)
+		})
+		writeJSON(w, "Key rotation started", requestId, map[string]interface{}{
+			"jobId":     j.id,
+			"masterKey": keys[0].name,
+		})
+		return
+	}
+
+	masterKeys.RLock()
+	list := make([]map[string]interface{}, 0, len(masterKeys.keys))
+	for i, k := range masterKeys.keys {
+		list = append(list, map[string]interface{}{
+			"name":    k.name,
+			"id":      hex.EncodeToString(k.id[:]),
+			"current": i == 0,
+		})
+	}
+	masterKeys.RUnlock()
+	writeJSON(w, "Master keys retrieved successfully", requestId, map[string]interface{}{
+		"keys": list,
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withMasterKeys loads the named master keys, the first current, for the
+// duration of the test.
+func withMasterKeys(t *testing.T, keys ...*masterKey) {
+	t.Helper()
+	masterKeys.Lock()
+	saved := masterKeys.keys
+	masterKeys.keys = keys
+	masterKeys.Unlock()
+	t.Cleanup(func() {
+		masterKeys.Lock()
+		masterKeys.keys = saved
+		masterKeys.Unlock()
+	})
+}
+
+func testMasterKey(t *testing.T, name string) *masterKey {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	k, err := newMasterKey(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func masterKeyOf(t *testing.T, filePath string) []byte {
+	t.Helper()
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header, err := readAtRestHeader(f)
+	if err != nil || header == nil {
+		t.Fatalf("%s has no header: %v", filePath, err)
+	}
+	return header[8 : 8+masterKeyIdSize]
+}
+
+func TestAtRestRoundTrip(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withMasterKeys(t, testMasterKey(t, "current"))
+
+	for _, size := range []int{0, 1, encryptedChunkSize, 2*encryptedChunkSize + 100} {
+		content := make([]byte, size)
+		rand.Read(content)
+		filePath := filepath.Join(root, "file")
+		if _, err := storeFileFrom(filePath, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, _ := os.ReadFile(filePath)
+		if size > 0 && !bytes.HasPrefix(stored, atRestMagic) || size >= 16 && bytes.Contains(stored, content[:16]) {
+			t.Fatalf("%d bytes stored in the clear", size)
+		}
+		f, err := openFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := f.Stat(); info.Size() != int64(size) {
+			t.Errorf("size %d, want %d", info.Size(), size)
+		}
+		got := make([]byte, size)
+		if _, err := io.ReadFull(f, got); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("read %d bytes back: %v", size, err)
+		}
+		// Reads may start anywhere and span chunks.
+		if size > encryptedChunkSize {
+			part := make([]byte, 200)
+			off := int64(encryptedChunkSize - 100)
+			if _, err := f.ReadAt(part, off); err != nil || !bytes.Equal(part, content[off:off+200]) {
+				t.Errorf("read across chunks: %v", err)
+			}
+		}
+		f.Close()
+	}
+}
+
+func TestAtRestRefusesUnreadable(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	previous := testMasterKey(t, "previous")
+	withMasterKeys(t, previous)
+	filePath := filepath.Join(root, "file")
+	if _, err := storeFileFrom(filePath, strings.NewReader(strings.Repeat("secret", 1000))); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := os.ReadFile(filePath)
+
+	withMasterKeys(t, testMasterKey(t, "current"))
+	if _, err := openFile(filePath); !errors.Is(err, errNoMasterKey) {
+		t.Errorf("opened with a retired key: %v", err)
+	}
+
+	withMasterKeys(t, previous)
+	for name, corrupt := range map[string]func([]byte) []byte{
+		"flipped bit": func(b []byte) []byte { b[len(b)-20] ^= 1; return b },
+		"truncated":   func(b []byte) []byte { return b[:len(b)-1] },
+	} {
+		os.WriteFile(filePath, corrupt(bytes.Clone(stored)), 0644)
+		f, err := openFile(filePath)
+		if err == nil {
+			_, err = io.ReadAll(f)
+			f.Close()
+		}
+		if !errors.Is(err, errCorruptEncrypted) {
+			t.Errorf("%s: %v, want %v", name, err, errCorruptEncrypted)
+		}
+	}
+}
+
+func TestRotateKeysRewrapsTrashAndUploads(t *testing.T) {
+	root := testRoot(t)
+	trashDir := t.TempDir()
+	uploads := t.TempDir()
+	withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = trashDir; c.UploadDir = uploads })
+	previous, current := testMasterKey(t, "previous"), testMasterKey(t, "current")
+	withMasterKeys(t, previous)
+
+	files := []string{
+		filepath.Join(root, "stored"),
+		filepath.Join(trashDir, "backup"),
+		filepath.Join(uploads, "id", "assembled"),
+	}
+	for _, filePath := range files {
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if _, err := storeFileFrom(filePath, strings.NewReader("secret")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withMasterKeys(t, current, previous)
+	j := startJob("rotateKeys", "test", func(ctx context.Context, j *job) error {
+		return rotateKeys(ctx, j, rotationRoots())
+	})
+	<-j.done
+	if status := j.summary(false)["status"]; status != "completed" {
+		t.Fatalf("rotation %v: %v", status, j.summary(true))
+	}
+
+	// Every file can still be read once the previous key is retired.
+	withMasterKeys(t, current)
+	for _, filePath := range files {
+		if id := masterKeyOf(t, filePath); !bytes.Equal(id, current.id[:]) {
+			t.Errorf("%s is still wrapped with %x", filePath, id)
+		}
+		content, release, err := readFileContent(filePath)
+		if err != nil || string(content) != "secret" {
+			t.Errorf("%s: %q, %v", filePath, content, err)
+		}
+		if release != nil {
+			release()
+		}
+	}
+}
+
+func TestRotateKeysPausesForMaintenance(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	previous, current := testMasterKey(t, "previous"), testMasterKey(t, "current")
+	withMasterKeys(t, previous)
+	filePath := filepath.Join(root, "stored")
+	if _, err := storeFileFrom(filePath, strings.NewReader("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	withMasterKeys(t, current, previous)
+	setMaintenance(t, "enabled=true")
+	t.Cleanup(func() { setMaintenance(t, "enabled=false") })
+
+	w := httptest.NewRecorder()
+	rotateKeysHandler(w, httptest.NewRequest("POST", "/admin/encryption/keys", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("rotation started in maintenance mode: %d", w.Code)
+	}
+
+	j := startJob("rotateKeys", "test", func(ctx context.Context, j *job) error {
+		return rotateKeys(ctx, j, rotationRoots())
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for j.summary(false)["status"] != "paused" {
+		if time.Now().After(deadline) {
+			t.Fatalf("rotation is %v, want paused", j.summary(false)["status"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if id := masterKeyOf(t, filePath); !bytes.Equal(id, previous.id[:]) {
+		t.Fatal("file rewrapped in maintenance mode")
+	}
+
+	setMaintenance(t, "enabled=false")
+	<-j.done
+	if status := j.summary(false)["status"]; status != "completed" {
+		t.Fatalf("rotation %v: %v", status, j.summary(true))
+	}
+	if id := masterKeyOf(t, filePath); !bytes.Equal(id, current.id[:]) {
+		t.Errorf("file is still wrapped with %x", id)
+	}
+}
+
+func TestRotationRoots(t *testing.T) {
+	root := testRoot(t)
+	uploads := t.TempDir()
+	withConfig(t, func(c *Config) {
+		c.RootDir = root
+		c.Tenants.Dir = root
+		c.TrashDir = filepath.Join(root, ".trash")
+		c.UploadDir = uploads
+	})
+	got := rotationRoots()
+	if want := []string{root, uploads}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("roots %v, want %v", got, want)
+	}
+}
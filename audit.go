@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditHistorySize is the number of recent audit events kept in memory for
+// /admin/audit.
+const auditHistorySize = 1000
+
+// auditEvent records an action taken on stored data, including ones the
+// server takes on its own such as lifecycle rules firing.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Path   string    `json:"path,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var audit struct {
+	sync.Mutex
+	events []auditEvent
+	file   *os.File
+}
+
+// recordAudit logs event, appends it to config.AuditLog if one is set and
+// keeps it in the in-memory history.
+func recordAudit(event auditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	logrus.WithFields(logrus.Fields{
+		"actor":    event.Actor,
+		"action":   event.Action,
+		"path":     event.Path,
+		"detail":   event.Detail,
+		"error":    event.Error,
+		"serverId": serverId,
+	}).Info("Audit")
+
+	audit.Lock()
+	defer audit.Unlock()
+	audit.events = append(audit.events, event)
+	if len(audit.events) > auditHistorySize {
+		audit.events = audit.events[len(audit.events)-auditHistorySize:]
+	}
+
+	if config.AuditLog == "" {
+		return
+	}
+	if audit.file == nil {
+		f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logrus.WithError(err).Error("Unable to open audit log")
+			return
+		}
+		audit.file = f
+	}
+	line, _ := json.Marshal(event)
+	if _, err := audit.file.Write(append(line, '\n')); err != nil {
+		logrus.WithError(err).Error("Unable to write audit log")
+	}
+}
+
+// listAudit returns the most recent audit events, newest last.
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := auditHistorySize
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			http.Error(w, "Invalid limit value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	audit.Lock()
+	events := audit.events
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	events = append([]auditEvent(nil), events...)
+	audit.Unlock()
+
+	writeJSON(w, "Audit events listed successfully", requestId, events)
+}
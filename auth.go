@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey is a credential clients send as "Authorization: Bearer <key>".
+type APIKey struct {
+	// Name identifies the key in the audit trail and /admin/keys. The key
+	// itself is never shown.
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// Scopes are the kinds of operation the key may perform: read, write,
+	// delete, generate, coordinate and admin.
+	Scopes []string `json:"scopes"`
+	// Tenant binds the key to a tenant. Keys without one pick a tenant with
+	// the X-Tenant header.
+	Tenant string `json:"tenant"`
+}
+
+func validateAPIKeys(keys []APIKey) error {
+	names := map[string]bool{}
+	secrets := map[string]bool{}
+	for _, k := range keys {
+		if k.Name == "" {
+			return errors.New("name is required")
+		}
+		if names[k.Name] {
+			return fmt.Errorf("duplicate name %q", k.Name)
+		}
+		names[k.Name] = true
+		if k.Key == "" {
+			return fmt.Errorf("key %q: key is required", k.Name)
+		}
+		if secrets[k.Key] {
+			return fmt.Errorf("key %q: key is used twice", k.Name)
+		}
+		secrets[k.Key] = true
+		for _, scope := range k.Scopes {
+			switch scope {
+			case opRead, opWrite, opDelete, opGenerate, opCoordinate, opAdmin:
+			default:
+				return fmt.Errorf("key %q: invalid scope %q", k.Name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// keyStatus is an API key as listed by /admin/keys.
+type keyStatus struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Revoked   bool       `json:"revoked"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// apiKeys holds the configured keys by the SHA-256 of the key, so looking one
+// up doesn't compare secrets byte by byte.
+var apiKeys struct {
+	sync.Mutex
+	byHash map[[sha256.Size]byte]*keyStatus
+	keys   []*keyStatus
+}
+
+func loadAPIKeys() {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	apiKeys.byHash = map[[sha256.Size]byte]*keyStatus{}
+	apiKeys.keys = nil
+	for _, k := range config.APIKeys {
+		status := &keyStatus{Name: k.Name, Scopes: append([]string{}, k.Scopes...), Tenant: k.Tenant}
+		apiKeys.byHash[sha256.Sum256([]byte(k.Key))] = status
+		apiKeys.keys = append(apiKeys.keys, status)
+	}
+}
+
+// lookupAPIKey returns the key matching secret, or nil if there is none or it
+// has been revoked.
+func lookupAPIKey(secret string) *keyStatus {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	k := apiKeys.byHash[sha256.Sum256([]byte(secret))]
+	if k == nil || k.Revoked {
+		return nil
+	}
+	return k
+}
+
+// revokeAPIKey makes the key with the given name unusable until the server
+// restarts. It reports false if there is no such key.
+func revokeAPIKey(name string) bool {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	for _, k := range apiKeys.keys {
+		if k.Name == name {
+			if !k.Revoked {
+				now := time.Now()
+				k.Revoked = true
+				k.RevokedAt = &now
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func listAPIKeys() []keyStatus {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	list := []keyStatus{}
+	for _, k := range apiKeys.keys {
+		list = append(list, *k)
+	}
+	return list
+}
+
+// principal is an authenticated caller and what it may do.
+type principal struct {
+	// Name is the API key name or the subject of the JWT.
+	Name   string
+	Scopes []string
+	// Paths are the path prefixes the caller is limited to. Empty allows
+	// any path.
+	Paths []string
+	// Exact limits the caller to the paths in Paths themselves rather than
+	// everything below them, as for a pre-signed URL.
+	Exact bool
+	// Tenant is the tenant the caller is bound to, if any.
+	Tenant string
+}
+
+func (p *principal) allows(op string) bool {
+	return containsString(p.Scopes, op)
+}
+
+// principalKey is the context key of the authenticated caller.
+type principalKey struct{}
+
+// requestPrincipal returns the caller r authenticated as, or nil when
+// authentication is off.
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// errPathNotAllowed is returned for paths the caller may not use, because
+// its scopes don't allow the operation, they lie outside its path prefixes
+// or no ACL rule allows them.
+var errPathNotAllowed = errors.New("path is not allowed for this caller")
+
+// checkPathScope returns errPathNotAllowed if the caller of r may not
+// perform r's operation on the resolved path. authorize checks the path
+// parameters of every request; handlers taking paths from the body call it
+// themselves.
+func checkPathScope(r *http.Request, resolved string) error {
+	return checkPathScopeFor(r, requestOp(r), resolved)
+}
+
+// checkPathScopeFor is checkPathScope for an operation other than r's own.
+// The caller's scopes must allow op too, as authenticate only checked them
+// for r's own operation.
+func checkPathScopeFor(r *http.Request, op string, resolved string) error {
+	if p := requestPrincipal(r); p != nil {
+		if !p.allows(op) {
+			return errPathNotAllowed
+		}
+		if len(p.Paths) > 0 && !withinAny(r, p.Paths, resolved) {
+			return errPathNotAllowed
+		}
+		if p.Exact && !equalsAny(r, p.Paths, resolved) {
+			return errPathNotAllowed
+		}
+	}
+	if aclEnabled() && !aclAllows(r, requestActor(r), op, resolved) {
+		return errPathNotAllowed
+	}
+	return nil
+}
+
+// isAdmin reports whether the caller of r may make admin requests, for
+// options of other requests reserved to administrators.
+func isAdmin(r *http.Request) bool {
+	if p := requestPrincipal(r); p != nil && !p.allows(opAdmin) {
+		return false
+	}
+	return !aclEnabled() || aclAllowsOp(requestActor(r), opAdmin)
+}
+
+// withinAny reports whether the resolved path lies below one of the client
+// path prefixes, resolved for r. An empty prefix matches every path.
+func withinAny(r *http.Request, prefixes []string, resolved string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return true
+		}
+		base, err := resolvePath(r, prefix)
+		if err == nil && isWithin(base, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalsAny reports whether the resolved path is one of the client paths,
+// resolved for r.
+func equalsAny(r *http.Request, paths []string, resolved string) bool {
+	for _, p := range paths {
+		if base, err := resolvePath(r, p); err == nil && base == resolved {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the credential in r's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func authEnabled() bool {
+	return len(config.APIKeys) > 0 || config.JWT.enabled()
+}
+
+// authenticate rejects requests without a valid API key or JWT with 401, and
+// requests for operations outside the caller's scopes with 403. It does
+// nothing when neither is configured. A pre-signed URL stands in for both.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("signature") {
+			p, err := verifySignedURL(r)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid signed URL: %s", err.Error()), http.StatusForbidden)
+				return
+			}
+			serveSigned(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), next)
+			return
+		}
+		if !authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="file-reader-writer"`)
+			http.Error(w, "Authorization header with a bearer API key or token is required", http.StatusUnauthorized)
+			return
+		}
+		var p *principal
+		if config.JWT.enabled() && strings.Count(token, ".") == 2 {
+			var err error
+			if p, err = verifyJWT(token); err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="file-reader-writer", error="invalid_token"`)
+				http.Error(w, fmt.Sprintf("Invalid token: %s", err.Error()), http.StatusUnauthorized)
+				return
+			}
+		} else if key := lookupAPIKey(token); key != nil {
+			p = &principal{Name: key.Name, Scopes: key.Scopes, Tenant: key.Tenant}
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="file-reader-writer", error="invalid_token"`)
+			http.Error(w, "Invalid or revoked API key", http.StatusUnauthorized)
+			return
+		}
+		if op := requestOp(r); op != "" && !p.allows(op) {
+			http.Error(w, fmt.Sprintf("%s does not have the %s scope", p.Name, op), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// apiKeysHandler lists the configured API keys, without the keys themselves.
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, "API keys listed successfully", requestId, listAPIKeys())
+}
+
+// revokeAPIKeyHandler revokes the API key with the given name.
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	if !revokeAPIKey(name) {
+		http.Error(w, fmt.Sprintf("No API key named %s", name), http.StatusNotFound)
+		return
+	}
+	recordAudit(auditEvent{Actor: requestActor(r), Action: "keyRevoked", Detail: name})
+	writeJSON(w, "API key revoked successfully", requestId, listAPIKeys())
+}
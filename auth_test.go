@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withACL puts rules in effect for the duration of the test.
+func withACL(t *testing.T, rules []ACLRule) {
+	t.Helper()
+	// Cleanups run last first: the rules are reloaded once config is back.
+	t.Cleanup(loadACL)
+	withConfig(t, func(c *Config) { c.ACL = rules })
+	loadACL()
+}
+
+// withRoute registers op for pattern for the duration of the test, without
+// a handler.
+func withRoute(t *testing.T, pattern string, op string) {
+	t.Helper()
+	saved, ok := routeOps[pattern]
+	routeOps[pattern] = op
+	t.Cleanup(func() {
+		if ok {
+			routeOps[pattern] = saved
+		} else {
+			delete(routeOps, pattern)
+		}
+	})
+}
+
+// asPrincipal returns r made by p.
+func asPrincipal(r *http.Request, p *principal) *http.Request {
+	if p == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+func TestCheckPathScopeFor(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withACL(t, nil)
+	in := func(p string) string { return filepath.Join(root, filepath.FromSlash(p)) }
+
+	tests := []struct {
+		name      string
+		principal *principal
+		op        string
+		path      string
+		ok        bool
+	}{
+		{name: "no authentication", op: opDelete, path: "a/f", ok: true},
+		{name: "scope allows op", principal: &principal{Scopes: []string{opWrite, opDelete}}, op: opDelete, path: "a/f", ok: true},
+		{name: "delete without the delete scope", principal: &principal{Scopes: []string{opWrite}}, op: opDelete, path: "a/f"},
+		{name: "read without the read scope", principal: &principal{Scopes: []string{opWrite}}, op: opRead, path: "a/f"},
+		{name: "below a prefix", principal: &principal{Scopes: []string{opRead}, Paths: []string{"/a"}}, op: opRead, path: "a/b/f", ok: true},
+		{name: "the prefix itself", principal: &principal{Scopes: []string{opRead}, Paths: []string{"/a"}}, op: opRead, path: "a", ok: true},
+		{name: "outside the prefixes", principal: &principal{Scopes: []string{opRead}, Paths: []string{"/a"}}, op: opRead, path: "b/f"},
+		{name: "sibling sharing the prefix", principal: &principal{Scopes: []string{opRead}, Paths: []string{"/a"}}, op: opRead, path: "ab/f"},
+		{name: "root with prefixes", principal: &principal{Scopes: []string{opRead}, Paths: []string{"/a"}}, op: opRead, path: ""},
+		{name: "exact path", principal: &principal{Scopes: []string{opWrite}, Paths: []string{"a/f"}, Exact: true}, op: opWrite, path: "a/f", ok: true},
+		{name: "below an exact path", principal: &principal{Scopes: []string{opWrite}, Paths: []string{"a"}, Exact: true}, op: opWrite, path: "a/f"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := asPrincipal(httptest.NewRequest("GET", "/", nil), tt.principal)
+			err := checkPathScopeFor(r, tt.op, in(tt.path))
+			if tt.ok && err != nil {
+				t.Fatalf("checkPathScopeFor(%s, %q) = %v, want nil", tt.op, tt.path, err)
+			}
+			if !tt.ok && !errors.Is(err, errPathNotAllowed) {
+				t.Fatalf("checkPathScopeFor(%s, %q) = %v, want errPathNotAllowed", tt.op, tt.path, err)
+			}
+		})
+	}
+}
+
+func TestCheckPathScopeForACL(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withACL(t, []ACLRule{
+		{Principal: "alice", Prefix: "/alice", Ops: []string{opRead, opWrite}},
+		{Principal: "*", Prefix: "/public", Ops: []string{opRead}},
+	})
+
+	tests := []struct {
+		actor string
+		op    string
+		path  string
+		ok    bool
+	}{
+		{actor: "alice", op: opWrite, path: "alice/f", ok: true},
+		{actor: "alice", op: opDelete, path: "alice/f"},
+		{actor: "alice", op: opWrite, path: "alicesmith/f"},
+		{actor: "bob", op: opRead, path: "public/f", ok: true},
+		{actor: "bob", op: opWrite, path: "public/f"},
+		{actor: "bob", op: opRead, path: "alice/f"},
+	}
+	for _, tt := range tests {
+		r := asPrincipal(httptest.NewRequest("GET", "/", nil), &principal{Name: tt.actor, Scopes: []string{opRead, opWrite, opDelete}})
+		err := checkPathScopeFor(r, tt.op, filepath.Join(root, filepath.FromSlash(tt.path)))
+		if tt.ok != (err == nil) {
+			t.Errorf("%s %s %q: checkPathScopeFor = %v, want allowed %t", tt.actor, tt.op, tt.path, err, tt.ok)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withRoute(t, "/test/write", opWrite)
+	withRoute(t, "/test/read", opRead)
+	for _, pattern := range []string{"/copyFile", "/moveFile", "/linkFile", "/symlink"} {
+		withRoute(t, pattern, opWrite)
+	}
+	shared := []ACLRule{
+		{Principal: "*", Prefix: "/pub", Ops: []string{opRead}},
+		{Principal: "*", Prefix: "/mine", Ops: []string{opRead, opWrite, opDelete}},
+	}
+
+	limited := &principal{Name: "limited", Scopes: []string{opRead, opWrite}, Paths: []string{"/a"}}
+	tests := []struct {
+		name      string
+		acl       []ACLRule
+		principal *principal
+		path      string
+		form      url.Values
+		body      url.Values
+		want      int
+	}{
+		{name: "inside the prefix", principal: limited, path: "/test/write", form: url.Values{"filePath": {"a/f"}}, want: http.StatusOK},
+		{name: "outside the prefix", principal: limited, path: "/test/write", form: url.Values{"filePath": {"b/f"}}, want: http.StatusForbidden},
+		{name: "climbing out of the prefix", principal: limited, path: "/test/write", form: url.Values{"filePath": {"a/../b/f"}}, want: http.StatusForbidden},
+		{name: "any path parameter", principal: limited, path: "/test/write", form: url.Values{"filePath": {"a/f"}, "destPath": {"b/f"}}, want: http.StatusForbidden},
+		{name: "repeated parameter", principal: limited, path: "/test/write", form: url.Values{"filePath": {"a/f", "b/f"}}, want: http.StatusForbidden},
+		{name: "path in the body", principal: limited, path: "/test/write", body: url.Values{"filePath": {"b/f"}}, want: http.StatusForbidden},
+		{name: "body overriding the query", principal: limited, path: "/test/write", form: url.Values{"filePath": {"a/f"}}, body: url.Values{"filePath": {"b/f"}}, want: http.StatusForbidden},
+		{name: "unrestricted caller", principal: &principal{Scopes: []string{opWrite}}, path: "/test/write", form: url.Values{"filePath": {"b/f"}}, want: http.StatusOK},
+		{name: "unregistered path", principal: limited, path: "/test/other", form: url.Values{"filePath": {"b/f"}}, want: http.StatusOK},
+		{name: "ACL allows the path", acl: []ACLRule{{Principal: "*", Prefix: "/pub", Ops: []string{opRead}}}, path: "/test/read", form: url.Values{"filePath": {"pub/f"}}, want: http.StatusOK},
+		{name: "ACL denies the op", acl: []ACLRule{{Principal: "*", Prefix: "/pub", Ops: []string{opRead}}}, path: "/test/write", form: url.Values{"filePath": {"pub/f"}}, want: http.StatusForbidden},
+		{name: "ACL denies the path", acl: []ACLRule{{Principal: "*", Prefix: "/pub", Ops: []string{opRead}}}, path: "/test/read", form: url.Values{"filePath": {"priv/f"}}, want: http.StatusForbidden},
+		{name: "ACL without a path", acl: []ACLRule{{Principal: "*", Prefix: "/pub", Ops: []string{opRead}}}, path: "/test/write", want: http.StatusForbidden},
+		{name: "copy source is only read", acl: shared, path: "/copyFile", form: url.Values{"sourcePath": {"pub/f"}, "destPath": {"mine/f"}}, want: http.StatusOK},
+		{name: "move source is deleted", acl: shared, path: "/moveFile", form: url.Values{"sourcePath": {"pub/f"}, "destPath": {"mine/f"}}, want: http.StatusForbidden},
+		{name: "move within writable paths", acl: shared, path: "/moveFile", form: url.Values{"sourcePath": {"mine/a"}, "destPath": {"mine/b"}}, want: http.StatusOK},
+		{name: "hard link source is written", acl: shared, path: "/linkFile", form: url.Values{"sourcePath": {"pub/f"}, "destPath": {"mine/f"}}, want: http.StatusForbidden},
+		{name: "symlink target is read", acl: shared, path: "/symlink", form: url.Values{"linkPath": {"mine/l"}, "target": {"../pub/f"}}, want: http.StatusOK},
+		{name: "symlink target outside", acl: shared, path: "/symlink", form: url.Values{"linkPath": {"mine/l"}, "target": {"../priv/f"}}, want: http.StatusForbidden},
+		{name: "absolute symlink target outside", acl: shared, path: "/symlink", form: url.Values{"linkPath": {"mine/l"}, "target": {"/priv/f"}}, want: http.StatusForbidden},
+		{name: "scope for another op", principal: &principal{Scopes: []string{opWrite}}, path: "/moveFile", form: url.Values{"sourcePath": {"a"}, "destPath": {"b"}}, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withACL(t, tt.acl)
+			target := tt.path
+			if tt.form != nil {
+				target += "?" + tt.form.Encode()
+			}
+			r := httptest.NewRequest("POST", target, strings.NewReader(tt.body.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = asPrincipal(r, tt.principal)
+			w := httptest.NewRecorder()
+			authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+// Multipart bodies of streaming routes are left unread until the request
+// reaches its handler, where the paths in them are checked.
+func TestAuthorizeStreamingMultipart(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withACL(t, nil)
+	withRoute(t, "/writeFile", opWrite)
+	limited := &principal{Name: "limited", Scopes: []string{opWrite}, Paths: []string{"/a"}}
+
+	for _, tt := range []struct {
+		name     string
+		bodyPath string
+		want     int
+	}{
+		{name: "no path in the body", want: http.StatusOK},
+		{name: "path inside the prefix", bodyPath: "a/g", want: http.StatusOK},
+		{name: "path outside the prefix", bodyPath: "b/f", want: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			if tt.bodyPath != "" {
+				mw.WriteField("filePath", tt.bodyPath)
+			}
+			part, _ := mw.CreateFormFile("fileContent", "f")
+			part.Write([]byte("content"))
+			mw.Close()
+			r := httptest.NewRequest("POST", "/writeFile?filePath=a/f", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r = asPrincipal(r, limited)
+
+			w := httptest.NewRecorder()
+			authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.MultipartForm != nil {
+					t.Error("authorize read the multipart body")
+				}
+				authorizeBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+			})).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CircuitBreakerConfig controls the storage circuit breaker. A background
+// probe reads CircuitBreakerConfig.Dir every ProbeInterval. After Failures
+// probes in a row took longer than SlowThreshold the breaker opens and
+// storage requests fail fast with 503 instead of piling up goroutines on
+// blocked syscalls. Once Cooldown has passed the next healthy probe closes it
+// again.
+type CircuitBreakerConfig struct {
+	// Dir is the directory probed. Defaults to the root directory, or the
+	// working directory without one.
+	Dir string `json:"dir"`
+	// SlowThreshold is the probe latency considered pathological. Zero
+	// disables the breaker.
+	SlowThreshold Duration `json:"slowThreshold"`
+	Failures      int      `json:"failures"`
+	Cooldown      Duration `json:"cooldown"`
+	ProbeInterval Duration `json:"probeInterval"`
+}
+
+var breaker struct {
+	sync.Mutex
+	open        bool
+	openedAt    time.Time
+	slowProbes  int
+	lastLatency time.Duration
+	// probing is set while a probe is running. A probe still stuck when the
+	// next one is due counts as slow without starting another.
+	probing bool
+}
+
+func startBreakerProbe() {
+	if config.CircuitBreaker.SlowThreshold <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.CircuitBreaker.ProbeInterval))
+		defer ticker.Stop()
+		for range ticker.C {
+			probeStorage()
+		}
+	}()
+}
+
+// probeStorage times a directory read of the probed directory.
+func probeStorage() {
+	threshold := time.Duration(config.CircuitBreaker.SlowThreshold)
+
+	breaker.Lock()
+	if breaker.probing {
+		breaker.Unlock()
+		recordProbe(threshold, fmt.Errorf("previous probe still blocked"))
+		return
+	}
+	breaker.probing = true
+	breaker.Unlock()
+
+	type result struct {
+		latency time.Duration
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		start := time.Now()
+		err := readDirProbe(config.CircuitBreaker.Dir)
+		breaker.Lock()
+		breaker.probing = false
+		breaker.Unlock()
+		done <- result{latency: time.Since(start), err: err}
+	}()
+
+	timer := time.NewTimer(threshold)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		recordProbe(res.latency, res.err)
+	case <-timer.C:
+		recordProbe(threshold, fmt.Errorf("probe took longer than %s", threshold))
+	}
+}
+
+func readDirProbe(dir string) error {
+	if dir == "" {
+		dir = config.RootDir
+	}
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// recordProbe updates the breaker with the outcome of a probe. A probe that
+// failed or reached the threshold counts as slow.
+func recordProbe(latency time.Duration, err error) {
+	cfg := config.CircuitBreaker
+	slow := err != nil || latency >= time.Duration(cfg.SlowThreshold)
+
+	breaker.Lock()
+	defer breaker.Unlock()
+	breaker.lastLatency = latency
+	now := time.Now()
+
+	if !slow {
+		breaker.slowProbes = 0
+		if breaker.open && now.Sub(breaker.openedAt) >= time.Duration(cfg.Cooldown) {
+			breaker.open = false
+			logrus.WithField("latency", latency).Info("Storage circuit breaker closed")
+			go recordAudit(auditEvent{Actor: "circuitBreaker", Action: "close", Path: cfg.Dir})
+		}
+		return
+	}
+
+	breaker.slowProbes++
+	if breaker.open {
+		if now.Sub(breaker.openedAt) >= time.Duration(cfg.Cooldown) {
+			// Still slow after the cool-down, start another one.
+			breaker.openedAt = now
+		}
+		return
+	}
+	if breaker.slowProbes >= cfg.Failures {
+		breaker.open = true
+		breaker.openedAt = now
+		detail := fmt.Sprintf("%d slow probes, last took %s", breaker.slowProbes, latency)
+		if err != nil {
+			detail += ": " + err.Error()
+		}
+		logrus.WithField("latency", latency).Warn("Storage circuit breaker opened")
+		go recordAudit(auditEvent{Actor: "circuitBreaker", Action: "open", Path: cfg.Dir, Detail: detail})
+	}
+}
+
+// breakerRetryAfter reports whether the breaker is open and, if so, how many
+// seconds are left of the cool-down.
+func breakerRetryAfter() (int, bool) {
+	breaker.Lock()
+	defer breaker.Unlock()
+	if !breaker.open {
+		return 0, false
+	}
+	remaining := time.Duration(config.CircuitBreaker.Cooldown) - time.Since(breaker.openedAt)
+	return int(math.Max(1, math.Ceil(remaining.Seconds()))), true
+}
+
+// breakerGuard fails storage requests fast while the breaker is open.
+func breakerGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requestOp(r) {
+		case opRead, opWrite, opDelete, opGenerate:
+			if retryAfter, open := breakerRetryAfter(); open {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				http.Error(w, "Storage is responding too slowly", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// breakerStatus reports the state of the storage circuit breaker.
+func breakerStatus(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	breaker.Lock()
+	status := map[string]interface{}{
+		"enabled":     config.CircuitBreaker.SlowThreshold > 0,
+		"open":        breaker.open,
+		"slowProbes":  breaker.slowProbes,
+		"lastLatency": breaker.lastLatency.String(),
+	}
+	if breaker.open {
+		status["openedAt"] = breaker.openedAt
+	}
+	breaker.Unlock()
+	writeJSON(w, "Circuit breaker retrieved successfully", requestId, status)
+}
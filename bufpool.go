@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBufferSize caps the buffers kept for reuse so one unusually large
+// file doesn't pin its memory for the lifetime of the process.
+const maxPooledBufferSize = 32 * 1024 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer hands buf back to the pool. buf must not be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// readFileContent reads filePath into a pooled buffer. The returned release
+// function hands the buffer back and must be called once the data is no
+// longer used.
+func readFileContent(filePath string) (data []byte, release func(), err error) {
+	err = retryFS("read", func() (err error) {
+		data, release, err = readFileBuffered(filePath)
+		return err
+	})
+	return data, release, err
+}
+
+func readFileBuffered(filePath string) ([]byte, func(), error) {
+	f, err := openFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return readBuffered(f)
+}
+
+// readBuffered reads f into a pooled buffer, handed back by the returned
+// release function.
+func readBuffered(f contentFile) ([]byte, func(), error) {
+	buf := getBuffer()
+	if fileInfo, err := f.Stat(); err == nil {
+		buf.Grow(int(fileInfo.Size()) + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(f); err != nil {
+		putBuffer(buf)
+		return nil, nil, err
+	}
+	return buf.Bytes(), func() { putBuffer(buf) }, nil
+}
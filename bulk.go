@@ -0,0 +1,323 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// bulkWriteRecord is one line of a /bulkWrite request body.
+type bulkWriteRecord struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// IfMatch and IfUnmodifiedSince make the record conditional the way
+	// the If-Match and If-Unmodified-Since headers make a writeFile. The
+	// request's headers apply to records without either.
+	IfMatch           string `json:"ifMatch,omitempty"`
+	IfUnmodifiedSince string `json:"ifUnmodifiedSince,omitempty"`
+}
+
+// bulkWrite reads newline-delimited {"path", "content"} records from the
+// request body and writes each file as soon as its line arrives. A result
+// line is streamed back for every record, followed by a summary line, so a
+// client can seed thousands of files over a single connection. A bad record
+// only fails that record.
+func bulkWrite(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"requestId": requestId,
+		"serverId":  serverId,
+	})
+	logger.Info("Bulk writing files")
+
+	// Results are written while the body is still being read.
+	http.NewResponseController(w).EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	written, failed := 0, 0
+	reader := bufio.NewReader(r.Body)
+	for line := 1; ; line++ {
+		if err := r.Context().Err(); err != nil {
+			// Records already written stay, the rest are never read.
+			logger.WithField("written", written).Info("Bulk write aborted")
+			enc.Encode(map[string]interface{}{"error": fmt.Sprintf("Request aborted: %s", err.Error())})
+			return
+		}
+		data, readErr := reader.ReadBytes('\n')
+		if len(trimNewline(data)) > 0 {
+			result := map[string]interface{}{"line": line}
+			filePath, err := bulkWriteLine(r, requestId, data)
+			result["path"] = filePath
+			if err != nil {
+				failed++
+				result["success"] = false
+				result["error"] = err.Error()
+				logger.WithField("line", line).WithError(err).Warn("Bulk write record failed")
+			} else {
+				written++
+				result["success"] = true
+			}
+			setRequestProgress(r.Context(), "written", int64(written))
+			setRequestProgress(r.Context(), "failed", int64(failed))
+			if err := enc.Encode(result); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			enc.Encode(map[string]interface{}{"error": fmt.Sprintf("Unable to read request body: %s", readErr.Error())})
+			return
+		}
+	}
+
+	enc.Encode(map[string]interface{}{
+		"summary": map[string]interface{}{
+			"written": written,
+			"failed":  failed,
+		},
+	})
+}
+
+// bulkWriteLine decodes and writes a single bulk write record, returning the
+// path it was written to.
+func bulkWriteLine(r *http.Request, requestId string, data []byte) (string, error) {
+	var record bulkWriteRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return "", fmt.Errorf("Invalid record: %s", err.Error())
+	}
+	if record.Path == "" {
+		return "", errors.New("path is required")
+	}
+	filePath, err := resolvePath(r, record.Path)
+	if err == nil {
+		err = checkPathScope(r, filePath)
+	}
+	if err != nil {
+		return record.Path, fmt.Errorf("Invalid path: %s", err.Error())
+	}
+	if err := checkFileSize(r, filePath, int64(len(record.Content))); err != nil {
+		return record.Path, fmt.Errorf("File %s", err.Error())
+	}
+	ifMatch, ifUnmodifiedSince := record.IfMatch, record.IfUnmodifiedSince
+	if ifMatch == "" && ifUnmodifiedSince == "" {
+		ifMatch, ifUnmodifiedSince = r.Header.Get("If-Match"), r.Header.Get("If-Unmodified-Since")
+	}
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if _, err := checkPreconditions(filePath, ifMatch, ifUnmodifiedSince); err != nil {
+		return record.Path, err
+	}
+	if err := ensureParentDir(filePath); err != nil {
+		return record.Path, fmt.Errorf("Unable to create directories: %s", err.Error())
+	}
+	existed, backup, err := backupFile(filePath)
+	if err != nil {
+		return record.Path, fmt.Errorf("Unable to back up file: %s", err.Error())
+	}
+	err = retryFS("write", func() error {
+		src := scanUpload(strings.NewReader(record.Content), filePath, requestActor(r))
+		defer src.Close()
+		_, err := storeFileFrom(filePath, src)
+		return err
+	})
+	if err != nil {
+		discardBackup(backup)
+		return record.Path, fmt.Errorf("Unable to write to file: %s", err.Error())
+	}
+	recordOperation(requestActor(r), requestId, "write", filePath, existed, backup)
+	return record.Path, nil
+}
+
+// trimNewline strips a trailing "\n" or "\r\n" from line.
+func trimNewline(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+	}
+	return line
+}
+
+// bulkReadFile is a file requested from /bulkRead.
+type bulkReadFile struct {
+	name     string // path as requested by the client
+	filePath string // resolved local path
+	info     os.FileInfo
+}
+
+// bulkRead streams every requested filePath back in one response, either as
+// multipart/mixed (the default) or as a tar archive with format=tar. All
+// files are checked before anything is sent so a missing file still results
+// in a proper error status.
+func bulkRead(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	filePaths := r.Form["filePath"]
+	format := r.FormValue("format")
+	logrus.WithFields(logrus.Fields{
+		"filePaths": filePaths,
+		"format":    format,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Bulk reading files")
+
+	if len(filePaths) == 0 {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if format != "" && format != "multipart" && format != "tar" {
+		http.Error(w, fmt.Sprintf("Invalid format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	files := make([]bulkReadFile, 0, len(filePaths))
+	for _, name := range filePaths {
+		filePath, err := resolvePath(r, name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid filePath %s: %s", name, err.Error()), pathErrorStatus(err))
+			return
+		}
+		info, err := statFile(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, fmt.Sprintf("File not found: %s", name), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", name, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if info.IsDir() {
+			http.Error(w, fmt.Sprintf("filePath %s is a directory", name), http.StatusBadRequest)
+			return
+		}
+		if err := checkPathNotClientEncrypted(filePath); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read %s: %s", name, err.Error()), clientKeyStatus(err))
+			return
+		}
+		files = append(files, bulkReadFile{name: name, filePath: filePath, info: info})
+	}
+
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	var err error
+	if format == "tar" {
+		err = writeTar(r.Context(), w, files)
+	} else {
+		err = writeMultipart(r.Context(), w, files)
+	}
+	if err != nil {
+		// The status has already been sent, all we can do is log and cut the
+		// response short.
+		logrus.WithFields(logrus.Fields{
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).WithError(err).Warn("Bulk read failed")
+	}
+}
+
+func writeMultipart(ctx context.Context, w http.ResponseWriter, files []bulkReadFile) error {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		setRequestProgress(ctx, "filesSent", int64(i))
+		contentType := mime.TypeByExtension(filepath.Ext(file.filePath))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.name}))
+		header.Set("Content-Length", strconv.FormatInt(file.info.Size(), 10))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(part, file.filePath); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func writeTar(ctx context.Context, w http.ResponseWriter, files []bulkReadFile) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		setRequestProgress(ctx, "filesSent", int64(i))
+		header, err := tar.FileInfoHeader(file.info, "")
+		if err != nil {
+			return err
+		}
+		// Keep the requested path as the entry name, but never as an
+		// absolute or parent-relative one.
+		name := strings.TrimLeft(filepath.ToSlash(cleanPath(file.name)), "/")
+		for strings.HasPrefix(name, "../") {
+			name = name[len("../"):]
+		}
+		header.Name = name
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyFileTo(tw, file.filePath); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// copyFileTo streams the content of filePath to dst.
+func copyFileTo(dst io.Writer, filePath string) error {
+	f, err := openFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	return err
+}
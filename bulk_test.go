@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bulkResults posts records to bulkWrite and returns the result of each
+// record by path.
+func bulkResults(t *testing.T, header map[string]string, records ...bulkWriteRecord) map[string]map[string]interface{} {
+	t.Helper()
+	var body strings.Builder
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+	r := httptest.NewRequest("POST", "/bulkWrite", strings.NewReader(body.String()))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	bulkWrite(w, r)
+
+	results := map[string]map[string]interface{}{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var result map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if path, ok := result["path"].(string); ok {
+			results[path] = result
+		}
+	}
+	return results
+}
+
+func TestBulkWriteConditional(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = "" })
+	// Different sizes give the files different tags.
+	for name, content := range map[string]string{"a": "old a", "b": "old bb"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	etagA := fileETag(info)
+
+	results := bulkResults(t, nil,
+		bulkWriteRecord{Path: "a", Content: "new a", IfMatch: etagA},
+		bulkWriteRecord{Path: "b", Content: "new b", IfMatch: etagA},
+		bulkWriteRecord{Path: "c", Content: "new c", IfMatch: "*"},
+		bulkWriteRecord{Path: "d", Content: "new d"},
+	)
+	for path, want := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		if results[path]["success"] != want {
+			t.Errorf("%s: result %v, want success %v", path, results[path], want)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(root, "b")); string(got) != "old bb" {
+		t.Errorf("b was overwritten: %q", got)
+	}
+
+	// The request's headers apply to records without conditions of their
+	// own.
+	results = bulkResults(t, map[string]string{"If-Match": etagA},
+		bulkWriteRecord{Path: "b", Content: "newer b"},
+		bulkWriteRecord{Path: "d", Content: "newer d", IfMatch: "*"},
+	)
+	if results["b"]["success"] != false || results["d"]["success"] != true {
+		t.Errorf("results %v", results)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ChaosExperiment puts a fault into effect for Duration every Every, e.g. 5%
+// write failures for 10 minutes every hour. Runs start on multiples of Every,
+// so an hourly experiment starts on the hour.
+type ChaosExperiment struct {
+	FaultRule
+	Duration Duration `json:"duration"`
+	Every    Duration `json:"every"`
+}
+
+func (e ChaosExperiment) validate() error {
+	if err := e.FaultRule.validate(); err != nil {
+		return err
+	}
+	if e.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if e.Every < e.Duration {
+		return errors.New("every must not be shorter than duration")
+	}
+	return nil
+}
+
+func validateChaos(experiments []ChaosExperiment) error {
+	names := map[string]bool{}
+	for i, e := range experiments {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("experiment %d: %w", i, err)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("experiment %d: duplicate name %q", i, e.Name)
+		}
+		names[e.Name] = true
+	}
+	return nil
+}
+
+// startChaosScheduler runs every configured experiment on its schedule.
+func startChaosScheduler() {
+	for _, e := range config.Chaos {
+		go runChaosExperiment(e)
+	}
+}
+
+func runChaosExperiment(e ChaosExperiment) {
+	every, duration := time.Duration(e.Every), time.Duration(e.Duration)
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(every).Add(every).Sub(now))
+
+		logrus.WithField("experiment", e.Name).Info("Starting chaos experiment")
+		addFault(e.FaultRule, "experiment", time.Now().Add(duration))
+		recordAudit(auditEvent{
+			Actor:  "chaos",
+			Action: "experimentStart",
+			Path:   e.Pattern,
+			Detail: faultDetail(e.FaultRule, duration),
+		})
+
+		time.Sleep(duration)
+		removeFault(e.Name)
+		logrus.WithField("experiment", e.Name).Info("Chaos experiment ended")
+		recordAudit(auditEvent{Actor: "chaos", Action: "experimentStop", Path: e.Pattern, Detail: e.Name})
+	}
+}
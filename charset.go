@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// charsetSniffLen is how much of a file detectCharset looks at.
+const charsetSniffLen = 64 << 10
+
+var (
+	errUnknownCharset = errors.New("Unknown charset")
+	errUnencodable    = errors.New("Content can't be represented in the target charset")
+)
+
+// lookupCharset returns the encoding called name, by its IANA name or one
+// of the labels browsers accept, and its canonical name.
+func lookupCharset(name string) (encoding.Encoding, string, error) {
+	switch strings.ToLower(name) {
+	case "utf-8", "utf8":
+		return unicode.UTF8, "UTF-8", nil
+	case "utf-16":
+		// Big endian unless a BOM says otherwise, as RFC 2781 asks.
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), "UTF-16", nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		if enc, err = htmlindex.Get(name); err != nil {
+			return nil, "", fmt.Errorf("%w: %s", errUnknownCharset, name)
+		}
+	}
+	// The MIME name, as in Content-Type headers, where there is one.
+	canonical, err := ianaindex.MIME.Name(enc)
+	if err != nil || canonical == "" {
+		if canonical, err = ianaindex.IANA.Name(enc); err != nil {
+			canonical = name
+		}
+	}
+	return enc, canonical, nil
+}
+
+// detectCharset guesses the charset of text starting with head, which is
+// truncated if the text goes on: from its byte order mark, then whether it
+// is valid UTF-8, then how zero bytes fall for UTF-16 without a mark.
+// Anything else is taken for Windows-1252 if it uses the bytes that set has
+// printable characters at and ISO-8859-1 otherwise.
+func detectCharset(head []byte, truncated bool) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return "UTF-8"
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "UTF-16LE"
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "UTF-16BE"
+	}
+	// A multi-byte character cut off at the end of head doesn't count.
+	valid := head
+	for i := 0; truncated && i < utf8.UTFMax-1 && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+	if utf8.Valid(valid) {
+		if bytes.IndexByte(head, 0) < 0 {
+			if isASCII(head) {
+				return "US-ASCII"
+			}
+			return "UTF-8"
+		}
+	}
+	var evenZeros, oddZeros int
+	for i, b := range head {
+		if b == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	if pairs := len(head) / 2; pairs > 0 {
+		if oddZeros*2 > pairs && evenZeros*10 < pairs {
+			return "UTF-16LE"
+		}
+		if evenZeros*2 > pairs && oddZeros*10 < pairs {
+			return "UTF-16BE"
+		}
+	}
+	for _, b := range head {
+		if b >= 0x80 && b <= 0x9F {
+			return "windows-1252"
+		}
+	}
+	return "ISO-8859-1"
+}
+
+func isASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeCharset returns data, in the charset called charset or the one
+// detectCharset guesses for "auto", as UTF-8, along with the charset's
+// name.
+func decodeCharset(data []byte, charset string) (string, string, error) {
+	if strings.EqualFold(charset, "auto") {
+		charset = detectCharset(data[:min(len(data), charsetSniffLen)], len(data) > charsetSniffLen)
+	}
+	enc, name, err := lookupCharset(charset)
+	if err != nil {
+		return "", "", err
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", "", err
+	}
+	// A BOM tells the charset but isn't part of the text.
+	return strings.TrimPrefix(string(decoded), "\uFEFF"), name, nil
+}
+
+// repertoireError is the error encoders fail with on characters their
+// charset has none for.
+type repertoireError interface {
+	error
+	Replacement() byte
+}
+
+// convertEncoding rewrites a text file from one charset to another, so
+// files in UTF-16 or legacy charsets can be read as UTF-8 and the other way
+// round. The source charset is detected unless given.
+func convertEncoding(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	destPath := r.FormValue("destPath")
+	from, to := r.FormValue("from"), r.FormValue("to")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"destPath":  destPath,
+		"from":      from,
+		"to":        to,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Converting file encoding")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if to == "" {
+		to = "UTF-8"
+	}
+	toEnc, toName, err := lookupCharset(to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	onError := r.FormValue("onError")
+	switch onError {
+	case "":
+		onError = "fail"
+	case "fail", "replace":
+	default:
+		http.Error(w, fmt.Sprintf("Invalid onError: %s", onError), http.StatusBadRequest)
+		return
+	}
+	bom, err := formBool(r, "bom")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	if destPath == "" {
+		destPath = filePath
+	} else if destPath, err = resolvePath(r, destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(destPath)
+	defer unlock()
+	f, err := openFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if err := checkNotClientEncrypted(f); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+	if from == "" {
+		head := make([]byte, charsetSniffLen)
+		n, err := f.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		from = detectCharset(head[:n], info.Size() > int64(n))
+	}
+	fromEnc, fromName, err := lookupCharset(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		var entries []dryRunEntry
+		if destInfo, err := statFile(destPath); err == nil {
+			entries = append(entries, dryRunEntry{Path: destPath, Action: "replace", Size: destInfo.Size()})
+		}
+		report := dryRunReport(r, entries)
+		report["from"] = fromName
+		report["to"] = toName
+		writeJSON(w, "Dry run: file not converted", requestId, report)
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// The content is decoded to UTF-8, stripped of any BOM, and encoded
+	// again, one buffer at a time.
+	encoder := toEnc.NewEncoder()
+	if onError == "replace" {
+		encoder = encoding.ReplaceUnsupported(encoder)
+	}
+	var out io.Reader = transform.NewReader(f, transform.Chain(fromEnc.NewDecoder(), unicode.BOMOverride(transform.Nop)))
+	out = transform.NewReader(out, encoder)
+	if bom {
+		switch toName {
+		case "UTF-8":
+			out = io.MultiReader(strings.NewReader("\uFEFF"), out)
+		case "UTF-16BE":
+			out = io.MultiReader(bytes.NewReader([]byte{0xFE, 0xFF}), out)
+		case "UTF-16LE":
+			out = io.MultiReader(bytes.NewReader([]byte{0xFF, 0xFE}), out)
+		}
+	}
+	size, err := storeFileFrom(destPath, &cappedReader{r: out, limit: sizeLimit(r, destPath)})
+	if err != nil {
+		discardBackup(backup)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.As(err, new(repertoireError)):
+			err = fmt.Errorf("%w %s; use onError=replace to substitute it", errUnencodable, toName)
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, fmt.Sprintf("Unable to convert file: %s", err.Error()), status)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "convertEncoding", destPath, existed, backup)
+	writeJSON(w, "File converted successfully", requestId, map[string]interface{}{
+		"from": fromName,
+		"to":   toName,
+		"size": size,
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checksum computes the digest of the file at filePath with algorithm
+// (md5, sha1, sha256, the default, sha512, crc32 or xxhash), streaming it
+// rather than reading it into memory. Given dirPath instead, it returns a
+// manifest of the digests of every regular file below it, keyed by their
+// slash-separated paths relative to dirPath, to verify a whole tree after
+// a transfer.
+func checksum(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	dirPath := r.FormValue("dirPath")
+	algorithm := r.FormValue("algorithm")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"dirPath":   dirPath,
+		"algorithm": algorithm,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Computing checksum")
+
+	if (filePath == "") == (dirPath == "") {
+		http.Error(w, "Exactly one of filePath and dirPath is required", http.StatusBadRequest)
+		return
+	}
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+	if _, err := newHash(algorithm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if filePath != "" {
+		filePath, err := resolvePath(r, filePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+			return
+		}
+		info, err := statFile(filePath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if !info.Mode().IsRegular() {
+			http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+			return
+		}
+		h, _ := newHash(algorithm)
+		sum, err := hashFile(filePath, h)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "Checksum computed successfully", requestId, map[string]interface{}{
+			"algorithm": algorithm,
+			"hash":      sum,
+			"size":      info.Size(),
+		})
+		return
+	}
+
+	dirPath, err := resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	info, err := statFile(dirPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "dirPath is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	// Files are hashed on the walk's goroutines, so several are read at
+	// once.
+	var mu sync.Mutex
+	manifest := map[string]string{}
+	err = walkTree(r.Context(), dirPath, 0, func(relPath string, entry fs.DirEntry) error {
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		h, _ := newHash(algorithm)
+		sum, err := hashFile(filepath.Join(dirPath, filepath.FromSlash(relPath)), h)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed since the directory was read.
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		manifest[relPath] = sum
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to hash directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "Checksums computed successfully", requestId, map[string]interface{}{
+		"algorithm": algorithm,
+		"files":     manifest,
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultClaimTTL is how long a claim lasts when the worker doesn't ask for
+// a specific TTL.
+const defaultClaimTTL = 5 * time.Minute
+
+// fileClaim marks a file as being processed by a worker. An expired claim
+// makes the file available again.
+type fileClaim struct {
+	ClaimId   string    `json:"claimId"`
+	FilePath  string    `json:"filePath"`
+	WorkerId  string    `json:"workerId"`
+	Expires   time.Time `json:"expires"`
+	Completed bool      `json:"completed"`
+}
+
+var claims = struct {
+	sync.Mutex
+	byPath map[string]*fileClaim
+	// swept is when claims that no longer matter were last dropped.
+	swept time.Time
+}{byPath: map[string]*fileClaim{}}
+
+// claimSweepInterval is how often claims are swept.
+const claimSweepInterval = time.Minute
+
+// available reports whether the file with claim c can be handed out.
+func (c *fileClaim) available(now time.Time) bool {
+	return c == nil || (!c.Completed && now.After(c.Expires))
+}
+
+// claimFile hands the first file in dirPath that isn't claimed or completed
+// to a worker, so a fleet of workers can divide a dataset between them.
+func claimFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dirPath := r.FormValue("dirPath")
+	workerId := r.FormValue("workerId")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"workerId":  workerId,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Claiming file")
+
+	if workerId == "" {
+		http.Error(w, "workerId is required", http.StatusBadRequest)
+		return
+	}
+	ttl, err := formClaimTTL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dirPath, err = resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	// A missing dirPath means the root, which authorize doesn't see.
+	if err := checkPathScope(r, dirPath); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), http.StatusForbidden)
+		return
+	}
+
+	files, err := os.ReadDir(dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	sweepClaims()
+	claim := claimNext(dirPath, files, workerId, ttl)
+	if claim == nil {
+		http.Error(w, "No unclaimed files", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, "File claimed successfully", requestId, claim)
+}
+
+// claimNext claims the first available regular file among files in dirPath,
+// or returns nil when there is none.
+func claimNext(dirPath string, files []os.DirEntry, workerId string, ttl time.Duration) *fileClaim {
+	now := time.Now()
+	claims.Lock()
+	defer claims.Unlock()
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		filePath := filepath.Join(dirPath, file.Name())
+		if !claims.byPath[filePath].available(now) {
+			continue
+		}
+		claim := &fileClaim{
+			ClaimId:  generateUUID(),
+			FilePath: filePath,
+			WorkerId: workerId,
+			Expires:  now.Add(ttl),
+		}
+		claims.byPath[filePath] = claim
+		claimCopy := *claim
+		return &claimCopy
+	}
+	return nil
+}
+
+// formClaimTTL parses the ttl parameter of r, defaulting to
+// defaultClaimTTL.
+func formClaimTTL(r *http.Request) (time.Duration, error) {
+	s := r.FormValue("ttl")
+	if s == "" {
+		return defaultClaimTTL, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("Invalid ttl value")
+	}
+	return ttl, nil
+}
+
+// sweepClaims drops, at most every claimSweepInterval, the claims that no
+// longer keep a file from being handed out: expired ones, and completed
+// ones whose file is gone. Completed claims on files that are still there
+// stay, or the files would be handed out again.
+func sweepClaims() {
+	now := time.Now()
+	claims.Lock()
+	if now.Sub(claims.swept) < claimSweepInterval {
+		claims.Unlock()
+		return
+	}
+	claims.swept = now
+	completed := map[string]*fileClaim{}
+	for filePath, claim := range claims.byPath {
+		switch {
+		case claim.Completed:
+			completed[filePath] = claim
+		case now.After(claim.Expires):
+			delete(claims.byPath, filePath)
+		}
+	}
+	claims.Unlock()
+
+	// The files are looked at without holding the lock.
+	for filePath, claim := range completed {
+		if _, err := os.Lstat(filePath); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		claims.Lock()
+		if claims.byPath[filePath] == claim {
+			delete(claims.byPath, filePath)
+		}
+		claims.Unlock()
+	}
+}
+
+var errClaimMismatch = errors.New("file is not claimed with this claimId")
+
+// finishClaim releases or completes the claim on filePath held with claimId.
+func finishClaim(filePath string, claimId string, complete bool) (fileClaim, error) {
+	claims.Lock()
+	defer claims.Unlock()
+	claim := claims.byPath[filePath]
+	if claim == nil || claim.ClaimId != claimId || claim.Completed || time.Now().After(claim.Expires) {
+		return fileClaim{}, errClaimMismatch
+	}
+	if complete {
+		claim.Completed = true
+	} else {
+		delete(claims.byPath, filePath)
+	}
+	return *claim, nil
+}
+
+// renewClaim extends the claim on filePath held with claimId to ttl from
+// now.
+func renewClaim(filePath string, claimId string, ttl time.Duration) (fileClaim, error) {
+	claims.Lock()
+	defer claims.Unlock()
+	claim := claims.byPath[filePath]
+	now := time.Now()
+	if claim == nil || claim.ClaimId != claimId || claim.Completed || now.After(claim.Expires) {
+		return fileClaim{}, errClaimMismatch
+	}
+	claim.Expires = now.Add(ttl)
+	return *claim, nil
+}
+
+// renewClaimHandler lets a worker still processing a file keep its claim
+// past the TTL it was claimed with.
+func renewClaimHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	claimId := r.FormValue("claimId")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"claimId":   claimId,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Renewing claim")
+
+	ttl, err := formClaimTTL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	claim, err := renewClaim(filePath, claimId, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, "Claim renewed successfully", requestId, claim)
+}
+
+func finishClaimHandler(complete bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestId := generateUUID()
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filePath := r.FormValue("filePath")
+		claimId := r.FormValue("claimId")
+		logrus.WithFields(logrus.Fields{
+			"filePath":  filePath,
+			"claimId":   claimId,
+			"complete":  complete,
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).Info("Finishing claim")
+
+		filePath, err := resolvePath(r, filePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+			return
+		}
+		claim, err := finishClaim(filePath, claimId, complete)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if complete {
+			writeJSON(w, "Claim completed successfully", requestId, claim)
+		} else {
+			writeJSON(w, "Claim released successfully", requestId, claim)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withClaims empties the claim table for the duration of the test.
+func withClaims(t *testing.T) {
+	t.Helper()
+	claims.Lock()
+	saved, savedSwept := claims.byPath, claims.swept
+	claims.byPath, claims.swept = map[string]*fileClaim{}, time.Time{}
+	claims.Unlock()
+	t.Cleanup(func() {
+		claims.Lock()
+		claims.byPath, claims.swept = saved, savedSwept
+		claims.Unlock()
+	})
+}
+
+func TestSweepClaims(t *testing.T) {
+	withClaims(t)
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present")
+	if err := os.WriteFile(present, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims.byPath = map[string]*fileClaim{
+		"expired":                     {ClaimId: "a", Expires: now.Add(-time.Second)},
+		"held":                        {ClaimId: "b", Expires: now.Add(time.Hour)},
+		present:                       {ClaimId: "c", Expires: now.Add(-time.Second), Completed: true},
+		filepath.Join(dir, "removed"): {ClaimId: "d", Expires: now.Add(-time.Second), Completed: true},
+	}
+
+	sweepClaims()
+	var left []string
+	for _, claim := range claims.byPath {
+		left = append(left, claim.ClaimId)
+	}
+	if len(left) != 2 || claims.byPath["held"] == nil || claims.byPath[present] == nil {
+		t.Errorf("claims left %v, want b and c", left)
+	}
+
+	// Sweeps are spaced out.
+	claims.byPath["expired"] = &fileClaim{ClaimId: "e", Expires: now.Add(-time.Second)}
+	sweepClaims()
+	if claims.byPath["expired"] == nil {
+		t.Error("swept again right away")
+	}
+}
+
+func TestRenewClaim(t *testing.T) {
+	withClaims(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	if err := os.WriteFile(filepath.Join(root, "job"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := os.ReadDir(root)
+	claim := claimNext(root, files, "worker", time.Minute)
+	if claim == nil {
+		t.Fatal("nothing claimed")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		claimId string
+		ttl     string
+		want    int
+	}{
+		{name: "wrong claim", claimId: "other", ttl: "1h", want: http.StatusConflict},
+		{name: "invalid ttl", claimId: claim.ClaimId, ttl: "-1s", want: http.StatusBadRequest},
+		{name: "renewed", claimId: claim.ClaimId, ttl: "1h", want: http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postForm(renewClaimHandler, "/renew", url.Values{"filePath": {"job"}, "claimId": {tt.claimId}, "ttl": {tt.ttl}})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+	claims.Lock()
+	expires := claims.byPath[claim.FilePath].Expires
+	claims.Unlock()
+	if time.Until(expires) < 59*time.Minute {
+		t.Errorf("claim expires in %s", time.Until(expires))
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Clients can have writeFile encrypt a file with a key of their own, sent
+// base64-encoded in the X-Encryption-Key header, and readFile decrypt it
+// with the same key, like S3's SSE-C. The server keeps only the ciphertext
+// and the SHA-256 fingerprint of the key, which is also returned in the
+// X-Encryption-Key-SHA256 header.
+const (
+	clientKeyHeader            = "X-Encryption-Key"
+	clientKeyFingerprintHeader = "X-Encryption-Key-SHA256"
+)
+
+// An encrypted file is a header of encryptedMagic, the key fingerprint and a
+// random nonce, followed by the content in chunks of encryptedChunkSize
+// bytes, each sealed with AES-256-GCM under the nonce xor its number. The
+// last chunk is sealed with different additional data, so a file cut short
+// at a chunk boundary doesn't decrypt.
+const (
+	encryptedChunkSize  = 64 << 10
+	encryptedHeaderSize = 8 + sha256.Size + 12
+)
+
+var encryptedMagic = []byte("FRWENC1\n")
+
+var (
+	errNoClientKey      = fmt.Errorf("File is encrypted; send its key in the %s header", clientKeyHeader)
+	errNotEncrypted     = errors.New("File is not encrypted")
+	errWrongClientKey   = errors.New("Encryption key does not match the one the file was written with")
+	errCorruptEncrypted = errors.New("Encrypted file is corrupt")
+	errClientEncrypted  = errors.New("File is encrypted with a client key; only readFile and /download can read it, with the key, and only writeFile can replace it")
+)
+
+// requestClientKey returns the key in r's X-Encryption-Key header, or nil if
+// it has none.
+func requestClientKey(r *http.Request) ([]byte, error) {
+	value := r.Header.Get(clientKeyHeader)
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid %s header: a base64-encoded 256-bit key is required", clientKeyHeader)
+	}
+	return key, nil
+}
+
+// keyFingerprint returns the base64 SHA-256 fingerprint of key.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// clientEncrypted reports whether the file at filePath was written with a
+// client key. A missing file is not.
+func clientEncrypted(filePath string) (bool, error) {
+	f, err := openFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	return checkNotClientEncrypted(f) != nil, nil
+}
+
+// checkNotClientEncrypted fails with errClientEncrypted if f holds a file
+// written with a client key. Endpoints other than readFile and /download
+// that read content, or change it in place, check the files they use with
+// it, since they would send the ciphertext or corrupt it.
+func checkNotClientEncrypted(f io.ReaderAt) error {
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		// Shorter files, and directories, can't be encrypted ones.
+		return nil
+	}
+	if bytes.Equal(magic, encryptedMagic) {
+		return errClientEncrypted
+	}
+	return nil
+}
+
+// checkPathNotClientEncrypted is checkNotClientEncrypted for the file at
+// filePath. A missing file passes.
+func checkPathNotClientEncrypted(filePath string) error {
+	encrypted, err := clientEncrypted(filePath)
+	if err == nil && encrypted {
+		err = errClientEncrypted
+	}
+	return err
+}
+
+// chunkNonce returns the nonce of chunk n of a file with the nonce base.
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := bytes.Clone(base)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^n)
+	return nonce
+}
+
+// chunkAD returns the additional data chunks are sealed with.
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptReader reads the encrypted form of what src holds.
+type encryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	chunk []byte
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+// newEncryptReader returns a reader of src encrypted with key.
+func newEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, encryptedMagic...)
+	sum := sha256.Sum256(key)
+	header = append(header, sum[:]...)
+	header = append(header, nonce...)
+	return newChunkEncryptReader(src, aead, nonce, header), nil
+}
+
+// newChunkEncryptReader returns a reader of header followed by src sealed
+// in chunks with aead under nonce.
+func newChunkEncryptReader(src io.Reader, aead cipher.AEAD, nonce []byte, header []byte) *encryptReader {
+	return &encryptReader{
+		src:   bufio.NewReaderSize(src, encryptedChunkSize),
+		aead:  aead,
+		nonce: nonce,
+		chunk: make([]byte, encryptedChunkSize),
+		out:   header,
+	}
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if err == nil {
+			_, err = e.src.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+		e.done = err != nil
+		e.buf = e.aead.Seal(e.buf[:0], chunkNonce(e.nonce, e.n), e.chunk[:n], chunkAD(e.done))
+		e.out = e.buf
+		e.n++
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// decryptReader reads the content of an encrypted file.
+type decryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	chunk []byte
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+// newDecryptReader checks the header of the encrypted file read from src
+// and returns a reader of its content decrypted with key. It fails with
+// errWrongClientKey before anything is decrypted if key isn't the one the
+// file was written with. The content fails to read with errCorruptEncrypted
+// if it was changed.
+func newDecryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	br := bufio.NewReaderSize(src, encryptedChunkSize+64)
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errNotEncrypted
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(encryptedMagic)], encryptedMagic) {
+		return nil, errNotEncrypted
+	}
+	sum := sha256.Sum256(key)
+	if !bytes.Equal(header[len(encryptedMagic):len(encryptedMagic)+sha256.Size], sum[:]) {
+		return nil, errWrongClientKey
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		src:   br,
+		aead:  aead,
+		nonce: header[len(encryptedMagic)+sha256.Size:],
+		chunk: make([]byte, encryptedChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.src, d.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if err == nil {
+			_, err = d.src.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+		d.done = err != nil
+		d.buf, err = d.aead.Open(d.buf[:0], chunkNonce(d.nonce, d.n), d.chunk[:n], chunkAD(d.done))
+		if err != nil {
+			return 0, errCorruptEncrypted
+		}
+		d.out = d.buf
+		d.n++
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// clientKeyStatus returns the status code to answer a failed read of a file
+// with a client key with.
+func clientKeyStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoClientKey), errors.Is(err, errNotEncrypted):
+		return http.StatusBadRequest
+	case errors.Is(err, errWrongClientKey):
+		return http.StatusForbidden
+	case errors.Is(err, errClientEncrypted):
+		return http.StatusConflict
+	case errors.Is(err, errCorruptEncrypted):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// readEncryptedFile answers a readFile request for the file at filePath,
+// which was written with the client key key: the decrypted content, in the
+// JSON envelope or raw as format says, cut to the offset and length form
+// values. Raw content is decrypted as it is sent, so a file that turns out
+// to be corrupt halfway breaks off the response.
+func readEncryptedFile(w http.ResponseWriter, r *http.Request, filePath string, key []byte, format string, content contentOptions, requestId string) {
+	f, err := openFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	offset, length, _, err := formRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plain, err := newDecryptReader(f, key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), clientKeyStatus(err))
+		return
+	}
+	// Only a client with the key learns whether its copy is current.
+	if notModified(w, r, fileInfo) {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, plain, offset); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), clientKeyStatus(err))
+		return
+	}
+	if length >= 0 {
+		plain = io.LimitReader(plain, length)
+	}
+	w.Header().Set(clientKeyFingerprintHeader, keyFingerprint(key))
+
+	if format == "raw" || r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Request-Id", requestId)
+		w.Header().Set("X-Server-Id", serverId)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := io.Copy(w, normalizeEOL(plain, content.eol)); err != nil {
+			if errors.Is(err, errCorruptEncrypted) {
+				// The status is sent already; breaking off the
+				// response keeps the client from taking part of the
+				// file for all of it.
+				panic(http.ErrAbortHandler)
+			}
+		}
+		return
+	}
+
+	data, err := io.ReadAll(plain)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), clientKeyStatus(err))
+		return
+	}
+	writeFileContent(w, data, content, requestId)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, plain []byte, key []byte) []byte {
+	t.Helper()
+	er, err := newEncryptReader(bytes.NewReader(plain), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func decrypt(sealed []byte, key []byte) ([]byte, error) {
+	dr, err := newDecryptReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dr)
+}
+
+func TestClientKeyRoundTrip(t *testing.T) {
+	key := testKey(t)
+	sealedChunk := encryptedChunkSize + 16
+	for _, size := range []int{0, 1, 100, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3 * encryptedChunkSize, 3*encryptedChunkSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := encrypt(t, plain, key)
+
+		// Every chunk, including an empty last one, carries its tag.
+		chunks := size/encryptedChunkSize + 1
+		if size > 0 && size%encryptedChunkSize == 0 {
+			chunks--
+		}
+		if want := encryptedHeaderSize + size + chunks*(sealedChunk-encryptedChunkSize); len(sealed) != want {
+			t.Errorf("size %d: sealed to %d bytes, want %d", size, len(sealed), want)
+		}
+		got, err := decrypt(sealed, key)
+		if err != nil {
+			t.Errorf("size %d: decrypt = %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted content differs", size)
+		}
+	}
+}
+
+func TestClientKeyTampering(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*encryptedChunkSize+100)
+	rand.Read(plain)
+	sealed := encrypt(t, plain, key)
+	sealedChunk := encryptedChunkSize + 16
+	chunk := func(n int) []byte {
+		start := encryptedHeaderSize + n*sealedChunk
+		return sealed[start:min(start+sealedChunk, len(sealed))]
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	header := sealed[:encryptedHeaderSize]
+
+	tests := []struct {
+		name    string
+		sealed  []byte
+		key     []byte
+		wantErr error
+	}{
+		{name: "wrong key", sealed: sealed, key: testKey(t), wantErr: errWrongClientKey},
+		{name: "plain file", sealed: plain, key: key, wantErr: errNotEncrypted},
+		{name: "short header", sealed: sealed[:encryptedHeaderSize-1], key: key, wantErr: errNotEncrypted},
+		{name: "header only", sealed: header, key: key, wantErr: errCorruptEncrypted},
+		{name: "flipped bit", sealed: flipBit(sealed, encryptedHeaderSize+sealedChunk+10), key: key, wantErr: errCorruptEncrypted},
+		{name: "flipped tag bit", sealed: flipBit(sealed, len(sealed)-1), key: key, wantErr: errCorruptEncrypted},
+		{name: "flipped nonce bit", sealed: flipBit(sealed, encryptedHeaderSize-1), key: key, wantErr: errCorruptEncrypted},
+		{name: "cut at a chunk boundary", sealed: join(header, chunk(0), chunk(1)), key: key, wantErr: errCorruptEncrypted},
+		{name: "last chunk dropped", sealed: join(header, chunk(0), chunk(1), chunk(2)), key: key, wantErr: errCorruptEncrypted},
+		{name: "cut inside a chunk", sealed: sealed[:len(sealed)-5], key: key, wantErr: errCorruptEncrypted},
+		{name: "chunks swapped", sealed: join(header, chunk(1), chunk(0), chunk(2), chunk(3)), key: key, wantErr: errCorruptEncrypted},
+		{name: "chunk repeated", sealed: join(header, chunk(0), chunk(0), chunk(2), chunk(3)), key: key, wantErr: errCorruptEncrypted},
+		{name: "bytes appended", sealed: join(sealed, []byte("x")), key: key, wantErr: errCorruptEncrypted},
+		{name: "chunk of another file", sealed: join(header, encrypt(t, plain, key)[encryptedHeaderSize:]), key: key, wantErr: errCorruptEncrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(tt.sealed, tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decrypt = %d bytes, %v, want %v", len(got), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// flipBit returns a copy of data with one bit of the byte at i flipped.
+func flipBit(data []byte, i int) []byte {
+	data = bytes.Clone(data)
+	data[i] ^= 1
+	return data
+}
+
+func TestClientEncryptedFilesRefused(t *testing.T) {
+	key := testKey(t)
+	plain := []byte("line one\nline two\n")
+	sealed := encrypt(t, plain, key)
+
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		form    url.Values
+		key     []byte
+		want    int
+	}{
+		{name: "download without the key", handler: downloadFile, method: "GET", want: http.StatusBadRequest},
+		{name: "download with another key", handler: downloadFile, method: "GET", key: testKey(t), want: http.StatusForbidden},
+		{name: "download with the key", handler: downloadFile, method: "GET", key: key, want: http.StatusOK},
+		{name: "tail", handler: tailFile, method: "GET", want: http.StatusConflict},
+		{name: "tail with the key", handler: tailFile, method: "GET", key: key, want: http.StatusConflict},
+		{name: "read lines", handler: readLines, method: "GET", want: http.StatusConflict},
+		{name: "bulk read", handler: bulkRead, method: "GET", want: http.StatusConflict},
+		{name: "diff", handler: diffFiles, method: "GET", form: url.Values{"otherPath": {"plain"}}, want: http.StatusConflict},
+		{name: "split", handler: splitFile, method: "POST", form: url.Values{"lines": {"1"}}, want: http.StatusConflict},
+		{name: "append", handler: appendFile, method: "POST", form: url.Values{"fileContent": {"more"}}, want: http.StatusConflict},
+		{name: "write at", handler: writeAt, method: "POST", form: url.Values{"offset": {"0"}, "fileContent": {"x"}}, want: http.StatusConflict},
+		{name: "patch", handler: patchFile, method: "POST", form: url.Values{"patch": {"@@ -1 +1 @@\n-a\n+b\n"}}, want: http.StatusConflict},
+		{name: "convert EOL", handler: convertEOL, method: "POST", form: url.Values{"to": {"crlf"}}, want: http.StatusConflict},
+		{name: "convert encoding", handler: convertEncoding, method: "POST", form: url.Values{"from": {"latin1"}, "to": {"utf-8"}}, want: http.StatusConflict},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := testRoot(t)
+			withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = "" })
+			filePath := filepath.Join(root, "vault")
+			if err := os.WriteFile(filePath, sealed, 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(filepath.Join(root, "plain"), plain, 0644)
+
+			form := url.Values{"filePath": {"vault"}}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			var r *http.Request
+			if tt.method == "GET" {
+				r = httptest.NewRequest("GET", "/?"+form.Encode(), nil)
+			} else {
+				r = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.key != nil {
+				r.Header.Set(clientKeyHeader, base64.StdEncoding.EncodeToString(tt.key))
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusConflict && !strings.Contains(w.Body.String(), errClientEncrypted.Error()) {
+				t.Errorf("refused for another reason: %s", w.Body.String())
+			}
+			if tt.want == http.StatusOK && !bytes.Equal(w.Body.Bytes(), plain) {
+				t.Errorf("got %q, want the decrypted content", w.Body.Bytes())
+			}
+			if got, _ := os.ReadFile(filePath); !bytes.Equal(got, sealed) {
+				t.Error("encrypted file was changed")
+			}
+		})
+	}
+}
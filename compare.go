@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxCompareDiffSize is the largest file a line diff is computed for.
+	// Bigger files are only checked for equality.
+	maxCompareDiffSize = 8 << 20
+	maxCompareEdits    = 10000
+	defaultDiffLines   = 200
+)
+
+// compare checks content, uploaded or stored at otherPath, against the
+// golden file at goldenPath and returns whether they are equal along with a
+// bounded unified diff.
+func compare(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	goldenPath := r.FormValue("goldenPath")
+	otherPath := r.FormValue("otherPath")
+	_, hasContent := r.PostForm["content"]
+	logrus.WithFields(logrus.Fields{
+		"goldenPath": goldenPath,
+		"otherPath":  otherPath,
+		"requestId":  requestId,
+		"serverId":   serverId,
+	}).Info("Comparing against golden file")
+
+	if goldenPath == "" {
+		http.Error(w, "goldenPath is required", http.StatusBadRequest)
+		return
+	}
+	if hasContent == (otherPath != "") {
+		http.Error(w, "Exactly one of content and otherPath is required", http.StatusBadRequest)
+		return
+	}
+	maxLines := defaultDiffLines
+	if r.FormValue("maxLines") != "" {
+		n, err := formPositiveInt(r, "maxLines")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		maxLines = n
+	}
+
+	golden, releaseGolden, status, err := readComparedFile(r, goldenPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read golden file: %s", err.Error()), status)
+		return
+	}
+	defer releaseGolden()
+
+	var actual []byte
+	if hasContent {
+		actual = []byte(r.PostFormValue("content"))
+	} else {
+		var releaseOther func()
+		actual, releaseOther, status, err = readComparedFile(r, otherPath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read otherPath: %s", err.Error()), status)
+			return
+		}
+		defer releaseOther()
+	}
+
+	equal := bytes.Equal(golden, actual)
+	result := map[string]interface{}{
+		"equal":      equal,
+		"goldenSize": len(golden),
+		"actualSize": len(actual),
+	}
+	if !equal {
+		describeDifference(result, golden, actual, maxLines)
+	}
+	writeJSON(w, "Files compared successfully", requestId, result)
+}
+
+// readComparedFile resolves and reads a file for the compare request r,
+// returning the status code to answer with if that fails.
+func readComparedFile(r *http.Request, p string) ([]byte, func(), int, error) {
+	filePath, err := resolvePath(r, p)
+	if err != nil {
+		return nil, nil, pathErrorStatus(err), err
+	}
+	data, release, err := readFileContent(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, http.StatusNotFound, fmt.Errorf("file not found: %s", p)
+		}
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	if err := checkNotClientEncrypted(bytes.NewReader(data)); err != nil {
+		release()
+		return nil, nil, clientKeyStatus(err), err
+	}
+	return data, release, 0, nil
+}
+
+// describeDifference adds where golden and actual differ to result: a
+// unified diff for text, or the offset of the first differing byte for
+// binary or very large content.
+func describeDifference(result map[string]interface{}, golden, actual []byte, maxLines int) {
+	binary := bytes.IndexByte(golden, 0) >= 0 || bytes.IndexByte(actual, 0) >= 0
+	if !binary && len(golden) <= maxCompareDiffSize && len(actual) <= maxCompareDiffSize {
+		ops, ok := diffLines(splitLines(string(golden)), splitLines(string(actual)), maxCompareEdits)
+		if ok {
+			diff, truncated := unifiedDiff(ops, 3, maxLines)
+			result["diff"] = diff
+			result["truncated"] = truncated
+			return
+		}
+	}
+
+	offset := 0
+	for offset < len(golden) && offset < len(actual) && golden[offset] == actual[offset] {
+		offset++
+	}
+	result["binary"] = binary
+	result["firstDifference"] = offset
+}
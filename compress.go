@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig controls the compression of file contents and listings
+// for clients that accept it.
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// MinSize is the smallest response, in bytes, worth compressing.
+	MinSize int64 `json:"minSize"`
+	// MaxSize is the largest response of known length, in bytes, that is
+	// compressed. Larger ones, such as big downloads, are sent as they
+	// are, straight from the file. 0 means no limit.
+	MaxSize int64 `json:"maxSize"`
+	// SkipTypes are the content types never compressed because they
+	// already are. Entries ending in "/" match a whole type such as
+	// "image/".
+	SkipTypes []string `json:"skipTypes"`
+}
+
+// defaultSkipTypes are content types that are compressed already.
+var defaultSkipTypes = []string{
+	"image/", "video/", "audio/",
+	"application/gzip", "application/x-gzip", "application/zstd", "application/zip",
+	"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+	"application/vnd.rar", "application/x-rar-compressed",
+}
+
+func (c CompressionConfig) validate() error {
+	if c.MinSize < 0 {
+		return errors.New("minSize must not be negative")
+	}
+	if c.MaxSize < 0 {
+		return errors.New("maxSize must not be negative")
+	}
+	return nil
+}
+
+func (c CompressionConfig) skips(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, skip := range c.SkipTypes {
+		if mediaType == skip || (strings.HasSuffix(skip, "/") && strings.HasPrefix(mediaType, skip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncoding picks the response encoding from an Accept-Encoding
+// header: zstd if the client takes it, else gzip, else "".
+func acceptedEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				weight = parsed
+			}
+		}
+		q[strings.ToLower(name)] = weight
+	}
+	for _, encoding := range []string{"zstd", "gzip"} {
+		weight, ok := q[encoding]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressed serves the responses of handler compressed with the encoding
+// the client accepts, unless they are small, partial or of a type in
+// SkipTypes.
+func compressed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.Compression.Enabled || r.Method != http.MethodGet {
+			handler(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			handler(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer cw.Close()
+		handler(cw, r)
+	}
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// to compress it: when the handler gives a Content-Length, which must lie
+// between MinSize and MaxSize, or once MinSize bytes have been written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         bytes.Buffer
+	enc         io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	if length := w.Header().Get("Content-Length"); length != "" {
+		size, _ := strconv.ParseInt(length, 10, 64)
+		w.decide(size >= config.Compression.MinSize && (config.Compression.MaxSize == 0 || size <= config.Compression.MaxSize))
+	} else if code != http.StatusOK {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf.Write(p)
+		if int64(w.buf.Len()) >= config.Compression.MinSize {
+			w.decide(true)
+			return len(p), w.flushBuffer()
+		}
+		return len(p), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide sends the headers, compressing the response if worthwhile and
+// allowed for its status and type.
+func (w *compressWriter) decide(worthwhile bool) {
+	w.decided = true
+	h := w.Header()
+	if worthwhile && w.status == http.StatusOK && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		!config.Compression.skips(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		// The compressed bytes differ, so the tag can only match weakly.
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		if w.encoding == "zstd" {
+			w.enc, _ = zstd.NewWriter(w.ResponseWriter, zstd.WithEncoderConcurrency(1))
+		} else {
+			w.enc = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) flushBuffer() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// ReadFrom passes src straight through when the response isn't compressed,
+// so downloads keep using sendfile.
+func (w *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case !w.decided:
+		// Without a length the start is held back until its size is known.
+		return io.Copy(struct{ io.Writer }{w}, src)
+	case w.enc != nil:
+		return io.Copy(w.enc, src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Flush compresses what has been held back, since a handler flushing is
+// streaming a response that is likely to grow.
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(true)
+		w.flushBuffer()
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close sends what is still held back and finishes the compressed stream.
+func (w *compressWriter) Close() error {
+	if !w.wroteHeader {
+		// Nothing was written; the server sends an empty 200 itself.
+		return nil
+	}
+	if !w.decided {
+		w.decide(false)
+	}
+	err := w.flushBuffer()
+	if w.enc != nil {
+		if closeErr := w.enc.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFromRecorder counts the bodies it is handed with ReadFrom, which is
+// how the connection sends files with sendfile.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom int
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom++
+	return io.Copy(struct{ io.Writer }{r.ResponseRecorder}, src)
+}
+
+func TestCompressedDownload(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		fileName string
+		size     int
+		encoding string
+		readFrom bool
+	}{
+		{name: "small", fileName: "small.txt", size: 64 << 10, encoding: "gzip"},
+		{name: "above maxSize", fileName: "large.txt", size: 2 << 20, readFrom: true},
+		{name: "compressed type", fileName: "logs.gz", size: 64 << 10, readFrom: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := testRoot(t)
+			withConfig(t, func(c *Config) {
+				c.RootDir = root
+				c.Compression = CompressionConfig{Enabled: true, MinSize: 1024, MaxSize: 1 << 20, SkipTypes: defaultSkipTypes}
+			})
+			content := bytes.Repeat([]byte("compressible "), tt.size/13+1)[:tt.size]
+			if err := os.WriteFile(filepath.Join(root, tt.fileName), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "/download?filePath="+tt.fileName, nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			compressed(downloadFile)(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding %q, want %q", got, tt.encoding)
+			}
+			if (w.readFrom > 0) != tt.readFrom {
+				t.Errorf("body passed to ReadFrom %d times", w.readFrom)
+			}
+			if tt.encoding == "" && !bytes.Equal(w.Body.Bytes(), content) {
+				t.Errorf("got %d bytes, want the %d of the file", w.Body.Len(), len(content))
+			}
+		})
+	}
+}
+
+func TestWritersPassReadFrom(t *testing.T) {
+	for name, wrap := range map[string]func(http.ResponseWriter) http.ResponseWriter{
+		"access log": func(w http.ResponseWriter) http.ResponseWriter { return &accessLogWriter{ResponseWriter: w} },
+		"tenant":     func(w http.ResponseWriter) http.ResponseWriter { return &tenantWriter{ResponseWriter: w} },
+		"size limit": func(w http.ResponseWriter) http.ResponseWriter {
+			return &limitWriter{ResponseWriter: w, body: &limitedBody{}}
+		},
+		"deadline": func(w http.ResponseWriter) http.ResponseWriter {
+			return &deadlineWriter{w: w, header: http.Header{}}
+		},
+		"debug bodies": func(w http.ResponseWriter) http.ResponseWriter {
+			return &captureWriter{ResponseWriter: w, capture: &bodyCapture{max: 10}}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			content := bytes.Repeat([]byte("x"), 100)
+			// http.ServeContent copies the file through a LimitedReader.
+			n, err := io.Copy(wrap(rec), io.LimitReader(bytes.NewReader(content), int64(len(content))))
+			if err != nil || n != int64(len(content)) {
+				t.Fatalf("copied %d bytes: %v", n, err)
+			}
+			if rec.readFrom != 1 {
+				t.Errorf("body passed to ReadFrom %d times", rec.readFrom)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), content) {
+				t.Errorf("got %q", rec.Body.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+)
+
+// compressionExts are the extensions of the formats /compressFile writes.
+var compressionExts = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// newCompressor returns a writer compressing into dst in format at level,
+// or at the default level of the format when level is 0.
+func newCompressor(dst io.Writer, format string, level int) (io.WriteCloser, error) {
+	switch format {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(dst, level)
+	case "zstd":
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(dst, opts...)
+	}
+	return nil, fmt.Errorf("Unsupported format %q: use gzip or zstd", format)
+}
+
+// compressFile compresses the file at filePath with format, gzip by default
+// or zstd, at level (1 to 9 for gzip, 1 to 22 for zstd). The result goes to
+// destPath, or like gzip does next to the file with the extension of the
+// format added, in which case the file is deleted unless keep=true. The
+// content is streamed through the compressor, so memory use doesn't grow
+// with the size of the file.
+func compressFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	destPath := r.FormValue("destPath")
+	format := r.FormValue("format")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"destPath":  destPath,
+		"format":    format,
+		"level":     r.FormValue("level"),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Compressing file")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if format == "" {
+		format = "gzip"
+	}
+	ext, ok := compressionExts[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported format %q: use gzip or zstd", format), http.StatusBadRequest)
+		return
+	}
+	level := 0
+	if value := r.FormValue("level"); value != "" {
+		n, err := strconv.Atoi(value)
+		maxLevel := 9
+		if format == "zstd" {
+			maxLevel = 22
+		}
+		if err != nil || n < 1 || n > maxLevel {
+			http.Error(w, fmt.Sprintf("Invalid level value: %s takes 1 to %d", format, maxLevel), http.StatusBadRequest)
+			return
+		}
+		level = n
+	}
+	keep, err := formBool(r, "keep")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Compressing next to the file replaces it, unless asked to keep it.
+	removeSource := destPath == "" && !keep
+	if destPath == "" {
+		destPath = filePath + ext
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err == nil && removeSource {
+		err = checkPathScopeFor(r, opDelete, filePath)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	destPath, err = resolvePath(r, destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	src, err := openFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockWrites(destPath)
+	defer unlock()
+	destInfo, err := statFile(destPath)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", destPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if destInfo != nil {
+		if destInfo.IsDir() {
+			http.Error(w, "destPath is a directory", http.StatusBadRequest)
+			return
+		}
+		if sameFile(info, destInfo) {
+			http.Error(w, "filePath and destPath are the same file", http.StatusBadRequest)
+			return
+		}
+		if !overwrite {
+			http.Error(w, "destPath already exists; set overwrite=true to replace it", http.StatusConflict)
+			return
+		}
+	}
+
+	if dryRun {
+		action := "create"
+		if destInfo != nil {
+			action = "replace"
+		}
+		entries := []dryRunEntry{{Path: destPath, Action: action}}
+		if removeSource {
+			entries = append(entries, dryRunEntry{Path: filePath, Action: "delete", Size: info.Size()})
+		}
+		writeJSON(w, "Dry run: file not compressed", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	pr, pw := io.Pipe()
+	compressed := make(chan error, 1)
+	go func() {
+		err := compressTo(pw, src, format, level)
+		pw.CloseWithError(err)
+		compressed <- err
+	}()
+	size, err := storeFileFrom(destPath, &cappedReader{r: pr, limit: sizeLimit(r, destPath)})
+	// Stops the compression if storing failed before reading it all.
+	pr.Close()
+	if compressErr := <-compressed; compressErr != nil && !errors.Is(compressErr, io.ErrClosedPipe) {
+		err = compressErr
+	}
+	if err != nil {
+		discardBackup(backup)
+		if errors.Is(err, errTooLarge) {
+			http.Error(w, fmt.Sprintf("File %s", err.Error()), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to compress file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "compress", destPath, existed, backup)
+
+	if removeSource {
+		backup, err := trashFile(filePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("File compressed but unable to delete it: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		recordOperation(requestActor(r), requestId, "delete", filePath, true, backup)
+	}
+	ratio := 0.0
+	if info.Size() > 0 {
+		ratio = float64(size) / float64(info.Size())
+	}
+	writeJSON(w, "File compressed successfully", requestId, map[string]interface{}{
+		"format":         format,
+		"originalSize":   info.Size(),
+		"compressedSize": size,
+		"ratio":          ratio,
+		"deleted":        removeSource,
+	})
+}
+
+// compressTo writes src compressed with format at level to dst.
+func compressTo(dst io.Writer, src io.Reader, format string, level int) error {
+	enc, err := newCompressor(dst, format, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, src); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// compressionMagic are the bytes files of each format /decompressFile reads
+// start with, to recognize them without a known extension.
+var compressionMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0}},
+}
+
+// decompressionExts map the extensions /decompressFile recognizes to their
+// format.
+var decompressionExts = map[string]string{
+	".gz":   "gzip",
+	".tgz":  "gzip",
+	".zst":  "zstd",
+	".zstd": "zstd",
+	".bz2":  "bzip2",
+	".tbz2": "bzip2",
+	".xz":   "xz",
+	".txz":  "xz",
+}
+
+// sniffCompression returns the format the content starting with head is
+// compressed in, or "" if it isn't one known.
+func sniffCompression(head []byte) string {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+	return ""
+}
+
+// newDecompressor returns a reader decompressing src from format.
+func newDecompressor(src io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case "gzip":
+		return gzip.NewReader(src)
+	case "zstd":
+		dec, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(src)), nil
+	case "xz":
+		dec, err := xz.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(dec), nil
+	}
+	return nil, fmt.Errorf("Unsupported format %q: use gzip, zstd, bzip2 or xz", format)
+}
+
+// errCorruptCompressed is returned when compressed content can't be
+// decoded.
+var errCorruptCompressed = errors.New("corrupt compressed data")
+
+// decodeReader tells errors decoding the content read through it apart from
+// those writing it, by wrapping them in errCorruptCompressed.
+type decodeReader struct {
+	r io.Reader
+}
+
+func (d decodeReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", errCorruptCompressed, err)
+	}
+	return n, err
+}
+
+// decompressionLimit returns the most bytes decompressing into the resolved
+// path dest may produce: the least of config.MaxDecompressedSize, the size
+// limit of dest and max, ignoring those that are zero.
+func decompressionLimit(r *http.Request, dest string, max int64) int64 {
+	limit := int64(0)
+	for _, l := range []int64{config.MaxDecompressedSize, sizeLimit(r, dest), max} {
+		if l > 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// decompressFile decompresses the file at filePath, compressed with gzip,
+// zstd, bzip2 or xz. The format is taken from format, or else the extension of
+// the file or its first bytes. The result goes to destPath, or like gunzip
+// does next to the file without its extension, in which case the file is
+// deleted unless keep=true. Decompressing stops with 413 once the result
+// grows past maxSize or the server's limit, so a decompression bomb can't
+// fill the disk.
+func decompressFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	destPath := r.FormValue("destPath")
+	format := r.FormValue("format")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"destPath":  destPath,
+		"format":    format,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Decompressing file")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	maxSize, err := formSize(r, "maxSize", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keep, err := formBool(r, "keep")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ext := strings.ToLower(path.Ext(filePath))
+	if format == "" {
+		format = decompressionExts[ext]
+	}
+	// Decompressing next to the file replaces it, unless asked to keep it.
+	removeSource := destPath == "" && !keep
+	if destPath == "" {
+		if decompressionExts[ext] == "" || decompressionExts[ext] != format {
+			http.Error(w, "destPath is required when filePath has no extension of its format to strip", http.StatusBadRequest)
+			return
+		}
+		destPath = strings.TrimSuffix(filePath, filePath[len(filePath)-len(ext):])
+		switch ext {
+		case ".tgz", ".tbz2", ".txz":
+			destPath += ".tar"
+		}
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err == nil && removeSource {
+		err = checkPathScopeFor(r, opDelete, filePath)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	destPath, err = resolvePath(r, destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	src, err := openFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+	br := bufio.NewReader(src)
+	if format == "" {
+		head, _ := br.Peek(8)
+		if format = sniffCompression(head); format == "" {
+			http.Error(w, "Unable to tell the format of filePath; give format", http.StatusBadRequest)
+			return
+		}
+	}
+	dec, err := newDecompressor(br, format)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to decompress file: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	defer dec.Close()
+
+	unlock := lockWrites(destPath)
+	defer unlock()
+	destInfo, err := statFile(destPath)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", destPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if destInfo != nil {
+		if destInfo.IsDir() {
+			http.Error(w, "destPath is a directory", http.StatusBadRequest)
+			return
+		}
+		if sameFile(info, destInfo) {
+			http.Error(w, "filePath and destPath are the same file", http.StatusBadRequest)
+			return
+		}
+		if !overwrite {
+			http.Error(w, "destPath already exists; set overwrite=true to replace it", http.StatusConflict)
+			return
+		}
+	}
+
+	if dryRun {
+		action := "create"
+		if destInfo != nil {
+			action = "replace"
+		}
+		entries := []dryRunEntry{{Path: destPath, Action: action}}
+		if removeSource {
+			entries = append(entries, dryRunEntry{Path: filePath, Action: "delete", Size: info.Size()})
+		}
+		writeJSON(w, "Dry run: file not decompressed", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	size, err := storeFileFrom(destPath, &cappedReader{r: decodeReader{dec}, limit: decompressionLimit(r, destPath, maxSize)})
+	if err != nil {
+		discardBackup(backup)
+		if errors.Is(err, errTooLarge) {
+			http.Error(w, fmt.Sprintf("Decompressed file %s", err.Error()), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errCorruptCompressed) {
+			http.Error(w, fmt.Sprintf("Unable to decompress file: %s", err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to decompress file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "decompress", destPath, existed, backup)
+
+	if removeSource {
+		backup, err := trashFile(filePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("File decompressed but unable to delete it: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		recordOperation(requestActor(r), requestId, "delete", filePath, true, backup)
+	}
+	writeJSON(w, "File decompressed successfully", requestId, map[string]interface{}{
+		"format":           format,
+		"compressedSize":   info.Size(),
+		"decompressedSize": size,
+		"deleted":          removeSource,
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func xzCompress(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressXZ(t *testing.T) {
+	content := []byte(strings.Repeat("line of text\n", 1000))
+	compressed := xzCompress(t, content)
+
+	for _, tt := range []struct {
+		name     string
+		fileName string
+		data     []byte
+		form     url.Values
+		want     int
+		destName string
+	}{
+		{name: "by extension", fileName: "app.log.xz", data: compressed, want: http.StatusOK, destName: "app.log"},
+		{name: "tarball extension", fileName: "files.txz", data: compressed, want: http.StatusOK, destName: "files.tar"},
+		{name: "by content", fileName: "blob", data: compressed, form: url.Values{"destPath": {"out"}}, want: http.StatusOK, destName: "out"},
+		{name: "truncated", fileName: "cut.xz", data: compressed[:len(compressed)/2], want: http.StatusUnprocessableEntity},
+		{name: "not xz", fileName: "plain.xz", data: content, want: http.StatusBadRequest},
+		{name: "too large", fileName: "bomb.xz", data: compressed, form: url.Values{"maxSize": {"100"}}, want: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := testRoot(t)
+			withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = "" })
+			if err := os.WriteFile(filepath.Join(root, tt.fileName), tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			form := url.Values{"filePath": {tt.fileName}}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			w := postForm(decompressFile, "/decompressFile", form)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.destName == "" {
+				return
+			}
+			got, err := os.ReadFile(filepath.Join(root, tt.destName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decompressed %d bytes, want %d", len(got), len(content))
+			}
+		})
+	}
+}
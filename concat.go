@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// concatFiles joins the files named by the sourcePath values, in the order
+// given, into destPath, streaming each in turn, to reassemble chunked
+// uploads or merge rotated logs. An existing destPath is only replaced with
+// overwrite=true; append=true adds the sources after its content instead.
+// With deleteSources=true the sources are deleted once destPath is written.
+func concatFiles(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	destPath := r.FormValue("destPath")
+	sourcePaths := r.Form["sourcePath"]
+	logrus.WithFields(logrus.Fields{
+		"sourcePaths": sourcePaths,
+		"destPath":    destPath,
+		"requestId":   requestId,
+		"serverId":    serverId,
+	}).Info("Concatenating files")
+
+	if len(sourcePaths) == 0 || destPath == "" {
+		http.Error(w, "sourcePath and destPath are required", http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appendTo, err := formBool(r, "append")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deleteSources, err := formBool(r, "deleteSources")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if overwrite && appendTo {
+		http.Error(w, "overwrite and append are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	destPath, err = resolvePath(r, destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	// Sources that are deleted afterwards need the same access as
+	// /deleteFile, otherwise reading them is enough.
+	sourceOp := opRead
+	if deleteSources {
+		sourceOp = opDelete
+	}
+	resolvedSources := make([]string, 0, len(sourcePaths))
+	sources := make([]contentFile, 0, len(sourcePaths))
+	defer func() {
+		for _, f := range sources {
+			f.Close()
+		}
+	}()
+	sourceInfos := make([]os.FileInfo, 0, len(sourcePaths))
+	var total int64
+	for _, sourcePath := range sourcePaths {
+		resolved, err := resolvePath(r, sourcePath)
+		if err == nil {
+			err = checkPathScopeFor(r, sourceOp, resolved)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid sourcePath %s: %s", sourcePath, err.Error()), pathErrorStatus(err))
+			return
+		}
+		resolvedSources = append(resolvedSources, resolved)
+		f, err := openFile(resolved)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, fmt.Sprintf("Source file not found: %s", sourcePath), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Unable to open source file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		sources = append(sources, f)
+		if err := checkNotClientEncrypted(f); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read sourcePath %s: %s", sourcePath, err.Error()), clientKeyStatus(err))
+			return
+		}
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", resolved, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if !info.Mode().IsRegular() {
+			http.Error(w, fmt.Sprintf("sourcePath %s is not a regular file", sourcePath), http.StatusBadRequest)
+			return
+		}
+		if deleteSources {
+			// Deleting a file twice would fail halfway through.
+			for _, other := range sourceInfos {
+				if sameFile(info, other) {
+					http.Error(w, fmt.Sprintf("sourcePath %s is given more than once", sourcePath), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		sourceInfos = append(sourceInfos, info)
+		total += info.Size()
+	}
+
+	unlock := lockWrites(destPath)
+	defer unlock()
+	destInfo, err := statFile(destPath)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", destPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if destInfo != nil {
+		if destInfo.IsDir() {
+			http.Error(w, "destPath is a directory", http.StatusBadRequest)
+			return
+		}
+		for _, info := range sourceInfos {
+			if sameFile(info, destInfo) {
+				http.Error(w, "destPath is one of the sources", http.StatusBadRequest)
+				return
+			}
+		}
+		if !overwrite && !appendTo {
+			http.Error(w, "destPath already exists; set overwrite=true to replace it or append=true to add to it", http.StatusConflict)
+			return
+		}
+		if appendTo {
+			if err := checkPathNotClientEncrypted(destPath); err != nil {
+				http.Error(w, fmt.Sprintf("Unable to append to destPath: %s", err.Error()), clientKeyStatus(err))
+				return
+			}
+			total += destInfo.Size()
+		}
+	}
+	if err := checkFileSize(r, destPath, total); err != nil {
+		http.Error(w, fmt.Sprintf("File %s", err.Error()), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if dryRun {
+		action := "create"
+		if destInfo != nil && appendTo {
+			action = "append"
+		} else if destInfo != nil {
+			action = "replace"
+		}
+		entries := []dryRunEntry{{Path: destPath, Action: action, Size: total}}
+		if deleteSources {
+			for i, sourcePath := range resolvedSources {
+				entries = append(entries, dryRunEntry{Path: sourcePath, Action: "delete", Size: sourceInfos[i].Size()})
+			}
+		}
+		writeJSON(w, "Dry run: files not concatenated", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	readers := make([]io.Reader, 0, len(sources)+1)
+	if destInfo != nil && appendTo {
+		dest, err := openFile(destPath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to open destination file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		defer dest.Close()
+		readers = append(readers, dest)
+	}
+	for _, f := range sources {
+		readers = append(readers, f)
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	size, err := storeFileFrom(destPath, io.MultiReader(readers...))
+	if err != nil {
+		discardBackup(backup)
+		http.Error(w, fmt.Sprintf("Unable to concatenate files: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "concat", destPath, existed, backup)
+
+	deleted := 0
+	if deleteSources {
+		for _, sourcePath := range resolvedSources {
+			backup, err := trashFile(sourcePath)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Files concatenated but unable to delete %s: %s", sourcePath, err.Error()), http.StatusInternalServerError)
+				return
+			}
+			recordOperation(requestActor(r), requestId, "delete", sourcePath, true, backup)
+			deleted++
+		}
+	}
+	writeJSON(w, "Files concatenated successfully", requestId, map[string]interface{}{
+		"size":    size,
+		"sources": len(sources),
+		"deleted": deleted,
+	})
+}
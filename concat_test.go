@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConcatFiles(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		form      url.Values
+		principal *principal
+		want      int
+		dest      string
+		// kept lists the sources still there afterwards.
+		kept []string
+	}{
+		{name: "in order", form: url.Values{"sourcePath": {"b", "a"}, "destPath": {"new"}}, want: http.StatusOK, dest: "BA", kept: []string{"a", "b"}},
+		{name: "existing destination", form: url.Values{"sourcePath": {"a"}, "destPath": {"out"}}, want: http.StatusConflict, dest: "O"},
+		{name: "overwrite", form: url.Values{"sourcePath": {"a", "b"}, "destPath": {"out"}, "overwrite": {"true"}}, want: http.StatusOK, dest: "AB"},
+		{name: "append", form: url.Values{"sourcePath": {"a", "b"}, "destPath": {"out"}, "append": {"true"}}, want: http.StatusOK, dest: "OAB"},
+		{name: "destination among the sources", form: url.Values{"sourcePath": {"a", "out"}, "destPath": {"out"}, "append": {"true"}}, want: http.StatusBadRequest, dest: "O"},
+		{name: "delete sources", form: url.Values{"sourcePath": {"a", "b"}, "destPath": {"new"}, "deleteSources": {"true"}}, want: http.StatusOK, dest: "AB"},
+		{name: "source twice", form: url.Values{"sourcePath": {"a", "a"}, "destPath": {"new"}, "deleteSources": {"true"}}, want: http.StatusBadRequest, kept: []string{"a"}},
+		{name: "source outside the root", form: url.Values{"sourcePath": {"../secret"}, "destPath": {"new"}}, want: http.StatusForbidden},
+		{name: "deleting needs the delete scope", form: url.Values{"sourcePath": {"a"}, "destPath": {"new"}, "deleteSources": {"true"}},
+			principal: &principal{Name: "writer", Scopes: []string{opRead, opWrite}}, want: http.StatusForbidden, kept: []string{"a"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := testRoot(t)
+			withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = "" })
+			for name, content := range map[string]string{"a": "A", "b": "B", "out": "O"} {
+				if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			os.WriteFile(filepath.Join(filepath.Dir(root), "secret"), []byte("S"), 0644)
+
+			r := httptest.NewRequest("POST", "/concatFiles", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = asPrincipal(r, tt.principal)
+			w := httptest.NewRecorder()
+			concatFiles(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+
+			if tt.dest != "" {
+				destPath := filepath.Join(root, tt.form.Get("destPath"))
+				if got, _ := os.ReadFile(destPath); string(got) != tt.dest {
+					t.Errorf("destPath holds %q, want %q", got, tt.dest)
+				}
+			}
+			for _, name := range tt.kept {
+				if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+					t.Errorf("source %s: %v", name, err)
+				}
+			}
+			if tt.form.Get("deleteSources") == "true" && tt.want == http.StatusOK {
+				for _, name := range tt.form["sourcePath"] {
+					if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+						t.Errorf("source %s not deleted: %v", name, err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeLocks serializes writes to the same file, so content streamed in
+// several writes isn't interleaved with another request's, and a conditional
+// write's check of the file can't be overtaken by another write. A file's
+// lock is dropped once no request holds or waits for it.
+var writeLocks struct {
+	sync.Mutex
+	byPath map[string]*writeLock
+}
+
+type writeLock struct {
+	sync.Mutex
+	// refs counts the requests holding or waiting for the lock.
+	refs int
+}
+
+// lockWrites locks the files at paths against other writes and returns the
+// function unlocking them. They are locked in a fixed order, so requests
+// writing to the same files can't deadlock.
+func lockWrites(paths ...string) func() {
+	paths = append([]string(nil), paths...)
+	sort.Strings(paths)
+	var unlocks []func()
+	for i, filePath := range paths {
+		if i > 0 && filePath == paths[i-1] {
+			continue
+		}
+		filePath := filePath
+		l := refWriteLock(filePath)
+		l.Lock()
+		unlocks = append(unlocks, func() {
+			l.Unlock()
+			unrefWriteLock(filePath, l)
+		})
+	}
+	return func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+}
+
+func refWriteLock(filePath string) *writeLock {
+	writeLocks.Lock()
+	defer writeLocks.Unlock()
+	if writeLocks.byPath == nil {
+		writeLocks.byPath = map[string]*writeLock{}
+	}
+	l := writeLocks.byPath[filePath]
+	if l == nil {
+		l = &writeLock{}
+		writeLocks.byPath[filePath] = l
+	}
+	l.refs++
+	return l
+}
+
+func unrefWriteLock(filePath string, l *writeLock) {
+	writeLocks.Lock()
+	defer writeLocks.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(writeLocks.byPath, filePath)
+	}
+}
+
+// etagMatches reports whether an If-None-Match style header lists etag,
+// comparing weakly: tags weakened by compression still match.
+func etagMatches(header string, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag and Last-Modified headers of a file version and,
+// if the request's If-None-Match or If-Modified-Since says the client has
+// that version already, answers 304 Not Modified and returns true. Raw reads
+// get the same from http.ServeContent.
+func notModified(w http.ResponseWriter, r *http.Request, info os.FileInfo) bool {
+	etag := fileETag(info)
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+
+	// If-Modified-Since is ignored when If-None-Match is given, as RFC 9110
+	// asks, since the tag is the more precise of the two.
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if !etagMatches(header, etag) {
+			return false
+		}
+	} else if header := r.Header.Get("If-Modified-Since"); header != "" {
+		since, err := http.ParseTime(header)
+		if err != nil || modTime.After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// preconditionsHold checks the If-Match and If-Unmodified-Since headers of a
+// write against the current version of filePath, answering 412 Precondition
+// Failed and returning false if the file changed since the client read it.
+func preconditionsHold(w http.ResponseWriter, r *http.Request, filePath string) bool {
+	info, err := checkPreconditions(filePath, r.Header.Get("If-Match"), r.Header.Get("If-Unmodified-Since"))
+	if errors.Is(err, errPreconditionFailed) {
+		if info != nil {
+			w.Header().Set("ETag", fileETag(info))
+		}
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+var errPreconditionFailed = errors.New("Precondition failed: the file has changed")
+
+// checkPreconditions checks If-Match and If-Unmodified-Since values against
+// the current version of filePath, returning errPreconditionFailed along with
+// that version if the file changed since the client read it. Tags weakened by
+// compression still match, as they name the same version. Writes check it
+// under lockWrites, so the file can't change between the check and the write.
+func checkPreconditions(filePath string, ifMatch string, ifUnmodifiedSince string) (os.FileInfo, error) {
+	if ifMatch == "" && ifUnmodifiedSince == "" {
+		return nil, nil
+	}
+	info, err := statFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to get info for file %s: %s", filePath, err.Error())
+	}
+
+	// If-Unmodified-Since is ignored when If-Match is given, as RFC 9110
+	// asks.
+	if ifMatch != "" {
+		if info != nil && etagMatches(ifMatch, fileETag(info)) {
+			return info, nil
+		}
+	} else if since, err := http.ParseTime(ifUnmodifiedSince); err != nil || info == nil ||
+		!info.ModTime().UTC().Truncate(time.Second).After(since) {
+		// An unparsable date is ignored, and a missing file can't have
+		// been modified.
+		return info, nil
+	}
+	return info, errPreconditionFailed
+}
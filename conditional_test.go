@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestWriteLocksExcludeAndArePruned(t *testing.T) {
+	var wg sync.WaitGroup
+	held := map[string]int{}
+	var mu sync.Mutex
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				filePath := fmt.Sprintf("/f%d", (i+n)%3)
+				unlock := lockWrites(filePath)
+				mu.Lock()
+				held[filePath]++
+				if held[filePath] > 1 {
+					t.Errorf("%s locked twice", filePath)
+				}
+				mu.Unlock()
+				mu.Lock()
+				held[filePath]--
+				mu.Unlock()
+				unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	writeLocks.Lock()
+	defer writeLocks.Unlock()
+	if n := len(writeLocks.byPath); n != 0 {
+		t.Errorf("%d locks left after every write finished", n)
+	}
+}
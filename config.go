@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config holds the server settings. They are read from an optional JSON file
+// given with -config, and flags on the command line override the file.
+type Config struct {
+	// Addr is the address the server listens on.
+	Addr string `json:"addr"`
+	// TLSCert and TLSKey are the PEM files of the certificate to serve HTTPS
+	// with. They are reloaded when they change. Empty serves plain HTTP.
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+	// TLSClientCA is a PEM bundle of the CAs client certificates must be
+	// signed by. When set, clients without a valid certificate are refused.
+	TLSClientCA string `json:"tlsClientCA"`
+	// RootDir confines the server to a directory. Client paths, absolute ones
+	// included, are resolved below it and may not leave it. Empty allows any
+	// path the process can access.
+	RootDir string `json:"rootDir"`
+	// ReadOnly starts the server in read-only mode, refusing every request
+	// that would change stored data. /admin/readOnly switches it at runtime.
+	ReadOnly bool `json:"readOnly"`
+	// SyncDir also syncs the directory after each write, so a crash right
+	// after a write can't lose the file. Written files are always synced.
+	SyncDir bool `json:"syncDir"`
+	// ModeMask holds the permission bits clients may give files and
+	// directories they create or chmod, such as 0755 to keep them from
+	// making anything world-writable.
+	ModeMask FileMode `json:"modeMask"`
+	// FileOwner and FileGroup, names or numeric ids, own the files and
+	// directories the server creates, so they can be handed to other
+	// system users. Replaced files keep their owner. Empty leaves files to
+	// the server's own user; changing the owner needs root.
+	FileOwner string `json:"fileOwner"`
+	FileGroup string `json:"fileGroup"`
+	// MaxBodySize caps request bodies and the files they write, in bytes.
+	// SizeLimits override it below path prefixes, the longest matching
+	// prefix winning. Zero means no limit.
+	MaxBodySize int64       `json:"maxBodySize"`
+	SizeLimits  []SizeLimit `json:"sizeLimits"`
+	// ContentSchemas are JSON Schemas the JSON and YAML files written
+	// below path prefixes must match, the longest matching prefix winning.
+	ContentSchemas []ContentSchema `json:"contentSchemas"`
+	// CaseInsensitivePaths resolves each path component against the
+	// existing directory entries ignoring case, like macOS and Windows do.
+	CaseInsensitivePaths bool `json:"caseInsensitivePaths"`
+	// UnicodeNormalization is the normal form incoming paths are converted
+	// to: NFC, NFD or none.
+	UnicodeNormalization string `json:"unicodeNormalization"`
+	// StreamThreshold is the file size in bytes above which readFile streams
+	// the raw content instead of wrapping it in JSON, unless format=json is
+	// given. Zero disables streaming by default.
+	StreamThreshold int64 `json:"streamThreshold"`
+	// MmapThreshold is the file size in bytes from which readFile serves
+	// content from a memory mapping rather than reading it. Zero disables
+	// mapping.
+	MmapThreshold int64 `json:"mmapThreshold"`
+	// WalkWorkers is the number of goroutines reading directories
+	// concurrently during recursive operations.
+	WalkWorkers int `json:"walkWorkers"`
+	// ListHidden lists dotfiles in listFiles and findFiles unless a request
+	// says otherwise with includeHidden.
+	ListHidden bool `json:"listHidden"`
+	// ListExcludePatterns are globs for entries left out of listFiles and
+	// findFiles, such as "*.tmp", unless a request gives its own
+	// excludePatterns.
+	ListExcludePatterns []string `json:"listExcludePatterns"`
+	// MaxDecompressedSize caps, in bytes, what decompressing a file may
+	// produce, so a small decompression bomb can't fill the disk. Zero
+	// means no limit besides the size limit of the path written.
+	MaxDecompressedSize int64 `json:"maxDecompressedSize"`
+	// LogFormat is the format of the server log: text, json or journald.
+	LogFormat string `json:"logFormat"`
+	// Syslog ships the log to syslog as well: "local" or a URL such as
+	// udp://loghost:514.
+	Syslog    string `json:"syslog"`
+	SyslogTag string `json:"syslogTag"`
+	// UploadDir keeps the chunks of unfinished chunked uploads. Defaults to
+	// a directory in the system temp directory.
+	UploadDir string `json:"uploadDir"`
+	// AccessLog is the file access log lines are appended to in the
+	// AccessLogFormat Apache format, "-" for stdout.
+	AccessLog       string `json:"accessLog"`
+	AccessLogFormat string `json:"accessLogFormat"`
+	// DebugBodyMaxBytes is how much of each body is logged by /admin/debug.
+	DebugBodyMaxBytes int `json:"debugBodyMaxBytes"`
+	// DebugRedactPatterns are regular expressions for secrets hidden from
+	// logged bodies. The first group of a match, if any, is kept.
+	DebugRedactPatterns []string `json:"debugRedactPatterns"`
+	// AuditLog is the file audit events are appended to as JSON lines.
+	AuditLog string `json:"auditLog"`
+	// JournalFile is the file the operation journal is persisted to.
+	JournalFile string `json:"journalFile"`
+	// TrashDir is where deleted and overwritten files are kept so the
+	// operation can be undone. Empty disables keeping them.
+	TrashDir string `json:"trashDir"`
+	// UndoWindow is how long after an operation it can still be undone.
+	UndoWindow Duration `json:"undoWindow"`
+	// MaxConcurrentRequests limits how many storage requests are served at
+	// once. Requests beyond it queue by priority. Zero means no limit.
+	MaxConcurrentRequests int `json:"maxConcurrentRequests"`
+	// QueueTimeout is how long a request waits for a slot before 503.
+	QueueTimeout Duration `json:"queueTimeout"`
+	// FSRetries is how many times a filesystem operation failing with a
+	// transient error is tried again.
+	FSRetries int `json:"fsRetries"`
+	// FSRetryDelay is the wait before the first retry. It doubles with each
+	// further attempt.
+	FSRetryDelay Duration `json:"fsRetryDelay"`
+	// MetricsPush sends the metrics to StatsD or Graphite.
+	MetricsPush MetricsPushConfig `json:"metricsPush"`
+	// CircuitBreaker trips when the storage becomes pathologically slow.
+	CircuitBreaker CircuitBreakerConfig `json:"circuitBreaker"`
+	// APIKeys are the credentials clients must present. Empty disables
+	// authentication.
+	APIKeys []APIKey `json:"apiKeys"`
+	// Tenants gives each tenant its own storage root.
+	Tenants TenantsConfig `json:"tenants"`
+	// ACL lists which principals may do what below which paths. Empty
+	// allows everything authentication lets through.
+	ACL []ACLRule `json:"acl"`
+	// Compression compresses file contents and listings for clients that
+	// accept it.
+	Compression CompressionConfig `json:"compression"`
+	// RateLimit limits the request rate of each client.
+	RateLimit RateLimitConfig `json:"rateLimit"`
+	// SigningKey is the secret pre-signed URLs are signed with. Without one
+	// a random key is used and URLs stop working when the server restarts.
+	SigningKey string `json:"signingKey"`
+	// JWT accepts bearer tokens from an identity provider.
+	JWT JWTConfig `json:"jwt"`
+	// Gateway forwards requests for path prefixes to other instances.
+	Gateway []GatewayRoute `json:"gateway"`
+	// Chaos lists fault injection experiments run on a schedule.
+	Chaos []ChaosExperiment `json:"chaos"`
+	// Lifecycle holds the rules applied to aging files in the background.
+	Lifecycle LifecycleConfig `json:"lifecycle"`
+	// Encryption encrypts stored files at rest.
+	Encryption EncryptionConfig `json:"encryption"`
+	// Antivirus scans uploaded content with ClamAV before storing it.
+	Antivirus AntivirusConfig `json:"antivirus"`
+}
+
+// Duration is a time.Duration written as a string such as "90s" or "1h" in
+// the config file and on the command line.
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// FileMode is a permission mode written as an octal string such as "0644" in
+// the config file and on the command line.
+type FileMode os.FileMode
+
+func (m *FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *FileMode) Set(s string) error {
+	parsed, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || parsed > 0777 {
+		return fmt.Errorf("invalid mode %q: must be octal permission bits such as 0644", s)
+	}
+	*m = FileMode(parsed)
+	return nil
+}
+
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return m.Set(s)
+}
+
+var config Config
+
+func loadConfig() {
+	configPath := flag.String("config", "", "Path to a JSON config file")
+	flag.StringVar(&config.Addr, "addr", ":8081", "Address to listen on")
+	flag.StringVar(&config.TLSCert, "tlsCert", "", "Certificate file to serve HTTPS with")
+	flag.StringVar(&config.TLSKey, "tlsKey", "", "Private key file of the TLS certificate")
+	flag.StringVar(&config.TLSClientCA, "tlsClientCA", "", "CA bundle to require and verify client certificates against")
+	flag.StringVar(&config.RootDir, "rootDir", "", "Directory all client paths are resolved below and confined to")
+	flag.BoolVar(&config.ReadOnly, "readOnly", false, "Refuse every request that would change stored data")
+	flag.BoolVar(&config.SyncDir, "syncDir", false, "Also fsync the directory after each write so the new file survives a crash")
+	config.ModeMask = 0777
+	flag.Var(&config.ModeMask, "modeMask", "Permission bits clients may set on files and directories, in octal")
+	flag.StringVar(&config.FileOwner, "fileOwner", "", "User, by name or id, to own the files the server creates")
+	flag.StringVar(&config.FileGroup, "fileGroup", "", "Group, by name or id, to own the files the server creates")
+	flag.Int64Var(&config.MaxBodySize, "maxBodySize", 0, "Largest request body and file written, in bytes (0 for no limit)")
+	flag.BoolVar(&config.CaseInsensitivePaths, "caseInsensitivePaths", false, "Resolve paths case-insensitively against existing files")
+	flag.StringVar(&config.UnicodeNormalization, "unicodeNormalization", "NFC", "Unicode normal form applied to paths: NFC, NFD or none")
+	flag.Int64Var(&config.StreamThreshold, "streamThreshold", 1<<20, "Stream files larger than this many bytes raw from readFile (0 disables)")
+	flag.Int64Var(&config.MmapThreshold, "mmapThreshold", 0, "Serve reads of files of at least this many bytes from a memory mapping (0 disables)")
+	flag.IntVar(&config.WalkWorkers, "walkWorkers", 16, "Number of directories read concurrently by recursive operations")
+	flag.BoolVar(&config.ListHidden, "listHidden", true, "List dotfiles unless a request asks otherwise")
+	flag.Int64Var(&config.MaxDecompressedSize, "maxDecompressedSize", 1<<30, "Most bytes decompressing a file may produce (0 for no limit)")
+	flag.StringVar(&config.LogFormat, "logFormat", "text", "Log format: text, json or journald")
+	flag.StringVar(&config.Syslog, "syslog", "", "Also log to syslog: local, or udp://host:port or tcp://host:port")
+	flag.StringVar(&config.SyslogTag, "syslogTag", "file-reader-writer", "Tag of the messages sent to syslog")
+	flag.StringVar(&config.UploadDir, "uploadDir", "", "Directory for the chunks of unfinished chunked uploads")
+	flag.StringVar(&config.AccessLog, "accessLog", "", "File to append Apache-style access log lines to (- for stdout)")
+	flag.StringVar(&config.AccessLogFormat, "accessLogFormat", "combined", "Access log format: common or combined")
+	flag.IntVar(&config.DebugBodyMaxBytes, "debugBodyMaxBytes", 4096, "Bytes of each request and response body logged in debug mode")
+	flag.StringVar(&config.AuditLog, "auditLog", "", "File to append audit events to")
+	flag.StringVar(&config.JournalFile, "journalFile", "", "File to persist the operation journal to")
+	flag.StringVar(&config.TrashDir, "trashDir", "", "Directory to keep deleted and overwritten files in so they can be undone")
+	config.UndoWindow = Duration(time.Hour)
+	flag.Var(&config.UndoWindow, "undoWindow", "How long after an operation it can still be undone")
+	flag.IntVar(&config.MaxConcurrentRequests, "maxConcurrentRequests", 0, "Maximum number of storage requests served at once (0 for no limit)")
+	config.QueueTimeout = Duration(30 * time.Second)
+	flag.Var(&config.QueueTimeout, "queueTimeout", "How long a request waits for a free slot")
+	flag.IntVar(&config.FSRetries, "fsRetries", 3, "Retries of filesystem operations failing with a transient error")
+	config.FSRetryDelay = Duration(10 * time.Millisecond)
+	flag.Var(&config.FSRetryDelay, "fsRetryDelay", "Wait before the first retry of a filesystem operation, doubled for each further one")
+	flag.StringVar(&config.MetricsPush.StatsD, "statsd", "", "StatsD host:port to push metrics to over UDP")
+	flag.StringVar(&config.MetricsPush.Graphite, "graphite", "", "Graphite plaintext host:port to push metrics to")
+	flag.StringVar(&config.MetricsPush.Prefix, "metricsPrefix", "", "Prefix for the names of pushed metrics")
+	config.MetricsPush.Interval = Duration(10 * time.Second)
+	flag.Var(&config.MetricsPush.Interval, "metricsPushInterval", "How often metrics are pushed")
+	flag.StringVar(&config.CircuitBreaker.Dir, "breakerDir", "", "Directory probed by the storage circuit breaker (default the root directory)")
+	flag.Var(&config.CircuitBreaker.SlowThreshold, "breakerSlowThreshold", "Probe latency that counts as slow storage (0 disables the circuit breaker)")
+	flag.IntVar(&config.CircuitBreaker.Failures, "breakerFailures", 3, "Slow probes in a row that open the circuit breaker")
+	config.CircuitBreaker.Cooldown = Duration(30 * time.Second)
+	flag.Var(&config.CircuitBreaker.Cooldown, "breakerCooldown", "How long the circuit breaker stays open")
+	config.CircuitBreaker.ProbeInterval = Duration(5 * time.Second)
+	flag.Var(&config.CircuitBreaker.ProbeInterval, "breakerProbeInterval", "How often the storage is probed")
+	flag.BoolVar(&config.Compression.Enabled, "compress", true, "Compress file contents and listings with gzip or zstd for clients that accept it")
+	flag.Int64Var(&config.Compression.MinSize, "compressMinSize", 1024, "Smallest response in bytes worth compressing")
+	flag.Int64Var(&config.Compression.MaxSize, "compressMaxSize", 8<<20, "Largest response of known length in bytes that is compressed, larger ones are sent straight from the file (0 disables)")
+	config.Compression.SkipTypes = defaultSkipTypes
+	flag.Float64Var(&config.RateLimit.RPS, "rateLimit", 0, "Requests per second allowed per client (0 disables rate limiting)")
+	flag.IntVar(&config.RateLimit.Burst, "rateBurst", 20, "Requests a client can send at once after a quiet period")
+	flag.Float64Var(&config.RateLimit.GenerateRPS, "generateRateLimit", 0, "File generation requests per second allowed per client (0 for no extra limit)")
+	flag.IntVar(&config.RateLimit.GenerateBurst, "generateRateBurst", 1, "File generation requests a client can send at once")
+	config.JWT.JWKSRefresh = Duration(time.Hour)
+	config.JWT.ScopesClaim = "scope"
+	config.JWT.PathsClaim = "paths"
+	config.JWT.TenantClaim = "tenant"
+	flag.StringVar(&config.Encryption.KeyFile, "encryptionKeyFile", "", "File of master keys to encrypt stored files at rest with (empty stores them in the clear)")
+	flag.StringVar(&config.Encryption.KMS.Provider, "kmsProvider", "", "Key management service the master keys are wrapped by: aws, gcp or vault (empty for plain keys)")
+	flag.StringVar(&config.Encryption.KMS.KeyId, "kmsKeyId", "", "Key the master keys are wrapped with in the key management service")
+	flag.StringVar(&config.Encryption.KMS.Region, "kmsRegion", "", "AWS region of the key management service (default AWS_REGION)")
+	flag.StringVar(&config.Encryption.KMS.Address, "kmsAddress", "", "Endpoint of the key management service (required for vault, default VAULT_ADDR)")
+	config.Encryption.KMS.Refresh = Duration(15 * time.Minute)
+	flag.Var(&config.Encryption.KMS.Refresh, "kmsRefresh", "How often the key management service is authenticated with again and the master keys reloaded")
+	flag.StringVar(&config.Antivirus.Clamd, "clamd", "", "Address of the ClamAV daemon uploads are scanned with: a unix socket path or host:port (empty disables scanning)")
+	flag.StringVar(&config.Antivirus.Action, "virusAction", "reject", "What becomes of infected uploads: reject or quarantine")
+	flag.StringVar(&config.Antivirus.QuarantineDir, "quarantineDir", "", "Directory infected uploads are quarantined in")
+	flag.BoolVar(&config.Antivirus.FailOpen, "virusScanFailOpen", false, "Store uploads unscanned when clamd can't scan them instead of refusing them")
+	config.Antivirus.Timeout = Duration(30 * time.Second)
+	flag.Var(&config.Antivirus.Timeout, "clamdTimeout", "How long to wait on clamd at each step of a scan")
+	flag.StringVar(&config.Tenants.Dir, "tenantsDir", "", "Directory holding a separate storage root per tenant (empty disables tenants)")
+	flag.Parse()
+
+	if *configPath != "" {
+		explicit := map[string]string{}
+		flag.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = f.Value.String()
+		})
+		if err := loadConfigFile(*configPath); err != nil {
+			logrus.Fatalf("Unable to load config file: %s", err.Error())
+		}
+		for name, value := range explicit {
+			flag.Set(name, value)
+		}
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		logrus.Fatalf("Invalid TLS config: tlsCert and tlsKey must be set together")
+	}
+	if config.TLSClientCA != "" && config.TLSCert == "" {
+		logrus.Fatalf("Invalid TLS config: tlsClientCA requires tlsCert and tlsKey")
+	}
+	if config.RootDir != "" {
+		root, err := realDir(config.RootDir)
+		if err != nil {
+			logrus.Fatalf("Invalid rootDir: %s", err.Error())
+		}
+		config.RootDir = root
+	}
+	if config.MaxBodySize < 0 {
+		logrus.Fatalf("Invalid maxBodySize: must not be negative")
+	}
+	if err := validateSizeLimits(config.SizeLimits); err != nil {
+		logrus.Fatalf("Invalid sizeLimits: %s", err.Error())
+	}
+	switch config.UnicodeNormalization {
+	case "NFC", "NFD", "none":
+	default:
+		logrus.Fatalf("Invalid unicodeNormalization %q: must be NFC, NFD or none", config.UnicodeNormalization)
+	}
+	owner, err := lookupOwner(config.FileOwner, config.FileGroup)
+	if err != nil {
+		logrus.Fatalf("Invalid fileOwner or fileGroup: %s", err.Error())
+	}
+	defaultOwner = owner
+	if config.StreamThreshold < 0 {
+		logrus.Fatalf("Invalid streamThreshold: must not be negative")
+	}
+	if config.MmapThreshold < 0 {
+		logrus.Fatalf("Invalid mmapThreshold: must not be negative")
+	}
+	if config.MaxDecompressedSize < 0 {
+		logrus.Fatalf("Invalid maxDecompressedSize: must not be negative")
+	}
+	for _, pattern := range config.ListExcludePatterns {
+		if err := checkGlob(pattern); err != nil {
+			logrus.Fatalf("Invalid listExcludePatterns %q: %s", pattern, err.Error())
+		}
+	}
+	if config.DebugBodyMaxBytes < 0 {
+		logrus.Fatalf("Invalid debugBodyMaxBytes: must not be negative")
+	}
+	if err := compileRedactPatterns(); err != nil {
+		logrus.Fatalf("Invalid debugRedactPatterns: %s", err.Error())
+	}
+	if config.MetricsPush.Interval <= 0 {
+		logrus.Fatalf("Invalid metricsPushInterval: must be positive")
+	}
+	if config.CircuitBreaker.ProbeInterval <= 0 {
+		logrus.Fatalf("Invalid breakerProbeInterval: must be positive")
+	}
+	if err := validateAPIKeys(config.APIKeys); err != nil {
+		logrus.Fatalf("Invalid apiKeys: %s", err.Error())
+	}
+	if config.Tenants.enabled() {
+		dir, err := realDir(config.Tenants.Dir)
+		if err != nil {
+			logrus.Fatalf("Invalid tenantsDir: %s", err.Error())
+		}
+		config.Tenants.Dir = dir
+	}
+	if err := validateACL(config.ACL); err != nil {
+		logrus.Fatalf("Invalid acl: %s", err.Error())
+	}
+	if err := config.Compression.validate(); err != nil {
+		logrus.Fatalf("Invalid compression config: %s", err.Error())
+	}
+	if err := config.RateLimit.validate(); err != nil {
+		logrus.Fatalf("Invalid rate limit config: %s", err.Error())
+	}
+	if err := config.JWT.validate(); err != nil {
+		logrus.Fatalf("Invalid jwt config: %s", err.Error())
+	}
+	if err := validateGateway(config.Gateway); err != nil {
+		logrus.Fatalf("Invalid gateway config: %s", err.Error())
+	}
+	if err := validateChaos(config.Chaos); err != nil {
+		logrus.Fatalf("Invalid chaos config: %s", err.Error())
+	}
+	if err := config.Lifecycle.validate(); err != nil {
+		logrus.Fatalf("Invalid lifecycle config: %s", err.Error())
+	}
+	if err := config.Encryption.KMS.validate(); err != nil {
+		logrus.Fatalf("Invalid kms config: %s", err.Error())
+	}
+	if err := config.Antivirus.validate(); err != nil {
+		logrus.Fatalf("Invalid antivirus config: %s", err.Error())
+	}
+}
+
+// loadConfigFile reads the JSON config file at configPath over the current
+// settings. Keys missing from the file keep their flag defaults.
+func loadConfigFile(configPath string) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	return nil
+}
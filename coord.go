@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Named semaphores, counters and barriers that load test clients on
+// different hosts use to coordinate through the server. They live in memory
+// only and every lease or wait is bounded by a TTL, so a crashed client can't
+// hold anything forever.
+
+const defaultLeaseTTL = time.Minute
+
+type semaphore struct {
+	limit  int
+	leases map[string]time.Time // leaseId to expiry
+	// changed is closed and replaced whenever a lease is released.
+	changed chan struct{}
+}
+
+type counter struct {
+	value   int64
+	expires time.Time // zero for counters without a TTL
+}
+
+type barrier struct {
+	parties int
+	waiting int
+	// release is closed once the parties have arrived, which lets the
+	// current generation of waiters through.
+	release chan struct{}
+}
+
+var coord = struct {
+	sync.Mutex
+	semaphores map[string]*semaphore
+	counters   map[string]*counter
+	barriers   map[string]*barrier
+}{
+	semaphores: map[string]*semaphore{},
+	counters:   map[string]*counter{},
+	barriers:   map[string]*barrier{},
+}
+
+// pruneLeases drops expired leases and returns when the next one expires.
+func (s *semaphore) pruneLeases(now time.Time) time.Time {
+	var next time.Time
+	for id, expires := range s.leases {
+		if now.After(expires) {
+			delete(s.leases, id)
+			continue
+		}
+		if next.IsZero() || expires.Before(next) {
+			next = expires
+		}
+	}
+	return next
+}
+
+// acquireSemaphore takes a lease on the named semaphore, waiting up to wait
+// for one of limit slots to free up.
+func acquireSemaphore(ctx context.Context, name string, limit int, ttl time.Duration, wait time.Duration) (string, bool) {
+	deadline := time.Now().Add(wait)
+	for {
+		coord.Lock()
+		s := coord.semaphores[name]
+		if s == nil {
+			s = &semaphore{leases: map[string]time.Time{}, changed: make(chan struct{})}
+			coord.semaphores[name] = s
+		}
+		s.limit = limit
+		now := time.Now()
+		nextExpiry := s.pruneLeases(now)
+		if len(s.leases) < s.limit {
+			leaseId := generateUUID()
+			s.leases[leaseId] = now.Add(ttl)
+			coord.Unlock()
+			return leaseId, true
+		}
+		changed := s.changed
+		coord.Unlock()
+
+		remaining := deadline.Sub(now)
+		if remaining <= 0 {
+			return "", false
+		}
+		// Expired leases don't signal changed, so wake up when the next one
+		// runs out as well.
+		if !nextExpiry.IsZero() && nextExpiry.Sub(now) < remaining {
+			remaining = nextExpiry.Sub(now) + time.Millisecond
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", false
+		}
+		timer.Stop()
+	}
+}
+
+func releaseSemaphore(name string, leaseId string) bool {
+	coord.Lock()
+	defer coord.Unlock()
+	s := coord.semaphores[name]
+	if s == nil {
+		return false
+	}
+	if _, ok := s.leases[leaseId]; !ok {
+		return false
+	}
+	delete(s.leases, leaseId)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	if len(s.leases) == 0 {
+		delete(coord.semaphores, name)
+	}
+	return true
+}
+
+// addCounter adds delta to the named counter and returns the new value. A
+// positive ttl makes the counter disappear when it isn't updated for that
+// long.
+func addCounter(name string, delta int64, ttl time.Duration) int64 {
+	coord.Lock()
+	defer coord.Unlock()
+	now := time.Now()
+	c := coord.counters[name]
+	if c == nil || (!c.expires.IsZero() && now.After(c.expires)) {
+		c = &counter{}
+		coord.counters[name] = c
+	}
+	c.value += delta
+	if ttl > 0 {
+		c.expires = now.Add(ttl)
+	}
+	return c.value
+}
+
+func readCounter(name string) int64 {
+	coord.Lock()
+	defer coord.Unlock()
+	c := coord.counters[name]
+	if c == nil {
+		return 0
+	}
+	if !c.expires.IsZero() && time.Now().After(c.expires) {
+		delete(coord.counters, name)
+		return 0
+	}
+	return c.value
+}
+
+// waitBarrier blocks until parties callers are waiting on the named barrier
+// or timeout passes. It reports whether the barrier was released.
+func waitBarrier(ctx context.Context, name string, parties int, timeout time.Duration) bool {
+	coord.Lock()
+	b := coord.barriers[name]
+	if b == nil {
+		b = &barrier{release: make(chan struct{})}
+		coord.barriers[name] = b
+	}
+	b.parties = parties
+	b.waiting++
+	if b.waiting >= b.parties {
+		close(b.release)
+		delete(coord.barriers, name)
+		coord.Unlock()
+		return true
+	}
+	release := b.release
+	coord.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-release:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	coord.Lock()
+	defer coord.Unlock()
+	select {
+	case <-release:
+		// Released while we were giving up.
+		return true
+	default:
+	}
+	b.waiting--
+	if b.waiting == 0 {
+		delete(coord.barriers, name)
+	}
+	return false
+}
+
+func coordSemaphoreAcquire(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	logrus.WithFields(logrus.Fields{
+		"name":      name,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Acquiring semaphore")
+
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	limit, err := formPositiveInt(r, "limit")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, err := formDuration(r, "ttl", defaultLeaseTTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait, err := formDuration(r, "wait", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	leaseId, ok := acquireSemaphore(r.Context(), name, limit, ttl, wait)
+	if !ok {
+		http.Error(w, "Semaphore is full", http.StatusConflict)
+		return
+	}
+	writeJSON(w, "Semaphore acquired successfully", requestId, map[string]interface{}{
+		"name":    name,
+		"leaseId": leaseId,
+		"expires": time.Now().Add(ttl),
+	})
+}
+
+func coordSemaphoreRelease(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	leaseId := r.FormValue("leaseId")
+	logrus.WithFields(logrus.Fields{
+		"name":      name,
+		"leaseId":   leaseId,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Releasing semaphore")
+
+	if !releaseSemaphore(name, leaseId) {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, "Semaphore released successfully", requestId, nil)
+}
+
+// coordCounter returns the named counter on GET and adds delta (default 1)
+// to it on POST.
+func coordCounter(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, "Counter read successfully", requestId, map[string]interface{}{
+			"name":  name,
+			"value": readCounter(name),
+		})
+		return
+	}
+
+	delta := int64(1)
+	if deltaStr := r.FormValue("delta"); deltaStr != "" {
+		var err error
+		delta, err = strconv.ParseInt(deltaStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid delta value", http.StatusBadRequest)
+			return
+		}
+	}
+	ttl, err := formDuration(r, "ttl", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"name":      name,
+		"delta":     delta,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Updating counter")
+
+	writeJSON(w, "Counter updated successfully", requestId, map[string]interface{}{
+		"name":  name,
+		"value": addCounter(name, delta, ttl),
+	})
+}
+
+func coordBarrierWait(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	logrus.WithFields(logrus.Fields{
+		"name":      name,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Waiting on barrier")
+
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	parties, err := formPositiveInt(r, "parties")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout, err := formDuration(r, "timeout", defaultLeaseTTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !waitBarrier(r.Context(), name, parties, timeout) {
+		http.Error(w, "Timed out waiting for barrier", http.StatusRequestTimeout)
+		return
+	}
+	writeJSON(w, "Barrier released", requestId, map[string]interface{}{
+		"name": name,
+	})
+}
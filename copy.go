@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// copyFile duplicates the file at sourcePath to destPath on the server,
+// streaming it instead of making the client download and upload it again.
+// An existing destPath is only replaced with overwrite=true, and
+// preserveMode=true gives the copy the permissions of the source.
+func copyFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sourcePath := r.FormValue("sourcePath")
+	destPath := r.FormValue("destPath")
+	logrus.WithFields(logrus.Fields{
+		"sourcePath": sourcePath,
+		"destPath":   destPath,
+		"requestId":  requestId,
+		"serverId":   serverId,
+	}).Info("Copying file")
+
+	if sourcePath == "" || destPath == "" {
+		http.Error(w, "sourcePath and destPath are required", http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	preserveMode, err := formBool(r, "preserveMode")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// authorize checked the caller may do this to the source.
+	sourcePath, err = resolvePath(r, sourcePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sourcePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	destPath, err = resolvePath(r, destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	src, err := openFile(sourcePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Source file not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open source file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+	sourceInfo, err := src.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", sourcePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !sourceInfo.Mode().IsRegular() {
+		http.Error(w, "sourcePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+	if err := checkFileSize(r, destPath, sourceInfo.Size()); err != nil {
+		http.Error(w, fmt.Sprintf("File %s", err.Error()), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	unlock := lockWrites(destPath)
+	defer unlock()
+	destInfo, err := statFile(destPath)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", destPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if destInfo != nil {
+		if destInfo.IsDir() {
+			http.Error(w, "destPath is a directory", http.StatusBadRequest)
+			return
+		}
+		if sameFile(sourceInfo, destInfo) {
+			http.Error(w, "sourcePath and destPath are the same file", http.StatusBadRequest)
+			return
+		}
+		if !overwrite {
+			http.Error(w, "destPath already exists; set overwrite=true to replace it", http.StatusConflict)
+			return
+		}
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		action := "create"
+		if destInfo != nil {
+			action = "replace"
+		}
+		writeJSON(w, "Dry run: file not copied", requestId, dryRunReport(r, []dryRunEntry{
+			{Path: destPath, Action: action, Size: sourceInfo.Size()},
+		}))
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	size, err := storeFileFrom(destPath, src)
+	if err == nil && preserveMode {
+		err = os.Chmod(destPath, sourceInfo.Mode().Perm())
+	}
+	if err != nil {
+		discardBackup(backup)
+		http.Error(w, fmt.Sprintf("Unable to copy file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "copy", destPath, existed, backup)
+	writeJSON(w, "File copied successfully", requestId, map[string]interface{}{
+		"size": size,
+	})
+}
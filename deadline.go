@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requestDeadline returns the deadline a client set for r with an X-Timeout
+// header (a duration such as "30s" or a number of seconds) or an X-Deadline
+// header (an RFC 3339 time or Unix seconds). When both are given the earlier
+// one wins.
+func requestDeadline(r *http.Request) (time.Time, bool, error) {
+	var deadline time.Time
+	if v := r.Header.Get("X-Timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			seconds, serr := strconv.ParseFloat(v, 64)
+			if serr != nil {
+				return time.Time{}, false, fmt.Errorf("Invalid X-Timeout header: %s", v)
+			}
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+		if timeout <= 0 {
+			return time.Time{}, false, fmt.Errorf("Invalid X-Timeout header: %s", v)
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	if v := r.Header.Get("X-Deadline"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			seconds, serr := strconv.ParseFloat(v, 64)
+			if serr != nil {
+				return time.Time{}, false, fmt.Errorf("Invalid X-Deadline header: %s", v)
+			}
+			t = time.Unix(0, int64(seconds*float64(time.Second)))
+		}
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return deadline, !deadline.IsZero(), nil
+}
+
+type progressKey struct{}
+
+// requestProgress collects what a handler got done, so it can be reported
+// when the request runs out of time.
+type requestProgress struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+// setRequestProgress records a progress value for the request ctx belongs
+// to. It does nothing for requests without a deadline.
+func setRequestProgress(ctx context.Context, name string, value int64) {
+	p, ok := ctx.Value(progressKey{}).(*requestProgress)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	p.values[name] = value
+	p.mu.Unlock()
+}
+
+func (p *requestProgress) snapshot() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	values := make(map[string]int64, len(p.values))
+	for name, value := range p.values {
+		values[name] = value
+	}
+	return values
+}
+
+// deadlineWriter passes a handler's response through until the deadline
+// guard takes over. Headers are kept apart until the response starts, so the
+// guard can still send its own.
+type deadlineWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (dw *deadlineWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *deadlineWriter) WriteHeader(code int) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if !dw.timedOut && !dw.wroteHeader {
+		dw.writeHeaderLocked(code)
+	}
+}
+
+func (dw *deadlineWriter) writeHeaderLocked(code int) {
+	dst := dw.w.Header()
+	for name, values := range dw.header {
+		dst[name] = values
+	}
+	dw.w.WriteHeader(code)
+	dw.wroteHeader = true
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !dw.wroteHeader {
+		dw.writeHeaderLocked(http.StatusOK)
+	}
+	return dw.w.Write(p)
+}
+
+// ReadFrom passes src through, so downloads keep using sendfile. Once the
+// response has started the guard leaves it to the handler, so the copy
+// doesn't hold the lock.
+func (dw *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	dw.mu.Lock()
+	if dw.timedOut {
+		dw.mu.Unlock()
+		return 0, http.ErrHandlerTimeout
+	}
+	if !dw.wroteHeader {
+		dw.writeHeaderLocked(http.StatusOK)
+	}
+	dw.mu.Unlock()
+	return io.Copy(dw.w, src)
+}
+
+func (dw *deadlineWriter) FlushError() error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	if !dw.wroteHeader {
+		dw.writeHeaderLocked(http.StatusOK)
+	}
+	return http.NewResponseController(dw.w).Flush()
+}
+
+func (dw *deadlineWriter) Flush() {
+	dw.FlushError()
+}
+
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.w
+}
+
+// deadlineGuard bounds how long the server works on a request whose client
+// set a deadline. The handler runs with a context that expires at the
+// deadline; if it hasn't started responding by then the client gets a 504
+// with the progress the handler reported, even if the handler is still stuck
+// in a syscall. A response already being streamed is cut short instead.
+func deadlineGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestOp(r) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		deadline, ok, err := requestDeadline(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		progress := &requestProgress{values: map[string]int64{}}
+		ctx = context.WithValue(ctx, progressKey{}, progress)
+
+		dw := &deadlineWriter{w: w, header: http.Header{}}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer close(done)
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(dw, r.WithContext(ctx))
+		}()
+
+		select {
+		case <-done:
+			select {
+			case p := <-panicked:
+				panic(p)
+			default:
+			}
+			return
+		case <-ctx.Done():
+		}
+
+		dw.mu.Lock()
+		if dw.wroteHeader {
+			dw.mu.Unlock()
+			// The handler sees the expired context and stops; w can't be
+			// used once we return, so wait for it.
+			<-done
+			return
+		}
+		dw.timedOut = true
+		dw.mu.Unlock()
+		if r.Context().Err() != nil {
+			// The client is gone, there is no one to answer.
+			return
+		}
+
+		requestId := generateUUID()
+		logrus.WithFields(logrus.Fields{
+			"path":      r.URL.Path,
+			"progress":  progress.snapshot(),
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).Warn("Request deadline exceeded")
+		writeJSONStatus(w, http.StatusGatewayTimeout, "Deadline exceeded", requestId, map[string]interface{}{
+			"deadline":  deadline,
+			"elapsedMs": latencyMs(time.Since(start)),
+			"progress":  progress.snapshot(),
+		})
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRedactPatterns hide the values of the usual secret fields in form
+// and JSON bodies.
+var defaultRedactPatterns = []string{
+	`(?i)((password|passwd|secret|token|api_?key|authorization)(\\?")?\s*[:=]\s*)(\\?"[^"\\]*\\?"|[^&\s,}"\\]*)`,
+}
+
+// debugBodies is the runtime state of body logging. Requests are logged when
+// their path matches one of paths or their X-Request-Id header is one of
+// requestIds.
+var debugBodies struct {
+	sync.RWMutex
+	enabled    bool
+	paths      []string
+	requestIds map[string]bool
+	redact     []*regexp.Regexp
+}
+
+// compileRedactPatterns compiles config.DebugRedactPatterns, falling back to
+// defaultRedactPatterns when none are configured.
+func compileRedactPatterns() error {
+	patterns := config.DebugRedactPatterns
+	if len(patterns) == 0 {
+		patterns = defaultRedactPatterns
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid redaction pattern %q: %w", pattern, err)
+		}
+		debugBodies.redact = append(debugBodies.redact, re)
+	}
+	return nil
+}
+
+// redactBody replaces secrets in body. For patterns with groups, the first
+// group is kept so the field name stays readable.
+func redactBody(body string) string {
+	for _, re := range debugBodies.redact {
+		if re.NumSubexp() > 0 {
+			body = re.ReplaceAllString(body, "${1}[REDACTED]")
+		} else {
+			body = re.ReplaceAllString(body, "[REDACTED]")
+		}
+	}
+	return body
+}
+
+func shouldLogBodies(r *http.Request) bool {
+	debugBodies.RLock()
+	defer debugBodies.RUnlock()
+	if !debugBodies.enabled {
+		return false
+	}
+	if id := r.Header.Get("X-Request-Id"); id != "" && debugBodies.requestIds[id] {
+		return true
+	}
+	for _, pattern := range debugBodies.paths {
+		if ok, _ := matchGlob(pattern, r.URL.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyCapture keeps the first max bytes passing through it.
+type bodyCapture struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *bodyCapture) capture(p []byte) {
+	if room := c.max - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		p = p[:room]
+	}
+	c.buf.Write(p)
+}
+
+func (c *bodyCapture) String() string {
+	s := redactBody(c.buf.String())
+	if c.truncated {
+		s += "...(truncated)"
+	}
+	return s
+}
+
+type captureReader struct {
+	io.ReadCloser
+	capture *bodyCapture
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.capture.capture(p[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	capture *bodyCapture
+	status  int
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.capture.capture(p[:n])
+	return n, err
+}
+
+// ReadFrom captures the start of what src holds and passes the rest through,
+// so downloads keep using sendfile while their bodies are logged.
+func (cw *captureWriter) ReadFrom(src io.Reader) (int64, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	var n int64
+	if room := int64(cw.capture.max - cw.capture.buf.Len()); room > 0 {
+		var err error
+		if n, err = io.Copy(struct{ io.Writer }{cw}, io.LimitReader(src, room)); err != nil || n < room {
+			return n, err
+		}
+	}
+	rest, err := io.Copy(cw.ResponseWriter, src)
+	if rest > 0 {
+		cw.capture.truncated = true
+	}
+	return n + rest, err
+}
+
+func (cw *captureWriter) Flush() {
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// logBodies logs the (truncated, redacted) request and response bodies of
+// the requests selected with /admin/debug.
+func logBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !shouldLogBodies(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reqBody := &bodyCapture{max: config.DebugBodyMaxBytes}
+		resBody := &bodyCapture{max: config.DebugBodyMaxBytes}
+		r.Body = &captureReader{ReadCloser: r.Body, capture: reqBody}
+		cw := &captureWriter{ResponseWriter: w, capture: resBody}
+		next.ServeHTTP(cw, r)
+
+		logrus.WithFields(logrus.Fields{
+			"method":       r.Method,
+			"uri":          redactBody(r.URL.RequestURI()),
+			"clientId":     r.Header.Get("X-Request-Id"),
+			"status":       cw.status,
+			"requestBody":  reqBody.String(),
+			"responseBody": resBody.String(),
+			"serverId":     serverId,
+		}).Info("Debug request bodies")
+	})
+}
+
+func debugStatus() map[string]interface{} {
+	debugBodies.RLock()
+	defer debugBodies.RUnlock()
+	requestIds := make([]string, 0, len(debugBodies.requestIds))
+	for id := range debugBodies.requestIds {
+		requestIds = append(requestIds, id)
+	}
+	return map[string]interface{}{
+		"enabled":    debugBodies.enabled,
+		"paths":      debugBodies.paths,
+		"requestIds": requestIds,
+		"maxBytes":   config.DebugBodyMaxBytes,
+	}
+}
+
+// debugMode reports the body logging settings on GET and changes them on
+// POST. paths and requestIds may be repeated and replace the previous ones.
+func debugMode(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, "Debug mode retrieved successfully", requestId, debugStatus())
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled value", http.StatusBadRequest)
+		return
+	}
+	paths := r.Form["paths"]
+	requestIds := r.Form["requestIds"]
+	for _, pattern := range paths {
+		if _, err := matchGlob(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid paths pattern %s: %s", pattern, err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"enabled":    enabled,
+		"paths":      paths,
+		"requestIds": requestIds,
+		"requestId":  requestId,
+		"serverId":   serverId,
+	}).Info("Setting debug mode")
+
+	debugBodies.Lock()
+	debugBodies.enabled = enabled
+	debugBodies.paths = paths
+	debugBodies.requestIds = map[string]bool{}
+	for _, id := range requestIds {
+		debugBodies.requestIds[id] = true
+	}
+	debugBodies.Unlock()
+
+	recordAudit(auditEvent{
+		Actor:  requestActor(r),
+		Action: "debug",
+		Detail: fmt.Sprintf("enabled=%t paths=%s requestIds=%s", enabled, strings.Join(paths, ","), strings.Join(requestIds, ",")),
+	})
+	writeJSON(w, "Debug mode updated successfully", requestId, debugStatus())
+}
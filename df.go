@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errDiskFreeUnsupported is returned where the free space of a filesystem
+// can't be asked for.
+var errDiskFreeUnsupported = errors.New("free space is not reported on this platform")
+
+// diskFree is the capacity of a filesystem reported by /df. Inodes are left
+// out where the platform doesn't count them.
+type diskFree struct {
+	TotalBytes     uint64  `json:"totalBytes"`
+	UsedBytes      uint64  `json:"usedBytes"`
+	AvailableBytes uint64  `json:"availableBytes"`
+	TotalInodes    *uint64 `json:"totalInodes,omitempty"`
+	UsedInodes     *uint64 `json:"usedInodes,omitempty"`
+	FreeInodes     *uint64 `json:"freeInodes,omitempty"`
+}
+
+// diskFreeHandler reports the size and free space of the filesystem holding
+// dirPath, the root directory by default, like df, so clients can check
+// there is room before generating files. availableBytes is what the server
+// may still write, which can be less than the total minus usedBytes.
+func diskFreeHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dirPath := r.FormValue("dirPath")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Getting free space")
+
+	if dirPath == "" {
+		dirPath = "/"
+	}
+	dirPath, err := resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	// A missing dirPath means the root, which authorize doesn't see.
+	if err := checkPathScope(r, dirPath); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), http.StatusForbidden)
+		return
+	}
+
+	df, err := statDiskFree(dirPath)
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			http.Error(w, "Directory not found", http.StatusNotFound)
+		case errors.Is(err, errDiskFreeUnsupported):
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		default:
+			http.Error(w, fmt.Sprintf("Unable to get free space: %s", err.Error()), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, "Free space retrieved successfully", requestId, df)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// statDiskFree fails where the platform's statfs isn't known.
+func statDiskFree(p string) (*diskFree, error) {
+	return nil, errDiskFreeUnsupported
+}
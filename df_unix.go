@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// statDiskFree asks statfs about the filesystem holding p.
+func statDiskFree(p string) (*diskFree, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	totalInodes := uint64(st.Files)
+	freeInodes := uint64(st.Ffree)
+	usedInodes := totalInodes - freeInodes
+	return &diskFree{
+		TotalBytes:     st.Blocks * bsize,
+		UsedBytes:      (st.Blocks - st.Bfree) * bsize,
+		AvailableBytes: st.Bavail * bsize,
+		TotalInodes:    &totalInodes,
+		UsedInodes:     &usedInodes,
+		FreeInodes:     &freeInodes,
+	}, nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// statDiskFree asks GetDiskFreeSpaceEx about the volume holding p. Windows
+// doesn't count inodes.
+func statDiskFree(p string) (*diskFree, error) {
+	name, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return nil, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, &total, &free); err != nil {
+		return nil, err
+	}
+	return &diskFree{
+		TotalBytes:     total,
+		UsedBytes:      total - free,
+		AvailableBytes: available,
+	}, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffOp is one line of an edit script: kind is ' ' for a line both sides
+// share, '-' for a line only in the first and '+' for one only in the second.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits s into lines without their terminators.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines computes a shortest edit script turning a into b with Myers'
+// algorithm. It gives up and returns false when more than maxEdits lines
+// differ, as the cost grows with the square of the number of edits.
+func diffLines(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace[d] holds v for k in [-d, d] after step d, for backtracking.
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+				return backtrackDiff(a, b, trace), true
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	return nil, false
+}
+
+func backtrackDiff(a, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if prevK == k+1 {
+			y--
+			ops = append(ops, diffOp{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, diffOp{' ', a[x]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff formats ops as unified diff hunks with context lines around
+// each change. At most maxLines lines are returned; the second result reports
+// whether some were left out.
+func unifiedDiff(ops []diffOp, context int, maxLines int) ([]string, bool) {
+	var out []string
+	lineA, lineB := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			lineA++
+			lineB++
+			i++
+			continue
+		}
+		// Extend the hunk backwards by up to context lines, then forwards
+		// until a run of more than 2*context unchanged lines.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for unchanged := 0; end < len(ops) && unchanged <= 2*context; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && ops[end-1].kind == ' ' && trailingContext(ops[i:end]) > context {
+			end--
+		}
+
+		startA, startB := lineA-(i-start), lineB-(i-start)
+		countA, countB := 0, 0
+		var body []string
+		for _, op := range ops[start:end] {
+			body = append(body, string(op.kind)+op.line)
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		// Like diff -u, an empty side names the line before it.
+		if countA == 0 {
+			startA--
+		}
+		if countB == 0 {
+			startB--
+		}
+		out = append(out, fmt.Sprintf("@@ -%d,%d +%d,%d @@", startA, countA, startB, countB))
+		out = append(out, body...)
+		if len(out) > maxLines {
+			return out[:maxLines], true
+		}
+
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				lineA++
+			}
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+		i = end
+	}
+	return out, false
+}
+
+// trailingContext counts the unchanged lines at the end of ops.
+func trailingContext(ops []diffOp) int {
+	n := 0
+	for i := len(ops) - 1; i >= 0 && ops[i].kind == ' '; i-- {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		a, b  string
+		edits int
+	}{
+		{name: "equal", a: "a\nb\n", b: "a\nb\n", edits: 0},
+		{name: "from nothing", a: "", b: "a\nb\n", edits: 2},
+		{name: "to nothing", a: "a\nb\n", b: "", edits: 2},
+		{name: "changed line", a: "a\nb\nc\n", b: "a\nB\nc\n", edits: 2},
+		{name: "moved line", a: "a\nb\nc\nd\n", b: "b\nc\nd\na\n", edits: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := splitLines(tt.a), splitLines(tt.b)
+			ops, ok := diffLines(a, b, 100)
+			if !ok {
+				t.Fatal("gave up")
+			}
+			// The script must turn a into b, with as few edits as can be.
+			var gotA, gotB []string
+			edits := 0
+			for _, op := range ops {
+				if op.kind != '+' {
+					gotA = append(gotA, op.line)
+				}
+				if op.kind != '-' {
+					gotB = append(gotB, op.line)
+				}
+				if op.kind != ' ' {
+					edits++
+				}
+			}
+			if strings.Join(gotA, "\n") != strings.Join(a, "\n") || strings.Join(gotB, "\n") != strings.Join(b, "\n") {
+				t.Errorf("script %v doesn't turn %q into %q", ops, tt.a, tt.b)
+			}
+			if edits != tt.edits {
+				t.Errorf("%d edits, want %d", edits, tt.edits)
+			}
+		})
+	}
+
+	if _, ok := diffLines(splitLines("a\nb\nc\n"), splitLines("x\ny\nz\n"), 2); ok {
+		t.Error("more edits than allowed were made")
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	for name, content := range map[string]string{
+		"old.txt": "a\nb\nc\n",
+		"new.txt": "a\nB\nc\n",
+		"bin":     "a\x00b",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		want   int
+		result map[string]interface{}
+	}{
+		{name: "text", query: "filePath=old.txt&otherPath=new.txt", want: http.StatusOK, result: map[string]interface{}{
+			"equal": false, "binary": false, "truncated": false,
+			"diff": "--- old.txt\n+++ new.txt\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		}},
+		{name: "equal", query: "filePath=old.txt&otherPath=old.txt", want: http.StatusOK, result: map[string]interface{}{"equal": true}},
+		{name: "binary", query: "filePath=old.txt&otherPath=bin", want: http.StatusOK, result: map[string]interface{}{"binary": true, "firstDifference": float64(1)}},
+		{name: "outside the root", query: "filePath=old.txt&otherPath=../../etc/passwd", want: http.StatusForbidden},
+		{name: "missing", query: "filePath=old.txt&otherPath=gone", want: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			diffFiles(w, httptest.NewRequest("GET", "/diffFiles?"+tt.query, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.result == nil {
+				return
+			}
+			var body struct {
+				Data map[string]interface{} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range tt.result {
+				if body.Data[k] != want {
+					t.Errorf("%s = %#v, want %#v", k, body.Data[k], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diffFiles compares the files at filePath and otherPath on the server and
+// returns a unified diff turning the first into the second, with context
+// unchanged lines, 3 by default, around each change and at most maxLines
+// lines. Binary files, and text too large or too different to diff, are
+// only reported as equal or not along with the offset of the first
+// differing byte.
+func diffFiles(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	otherPath := r.FormValue("otherPath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"otherPath": otherPath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Diffing files")
+
+	if filePath == "" || otherPath == "" {
+		http.Error(w, "filePath and otherPath are required", http.StatusBadRequest)
+		return
+	}
+	maxLines := defaultDiffLines
+	if r.FormValue("maxLines") != "" {
+		n, err := formPositiveInt(r, "maxLines")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		maxLines = n
+	}
+	contextLines := 3
+	if value := r.FormValue("context"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid context value", http.StatusBadRequest)
+			return
+		}
+		contextLines = n
+	}
+
+	a, releaseA, status, err := readComparedFile(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read filePath: %s", err.Error()), status)
+		return
+	}
+	defer releaseA()
+	b, releaseB, status, err := readComparedFile(r, otherPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read otherPath: %s", err.Error()), status)
+		return
+	}
+	defer releaseB()
+
+	equal := bytes.Equal(a, b)
+	binary := isBinary(a) || isBinary(b)
+	result := map[string]interface{}{
+		"equal":     equal,
+		"binary":    binary,
+		"size":      len(a),
+		"otherSize": len(b),
+	}
+	if equal {
+		writeJSON(w, "Files diffed successfully", requestId, result)
+		return
+	}
+
+	if !binary && len(a) <= maxCompareDiffSize && len(b) <= maxCompareDiffSize {
+		ops, ok := diffLines(splitLines(string(a)), splitLines(string(b)), maxCompareEdits)
+		if ok {
+			hunks, truncated := unifiedDiff(ops, contextLines, maxLines)
+			var diff strings.Builder
+			fmt.Fprintf(&diff, "--- %s\n+++ %s\n", filePath, otherPath)
+			for _, line := range hunks {
+				diff.WriteString(line)
+				diff.WriteByte('\n')
+			}
+			result["diff"] = diff.String()
+			result["truncated"] = truncated
+			writeJSON(w, "Files diffed successfully", requestId, result)
+			return
+		}
+	}
+
+	offset := 0
+	for offset < len(a) && offset < len(b) && a[offset] == b[offset] {
+		offset++
+	}
+	result["firstDifference"] = offset
+	writeJSON(w, "Files diffed successfully", requestId, result)
+}
+
+// isBinary reports whether data looks like binary rather than text: it holds
+// a NUL byte or isn't valid UTF-8.
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// createDir creates dirPath and any missing parents with the given mode,
+// 0755 by default, so clients can lay out directories without writing
+// placeholder files. It succeeds if the directory exists already and says so.
+func createDir(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dirPath := r.FormValue("dirPath")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Creating directory")
+
+	if dirPath == "" {
+		http.Error(w, "dirPath is required", http.StatusBadRequest)
+		return
+	}
+	mode, err := formMode(r, "mode", 0755)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dirPath, err = resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	existed := false
+	if info, err := statFile(dirPath); err == nil {
+		if !info.IsDir() {
+			http.Error(w, "dirPath exists and is not a directory", http.StatusConflict)
+			return
+		}
+		existed = true
+	} else if !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		var entries []dryRunEntry
+		if !existed {
+			entries = append(entries, dryRunEntry{Path: dirPath, Action: "create"})
+		}
+		writeJSON(w, "Dry run: directory not created", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if !existed {
+		if err := os.MkdirAll(dirPath, mode); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to create directory: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		// MkdirAll's mode is narrowed by the umask; the directory asked for
+		// gets exactly the mode given.
+		if err := os.Chmod(dirPath, mode); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to set directory mode: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if err := chownCreated(dirPath); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to set directory owner: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, "Directory created successfully", requestId, map[string]interface{}{
+		"existed": existed,
+	})
+}
+
+// deleteDir removes dirPath and everything below it, which deleteFile
+// refuses to do. Since the removal can't be undone it has to be confirmed
+// with confirm=true, and the root directory is never removed. It returns
+// the number of entries removed, dirPath included.
+func deleteDir(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dirPath := r.URL.Query().Get("dirPath")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Deleting directory")
+
+	if dirPath == "" {
+		http.Error(w, "dirPath is required", http.StatusBadRequest)
+		return
+	}
+	dirPath, err := resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	if isRootPath(r, dirPath) {
+		http.Error(w, "Cannot delete the root directory", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Lstat(dirPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		// A symbolic link to a directory is removed with deleteFile, which
+		// leaves the directory it points to alone.
+		http.Error(w, "dirPath is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	var entries []dryRunEntry
+	err = filepath.WalkDir(dirPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		entry := dryRunEntry{Path: p, Action: "delete"}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				entry.Size = info.Size()
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to list directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		writeJSON(w, "Dry run: directory not deleted", requestId, dryRunReport(r, entries))
+		return
+	}
+	confirm, err := formBool(r, "confirm")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !confirm {
+		http.Error(w, "Deleting a directory with everything in it can't be undone; set confirm=true to go ahead", http.StatusBadRequest)
+		return
+	}
+
+	if err := os.RemoveAll(dirPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to delete directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "Directory deleted successfully", requestId, map[string]interface{}{
+		"removed": len(entries),
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// downloadFile serves the raw bytes of a file as an attachment, with the
+// Content-Type detectType tells from its extension and content.
+// http.ServeContent hands the *os.File to the connection, which lets the
+// kernel sendfile the content straight from the page cache instead of copying
+// it through userspace.
+func downloadFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Downloading file")
+
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	f, err := openFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if fileInfo.IsDir() {
+		http.Error(w, "filePath is a directory", http.StatusBadRequest)
+		return
+	}
+
+	if err := rangeFromForm(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// FormatMediaType encodes names that aren't plain ASCII as RFC 2231
+	// asks.
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileInfo.Name()}))
+	// A file written with a client key is only sent decrypted with that
+	// key, like readFile does.
+	if checkNotClientEncrypted(f) != nil {
+		clientKey, err := requestClientKey(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if clientKey == nil {
+			http.Error(w, errNoClientKey.Error(), clientKeyStatus(errNoClientKey))
+			return
+		}
+		readEncryptedFile(w, r, filePath, clientKey, "raw", contentOptions{}, requestId)
+		return
+	}
+	if typ, err := fileType(f, fileInfo.Name()); err == nil {
+		w.Header().Set("Content-Type", typ)
+	}
+	w.Header().Set("ETag", fileETag(fileInfo))
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	if serveMapped(w, r, f, fileInfo, requestId) {
+		return
+	}
+	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), f)
+}
+
+// streamFile serves the raw content of a file as it is read, so files of any
+// size are served without holding them in memory. Range and HEAD requests
+// are served by http.ServeContent like for downloadFile.
+func streamFile(w http.ResponseWriter, r *http.Request, filePath string, requestId string) {
+	f, err := openFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if fileInfo.IsDir() {
+		http.Error(w, "filePath is a directory", http.StatusBadRequest)
+		return
+	}
+
+	if err := rangeFromForm(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if typ, err := fileType(f, fileInfo.Name()); err == nil {
+		w.Header().Set("Content-Type", typ)
+	}
+	w.Header().Set("ETag", fileETag(fileInfo))
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	if serveMapped(w, r, f, fileInfo, requestId) {
+		return
+	}
+	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), f)
+}
+
+// fileETag returns the entity tag of a file version, made of its size and
+// modification time.
+func fileETag(info os.FileInfo) string {
+	// The tag is the same whether the file was opened or only stat'ed.
+	if i, ok := info.(atRestInfo); ok {
+		info = i.FileInfo
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// formRange parses the optional offset and length form values, which select
+// part of a file like a Range header does. length is -1 when not given,
+// meaning up to the end of the file; ok is false when neither is given.
+func formRange(r *http.Request) (offset int64, length int64, ok bool, err error) {
+	offsetStr, lengthStr := r.FormValue("offset"), r.FormValue("length")
+	if offsetStr == "" && lengthStr == "" {
+		return 0, -1, false, nil
+	}
+	if offsetStr != "" {
+		offset, err = strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, false, errors.New("Invalid offset value")
+		}
+	}
+	length = -1
+	if lengthStr != "" {
+		length, err = strconv.ParseInt(lengthStr, 10, 64)
+		if err != nil || length < 1 {
+			return 0, 0, false, errors.New("Invalid length value")
+		}
+	}
+	return offset, length, true, nil
+}
+
+// rangeFromForm turns offset and length form values into the Range header
+// they stand for, so http.ServeContent serves them. A Range header sent by
+// the client takes precedence.
+func rangeFromForm(r *http.Request) error {
+	offset, length, ok, err := formRange(r)
+	if err != nil || !ok || r.Header.Get("Range") != "" {
+		return err
+	}
+	if length < 0 {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// dryRunEntry is a path a destructive operation would have touched.
+type dryRunEntry struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Size   int64  `json:"size"` // Size in bytes
+}
+
+// dryRunReport is the response data of a destructive operation called with
+// dryRun=true. Nothing has been changed when it is returned. The paths of
+// entries are given as the client of r sees them.
+func dryRunReport(r *http.Request, entries []dryRunEntry) map[string]interface{} {
+	var total int64
+	for i, entry := range entries {
+		total += entry.Size
+		entries[i].Path = clientPath(r, entry.Path)
+	}
+	if entries == nil {
+		entries = []dryRunEntry{}
+	}
+	return map[string]interface{}{
+		"dryRun":  true,
+		"entries": entries,
+		"count":   len(entries),
+		"bytes":   total,
+	}
+}
+
+// isDryRun reports whether r asks for a dry run. It only looks at the query
+// string and url-encoded bodies so that middleware never consumes a streamed
+// or multipart body. Conflicting values aren't a dry run: the handler
+// refuses them.
+func isDryRun(r *http.Request) bool {
+	var body string
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/x-www-form-urlencoded" {
+		body = r.PostFormValue("dryRun")
+	}
+	dryRun, err := dryRunValue(r.URL.Query().Get("dryRun"), body)
+	return err == nil && dryRun
+}
+
+// dryRunParam is the dryRun parameter of r as handlers see it. The guards
+// decide from the query string, so a body value, url-encoded or multipart,
+// that disagrees with it is refused rather than letting a request pass as a
+// dry run and then write.
+func dryRunParam(r *http.Request) (bool, error) {
+	return dryRunValue(r.URL.Query().Get("dryRun"), r.PostFormValue("dryRun"))
+}
+
+// dryRunValue parses the dryRun values of the query string and the body,
+// either of which may be missing.
+func dryRunValue(query, body string) (bool, error) {
+	var values []bool
+	for _, value := range []string{query, body} {
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("Invalid dryRun value")
+		}
+		values = append(values, b)
+	}
+	switch {
+	case len(values) == 0:
+		return false, nil
+	case len(values) == 2 && values[0] != values[1]:
+		return false, fmt.Errorf("Conflicting dryRun values in the query string and the body")
+	}
+	return values[0], nil
+}
+
+// dryRunRoutes are the endpoints that implement dryRun. Elsewhere the
+// parameter is ignored and the request really changes stored data.
+var dryRunRoutes = map[string]bool{
+	"/appendFile":      true,
+	"/chmod":           true,
+	"/compressFile":    true,
+	"/concatFiles":     true,
+	"/convertEOL":      true,
+	"/convertEncoding": true,
+	"/copyFile":        true,
+	"/createDir":       true,
+	"/decompressFile":  true,
+	"/deleteDir":       true,
+	"/deleteFile":      true,
+	"/extract":         true,
+	"/linkFile":        true,
+	"/moveFile":        true,
+	"/patchFile":       true,
+	"/renderTemplate":  true,
+	"/seed":            true,
+	"/splitFile":       true,
+	"/symlink":         true,
+	"/touch":           true,
+	"/upload":          true,
+	"/writeAt":         true,
+	"/writeFile":       true,
+}
+
+// isHarmlessDryRun reports whether r is a dry run of an endpoint that
+// implements them, so it can't change anything whatever mode the server is
+// in.
+func isHarmlessDryRun(r *http.Request) bool {
+	return dryRunRoutes[r.URL.Path] && isDryRun(r)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRunParam(t *testing.T) {
+	multipartBody := func(value string) (string, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("dryRun", value)
+		mw.Close()
+		return body.String(), mw.FormDataContentType()
+	}
+	tests := []struct {
+		name        string
+		query       string
+		body        string
+		contentType string
+		multipart   string
+		want        bool
+		wantErr     bool
+	}{
+		{name: "missing"},
+		{name: "query", query: "true", want: true},
+		{name: "body", body: "1", want: true},
+		{name: "multipart", multipart: "true", want: true},
+		{name: "both agreeing", query: "true", body: "t", want: true},
+		{name: "both false", query: "false", body: "0"},
+		{name: "query true, body false", query: "true", body: "false", wantErr: true},
+		{name: "query false, body true", query: "false", body: "true", wantErr: true},
+		{name: "query true, multipart false", query: "true", multipart: "false", wantErr: true},
+		{name: "invalid", query: "maybe", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/writeFile"
+			if tt.query != "" {
+				target += "?dryRun=" + tt.query
+			}
+			var body, contentType string
+			switch {
+			case tt.body != "":
+				body, contentType = "dryRun="+tt.body, "application/x-www-form-urlencoded"
+			case tt.multipart != "":
+				body, contentType = multipartBody(tt.multipart)
+			}
+			r := httptest.NewRequest("POST", target, strings.NewReader(body))
+			if contentType != "" {
+				r.Header.Set("Content-Type", contentType)
+			}
+			got, err := dryRunParam(r)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("dryRunParam = %t, %v, want %t, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A request the guards take for a dry run must be one for the handler too,
+// or it gets through read-only mode and writes.
+func TestConflictingDryRunDoesNotWrite(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withRoute(t, "/writeFile", opWrite)
+
+	for _, guard := range []struct {
+		name string
+		wrap func(http.Handler) http.Handler
+		set  func(bool)
+	}{
+		{name: "read-only", wrap: readOnlyGuard, set: func(on bool) {
+			readOnly.Lock()
+			readOnly.enabled = on
+			readOnly.Unlock()
+		}},
+		{name: "maintenance", wrap: maintenanceGuard, set: func(on bool) {
+			maintenance.Lock()
+			maintenance.enabled = on
+			maintenance.Unlock()
+		}},
+	} {
+		t.Run(guard.name, func(t *testing.T) {
+			guard.set(true)
+			t.Cleanup(func() { guard.set(false) })
+
+			r := httptest.NewRequest("POST", "/writeFile?dryRun=true", strings.NewReader("filePath=f.txt&fileContent=x&dryRun=false"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			guard.wrap(http.HandlerFunc(writeFile)).ServeHTTP(w, r)
+			if w.Code < 400 {
+				t.Fatalf("answered %d, want an error", w.Code)
+			}
+			if _, err := os.Stat(filepath.Join(root, "f.txt")); !os.IsNotExist(err) {
+				t.Fatalf("file was written: %v", err)
+			}
+		})
+	}
+}
+
+func TestDryRunReportsClientPaths(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	os.WriteFile(filepath.Join(root, "dir", "f.txt"), []byte("content"), 0644)
+
+	w := httptest.NewRecorder()
+	deleteFile(w, httptest.NewRequest("DELETE", "/deleteFile?filePath=dir/f.txt&dryRun=true", nil))
+	var res struct {
+		Data struct {
+			Entries []dryRunEntry `json:"entries"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body.String(), err)
+	}
+	want := string(filepath.Separator) + filepath.Join("dir", "f.txt")
+	if len(res.Data.Entries) != 1 || res.Data.Entries[0].Path != want {
+		t.Fatalf("got %+v, want %s", res.Data.Entries, want)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diskUsageTotals is what /diskUsage counts for a tree.
+type diskUsageTotals struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+	Dirs  int64 `json:"dirs"`
+}
+
+// add counts the entry d.
+func (t *diskUsageTotals) add(d fs.DirEntry) {
+	switch {
+	case d.IsDir():
+		t.Dirs++
+	case d.Type().IsRegular():
+		if info, err := d.Info(); err == nil {
+			t.Files++
+			t.Bytes += info.Size()
+		}
+	}
+}
+
+// diskUsageChild is the usage of one entry of the directory /diskUsage was
+// asked about, including everything below it.
+type diskUsageChild struct {
+	Name  string `json:"name"`
+	IsDir bool   `json:"isDir"`
+	diskUsageTotals
+}
+
+// diskUsage walks the tree below dirPath and returns the bytes in its
+// regular files and the number of files and directories, like du. With
+// byChild=true the totals are also broken down per entry of dirPath, largest
+// first. Sizes are apparent sizes, and symbolic links are not followed.
+func diskUsage(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dirPath := r.FormValue("dirPath")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Measuring disk usage")
+
+	if dirPath == "" {
+		http.Error(w, "dirPath is required", http.StatusBadRequest)
+		return
+	}
+	byChild, err := formBool(r, "byChild")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dirPath, err = resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	info, err := statFile(dirPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "dirPath is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	var mu sync.Mutex
+	var total diskUsageTotals
+	children := map[string]*diskUsageChild{}
+	err = walkTree(r.Context(), dirPath, 0, func(relPath string, d fs.DirEntry) error {
+		mu.Lock()
+		defer mu.Unlock()
+		total.add(d)
+		if byChild {
+			name, _, nested := strings.Cut(relPath, "/")
+			child := children[name]
+			if child == nil {
+				child = &diskUsageChild{Name: name}
+				children[name] = child
+			}
+			// A child directory counts what is below it, not itself.
+			if !nested {
+				child.IsDir = d.IsDir()
+			}
+			if nested || !child.IsDir {
+				child.add(d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to measure directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"bytes": total.Bytes,
+		"files": total.Files,
+		"dirs":  total.Dirs,
+	}
+	if byChild {
+		list := make([]*diskUsageChild, 0, len(children))
+		for _, child := range children {
+			list = append(list, child)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Bytes != list[j].Bytes {
+				return list[i].Bytes > list[j].Bytes
+			}
+			return list[i].Name < list[j].Name
+		})
+		data["children"] = list
+	}
+	writeJSON(w, "Disk usage measured successfully", requestId, data)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/transform"
+)
+
+// eolTransformer rewrites line endings, both LF and CRLF, to LF or to CRLF.
+// A lone CR is left alone.
+type eolTransformer struct {
+	crlf bool
+}
+
+func (t eolTransformer) Reset() {}
+
+func (t eolTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	newline := []byte("\n")
+	if t.crlf {
+		newline = []byte("\r\n")
+	}
+	for nSrc < len(src) {
+		c := src[nSrc]
+		if c == '\r' && nSrc+1 == len(src) && !atEOF {
+			// Whether it starts a CRLF shows with the next byte.
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		if c == '\n' || c == '\r' && nSrc+1 < len(src) && src[nSrc+1] == '\n' {
+			if nDst+len(newline) > len(dst) {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+			nDst += copy(dst[nDst:], newline)
+			if c == '\r' {
+				nSrc++
+			}
+			nSrc++
+			continue
+		}
+		if nDst == len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		dst[nDst] = c
+		nDst++
+		nSrc++
+	}
+	return nDst, nSrc, nil
+}
+
+// formEOL parses the optional normalizeEOL form value: lf or crlf to
+// rewrite line endings to, or keep, the default, which leaves them alone
+// and is returned as "".
+func formEOL(r *http.Request) (string, error) {
+	switch eol := r.FormValue("normalizeEOL"); eol {
+	case "", "keep":
+		return "", nil
+	case "lf", "crlf":
+		return eol, nil
+	default:
+		return "", fmt.Errorf("Invalid normalizeEOL: %s", eol)
+	}
+}
+
+// normalizeEOL returns src with its line endings rewritten to eol, or src
+// itself if eol is "".
+func normalizeEOL(src io.Reader, eol string) io.Reader {
+	if eol == "" {
+		return src
+	}
+	return transform.NewReader(src, eolTransformer{crlf: eol == "crlf"})
+}
+
+// normalizeEOLBytes is normalizeEOL for content held in memory.
+func normalizeEOLBytes(data []byte, eol string) []byte {
+	if eol == "" {
+		return data
+	}
+	out, _, _ := transform.Bytes(eolTransformer{crlf: eol == "crlf"}, data)
+	return out
+}
+
+// streamNormalized serves the raw content of the file at filePath, cut to
+// the offset and length form values, with its line endings rewritten to
+// eol. The size isn't known up front, so Range requests aren't served.
+func streamNormalized(w http.ResponseWriter, r *http.Request, filePath string, eol string, requestId string) {
+	f, err := openFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if fileInfo.IsDir() {
+		http.Error(w, "filePath is a directory", http.StatusBadRequest)
+		return
+	}
+	offset, length, _, err := formRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if length < 0 {
+		length = fileInfo.Size() - offset
+	}
+	if typ, err := fileType(f, fileInfo.Name()); err == nil {
+		w.Header().Set("Content-Type", typ)
+	}
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	io.Copy(w, normalizeEOL(io.NewSectionReader(f, offset, max(length, 0)), eol))
+}
+
+// convertEOL rewrites the line endings of a text file to LF or CRLF, so
+// files exchanged between Windows and Unix clients stay consistent.
+func convertEOL(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	destPath := r.FormValue("destPath")
+	to := r.FormValue("to")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"destPath":  destPath,
+		"to":        to,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Converting line endings")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if to != "lf" && to != "crlf" {
+		http.Error(w, "to must be lf or crlf", http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	if destPath == "" {
+		destPath = filePath
+	} else if destPath, err = resolvePath(r, destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(destPath)
+	defer unlock()
+	f, err := openFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if err := checkNotClientEncrypted(f); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		var entries []dryRunEntry
+		if destInfo, err := statFile(destPath); err == nil {
+			entries = append(entries, dryRunEntry{Path: destPath, Action: "replace", Size: destInfo.Size()})
+		}
+		writeJSON(w, "Dry run: file not converted", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	size, err := storeFileFrom(destPath, &cappedReader{r: normalizeEOL(f, to), limit: sizeLimit(r, destPath)})
+	if err != nil {
+		discardBackup(backup)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("Unable to convert file: %s", err.Error()), status)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "convertEOL", destPath, existed, backup)
+	writeJSON(w, "File converted successfully", requestId, map[string]interface{}{
+		"to":   to,
+		"size": size,
+	})
+}
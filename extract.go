@@ -0,0 +1,544 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxExtractEntries bounds the number of entries one archive may have.
+const maxExtractEntries = 100000
+
+// errUnsafeEntry is returned for an archive entry that would land outside
+// the directory it is extracted into.
+var errUnsafeEntry = errors.New("unsafe archive entry")
+
+// errExtractConflict is returned when an entry collides with an existing
+// file that onConflict doesn't allow replacing.
+var errExtractConflict = errors.New("conflict")
+
+// extractEntry is one entry read from an archive.
+type extractEntry struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	link    string
+	content io.Reader
+}
+
+// sniffArchive returns the format of the archive starting with head: zip,
+// tar, or tar compressed with one of the formats of /decompressFile.
+func sniffArchive(head []byte) string {
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")) {
+		return "zip"
+	}
+	if format := sniffCompression(head); format != "" {
+		return "tar." + map[string]string{"gzip": "gz", "zstd": "zst", "bzip2": "bz2", "xz": "xz"}[format]
+	}
+	if len(head) >= 262 && string(head[257:262]) == "ustar" {
+		return "tar"
+	}
+	return ""
+}
+
+// archiveFormatOf returns the archive format the extension of name stands
+// for, or "" if it doesn't name one.
+func archiveFormatOf(name string) string {
+	name = strings.ToLower(name)
+	for _, s := range []struct{ ext, format string }{
+		{".zip", "zip"}, {".tar", "tar"},
+		{".tar.gz", "tar.gz"}, {".tgz", "tar.gz"},
+		{".tar.zst", "tar.zst"}, {".tar.zstd", "tar.zst"},
+		{".tar.bz2", "tar.bz2"}, {".tbz2", "tar.bz2"},
+		{".tar.xz", "tar.xz"}, {".txz", "tar.xz"},
+	} {
+		if strings.HasSuffix(name, s.ext) {
+			return s.format
+		}
+	}
+	return ""
+}
+
+// readArchive calls fn for every entry of the archive f of format, in the
+// order they are stored. The content of an entry can only be read during
+// its call.
+func readArchive(f contentFile, format string, fn func(e *extractEntry) error) error {
+	if format == "zip" {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return fmt.Errorf("%w: %v", errCorruptCompressed, err)
+		}
+		for _, zf := range zr.File {
+			e := &extractEntry{
+				name:    zf.Name,
+				mode:    zf.Mode(),
+				size:    int64(zf.UncompressedSize64),
+				modTime: zf.Modified,
+			}
+			err := func() error {
+				if e.mode.IsDir() {
+					return fn(e)
+				}
+				rc, err := zf.Open()
+				if err != nil {
+					return fmt.Errorf("%w: %v", errCorruptCompressed, err)
+				}
+				defer rc.Close()
+				if e.mode&fs.ModeSymlink != 0 {
+					// Zip stores the target of a link as its content.
+					link, err := io.ReadAll(io.LimitReader(rc, 4096))
+					if err != nil {
+						return fmt.Errorf("%w: %v", errCorruptCompressed, err)
+					}
+					e.link = string(link)
+				} else {
+					e.content = decodeReader{rc}
+				}
+				return fn(e)
+			}()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	compression, ok := strings.CutPrefix(format, "tar")
+	if !ok {
+		return fmt.Errorf("Unsupported format %q: use zip, tar, tar.gz, tar.zst or tar.bz2", format)
+	}
+	var src io.Reader = bufio.NewReader(f)
+	if compression != "" {
+		dec, err := newDecompressor(src, map[string]string{".gz": "gzip", ".zst": "zstd", ".bz2": "bzip2", ".xz": "xz"}[compression])
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		src = dec
+	}
+	tr := tar.NewReader(decodeReader{src})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, errCorruptCompressed) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", errCorruptCompressed, err)
+		}
+		e := &extractEntry{
+			name:    hdr.Name,
+			mode:    hdr.FileInfo().Mode(),
+			size:    hdr.Size,
+			modTime: hdr.ModTime,
+			link:    hdr.Linkname,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+		default:
+			// Hard links, devices and the like are left out.
+			continue
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			e.content = tr
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// extractName returns the cleaned slash-separated path of an entry name,
+// "" for the archive root, or errUnsafeEntry if it would leave the
+// directory extracted into.
+func extractName(name string) (string, error) {
+	name = path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("%w: %q", errUnsafeEntry, name)
+	}
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// extractStatus returns the status code to answer a failed extraction with.
+func extractStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnsafeEntry):
+		return http.StatusBadRequest
+	case errors.Is(err, errTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errCorruptCompressed):
+		return http.StatusUnprocessableEntity
+	}
+	return scanStatus(err)
+}
+
+// extractedFile is an entry of the manifest /extract returns.
+type extractedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Type   string `json:"type"`
+	Action string `json:"action"`
+}
+
+// uploadedArchive spools the archive uploaded with r, as the archive file of
+// a multipart form or the raw request body, to a temporary file, so it can be
+// read twice like a stored one. The caller removes the file.
+func uploadedArchive(r *http.Request) (*os.File, string, error) {
+	var src io.Reader = r.Body
+	var name string
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		part, header, err := r.FormFile("archive")
+		if err != nil {
+			return nil, "", err
+		}
+		defer part.Close()
+		src, name = part, header.Filename
+	}
+	f, err := os.CreateTemp("", "frw-extract-")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	return f, name, nil
+}
+
+// extract unpacks a zip, tar, tar.gz, tar.zst or tar.bz2 archive into the
+// directory at dirPath: the one stored at archivePath, which only needs to
+// be readable, or one uploaded as the request body or the archive file of a
+// multipart form. The format is taken
+// from format, or else the extension of the archive or its first bytes.
+// Entries that would land outside dirPath, by their names or through
+// symbolic links, are refused before anything is written. Existing files
+// are skipped, replaced or make the request fail with 409 as onConflict
+// (skip, replace or error, the default) says. What the archive expands to is
+// capped like for /decompressFile. The response lists every entry.
+func extract(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	archivePath := r.URL.Query().Get("archivePath")
+	dirPath := r.URL.Query().Get("dirPath")
+	format := r.URL.Query().Get("format")
+	logrus.WithFields(logrus.Fields{
+		"archivePath": archivePath,
+		"dirPath":     dirPath,
+		"format":      format,
+		"requestId":   requestId,
+		"serverId":    serverId,
+	}).Info("Extracting archive")
+
+	if dirPath == "" {
+		http.Error(w, "dirPath is required", http.StatusBadRequest)
+		return
+	}
+	onConflict := r.URL.Query().Get("onConflict")
+	switch onConflict {
+	case "":
+		onConflict = "error"
+	case "error", "skip", "replace":
+	default:
+		http.Error(w, "Invalid onConflict value: use error, skip or replace", http.StatusBadRequest)
+		return
+	}
+	maxSize, err := formSize(r, "maxSize", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dirPath, err = resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	var f contentFile
+	var name string
+	if archivePath != "" {
+		resolved, err := resolvePath(r, archivePath)
+		if err == nil {
+			// The archive is only read.
+			err = checkPathScopeFor(r, opRead, resolved)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid archivePath: %s", err.Error()), pathErrorStatus(err))
+			return
+		}
+		if f, err = openFile(resolved); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "Archive not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Unable to open archive: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		name = resolved
+	} else {
+		upload, uploadName, err := uploadedArchive(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read uploaded archive: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		defer os.Remove(upload.Name())
+		f, name = upload, uploadName
+	}
+	defer f.Close()
+	if format == "" {
+		format = archiveFormatOf(name)
+	}
+	if format == "" {
+		head := make([]byte, 512)
+		n, _ := f.ReadAt(head, 0)
+		if format = sniffArchive(head[:n]); format == "" {
+			http.Error(w, "Unable to tell the format of the archive; give format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if info, err := statFile(dirPath); err == nil && !info.IsDir() {
+		http.Error(w, "dirPath is not a directory", http.StatusBadRequest)
+		return
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	limit := decompressionLimit(r, dirPath, maxSize)
+
+	// The first pass checks every entry and works out what happens to it,
+	// so unsafe names, conflicts and oversized archives fail before
+	// anything is written.
+	var manifest []extractedFile
+	var total int64
+	err = readArchive(f, format, func(e *extractEntry) error {
+		rel, err := extractName(e.name)
+		if err != nil || rel == "" {
+			return err
+		}
+		if len(manifest) == maxExtractEntries {
+			return fmt.Errorf("%w: more than %d entries", errTooLarge, maxExtractEntries)
+		}
+		target := filepath.Join(dirPath, filepath.FromSlash(rel))
+		entry := extractedFile{Path: rel, Type: "file", Action: "create"}
+		switch {
+		case e.mode.IsDir():
+			entry.Type = "dir"
+		case e.mode&fs.ModeSymlink != 0:
+			entry.Type = "symlink"
+			// The link may only lead to somewhere inside dirPath.
+			if path.IsAbs(e.link) || filepath.IsAbs(e.link) {
+				return fmt.Errorf("%w: link %q points to %q", errUnsafeEntry, rel, e.link)
+			}
+			if _, err := extractName(path.Join(path.Dir(rel), e.link)); err != nil {
+				return fmt.Errorf("%w: link %q points to %q", errUnsafeEntry, rel, e.link)
+			}
+		default:
+			entry.Size = e.size
+			total += e.size
+			if limit > 0 && total > limit {
+				return fmt.Errorf("%w: more than the limit of %d bytes", errTooLarge, limit)
+			}
+		}
+		if existing, err := os.Lstat(target); err == nil {
+			switch {
+			case existing.IsDir() && entry.Type == "dir":
+				entry.Action = "exists"
+			case existing.IsDir():
+				return fmt.Errorf("%w: %q is a directory", errExtractConflict, rel)
+			case onConflict == "error":
+				return fmt.Errorf("%w: %q already exists", errExtractConflict, rel)
+			case onConflict == "skip":
+				entry.Action = "skip"
+			case existing.Mode()&fs.ModeSymlink != 0 && entry.Type != "symlink":
+				// Replacing it would write through the link.
+				return fmt.Errorf("%w: %q is a symbolic link", errExtractConflict, rel)
+			default:
+				entry.Action = "replace"
+			}
+		}
+		manifest = append(manifest, entry)
+		return nil
+	})
+	if err != nil {
+		status := extractStatus(err)
+		if errors.Is(err, errExtractConflict) {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Unable to extract archive: %s", err.Error()), status)
+		return
+	}
+
+	if dryRun {
+		entries := make([]dryRunEntry, 0, len(manifest))
+		for _, entry := range manifest {
+			if entry.Action == "create" || entry.Action == "replace" {
+				entries = append(entries, dryRunEntry{Path: filepath.Join(dirPath, filepath.FromSlash(entry.Path)), Action: entry.Action, Size: entry.Size})
+			}
+		}
+		writeJSON(w, "Dry run: archive not extracted", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	realDir, err := filepath.EvalSymlinks(dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read archive: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// Links are made after everything else, so no entry is written through
+	// a link of the same archive.
+	var links []*extractEntry
+	remaining := limit
+	i := 0
+	err = readArchive(f, format, func(e *extractEntry) error {
+		rel, err := extractName(e.name)
+		if err != nil || rel == "" {
+			return err
+		}
+		if i >= len(manifest) || manifest[i].Path != rel {
+			return errors.New("archive changed while it was extracted")
+		}
+		entry := &manifest[i]
+		i++
+		if entry.Action == "skip" || entry.Action == "exists" {
+			return nil
+		}
+		target := filepath.Join(dirPath, filepath.FromSlash(rel))
+		if err := checkInsideRoot(realDir, target); err != nil {
+			return fmt.Errorf("%w: %q leads outside dirPath", errUnsafeEntry, rel)
+		}
+		switch entry.Type {
+		case "dir":
+			return os.MkdirAll(target, 0755)
+		case "symlink":
+			links = append(links, &extractEntry{name: rel, link: e.link})
+			return nil
+		}
+		size, err := extractFile(r, requestId, target, e, remaining)
+		entry.Size = size
+		if remaining > 0 {
+			remaining -= size
+		}
+		return err
+	})
+	for err == nil && len(links) > 0 {
+		link := links[0]
+		links = links[1:]
+		target := filepath.Join(dirPath, filepath.FromSlash(link.name))
+		if err = checkInsideRoot(realDir, target); err != nil {
+			err = fmt.Errorf("%w: %q leads outside dirPath", errUnsafeEntry, link.name)
+			break
+		}
+		err = extractLink(r, requestId, target, link.link)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to extract archive: %s", err.Error()), extractStatus(err))
+		return
+	}
+	writeJSON(w, "Archive extracted successfully", requestId, map[string]interface{}{
+		"format": format,
+		"files":  manifest,
+	})
+}
+
+// extractFile writes the content of the regular file entry e to target,
+// failing with errTooLarge beyond limit bytes, and returns its size.
+func extractFile(r *http.Request, requestId string, target string, e *extractEntry, limit int64) (int64, error) {
+	if sl := sizeLimit(r, target); sl > 0 && (limit <= 0 || sl < limit) {
+		limit = sl
+	}
+	unlock := lockWrites(target)
+	defer unlock()
+	if err := ensureParentDir(target); err != nil {
+		return 0, err
+	}
+	existed, backup, err := backupFile(target)
+	if err != nil {
+		return 0, err
+	}
+	perm := e.mode.Perm() & os.FileMode(config.ModeMask)
+	src := scanUpload(e.content, target, requestActor(r))
+	defer src.Close()
+	size, err := storeFileMode(target, &cappedReader{r: src, limit: limit}, &perm, nil)
+	if err != nil {
+		discardBackup(backup)
+		return 0, err
+	}
+	if !e.modTime.IsZero() {
+		os.Chtimes(target, e.modTime, e.modTime)
+	}
+	recordOperation(requestActor(r), requestId, "extract", target, existed, backup)
+	return size, nil
+}
+
+// extractLink makes target a symbolic link to link, replacing what is there.
+func extractLink(r *http.Request, requestId string, target string, link string) error {
+	unlock := lockWrites(target)
+	defer unlock()
+	if err := ensureParentDir(target); err != nil {
+		return err
+	}
+	existed, backup, err := backupFile(target)
+	if err != nil {
+		return err
+	}
+	if existed {
+		if err := os.Remove(target); err != nil {
+			discardBackup(backup)
+			return err
+		}
+	}
+	if err := os.Symlink(link, target); err != nil {
+		discardBackup(backup)
+		return err
+	}
+	recordOperation(requestActor(r), requestId, "extract", target, existed, backup)
+	return nil
+}
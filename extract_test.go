@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testEntry is an entry of a test archive. A link makes it a symbolic
+// link, in tar archives.
+type testEntry struct {
+	name    string
+	content string
+	link    string
+}
+
+func zipArchive(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarArchive(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			header = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractRefusesUnsafeEntries(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		format  string
+		archive func(t *testing.T) []byte
+		query   string
+		want    int
+	}{
+		{name: "safe zip", format: "zip", archive: func(t *testing.T) []byte {
+			return zipArchive(t, testEntry{name: "a/b.txt", content: "b"}, testEntry{name: "./c.txt", content: "c"})
+		}, want: http.StatusOK},
+		{name: "parent in zip", format: "zip", archive: func(t *testing.T) []byte {
+			return zipArchive(t, testEntry{name: "ok.txt", content: "ok"}, testEntry{name: "../evil.txt", content: "evil"})
+		}, want: http.StatusBadRequest},
+		{name: "parent after a directory", format: "zip", archive: func(t *testing.T) []byte {
+			return zipArchive(t, testEntry{name: "a/../../evil.txt", content: "evil"})
+		}, want: http.StatusBadRequest},
+		{name: "backslashes", format: "zip", archive: func(t *testing.T) []byte {
+			return zipArchive(t, testEntry{name: `..\evil.txt`, content: "evil"})
+		}, want: http.StatusBadRequest},
+		{name: "absolute name", format: "tar", archive: func(t *testing.T) []byte {
+			return tarArchive(t, testEntry{name: "/evil.txt", content: "evil"})
+		}, want: http.StatusBadRequest},
+		{name: "link leaving the directory", format: "tar", archive: func(t *testing.T) []byte {
+			return tarArchive(t, testEntry{name: "link", link: "../outside"})
+		}, want: http.StatusBadRequest},
+		{name: "absolute link", format: "tar", archive: func(t *testing.T) []byte {
+			return tarArchive(t, testEntry{name: "link", link: "/etc"})
+		}, want: http.StatusBadRequest},
+		{name: "link inside the directory", format: "tar", archive: func(t *testing.T) []byte {
+			return tarArchive(t, testEntry{name: "a/b.txt", content: "b"}, testEntry{name: "a/link", link: "b.txt"})
+		}, want: http.StatusOK},
+		{name: "through an existing link", format: "tar", archive: func(t *testing.T) []byte {
+			return tarArchive(t, testEntry{name: "out/evil.txt", content: "evil"})
+		}, want: http.StatusBadRequest},
+		{name: "bomb", format: "zip", archive: func(t *testing.T) []byte {
+			return zipArchive(t, testEntry{name: "big", content: string(make([]byte, 1<<20))})
+		}, query: "&maxSize=1024", want: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := testRoot(t)
+			outside := testRoot(t)
+			withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = "" })
+			dest := filepath.Join(root, "dest")
+			os.MkdirAll(dest, 0755)
+			// A link a previous extraction or user left behind.
+			if err := os.Symlink(outside, filepath.Join(dest, "out")); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("POST", "/extract?dirPath=dest&onConflict=replace&format="+tt.format+tt.query, bytes.NewReader(tt.archive(t)))
+			w := httptest.NewRecorder()
+			extract(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+
+			for _, dir := range []string{root, outside} {
+				if _, err := os.Stat(filepath.Join(dir, "evil.txt")); !os.IsNotExist(err) {
+					t.Errorf("entry written outside dirPath: %v", err)
+				}
+			}
+			if tt.want != http.StatusOK {
+				// Nothing is written when an entry is refused.
+				if _, err := os.Stat(filepath.Join(dest, "ok.txt")); !os.IsNotExist(err) {
+					t.Errorf("entries before the refused one were written: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FaultRule makes a share of the requests for matching paths fail or slow
+// down, to test how clients cope with misbehaving storage.
+type FaultRule struct {
+	Name string `json:"name"`
+	// Pattern is a glob, see matchGlob, matched against the filePath or
+	// dirPath of a request. Empty matches every request.
+	Pattern string `json:"pattern"`
+	// Ops limits the rule to these kinds of operation: read, write, delete
+	// or generate. Empty means all of them.
+	Ops []string `json:"ops"`
+	// ErrorRate is the share of matching requests, from 0 to 1, answered
+	// with a 500.
+	ErrorRate float64 `json:"errorRate"`
+	// Latency is added to every matching request.
+	Latency Duration `json:"latency"`
+}
+
+func (f FaultRule) validate() error {
+	if f.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, err := matchGlob(f.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", f.Pattern, err)
+	}
+	for _, op := range f.Ops {
+		switch op {
+		case opRead, opWrite, opDelete, opGenerate:
+		default:
+			return fmt.Errorf("invalid op %q", op)
+		}
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return errors.New("errorRate must be between 0 and 1")
+	}
+	if f.Latency < 0 {
+		return errors.New("latency must not be negative")
+	}
+	return nil
+}
+
+func (f FaultRule) matches(op string, p string) bool {
+	if len(f.Ops) > 0 {
+		found := false
+		for _, o := range f.Ops {
+			found = found || o == op
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Pattern == "" {
+		return true
+	}
+	ok, _ := matchGlob(f.Pattern, p)
+	return ok
+}
+
+// activeFault is a fault rule in effect, until a time if it expires.
+type activeFault struct {
+	FaultRule
+	Source string    `json:"source"`
+	Until  time.Time `json:"until,omitempty"`
+}
+
+var faults struct {
+	sync.Mutex
+	active []activeFault
+}
+
+// addFault puts rule into effect, replacing any active fault of the same
+// name. A zero until never expires.
+func addFault(rule FaultRule, source string, until time.Time) {
+	faults.Lock()
+	defer faults.Unlock()
+	removeFaultLocked(rule.Name)
+	faults.active = append(faults.active, activeFault{FaultRule: rule, Source: source, Until: until})
+}
+
+func removeFault(name string) bool {
+	faults.Lock()
+	defer faults.Unlock()
+	return removeFaultLocked(name)
+}
+
+func removeFaultLocked(name string) bool {
+	for i, f := range faults.active {
+		if f.Name == name {
+			faults.active = append(faults.active[:i], faults.active[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// activeFaults returns the faults in effect, dropping expired ones.
+func activeFaults() []activeFault {
+	faults.Lock()
+	defer faults.Unlock()
+	now := time.Now()
+	kept := faults.active[:0]
+	for _, f := range faults.active {
+		if f.Until.IsZero() || now.Before(f.Until) {
+			kept = append(kept, f)
+		}
+	}
+	faults.active = kept
+	return append([]activeFault{}, kept...)
+}
+
+// injectFaults applies the active faults to storage requests.
+func injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := requestOp(r)
+		if op != opRead && op != opWrite && op != opDelete && op != opGenerate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		active := activeFaults()
+		if len(active) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p := r.FormValue("filePath")
+		if p == "" {
+			p = r.FormValue("dirPath")
+		}
+		p = filepath.ToSlash(cleanPath(p))
+		for _, f := range active {
+			if !f.matches(op, p) {
+				continue
+			}
+			if f.Latency > 0 {
+				select {
+				case <-time.After(time.Duration(f.Latency)):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+				logrus.WithFields(logrus.Fields{
+					"fault":    f.Name,
+					"path":     p,
+					"serverId": serverId,
+				}).Info("Injecting fault")
+				http.Error(w, fmt.Sprintf("Injected fault: %s", f.Name), http.StatusInternalServerError)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// faultInjection returns the active faults and the configured chaos
+// experiments on GET, and puts a fault into effect on POST, for duration if
+// given.
+func faultInjection(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, "Faults retrieved successfully", requestId, map[string]interface{}{
+			"faults":      activeFaults(),
+			"experiments": config.Chaos,
+		})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	rule := FaultRule{
+		Name:    r.FormValue("name"),
+		Pattern: r.FormValue("pattern"),
+		Ops:     r.Form["ops"],
+	}
+	if v := r.FormValue("errorRate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "Invalid errorRate value", http.StatusBadRequest)
+			return
+		}
+		rule.ErrorRate = rate
+	}
+	latency, err := formDuration(r, "latency", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.Latency = Duration(latency)
+	duration, err := formDuration(r, "duration", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid fault: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	addFault(rule, "manual", until)
+	recordAudit(auditEvent{
+		Actor:  requestActor(r),
+		Action: "fault",
+		Path:   rule.Pattern,
+		Detail: faultDetail(rule, duration),
+	})
+	writeJSON(w, "Fault added successfully", requestId, activeFaults())
+}
+
+// removeFaultHandler ends the fault with the given name.
+func removeFaultHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	if !removeFault(name) {
+		http.Error(w, fmt.Sprintf("No active fault named %s", name), http.StatusNotFound)
+		return
+	}
+	recordAudit(auditEvent{Actor: requestActor(r), Action: "faultRemoved", Detail: name})
+	writeJSON(w, "Fault removed successfully", requestId, activeFaults())
+}
+
+func faultDetail(rule FaultRule, duration time.Duration) string {
+	detail := fmt.Sprintf("%s: errorRate=%g latency=%s ops=%v", rule.Name, rule.ErrorRate, time.Duration(rule.Latency), rule.Ops)
+	if duration > 0 {
+		detail += fmt.Sprintf(" for %s", duration)
+	}
+	return detail
+}
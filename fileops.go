@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// movePath renames src to dst. When they are on different filesystems the
+// file or directory tree is copied and the source removed instead.
+func movePath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := copyEntry(src, dst, info); err != nil {
+			return err
+		}
+		return os.Remove(src)
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies the directory tree at src to dst, keeping modes,
+// modification times and symbolic links.
+func copyTree(src, dst string) error {
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Owner write access is needed to fill the directory; the
+			// real mode is set once it is.
+			return os.MkdirAll(filepath.Join(dst, rel), info.Mode().Perm()|0700)
+		}
+		return copyEntry(p, filepath.Join(dst, rel), info)
+	})
+	if err != nil {
+		return err
+	}
+	// Directories are finished last, since copying into them changes their
+	// modification time.
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(filepath.Join(dst, rel), info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(filepath.Join(dst, rel), info.ModTime(), info.ModTime())
+	})
+}
+
+// copyEntry copies the regular file or symbolic link src, described by info,
+// to dst.
+func copyEntry(src, dst string, info fs.FileInfo) error {
+	switch {
+	case info.Mode().IsRegular():
+		return copyRegularFile(src, dst)
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		return os.Symlink(target, dst)
+	default:
+		return fmt.Errorf("%s is not a regular file, directory or symbolic link", src)
+	}
+}
+
+// copyRegularFile copies src to dst, keeping its mode and modification time.
+func copyRegularFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// gzipFile compresses src into dst, keeping the modification time of src so
+// age based rules still see the original age. src is left in place.
+func gzipFile(src, dst string, level int) error {
+	in, err := openFile(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return &fs.PathError{Op: "create", Path: dst, Err: fs.ErrExist}
+	}
+
+	pr, pw := io.Pipe()
+	zw, err := gzip.NewWriterLevel(pw, level)
+	if err != nil {
+		return err
+	}
+	zw.Name = info.Name()
+	zw.ModTime = info.ModTime()
+	compressed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(zw, in)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+		compressed <- err
+	}()
+	perm := info.Mode().Perm()
+	_, err = storeFileMode(dst, pr, &perm, nil)
+	pr.Close()
+	if zipErr := <-compressed; zipErr != nil && zipErr != io.ErrClosedPipe {
+		err = zipErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
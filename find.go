@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errFindLimit stops the walk of findFiles once maxResults files matched.
+var errFindLimit = errors.New("result limit reached")
+
+// checkGlob makes sure pattern is a valid glob for matchGlob.
+func checkGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globDepth returns the number of levels a walk has to descend to find
+// every match of pattern, 0 if a "**" segment means all of them.
+func globDepth(pattern string) int {
+	segments := strings.Split(pattern, "/")
+	for _, segment := range segments {
+		if segment == "**" {
+			return 0
+		}
+	}
+	return len(segments)
+}
+
+// findFiles returns the entries below dirPath whose slash-separated path
+// relative to it matches pattern, such as "**/*.log", in one request rather
+// than a walk by the client. The listFiles filters and sorting apply, and
+// maxResults stops the search after that many matches.
+func findFiles(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dirPath := r.FormValue("dirPath")
+	pattern := r.FormValue("pattern")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"pattern":   pattern,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Finding files")
+
+	if dirPath == "" || pattern == "" {
+		http.Error(w, "dirPath and pattern are required", http.StatusBadRequest)
+		return
+	}
+	pattern = strings.TrimPrefix(path.Clean(strings.ReplaceAll(pattern, `\`, "/")), "/")
+	if err := checkGlob(pattern); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid pattern: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if _, err := formSymlinks(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := formListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxResults := 0
+	if r.FormValue("maxResults") != "" {
+		if maxResults, err = formPositiveInt(r, "maxResults"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	dirPath, err = resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	info, err := statFile(dirPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for directory %s: %s", dirPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "dirPath is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	var mu sync.Mutex
+	files := []map[string]interface{}{}
+	truncated := false
+	err = walkTree(r.Context(), dirPath, globDepth(pattern), func(relPath string, entry fs.DirEntry) error {
+		if opts.hidden(relPath) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ok, err := matchGlob(pattern, relPath)
+		if err != nil || !ok {
+			return err
+		}
+		fileInfo, err := fileListEntry(r, dirPath, relPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed since the directory was read.
+				return nil
+			}
+			return err
+		}
+		if !opts.match(fileInfo) {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if maxResults > 0 && len(files) >= maxResults {
+			truncated = true
+			return errFindLimit
+		}
+		files = append(files, fileInfo)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFindLimit) {
+		http.Error(w, fmt.Sprintf("Unable to search directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	opts.sort(files)
+	writeJSON(w, "Files found successfully", requestId, map[string]interface{}{
+		"files":     files,
+		"truncated": truncated,
+	})
+}
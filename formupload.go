@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// uploadedFile is a file written by /upload.
+type uploadedFile struct {
+	FileName string `json:"fileName"`
+	FilePath string `json:"filePath"`
+	Size     int64  `json:"size"`
+}
+
+// uploadFiles stores the files of a multipart/form-data request, as sent by
+// curl -F or an HTML form, below dirPath under their original names. Any
+// number of file parts is accepted, whatever their field names. Parts larger
+// than the memory limit are spooled to temporary files, never held whole in
+// memory.
+func uploadFiles(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid multipart form: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	dirPath := r.FormValue("dirPath")
+	logrus.WithFields(logrus.Fields{
+		"dirPath":   dirPath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Uploading files")
+
+	if dirPath == "" {
+		http.Error(w, "dirPath is required", http.StatusBadRequest)
+		return
+	}
+	clientDir := dirPath
+	dirPath, err := resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	// Check every file before writing any, so a bad one doesn't leave the
+	// upload half done.
+	type upload struct {
+		header   *multipart.FileHeader
+		filePath string
+	}
+	var fields []string
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var uploads []upload
+	for _, field := range fields {
+		for _, header := range r.MultipartForm.File[field] {
+			name := filepath.Base(header.Filename)
+			if name == "." || name == ".." || name == string(filepath.Separator) {
+				http.Error(w, fmt.Sprintf("Invalid file name %q", header.Filename), http.StatusBadRequest)
+				return
+			}
+			filePath, err := resolvePath(r, filepath.Join(clientDir, name))
+			if err == nil {
+				err = checkPathScope(r, filePath)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid file name %q: %s", header.Filename, err.Error()), pathErrorStatus(err))
+				return
+			}
+			if err := checkFileSize(r, filePath, header.Size); err != nil {
+				http.Error(w, fmt.Sprintf("File %s %s", header.Filename, err.Error()), http.StatusRequestEntityTooLarge)
+				return
+			}
+			uploads = append(uploads, upload{header: header, filePath: filePath})
+		}
+	}
+	if len(uploads) == 0 {
+		http.Error(w, "No files in request", http.StatusBadRequest)
+		return
+	}
+
+	// Every file is locked for the whole upload, so the checks of the
+	// request's preconditions still hold when the last one is written.
+	paths := make([]string, len(uploads))
+	for i, u := range uploads {
+		paths[i] = u.filePath
+	}
+	unlock := lockWrites(paths...)
+	defer unlock()
+	for _, u := range uploads {
+		if !preconditionsHold(w, r, u.filePath) {
+			return
+		}
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		var entries []dryRunEntry
+		for _, u := range uploads {
+			action := "create"
+			if _, err := statFile(u.filePath); err == nil {
+				action = "replace"
+			}
+			entries = append(entries, dryRunEntry{Path: u.filePath, Action: action, Size: u.header.Size})
+		}
+		writeJSON(w, "Dry run: files not uploaded", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	uploaded := []uploadedFile{}
+	for _, u := range uploads {
+		size, err := storeUploadedFile(r, requestId, u.header, u.filePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to write %s: %s", u.header.Filename, err.Error()), scanStatus(err))
+			return
+		}
+		uploaded = append(uploaded, uploadedFile{
+			FileName: filepath.Base(u.header.Filename),
+			FilePath: u.filePath,
+			Size:     size,
+		})
+	}
+	writeJSON(w, "Files uploaded successfully", requestId, uploaded)
+}
+
+// storeUploadedFile writes one file part of an upload to filePath.
+func storeUploadedFile(r *http.Request, requestId string, header *multipart.FileHeader, filePath string) (int64, error) {
+	f, err := header.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	existed, backup, err := backupFile(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to back up file: %s", err.Error())
+	}
+	src := scanUpload(f, filePath, requestActor(r))
+	defer src.Close()
+	size, err := storeFileFrom(filePath, src)
+	if err != nil {
+		discardBackup(backup)
+		return 0, err
+	}
+	recordOperation(requestActor(r), requestId, "write", filePath, existed, backup)
+	return size, nil
+}
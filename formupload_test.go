@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadFilesConditional(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = "" })
+	existing := filepath.Join(root, "a.txt")
+	if err := os.WriteFile(existing, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(existing, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		since time.Time
+		want  int
+	}{
+		{name: "changed since", since: modified.Add(-time.Minute), want: http.StatusPreconditionFailed},
+		{name: "unchanged since", since: modified.Add(time.Minute), want: http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			mw.WriteField("dirPath", ".")
+			for _, name := range []string{"a.txt", "b.txt"} {
+				part, _ := mw.CreateFormFile("file", name)
+				part.Write([]byte("new " + name))
+			}
+			mw.Close()
+			r := httptest.NewRequest("POST", "/upload", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.Header.Set("If-Unmodified-Since", tt.since.UTC().Format(http.TimeFormat))
+			w := httptest.NewRecorder()
+			uploadFiles(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+
+			_, err := os.Stat(filepath.Join(root, "b.txt"))
+			if written := err == nil; written != (tt.want == http.StatusOK) {
+				t.Errorf("b.txt written %v with status %d", written, w.Code)
+			}
+		})
+	}
+}
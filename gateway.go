@@ -0,0 +1,551 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GatewayRoute maps the files below Prefix to another file-reader-writer
+// instance. Several routes may share a prefix: their listings are merged,
+// reads go to the first that has the file and writes to the first one.
+type GatewayRoute struct {
+	// Prefix is a slash-separated path such as "/siteA".
+	Prefix string `json:"prefix"`
+	// Upstream is the base URL of the instance, e.g. "http://hostA:8081".
+	Upstream string `json:"upstream"`
+}
+
+func validateGateway(routes []GatewayRoute) error {
+	for i := range routes {
+		route := &routes[i]
+		route.Prefix = gatewayPath(route.Prefix)
+		if route.Prefix == "/" {
+			return fmt.Errorf("route %d: prefix must not be the root", i)
+		}
+		u, err := url.Parse(route.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("route %d: invalid upstream %q", i, route.Upstream)
+		}
+		route.Upstream = strings.TrimSuffix(route.Upstream, "/")
+	}
+	return nil
+}
+
+// gatewayPath turns a client supplied path into the absolute slash-separated
+// form route prefixes are written in.
+func gatewayPath(p string) string {
+	return "/" + strings.Trim(filepath.ToSlash(cleanPath(p)), "/.")
+}
+
+// gatewayRoutes returns the routes with the longest prefix p lies below and
+// the path relative to that prefix.
+func gatewayRoutes(p string) ([]GatewayRoute, string) {
+	var matched []GatewayRoute
+	var rest string
+	for _, route := range config.Gateway {
+		if p != route.Prefix && !strings.HasPrefix(p, route.Prefix+"/") {
+			continue
+		}
+		if len(matched) > 0 && len(route.Prefix) < len(matched[0].Prefix) {
+			continue
+		}
+		if len(matched) > 0 && len(route.Prefix) > len(matched[0].Prefix) {
+			matched = nil
+		}
+		matched = append(matched, route)
+		rest = strings.TrimPrefix(strings.TrimPrefix(p, route.Prefix), "/")
+	}
+	if rest == "" {
+		rest = "."
+	}
+	return matched, rest
+}
+
+// gatewayChildren returns the names of the route prefix components directly
+// below the directory p, for directories that only exist on the gateway.
+func gatewayChildren(p string) []string {
+	seen := map[string]bool{}
+	var names []string
+	base := strings.TrimSuffix(p, "/") + "/"
+	for _, route := range config.Gateway {
+		if !strings.HasPrefix(route.Prefix, base) {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(route.Prefix, base), "/")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isGatewayParam reports whether the parameter name holds a path requests
+// are routed by. The target of a symbolic link is stored as given, so it is
+// forwarded unchanged.
+func isGatewayParam(name string) bool {
+	if name == "target" {
+		return false
+	}
+	for _, param := range pathParams {
+		if param.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayValues returns the parameters r is routed by. The multipart bodies
+// of streaming routes are left unread, so only their query strings count;
+// other bodies are parsed the way the handlers will parse them.
+func gatewayValues(r *http.Request) url.Values {
+	if streamingRoutes[r.URL.Path] && isMultipart(r) {
+		return r.URL.Query()
+	}
+	r.ParseMultipartForm(32 << 20)
+	return r.Form
+}
+
+// gatewayTarget returns the routes the paths in values lie below, or none
+// if they are served locally. Requests naming paths served by different
+// instances are refused, as none of them could serve the request whole.
+func gatewayTarget(values url.Values) ([]GatewayRoute, error) {
+	var routes []GatewayRoute
+	first := ""
+	for _, param := range pathParams {
+		if !isGatewayParam(param.name) {
+			continue
+		}
+		for _, value := range values[param.name] {
+			matched, _ := gatewayRoutes(gatewayPath(value))
+			if first == "" {
+				routes, first = matched, param.name
+				continue
+			}
+			if !sameUpstreams(routes, matched) {
+				return nil, fmt.Errorf("%s and %s are served by different instances", first, param.name)
+			}
+		}
+	}
+	return routes, nil
+}
+
+func sameUpstreams(a, b []GatewayRoute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Upstream != b[i].Upstream {
+			return false
+		}
+	}
+	return true
+}
+
+// gatewayRest returns the path the upstream serving value knows it by.
+func gatewayRest(value string) string {
+	_, rest := gatewayRoutes(gatewayPath(value))
+	return rest
+}
+
+// routeGateway forwards storage requests for paths below a gateway route to
+// the instance serving them, and adds the route prefixes to listings of the
+// directories above them.
+func routeGateway(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := requestOp(r)
+		if len(config.Gateway) == 0 || (op != opRead && op != opWrite && op != opDelete && op != opGenerate) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		values := gatewayValues(r)
+
+		if r.URL.Path == "/listFiles" {
+			dirPath := values.Get("dirPath")
+			if dirPath == "" {
+				dirPath = "."
+			}
+			p := gatewayPath(dirPath)
+			routes, _ := gatewayRoutes(p)
+			switch {
+			case len(routes) > 1:
+				listMerged(w, r, routes)
+			case len(routes) == 1:
+				forwardRequest(w, r, routes[0], false)
+			default:
+				if children := gatewayChildren(p); len(children) > 0 {
+					listGatewayDir(w, r, dirPath, children)
+					return
+				}
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		routes, err := gatewayTarget(values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(routes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if op != opRead {
+			forwardRequest(w, r, routes[0], false)
+			return
+		}
+		// Try each upstream in turn until one has the file.
+		for i, route := range routes {
+			if forwardRequest(w, r, route, i < len(routes)-1) {
+				return
+			}
+		}
+	})
+}
+
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// gatewayRequest builds the request sent to route for r, with every path in
+// its query string and body replaced by the path route knows it by.
+func gatewayRequest(r *http.Request, route GatewayRoute) (*http.Request, error) {
+	query := rewriteGatewayValues(r.URL.Query())
+	target := route.Upstream + r.URL.Path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var body io.Reader = r.Body
+	header := r.Header.Clone()
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case r.MultipartForm != nil:
+		// The form has been parsed, which consumed the body, so it is
+		// encoded again.
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		go func() { pw.CloseWithError(encodeMultipart(mw, r.MultipartForm)) }()
+		body = pr
+		header.Set("Content-Type", mw.FormDataContentType())
+	case contentType == "multipart/form-data":
+		// Streamed bodies are copied part by part as they arrive.
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		go func() { pw.CloseWithError(rewriteMultipart(mw, mr, route)) }()
+		body = pr
+		header.Set("Content-Type", mw.FormDataContentType())
+	case contentType == "application/x-www-form-urlencoded":
+		body = strings.NewReader(rewriteGatewayValues(r.PostForm).Encode())
+	}
+
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, target, body)
+	if err != nil {
+		if c, ok := body.(io.Closer); ok && body != r.Body {
+			c.Close()
+		}
+		return nil, err
+	}
+	out.Header = header
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	out.Header.Del("Content-Length")
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		out.Header.Set("X-Forwarded-For", host)
+	}
+	return out, nil
+}
+
+// rewriteGatewayValues returns a copy of values with every path replaced by
+// the path its upstream knows it by.
+func rewriteGatewayValues(values url.Values) url.Values {
+	c := cloneValues(values)
+	for name, vs := range c {
+		if !isGatewayParam(name) {
+			continue
+		}
+		for i, value := range vs {
+			vs[i] = gatewayRest(value)
+		}
+	}
+	return c
+}
+
+// encodeMultipart writes a parsed multipart form to mw, with its paths
+// rewritten.
+func encodeMultipart(mw *multipart.Writer, form *multipart.Form) error {
+	values := rewriteGatewayValues(form.Value)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range values[name] {
+			if err := mw.WriteField(name, value); err != nil {
+				return err
+			}
+		}
+	}
+	for _, headers := range form.File {
+		for _, fh := range headers {
+			if err := copyFilePart(mw, fh); err != nil {
+				return err
+			}
+		}
+	}
+	return mw.Close()
+}
+
+func copyFilePart(mw *multipart.Writer, fh *multipart.FileHeader) error {
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part, err := mw.CreatePart(fh.Header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// maxGatewayField bounds the path fields read from streamed multipart bodies.
+const maxGatewayField = 64 << 10
+
+// rewriteMultipart copies the parts of mr to mw, rewriting the paths in its
+// fields for route. A path served by another instance aborts the request.
+func rewriteMultipart(mw *multipart.Writer, mr *multipart.Reader, route GatewayRoute) error {
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		out, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		if part.FileName() != "" || !isGatewayParam(part.FormName()) {
+			if _, err := io.Copy(out, part); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxGatewayField))
+		if err != nil {
+			return err
+		}
+		routes, rest := gatewayRoutes(gatewayPath(string(value)))
+		if !containsRoute(routes, route) {
+			return fmt.Errorf("%s is not served by %s", part.FormName(), route.Upstream)
+		}
+		if _, err := io.WriteString(out, rest); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func containsRoute(routes []GatewayRoute, route GatewayRoute) bool {
+	for _, r := range routes {
+		if r.Upstream == route.Upstream {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGatewayBody refuses paths below gateway routes in multipart bodies
+// routeGateway left unread: only paths in the query string are routed.
+func checkGatewayBody(values url.Values) error {
+	for name, vs := range values {
+		if !isGatewayParam(name) {
+			continue
+		}
+		for _, value := range vs {
+			if routes, _ := gatewayRoutes(gatewayPath(value)); len(routes) > 0 {
+				return fmt.Errorf("%s lies below a gateway route and must be passed in the query string", name)
+			}
+		}
+	}
+	return nil
+}
+
+func cloneValues(v url.Values) url.Values {
+	c := url.Values{}
+	for k, values := range v {
+		c[k] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// forwardRequest sends r to route and copies the response back. With
+// skipNotFound a 404 from the upstream is not copied and false is returned,
+// so the next upstream can be tried.
+func forwardRequest(w http.ResponseWriter, r *http.Request, route GatewayRoute, skipNotFound bool) bool {
+	out, err := gatewayRequest(r, route)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to forward request: %s", err.Error()), http.StatusInternalServerError)
+		return true
+	}
+	res, err := http.DefaultClient.Do(out)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"upstream": route.Upstream,
+			"serverId": serverId,
+		}).WithError(err).Warn("Gateway upstream unreachable")
+		http.Error(w, fmt.Sprintf("Upstream %s unreachable", route.Upstream), http.StatusBadGateway)
+		return true
+	}
+	defer res.Body.Close()
+	if skipNotFound && res.StatusCode == http.StatusNotFound {
+		return false
+	}
+
+	for k, values := range res.Header {
+		w.Header()[k] = values
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.Header().Set("X-Upstream", route.Upstream)
+	w.WriteHeader(res.StatusCode)
+	// Flush as data arrives so streamed responses stay streamed.
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return true
+			}
+			rc.Flush()
+		}
+		if err != nil {
+			return true
+		}
+	}
+}
+
+// listMerged lists the directory on every upstream of a prefix and merges
+// the results. Entries with the same name are shown once, from the first
+// route.
+func listMerged(w http.ResponseWriter, r *http.Request, routes []GatewayRoute) {
+	requestId := generateUUID()
+	if format := r.FormValue("format"); format != "" && format != "json" {
+		http.Error(w, "Only the json format can be merged across upstreams", http.StatusBadRequest)
+		return
+	}
+	opts, err := formListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seen := map[string]bool{}
+	merged := []map[string]interface{}{}
+	for _, route := range routes {
+		entries, err := listUpstream(r, route)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to list %s: %s", route.Upstream, err.Error()), http.StatusBadGateway)
+			return
+		}
+		for _, entry := range entries {
+			name, _ := entry["fileName"].(string)
+			if !seen[name] {
+				seen[name] = true
+				merged = append(merged, entry)
+			}
+		}
+	}
+	// Each upstream filtered and sorted its own listing.
+	if opts.sorted() {
+		opts.sort(merged)
+	}
+	writeJSON(w, "Files listed successfully", requestId, merged)
+}
+
+func listUpstream(r *http.Request, route GatewayRoute) ([]map[string]interface{}, error) {
+	out, err := gatewayRequest(r, route)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(out)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, errors.New(strings.TrimSpace(string(msg)))
+	}
+	var body struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Data, nil
+}
+
+// listGatewayDir lists a directory above route prefixes: its local entries,
+// if it exists locally, plus one entry per prefix component below it.
+func listGatewayDir(w http.ResponseWriter, r *http.Request, dirPath string, children []string) {
+	requestId := generateUUID()
+	if format := r.FormValue("format"); format != "" && format != "json" {
+		http.Error(w, "Only the json format is supported above gateway routes", http.StatusBadRequest)
+		return
+	}
+	opts, err := formListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seen := map[string]bool{}
+	entries := []map[string]interface{}{}
+	if resolved, err := resolvePath(r, dirPath); err == nil {
+		if files, err := os.ReadDir(resolved); err == nil {
+			for _, file := range files {
+				entry, err := fileListEntry(r, resolved, file.Name())
+				if err != nil {
+					continue
+				}
+				seen[file.Name()] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	for _, name := range children {
+		if !seen[name] {
+			entries = append(entries, map[string]interface{}{"fileName": name, "size": 0, "isDir": true})
+		}
+	}
+	entries = opts.filter(entries)
+	if opts.sorted() {
+		opts.sort(entries)
+	}
+	writeJSON(w, "Files listed successfully", requestId, entries)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// upstreamRequest is what a gateway upstream received.
+type upstreamRequest struct {
+	query   url.Values
+	form    url.Values
+	content string
+}
+
+// withUpstream configures a gateway route from prefix to a test server and
+// returns the requests it receives.
+func withUpstream(t *testing.T, prefix string) *[]upstreamRequest {
+	t.Helper()
+	var received []upstreamRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := upstreamRequest{query: r.URL.Query()}
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			if f, _, err := r.FormFile("fileContent"); err == nil {
+				content, _ := io.ReadAll(f)
+				got.content = string(content)
+			}
+		} else {
+			r.ParseForm()
+		}
+		got.form = r.PostForm
+		received = append(received, got)
+		w.Write([]byte("upstream"))
+	}))
+	t.Cleanup(server.Close)
+	withConfig(t, func(c *Config) {
+		c.Gateway = []GatewayRoute{{Prefix: prefix, Upstream: server.URL}}
+	})
+	return &received
+}
+
+func multipartBody(t *testing.T, fields url.Values, content string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, values := range fields {
+		for _, value := range values {
+			mw.WriteField(name, value)
+		}
+	}
+	part, _ := mw.CreateFormFile("fileContent", "f")
+	part.Write([]byte(content))
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func serveGateway(r *http.Request) (*httptest.ResponseRecorder, bool) {
+	local := false
+	w := httptest.NewRecorder()
+	routeGateway(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local = true
+	})).ServeHTTP(w, r)
+	return w, local
+}
+
+func TestGatewayStreamsMultipartBodies(t *testing.T) {
+	received := withUpstream(t, "/siteA")
+	withRoute(t, "/writeFile", opWrite)
+
+	body, contentType := multipartBody(t, url.Values{"filePath": {"siteA/dir/f"}}, "content")
+	r := httptest.NewRequest("POST", "/writeFile?filePath=siteA/dir/f", body)
+	r.Header.Set("Content-Type", contentType)
+	w, local := serveGateway(r)
+	if local || w.Code != http.StatusOK {
+		t.Fatalf("local %v, status %d: %s", local, w.Code, w.Body.String())
+	}
+	got := (*received)[0]
+	if got.query.Get("filePath") != "dir/f" || got.form.Get("filePath") != "dir/f" {
+		t.Errorf("forwarded query %v, form %v", got.query, got.form)
+	}
+	if got.content != "content" {
+		t.Errorf("forwarded content %q", got.content)
+	}
+}
+
+func TestGatewayReencodesParsedBodies(t *testing.T) {
+	received := withUpstream(t, "/siteA")
+	withRoute(t, "/copyFile", opWrite)
+
+	for _, tt := range []struct {
+		name string
+		body func() (io.Reader, string)
+	}{
+		{name: "multipart", body: func() (io.Reader, string) {
+			return multipartBody(t, url.Values{"sourcePath": {"siteA/a"}, "destPath": {"/siteA/b"}}, "content")
+		}},
+		{name: "urlencoded", body: func() (io.Reader, string) {
+			form := url.Values{"sourcePath": {"siteA/a"}, "destPath": {"/siteA/b"}}
+			return strings.NewReader(form.Encode()), "application/x-www-form-urlencoded"
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			*received = nil
+			body, contentType := tt.body()
+			r := httptest.NewRequest("POST", "/copyFile", body)
+			r.Header.Set("Content-Type", contentType)
+			// authorize parses the body before the request is routed.
+			r.ParseMultipartForm(32 << 20)
+			if w, local := serveGateway(r); local || w.Code != http.StatusOK {
+				t.Fatalf("local %v, status %d: %s", local, w.Code, w.Body.String())
+			}
+			got := (*received)[0]
+			if got.form.Get("sourcePath") != "a" || got.form.Get("destPath") != "b" {
+				t.Errorf("forwarded form %v", got.form)
+			}
+		})
+	}
+}
+
+func TestGatewayRoutesEveryPath(t *testing.T) {
+	received := withUpstream(t, "/siteA")
+	for _, pattern := range []string{"/copyFile", "/moveFile", "/concatFiles"} {
+		withRoute(t, pattern, opWrite)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		target    string
+		wantLocal bool
+		want      int
+		forwarded url.Values
+	}{
+		{name: "both local", target: "/copyFile?sourcePath=a&destPath=b", wantLocal: true, want: http.StatusOK},
+		{name: "both routed", target: "/moveFile?sourcePath=siteA/a&destPath=siteA/b", want: http.StatusOK, forwarded: url.Values{"sourcePath": {"a"}, "destPath": {"b"}}},
+		{name: "only the source routed", target: "/copyFile?sourcePath=siteA/a&destPath=b", want: http.StatusBadRequest},
+		{name: "only the destination routed", target: "/moveFile?sourcePath=a&destPath=siteA/b", want: http.StatusBadRequest},
+		{name: "every source rewritten", target: "/concatFiles?sourcePath=siteA/a&sourcePath=siteA/b&destPath=siteA/c", want: http.StatusOK, forwarded: url.Values{"sourcePath": {"a", "b"}, "destPath": {"c"}}},
+		{name: "one source local", target: "/concatFiles?sourcePath=siteA/a&sourcePath=b&destPath=siteA/c", want: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			*received = nil
+			w, local := serveGateway(httptest.NewRequest("POST", tt.target, nil))
+			if local != tt.wantLocal || w.Code != tt.want {
+				t.Fatalf("local %v, status %d, want %v, %d: %s", local, w.Code, tt.wantLocal, tt.want, w.Body.String())
+			}
+			if tt.forwarded == nil {
+				if len(*received) > 0 {
+					t.Fatal("request was forwarded")
+				}
+				return
+			}
+			got := (*received)[0].query
+			for name, want := range tt.forwarded {
+				if strings.Join(got[name], ",") != strings.Join(want, ",") {
+					t.Errorf("forwarded %s %v, want %v", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+// Streamed bodies handled locally may not name paths that would have been
+// routed had they been in the query string.
+func TestGatewayRefusesRoutedPathsInStreamedBodies(t *testing.T) {
+	withUpstream(t, "/siteA")
+	withRoute(t, "/writeFile", opWrite)
+
+	for _, tt := range []struct {
+		name     string
+		bodyPath string
+		want     int
+	}{
+		{name: "local path", bodyPath: "a/f", want: http.StatusOK},
+		{name: "routed path", bodyPath: "siteA/f", want: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, url.Values{"filePath": {tt.bodyPath}}, "content")
+			r := httptest.NewRequest("POST", "/writeFile", body)
+			r.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			routeGateway(authorizeBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
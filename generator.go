@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxGeneratedFiles bounds how many files one generateFiles request
+	// creates.
+	maxGeneratedFiles = 100000
+	// maxGeneratedSize bounds the size of each, including those drawn from
+	// a distribution.
+	maxGeneratedSize = 1 << 40
+)
+
+// generatedPattern is repeated to make up text content of generated files.
+const generatedPattern = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// patternReader endlessly repeats generatedPattern.
+type patternReader struct {
+	offset int
+}
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		c := copy(b[n:], generatedPattern[p.offset:])
+		n += c
+		p.offset = (p.offset + c) % len(generatedPattern)
+	}
+	return n, nil
+}
+
+// generatedContent returns an endless reader of the content kind names:
+// text repeats generatedPattern, random is incompressible pseudo-random
+// bytes for exercising compression and deduplication. Files are cut from it
+// with io.LimitReader, so generating them takes constant memory whatever
+// their size.
+func generatedContent(kind string) io.Reader {
+	if kind == "random" {
+		return rand.New(rand.NewSource(rand.Int63()))
+	}
+	return &patternReader{}
+}
+
+// formContentKind parses the optional content form value of generateFiles:
+// text, the default, or random.
+func formContentKind(r *http.Request) (string, error) {
+	switch kind := r.FormValue("content"); kind {
+	case "", "text":
+		return "text", nil
+	case "random":
+		return kind, nil
+	default:
+		return "", fmt.Errorf("Invalid content: %s", kind)
+	}
+}
+
+// generatedFile is one file of a generateFiles request: its name in the
+// directory and its size, the planned one until it is written and the
+// actual one afterwards.
+type generatedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// splitPlan is the original layout of generateFiles: sizeInMB split into
+// 10 MB files plus one last file for the remainder.
+func splitPlan(prefix string, sizeInMB int) []generatedFile {
+	var files []generatedFile
+	for i := 0; i < sizeInMB/10; i++ {
+		files = append(files, generatedFile{Name: fmt.Sprintf("%s_file_%d.txt", prefix, i+1), Size: 10 << 20})
+	}
+	if remainder := sizeInMB % 10; remainder > 0 {
+		files = append(files, generatedFile{Name: fmt.Sprintf("%s_file_last.txt", prefix), Size: int64(remainder) << 20})
+	}
+	return files
+}
+
+// sizedPlan is count files whose sizes follow distribution: fixed makes
+// every file fileSize bytes, uniform spreads them evenly between 0 and
+// twice fileSize and lognormal draws them from a log-normal distribution
+// with shape sigma, as real file sizes tend to be, both averaging fileSize.
+func sizedPlan(prefix string, count int, fileSize int64, distribution string, sigma float64) []generatedFile {
+	files := make([]generatedFile, count)
+	for i := range files {
+		size := fileSize
+		switch distribution {
+		case "uniform":
+			size = rand.Int63n(2*fileSize + 1)
+		case "lognormal":
+			mu := math.Log(float64(fileSize)) - sigma*sigma/2
+			size = int64(math.Round(math.Min(math.Exp(mu+sigma*rand.NormFloat64()), maxGeneratedSize)))
+		}
+		files[i] = generatedFile{Name: fmt.Sprintf("%s_file_%d.txt", prefix, i+1), Size: size}
+	}
+	return files
+}
+
+// byteUnits are the size suffixes formByteSize accepts, as powers of 1024
+// like the MB of sizeInMB.
+var byteUnits = map[string]int64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+}
+
+// formByteSize parses the optional size form value name, a number of bytes
+// with an optional unit such as 512, 64KB or 1.5GB, returning -1 when it is
+// missing.
+func formByteSize(r *http.Request, name string) (int64, error) {
+	value := strings.TrimSpace(r.FormValue(name))
+	if value == "" {
+		return -1, nil
+	}
+	number := strings.TrimRight(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ ")
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(value[len(number):]))]
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || n < 0 || math.IsInf(n*float64(unit), 0) || n*float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("Invalid %s value: %s", name, value)
+	}
+	return int64(math.Round(n * float64(unit))), nil
+}
+
+// formGeneratePlan returns the files a generateFiles request asks for,
+// named after prefix: count files of fileSize bytes, distributed as
+// distribution says, or else sizeInMB split into 10 MB files.
+func formGeneratePlan(r *http.Request, prefix string) ([]generatedFile, error) {
+	fileSize, err := formByteSize(r, "fileSize")
+	if err != nil {
+		return nil, err
+	}
+	if r.FormValue("count") == "" && fileSize < 0 {
+		sizeInMB, err := strconv.Atoi(r.FormValue("sizeInMB"))
+		if err != nil || sizeInMB < 0 {
+			return nil, errors.New("Invalid size value")
+		}
+		return splitPlan(prefix, sizeInMB), nil
+	}
+	if r.FormValue("sizeInMB") != "" {
+		return nil, errors.New("sizeInMB can't be combined with count and fileSize")
+	}
+	count, err := formPositiveInt(r, "count")
+	if err != nil {
+		return nil, err
+	}
+	if count > maxGeneratedFiles {
+		return nil, fmt.Errorf("Invalid count value: at most %d files can be generated at once", maxGeneratedFiles)
+	}
+	if fileSize < 0 {
+		return nil, errors.New("fileSize is required with count")
+	}
+	if fileSize > maxGeneratedSize/2 {
+		return nil, fmt.Errorf("Invalid fileSize value: at most %d bytes", int64(maxGeneratedSize/2))
+	}
+	distribution := r.FormValue("distribution")
+	sigma := 1.0
+	switch distribution {
+	case "":
+		distribution = "fixed"
+	case "fixed", "uniform":
+	case "lognormal":
+		if s := r.FormValue("sigma"); s != "" {
+			if sigma, err = strconv.ParseFloat(s, 64); err != nil || sigma <= 0 || sigma > 10 {
+				return nil, fmt.Errorf("Invalid sigma value: %s", s)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Invalid distribution: %s", distribution)
+	}
+	if distribution != "fixed" && fileSize == 0 {
+		return nil, errors.New("fileSize must be positive with a distribution")
+	}
+	return sizedPlan(prefix, count, fileSize, distribution, sigma), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// matchGlob reports whether the slash-separated name matches pattern. Besides
+// the path.Match syntax, a "**" segment matches any number of segments,
+// including none, so "logs/**/*.gz" matches both "logs/a.gz" and
+// "logs/2024/01/a.gz".
+func matchGlob(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return true, nil
+			}
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchSegments(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
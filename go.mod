@@ -3,7 +3,12 @@ module github.com/chathurangakcd/file-reader-writer
 go 1.21.1
 
 require (
-	github.com/google/uuid v1.3.1 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	github.com/google/uuid v1.3.1
+	github.com/hanwen/go-fuse/v2 v2.5.1
+	github.com/klauspost/compress v1.17.11
+	github.com/sirupsen/logrus v1.9.3
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/sys v0.5.0
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
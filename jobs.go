@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxFinishedJobs is the number of finished jobs kept for inspection.
+	maxFinishedJobs = 100
+	// maxJobLogLines caps the log kept per job.
+	maxJobLogLines = 1000
+	// maintenancePollInterval is how often a paused job checks whether
+	// maintenance mode is over.
+	maintenancePollInterval = time.Second
+)
+
+// job is a background operation that can be inspected and cancelled through
+// /admin/jobs.
+type job struct {
+	id          string
+	kind        string
+	description string
+	started     time.Time
+	cancel      context.CancelFunc
+	done        chan struct{}
+	// writing is whether the job counts as a write in progress for
+	// maintenance mode. Only the job's own goroutine uses it.
+	writing bool
+
+	mu       sync.Mutex
+	status   string // running, paused, completed, failed or cancelled
+	finished time.Time
+	progress int64
+	total    int64
+	err      string
+	logs     []string
+}
+
+var jobs = struct {
+	sync.Mutex
+	byId map[string]*job
+}{byId: map[string]*job{}}
+
+// startJob runs fn in the background as a new job. fn should stop when ctx is
+// cancelled and report progress through the job it is given. Jobs write to
+// the storage, so a job counts as a write in progress for maintenance mode
+// and doesn't start while it is enabled; fn should call pauseForMaintenance
+// between units of work so it stops writing once maintenance mode is enabled.
+func startJob(kind string, description string, fn func(ctx context.Context, j *job) error) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:          generateUUID(),
+		kind:        kind,
+		description: description,
+		started:     time.Now(),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		status:      "running",
+	}
+
+	jobs.Lock()
+	jobs.byId[j.id] = j
+	jobs.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"jobId":       j.id,
+		"kind":        kind,
+		"description": description,
+		"serverId":    serverId,
+	}).Info("Starting job")
+
+	go func() {
+		defer close(j.done)
+		defer cancel()
+		err := j.pauseForMaintenance(ctx)
+		if err == nil {
+			err = fn(ctx, j)
+		}
+		if j.writing {
+			endWrite()
+		}
+
+		j.mu.Lock()
+		j.finished = time.Now()
+		switch {
+		case err == nil:
+			j.status = "completed"
+		case ctx.Err() != nil:
+			j.status = "cancelled"
+			j.err = err.Error()
+		default:
+			j.status = "failed"
+			j.err = err.Error()
+		}
+		status := j.status
+		j.mu.Unlock()
+
+		logrus.WithFields(logrus.Fields{
+			"jobId":    j.id,
+			"kind":     kind,
+			"status":   status,
+			"serverId": serverId,
+		}).Info("Job finished")
+		pruneJobs()
+	}()
+	return j
+}
+
+// pauseForMaintenance waits, no longer counting the job as a write in
+// progress, while maintenance mode is enabled. It returns ctx's error if the
+// job is cancelled meanwhile.
+func (j *job) pauseForMaintenance(ctx context.Context) error {
+	if j.writing {
+		if !inMaintenance() {
+			return nil
+		}
+		endWrite()
+		j.writing = false
+	}
+	paused := false
+	for !beginWrite() {
+		if !paused {
+			paused = true
+			j.setStatus("paused")
+			j.logf("Paused for maintenance mode")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(maintenancePollInterval):
+		}
+	}
+	j.writing = true
+	if paused {
+		j.setStatus("running")
+		j.logf("Resumed after maintenance mode")
+	}
+	return nil
+}
+
+func (j *job) setStatus(status string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+}
+
+// setProgress records that done out of total units of work are finished.
+func (j *job) setProgress(done, total int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress = done
+	j.total = total
+}
+
+// logf appends a line to the job log.
+func (j *job) logf(format string, args ...interface{}) {
+	line := time.Now().Format(time.RFC3339) + " " + fmt.Sprintf(format, args...)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.logs = append(j.logs, line)
+	if len(j.logs) > maxJobLogLines {
+		j.logs = j.logs[len(j.logs)-maxJobLogLines:]
+	}
+}
+
+func (j *job) summary(withLogs bool) map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	res := map[string]interface{}{
+		"jobId":       j.id,
+		"kind":        j.kind,
+		"description": j.description,
+		"status":      j.status,
+		"started":     j.started,
+		"progress":    j.progress,
+		"total":       j.total,
+	}
+	if !j.finished.IsZero() {
+		res["finished"] = j.finished
+	}
+	if j.err != "" {
+		res["error"] = j.err
+	}
+	if withLogs {
+		res["logs"] = append([]string{}, j.logs...)
+	}
+	return res
+}
+
+// pruneJobs drops the oldest finished jobs beyond maxFinishedJobs.
+func pruneJobs() {
+	jobs.Lock()
+	defer jobs.Unlock()
+	var finished []*job
+	for _, j := range jobs.byId {
+		select {
+		case <-j.done:
+			finished = append(finished, j)
+		default:
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool {
+		return finished[a].started.Before(finished[b].started)
+	})
+	for _, j := range finished[:len(finished)-maxFinishedJobs] {
+		delete(jobs.byId, j.id)
+	}
+}
+
+func findJob(id string) *job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	return jobs.byId[id]
+}
+
+// listJobs returns every known job, or a single job including its log when
+// jobId is given.
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if jobId := r.FormValue("jobId"); jobId != "" {
+		j := findJob(jobId)
+		if j == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, "Job retrieved successfully", requestId, j.summary(true))
+		return
+	}
+
+	status := r.FormValue("status")
+	jobs.Lock()
+	all := make([]*job, 0, len(jobs.byId))
+	for _, j := range jobs.byId {
+		all = append(all, j)
+	}
+	jobs.Unlock()
+	sort.Slice(all, func(a, b int) bool {
+		return all[a].started.Before(all[b].started)
+	})
+
+	list := []map[string]interface{}{}
+	for _, j := range all {
+		summary := j.summary(false)
+		if status != "" && summary["status"] != status {
+			continue
+		}
+		list = append(list, summary)
+	}
+	writeJSON(w, "Jobs listed successfully", requestId, list)
+}
+
+// cancelJob asks a running job to stop.
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobId := r.FormValue("jobId")
+	logrus.WithFields(logrus.Fields{
+		"jobId":     jobId,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Cancelling job")
+
+	j := findJob(jobId)
+	if j == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	select {
+	case <-j.done:
+		http.Error(w, "Job already finished", http.StatusConflict)
+		return
+	default:
+	}
+	j.logf("Cancelled by request %s", requestId)
+	j.cancel()
+	writeJSON(w, "Job cancelled successfully", requestId, j.summary(false))
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxJournalEntries is the number of operations kept in memory.
+const maxJournalEntries = 10000
+
+// journalEntry records one operation that changed a file.
+type journalEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"requestId"`
+	Actor     string    `json:"actor"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path"`
+	// Existed tells whether there was a file at Path before the operation.
+	Existed bool `json:"existed"`
+	// Backup holds the previous content of Path in the trash directory, if
+	// it was saved and hasn't expired yet. Clients aren't shown it.
+	Backup string `json:"backup,omitempty"`
+	// From is where the file at Path was moved from: undo moves it back.
+	From string `json:"from,omitempty"`
+	// Size is the size Path had when it was written in place, by an
+	// append or at an offset: undo puts back the bytes saved in Backup,
+	// which were at Offset, and cuts the file back to Size.
+	Size   *int64 `json:"size,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Undone bool   `json:"undone,omitempty"`
+}
+
+var journal struct {
+	sync.Mutex
+	entries []*journalEntry
+	seq     int64
+	file    *os.File
+	// lines is the number of records in the journal file, which grows by
+	// one whenever an entry is recorded or changes.
+	lines int
+}
+
+// loadJournal reads back the operations recorded in config.JournalFile by
+// earlier runs, so history and undo survive a restart. A record torn by a
+// crash while it was appended is dropped. Saved versions no entry refers to
+// any more are removed from the trash directory.
+func loadJournal() error {
+	journal.Lock()
+	defer journal.Unlock()
+	if err := readJournal(); err != nil {
+		return err
+	}
+	trimJournal()
+	sweepTrash()
+	if journal.lines > len(journal.entries) {
+		return compactJournal()
+	}
+	return nil
+}
+
+// readJournal reads config.JournalFile into journal. The journal lock must
+// be held.
+func readJournal() error {
+	if config.JournalFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(config.JournalFile, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	byseq := map[int64]*journalEntry{}
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// Records are written whole with their newline, so this
+				// one was cut short.
+				logrus.WithField("journalFile", config.JournalFile).Warn("Dropping torn last record of operation journal")
+				if err := f.Truncate(offset); err != nil {
+					return fmt.Errorf("%s: %w", config.JournalFile, err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", config.JournalFile, err)
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("%s: record at offset %d: %w", config.JournalFile, offset, err)
+		}
+		offset += int64(len(line))
+		journal.lines++
+		// An entry is written again whenever it changes, the last copy wins.
+		if existing, ok := byseq[entry.Seq]; ok {
+			*existing = entry
+			continue
+		}
+		byseq[entry.Seq] = &entry
+		journal.entries = append(journal.entries, &entry)
+		if entry.Seq > journal.seq {
+			journal.seq = entry.Seq
+		}
+	}
+}
+
+// persistJournalEntry appends entry to the journal file. The journal lock
+// must be held.
+func persistJournalEntry(entry *journalEntry) {
+	if config.JournalFile == "" {
+		return
+	}
+	if journal.file == nil {
+		f, err := os.OpenFile(config.JournalFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logrus.WithError(err).Error("Unable to open operation journal")
+			return
+		}
+		journal.file = f
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := journal.file.Write(append(line, '\n')); err != nil {
+		logrus.WithError(err).Error("Unable to write operation journal")
+		return
+	}
+	journal.lines++
+	// Most records are superseded copies of an entry or entries trimmed
+	// from memory: the file is rewritten with only the live ones.
+	if journal.lines > 2*maxJournalEntries {
+		if err := compactJournal(); err != nil {
+			logrus.WithError(err).Error("Unable to compact operation journal")
+		}
+	}
+}
+
+// compactJournal rewrites the journal file with one record per entry kept in
+// memory. The journal lock must be held.
+func compactJournal() error {
+	if config.JournalFile == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(config.JournalFile), "."+filepath.Base(config.JournalFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, entry := range journal.entries {
+		line, _ := json.Marshal(entry)
+		w.Write(append(line, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), config.JournalFile)
+	}
+	if err != nil {
+		return err
+	}
+	// Later records go to the new file.
+	if journal.file != nil {
+		journal.file.Close()
+		journal.file = nil
+	}
+	journal.lines = len(journal.entries)
+	return nil
+}
+
+// recordOperation adds an operation to the journal.
+func recordOperation(actor string, requestId string, operation string, filePath string, existed bool, backup string) {
+	addJournalEntry(&journalEntry{
+		RequestId: requestId,
+		Actor:     actor,
+		Operation: operation,
+		Path:      filePath,
+		Existed:   existed,
+		Backup:    backup,
+	})
+}
+
+// recordMove adds the move of sourcePath to destPath to the journal.
+// existed and backup are about the file destPath replaced.
+func recordMove(actor string, requestId string, sourcePath string, destPath string, existed bool, backup string) {
+	addJournalEntry(&journalEntry{
+		RequestId: requestId,
+		Actor:     actor,
+		Operation: "move",
+		Path:      destPath,
+		From:      sourcePath,
+		Existed:   existed,
+		Backup:    backup,
+	})
+}
+
+// recordInPlace adds an operation that wrote to the existing file filePath
+// in place, which was size bytes long, to the journal. backup holds the
+// bytes it overwrote from offset, if any.
+func recordInPlace(actor string, requestId string, operation string, filePath string, size int64, offset int64, backup string) {
+	addJournalEntry(&journalEntry{
+		RequestId: requestId,
+		Actor:     actor,
+		Operation: operation,
+		Path:      filePath,
+		Existed:   true,
+		Backup:    backup,
+		Size:      &size,
+		Offset:    offset,
+	})
+}
+
+func addJournalEntry(entry *journalEntry) {
+	journal.Lock()
+	defer journal.Unlock()
+	journal.seq++
+	entry.Seq = journal.seq
+	entry.Time = time.Now()
+	journal.entries = append(journal.entries, entry)
+	persistJournalEntry(entry)
+	trimJournal()
+	expireBackups()
+}
+
+// trimJournal drops the oldest entries beyond maxJournalEntries. They can't
+// be undone any more, so their saved versions go with them. The journal lock
+// must be held.
+func trimJournal() {
+	excess := len(journal.entries) - maxJournalEntries
+	if excess <= 0 {
+		return
+	}
+	for _, entry := range journal.entries[:excess] {
+		removeBackup(entry)
+	}
+	journal.entries = append([]*journalEntry(nil), journal.entries[excess:]...)
+}
+
+// expireBackups removes saved versions that are too old to be restored by
+// /undo. The journal lock must be held.
+func expireBackups() {
+	cutoff := time.Now().Add(-time.Duration(config.UndoWindow))
+	for _, entry := range journal.entries {
+		if !entry.Time.Before(cutoff) {
+			break
+		}
+		if entry.Backup != "" && removeBackup(entry) {
+			persistJournalEntry(entry)
+		}
+	}
+}
+
+// removeBackup removes the saved version of entry, if any, and reports
+// whether it did.
+func removeBackup(entry *journalEntry) bool {
+	if entry.Backup == "" {
+		return false
+	}
+	if err := os.Remove(entry.Backup); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logrus.WithError(err).Warn("Unable to remove expired backup")
+		return false
+	}
+	entry.Backup = ""
+	return true
+}
+
+// sweepTrash removes the files of the trash directory no journal entry
+// refers to, left behind by entries dropped from the journal or by an
+// operation cut short. They can't be restored by /undo. The journal lock
+// must be held and no operation may be under way.
+func sweepTrash() {
+	if config.TrashDir == "" {
+		return
+	}
+	files, err := os.ReadDir(config.TrashDir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logrus.WithError(err).Warn("Unable to read trash directory")
+		}
+		return
+	}
+	referenced := map[string]bool{}
+	for _, entry := range journal.entries {
+		if entry.Backup != "" {
+			referenced[entry.Backup] = true
+		}
+	}
+	for _, file := range files {
+		backup := filepath.Join(config.TrashDir, file.Name())
+		if file.IsDir() || referenced[backup] {
+			continue
+		}
+		if err := os.Remove(backup); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logrus.WithError(err).Warn("Unable to remove unreferenced backup")
+		}
+	}
+}
+
+// requestActor identifies who sent r: the API key or token subject it
+// authenticated with, the common name of its client certificate, or else its
+// address.
+func requestActor(r *http.Request) string {
+	if p := requestPrincipal(r); p != nil {
+		return p.Name
+	}
+	if name := clientCertName(r); name != "" {
+		return name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trashPath returns a new, unique location in the trash directory for a
+// saved version of filePath.
+func trashPath(filePath string) string {
+	return filepath.Join(config.TrashDir, generateUUID()+"_"+filepath.Base(filePath))
+}
+
+// backupFile copies the current content of filePath into the trash directory
+// before it is overwritten. It returns whether the file existed and where
+// the copy was saved, which is "" when there was nothing to save or no trash
+// directory is configured.
+func backupFile(filePath string) (existed bool, backup string, err error) {
+	info, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	if config.TrashDir == "" || !info.Mode().IsRegular() {
+		return true, "", nil
+	}
+	if err := os.MkdirAll(config.TrashDir, 0755); err != nil {
+		return true, "", err
+	}
+	backup = trashPath(filePath)
+	if err := copyRegularFile(filePath, backup); err != nil {
+		return true, "", err
+	}
+	return true, backup, nil
+}
+
+// createBackup creates a new file in the trash directory to save part of
+// the content of filePath in.
+func createBackup(filePath string) (*os.File, error) {
+	if err := os.MkdirAll(config.TrashDir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(trashPath(filePath), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// discardBackup removes a saved version that is no longer needed because the
+// operation it was taken for failed.
+func discardBackup(backup string) {
+	if backup != "" {
+		os.Remove(backup)
+	}
+}
+
+// trashFile deletes filePath. With a trash directory configured the file is
+// moved there instead so the deletion can be undone, and its new location
+// is returned.
+func trashFile(filePath string) (backup string, err error) {
+	if config.TrashDir == "" {
+		return "", os.Remove(filePath)
+	}
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		// os.Remove only deletes empty directories, there is nothing to keep.
+		return "", os.Remove(filePath)
+	}
+	if err := os.MkdirAll(config.TrashDir, 0755); err != nil {
+		return "", err
+	}
+	backup = trashPath(filePath)
+	return backup, movePath(filePath, backup)
+}
+
+var errNothingToUndo = errors.New("nothing to undo")
+
+// undoLatest reverts the most recent operation on filePath that hasn't been
+// undone yet and is still inside the undo window. A move is found by either
+// of its paths.
+func undoLatest(r *http.Request, requestId string, filePath string) (*journalEntry, error) {
+	// The files the operation changed are locked like for any write, and
+	// before the journal as writes take it. Which they are is only known
+	// from the entry, so it is looked up again once they are locked in case
+	// another operation came first.
+	for {
+		journal.Lock()
+		entry := latestEntry(filePath)
+		journal.Unlock()
+		if entry == nil {
+			return nil, errNothingToUndo
+		}
+		paths := []string{entry.Path}
+		if entry.From != "" {
+			paths = append(paths, entry.From)
+		}
+		unlock := lockWrites(paths...)
+		journal.Lock()
+		if latestEntry(filePath) != entry {
+			journal.Unlock()
+			unlock()
+			continue
+		}
+		undone, err := undoEntry(r, requestId, filePath, entry)
+		journal.Unlock()
+		unlock()
+		return undone, err
+	}
+}
+
+// latestEntry returns the most recent operation on filePath that hasn't been
+// undone yet, or nil. The journal lock must be held.
+func latestEntry(filePath string) *journalEntry {
+	for i := len(journal.entries) - 1; i >= 0; i-- {
+		if e := journal.entries[i]; (e.Path == filePath || e.From == filePath) && !e.Undone && e.Operation != "undo" {
+			return e
+		}
+	}
+	return nil
+}
+
+// undoEntry reverts the operation of entry, asked for on filePath. The
+// journal lock and write locks of the files it changed must be held.
+func undoEntry(r *http.Request, requestId string, filePath string, entry *journalEntry) (*journalEntry, error) {
+	if time.Since(entry.Time) > time.Duration(config.UndoWindow) {
+		return nil, errNothingToUndo
+	}
+	if entry.Existed && entry.Backup == "" && entry.Size == nil {
+		return nil, fmt.Errorf("%w: no saved version of %s", errNothingToUndo, entry.Path)
+	}
+
+	switch {
+	case entry.From != "":
+		// A moved file goes back, then what it replaced is restored.
+		if _, err := os.Lstat(entry.From); err == nil {
+			return nil, fmt.Errorf("%w: %s exists again", errNothingToUndo, entry.From)
+		}
+		if err := ensureParentDir(entry.From); err != nil {
+			return nil, err
+		}
+		if err := movePath(entry.Path, entry.From); err != nil {
+			return nil, err
+		}
+		if entry.Existed {
+			if err := movePath(entry.Backup, entry.Path); err != nil {
+				return nil, err
+			}
+		}
+	case entry.Size != nil:
+		if err := restoreInPlace(entry.Path, entry); err != nil {
+			return nil, err
+		}
+	case entry.Existed:
+		if err := ensureParentDir(entry.Path); err != nil {
+			return nil, err
+		}
+		if err := movePath(entry.Backup, entry.Path); err != nil {
+			return nil, err
+		}
+	default:
+		if err := os.Remove(entry.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	entry.Undone = true
+	entry.Backup = ""
+	persistJournalEntry(entry)
+
+	journal.seq++
+	undo := &journalEntry{
+		Seq:       journal.seq,
+		Time:      time.Now(),
+		RequestId: requestId,
+		Actor:     requestActor(r),
+		Operation: "undo",
+		Path:      filePath,
+		Existed:   true,
+	}
+	journal.entries = append(journal.entries, undo)
+	persistJournalEntry(undo)
+	trimJournal()
+
+	undone := *entry
+	return &undone, nil
+}
+
+// restoreInPlace undoes a write made to filePath in place: the bytes saved
+// in entry.Backup go back where they were and the file is cut back to its
+// previous size.
+func restoreInPlace(filePath string, entry *journalEntry) error {
+	f, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if entry.Backup != "" {
+		saved, err := os.Open(entry.Backup)
+		if err != nil {
+			return err
+		}
+		defer saved.Close()
+		if _, err := io.Copy(io.NewOffsetWriter(f, entry.Offset), saved); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(*entry.Size); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	discardBackup(entry.Backup)
+	return nil
+}
+
+// undo reverts the most recent operation on filePath: a deleted file is
+// restored, an overwritten one rolled back and a newly created one removed.
+func undo(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Undoing last operation")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	entry, err := undoLatest(r, requestId, filePath)
+	if err != nil {
+		if errors.Is(err, errNothingToUndo) {
+			http.Error(w, fmt.Sprintf("Unable to undo: %s", err.Error()), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to undo: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "Operation undone successfully", requestId, map[string]interface{}{
+		"undone": clientEntry(r, *entry),
+	})
+}
+
+// clientEntry returns entry as the client of r is shown it: its paths as the
+// client sees them, without where the previous version is saved.
+func clientEntry(r *http.Request, entry journalEntry) journalEntry {
+	entry.Path = clientPath(r, entry.Path)
+	if entry.From != "" {
+		entry.From = clientPath(r, entry.From)
+	}
+	entry.Backup = ""
+	return entry
+}
+
+// history lists the recorded operations on filePath, oldest first.
+func history(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Listing file history")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	entries := []journalEntry{}
+	journal.Lock()
+	for _, entry := range journal.entries {
+		if entry.Path == filePath || entry.From == filePath {
+			entries = append(entries, clientEntry(r, *entry))
+		}
+	}
+	journal.Unlock()
+
+	writeJSON(w, "File history listed successfully", requestId, entries)
+}
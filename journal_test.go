@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withJournal gives the test an empty journal persisted to a new file, and
+// a trash directory.
+func withJournal(t *testing.T) (journalFile string, trashDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	journalFile = filepath.Join(dir, "journal.ndjson")
+	trashDir = filepath.Join(dir, "trash")
+	withConfig(t, func(c *Config) {
+		c.JournalFile = journalFile
+		c.TrashDir = trashDir
+		c.UndoWindow = Duration(time.Hour)
+	})
+	resetJournal := func() {
+		journal.Lock()
+		if journal.file != nil {
+			journal.file.Close()
+		}
+		journal.entries, journal.seq, journal.file, journal.lines = nil, 0, nil, 0
+		journal.Unlock()
+	}
+	resetJournal()
+	t.Cleanup(resetJournal)
+	return journalFile, trashDir
+}
+
+// journalLines encodes entries as journal records.
+func journalLines(t *testing.T, entries ...journalEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return buf.Bytes()
+}
+
+func TestLoadJournalTornRecord(t *testing.T) {
+	journalFile, _ := withJournal(t)
+	now := time.Now()
+	complete := journalLines(t,
+		journalEntry{Seq: 1, Time: now, Operation: "write", Path: "/a"},
+		journalEntry{Seq: 2, Time: now, Operation: "write", Path: "/b"},
+	)
+	torn := journalLines(t, journalEntry{Seq: 3, Time: now, Operation: "delete", Path: "/c"})
+	for _, cut := range []int{1, len(torn) / 2, len(torn) - 1} {
+		journal.entries, journal.seq, journal.lines = nil, 0, 0
+		if err := os.WriteFile(journalFile, append(bytes.Clone(complete), torn[:cut]...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadJournal(); err != nil {
+			t.Fatalf("cut at %d: loadJournal = %v", cut, err)
+		}
+		if len(journal.entries) != 2 || journal.seq != 2 {
+			t.Errorf("cut at %d: loaded %d entries up to %d, want 2", cut, len(journal.entries), journal.seq)
+		}
+		if data, _ := os.ReadFile(journalFile); !bytes.Equal(data, complete) {
+			t.Errorf("cut at %d: torn record left in the journal file", cut)
+		}
+	}
+}
+
+func TestLoadJournalCorruptRecord(t *testing.T) {
+	journalFile, _ := withJournal(t)
+	data := append([]byte("{not json}\n"), journalLines(t, journalEntry{Seq: 1, Operation: "write", Path: "/a"})...)
+	if err := os.WriteFile(journalFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadJournal(); err == nil {
+		t.Fatal("loadJournal accepted a corrupt record before the last one")
+	}
+}
+
+func TestLoadJournalCompacts(t *testing.T) {
+	journalFile, _ := withJournal(t)
+	now := time.Now()
+	data := journalLines(t,
+		journalEntry{Seq: 1, Time: now, Operation: "write", Path: "/a"},
+		journalEntry{Seq: 2, Time: now, Operation: "write", Path: "/b"},
+		journalEntry{Seq: 1, Time: now, Operation: "write", Path: "/a", Undone: true},
+	)
+	if err := os.WriteFile(journalFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	want := journalLines(t,
+		journalEntry{Seq: 1, Time: now, Operation: "write", Path: "/a", Undone: true},
+		journalEntry{Seq: 2, Time: now, Operation: "write", Path: "/b"},
+	)
+	if got, _ := os.ReadFile(journalFile); !bytes.Equal(got, want) {
+		t.Errorf("journal file after loading:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Records appended afterwards go to the compacted file.
+	recordOperation("test", "r", "write", "/c", false, "")
+	if journal.lines != 3 {
+		t.Errorf("journal file has %d records, want 3", journal.lines)
+	}
+}
+
+func TestTrimJournalRemovesBackups(t *testing.T) {
+	_, trashDir := withJournal(t)
+	withConfig(t, func(c *Config) { c.JournalFile = "" })
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldest := filepath.Join(trashDir, "oldest")
+	kept := filepath.Join(trashDir, "kept")
+	for _, backup := range []string{oldest, kept} {
+		if err := os.WriteFile(backup, []byte("saved"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	journal.entries = append(journal.entries, &journalEntry{Seq: 1, Time: now, Path: "/a", Existed: true, Backup: oldest})
+	for i := 2; i < maxJournalEntries; i++ {
+		journal.entries = append(journal.entries, &journalEntry{Seq: int64(i), Time: now, Path: "/b"})
+	}
+	journal.seq = maxJournalEntries - 1
+	recordOperation("test", "r", "write", "/c", true, kept)
+	if _, err := os.Stat(oldest); err != nil {
+		t.Fatalf("backup removed before its entry was trimmed: %v", err)
+	}
+	recordOperation("test", "r", "write", "/d", false, "")
+
+	if len(journal.entries) != maxJournalEntries {
+		t.Errorf("journal holds %d entries, want %d", len(journal.entries), maxJournalEntries)
+	}
+	if _, err := os.Stat(oldest); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("backup of a trimmed entry left in the trash: %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("backup of a kept entry removed: %v", err)
+	}
+}
+
+func TestSweepTrash(t *testing.T) {
+	journalFile, trashDir := withJournal(t)
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	referenced := filepath.Join(trashDir, "referenced")
+	leaked := filepath.Join(trashDir, "leaked")
+	for _, backup := range []string{referenced, leaked} {
+		if err := os.WriteFile(backup, []byte("saved"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := journalLines(t, journalEntry{Seq: 1, Time: time.Now(), Operation: "delete", Path: "/a", Existed: true, Backup: referenced})
+	if err := os.WriteFile(journalFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(referenced); err != nil {
+		t.Errorf("referenced backup removed: %v", err)
+	}
+	if _, err := os.Stat(leaked); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unreferenced backup left in the trash: %v", err)
+	}
+}
+
+func TestUndoWaitsForWrites(t *testing.T) {
+	withJournal(t)
+	root := testRoot(t)
+	filePath := filepath.Join(root, "f.txt")
+	if err := os.WriteFile(filePath, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recordOperation("test", "r", "write", filePath, false, "")
+
+	unlock := lockWrites(filePath)
+	done := make(chan error)
+	go func() {
+		_, err := undoLatest(httptest.NewRequest("POST", "/undo", nil), "u", filePath)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("undo didn't wait for the write in progress: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("undo left the created file: %v", err)
+	}
+}
+
+func TestUndoShowsClientPaths(t *testing.T) {
+	_, trashDir := withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	os.MkdirAll(trashDir, 0755)
+	sourcePath, destPath := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	backup := filepath.Join(trashDir, "b.txt.1")
+	os.WriteFile(destPath, []byte("moved"), 0644)
+	os.WriteFile(backup, []byte("replaced"), 0644)
+	recordMove("test", "r", sourcePath, destPath, true, backup)
+
+	w := postForm(undo, "/undo", url.Values{"filePath": {"b.txt"}})
+	var res struct {
+		Data struct {
+			Undone map[string]interface{} `json:"undone"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body.String(), err)
+	}
+	sep := string(filepath.Separator)
+	if got := res.Data.Undone; got["path"] != sep+"b.txt" || got["from"] != sep+"a.txt" {
+		t.Errorf("got %v, want the paths relative to the root", got)
+	}
+	if _, ok := res.Data.Undone["backup"]; ok || strings.Contains(w.Body.String(), root) || strings.Contains(w.Body.String(), trashDir) {
+		t.Errorf("server paths shown: %s", w.Body.String())
+	}
+}
+
+func TestHistoryShowsClientPaths(t *testing.T) {
+	_, trashDir := withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	sourcePath, destPath := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	recordMove("test", "r", sourcePath, destPath, true, filepath.Join(trashDir, "b.txt.1"))
+
+	w := httptest.NewRecorder()
+	history(w, httptest.NewRequest("GET", "/history?filePath=b.txt", nil))
+	var res struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body.String(), err)
+	}
+	sep := string(filepath.Separator)
+	if len(res.Data) != 1 || res.Data[0]["path"] != sep+"b.txt" || res.Data[0]["from"] != sep+"a.txt" {
+		t.Fatalf("got %v, want the paths relative to the root", res.Data)
+	}
+	if _, ok := res.Data[0]["backup"]; ok || strings.Contains(w.Body.String(), root) || strings.Contains(w.Body.String(), trashDir) {
+		t.Errorf("server paths shown: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a JSON Schema that documents are validated against. It
+// supports the keywords that constrain structure and values: type, enum,
+// const, properties, required, additionalProperties, patternProperties,
+// items, prefixItems, the size and range bounds, multipleOf, pattern,
+// allOf, anyOf, oneOf, not and $ref to definitions in the same schema.
+// Other keywords, like format, are ignored.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// loadJSONSchema reads the JSON Schema in the file at path, checking that
+// its patterns compile and its references resolve.
+func loadJSONSchema(path string) (*jsonSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	s := &jsonSchema{root: root, patterns: map[string]*regexp.Regexp{}}
+	if err := s.prepare(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// prepare compiles the patterns below schema and resolves its references.
+func (s *jsonSchema) prepare(schema interface{}) error {
+	switch v := schema.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if err := s.prepare(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if pattern, ok := v["pattern"].(string); ok {
+			if err := s.compile(pattern); err != nil {
+				return err
+			}
+		}
+		if props, ok := v["patternProperties"].(map[string]interface{}); ok {
+			for pattern := range props {
+				if err := s.compile(pattern); err != nil {
+					return err
+				}
+			}
+		}
+		if ref, ok := v["$ref"].(string); ok {
+			if _, err := s.resolve(ref); err != nil {
+				return err
+			}
+		}
+		for _, value := range v {
+			if err := s.prepare(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) compile(pattern string) error {
+	if _, ok := s.patterns[pattern]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", pattern, err.Error())
+	}
+	s.patterns[pattern] = re
+	return nil
+}
+
+// resolve returns the part of the schema ref points to, which must be a
+// JSON pointer within it, like #/$defs/name.
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q: only references within the schema are", ref)
+	}
+	target := s.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch v := target.(type) {
+		case map[string]interface{}:
+			next, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("unresolvable $ref %q", ref)
+			}
+			target = next
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("unresolvable $ref %q", ref)
+			}
+			target = v[i]
+		default:
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return target, nil
+}
+
+// validate returns an error saying where and how doc, as decoded from JSON
+// into interface{}, first fails to match the schema, or nil.
+func (s *jsonSchema) validate(doc interface{}) error {
+	return s.check(s.root, doc, "")
+}
+
+// check validates value, found at the JSON pointer at, against schema.
+func (s *jsonSchema) check(schema interface{}, value interface{}, at string) error {
+	fail := func(format string, args ...interface{}) error {
+		where := at
+		if where == "" {
+			where = "/"
+		}
+		return fmt.Errorf("at %s: %s", where, fmt.Sprintf(format, args...))
+	}
+	switch v := schema.(type) {
+	case bool:
+		if !v {
+			return fail("no value is allowed here")
+		}
+		return nil
+	case map[string]interface{}:
+	default:
+		return nil
+	}
+	sch := schema.(map[string]interface{})
+
+	if ref, ok := sch["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+		if err := s.check(target, value, at); err != nil {
+			return err
+		}
+	}
+	if t, ok := sch["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, name := range t {
+				if name, ok := name.(string); ok {
+					types = append(types, name)
+				}
+			}
+		}
+		matched := false
+		for _, name := range types {
+			if hasJSONType(value, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("must be of type %s, not %s", strings.Join(types, " or "), jsonType(value))
+		}
+	}
+	if enum, ok := sch["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if jsonEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("must be one of %s", compactJSON(enum))
+		}
+	}
+	if allowed, ok := sch["const"]; ok && !jsonEqual(allowed, value) {
+		return fail("must be %s", compactJSON(allowed))
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if min, ok := sch["minimum"].(float64); ok && v < min {
+			return fail("must be at least %v", min)
+		}
+		if max, ok := sch["maximum"].(float64); ok && v > max {
+			return fail("must be at most %v", max)
+		}
+		if min, ok := sch["exclusiveMinimum"].(float64); ok && v <= min {
+			return fail("must be greater than %v", min)
+		}
+		if max, ok := sch["exclusiveMaximum"].(float64); ok && v >= max {
+			return fail("must be less than %v", max)
+		}
+		if m, ok := sch["multipleOf"].(float64); ok && m > 0 {
+			if q := v / m; q != math.Trunc(q) {
+				return fail("must be a multiple of %v", m)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := sch["minLength"].(float64); ok && length < min {
+			return fail("must be at least %v characters long", min)
+		}
+		if max, ok := sch["maxLength"].(float64); ok && length > max {
+			return fail("must be at most %v characters long", max)
+		}
+		if pattern, ok := sch["pattern"].(string); ok && !s.patterns[pattern].MatchString(v) {
+			return fail("must match the pattern %q", pattern)
+		}
+	case []interface{}:
+		if min, ok := sch["minItems"].(float64); ok && float64(len(v)) < min {
+			return fail("must have at least %v items", min)
+		}
+		if max, ok := sch["maxItems"].(float64); ok && float64(len(v)) > max {
+			return fail("must have at most %v items", max)
+		}
+		if unique, _ := sch["uniqueItems"].(bool); unique {
+			for i := range v {
+				for j := 0; j < i; j++ {
+					if jsonEqual(v[i], v[j]) {
+						return fail("items %d and %d must not be equal", j, i)
+					}
+				}
+			}
+		}
+		// prefixItems, or items given as an array in older drafts,
+		// validate the first items each, and items the rest.
+		prefix, _ := sch["prefixItems"].([]interface{})
+		rest := sch["items"]
+		if tuple, ok := rest.([]interface{}); ok {
+			prefix, rest = tuple, sch["additionalItems"]
+		}
+		for i, item := range v {
+			itemSchema := rest
+			if i < len(prefix) {
+				itemSchema = prefix[i]
+			}
+			if itemSchema == nil {
+				continue
+			}
+			if err := s.check(itemSchema, item, at+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if min, ok := sch["minProperties"].(float64); ok && float64(len(v)) < min {
+			return fail("must have at least %v properties", min)
+		}
+		if max, ok := sch["maxProperties"].(float64); ok && float64(len(v)) > max {
+			return fail("must have at most %v properties", max)
+		}
+		if required, ok := sch["required"].([]interface{}); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, ok := v[name]; !ok {
+						return fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		properties, _ := sch["properties"].(map[string]interface{})
+		patternProperties, _ := sch["patternProperties"].(map[string]interface{})
+		// Properties are checked in order, so the same document always
+		// fails the same way.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path := at + "/" + strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+			matched := false
+			if propSchema, ok := properties[name]; ok {
+				matched = true
+				if err := s.check(propSchema, v[name], path); err != nil {
+					return err
+				}
+			}
+			for pattern, propSchema := range patternProperties {
+				if s.patterns[pattern].MatchString(name) {
+					matched = true
+					if err := s.check(propSchema, v[name], path); err != nil {
+						return err
+					}
+				}
+			}
+			if additional, ok := sch["additionalProperties"]; ok && !matched {
+				if allowed, ok := additional.(bool); ok && !allowed {
+					return fail("property %q is not allowed", name)
+				}
+				if err := s.check(additional, v[name], path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if all, ok := sch["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := s.check(sub, value, at); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := sch["anyOf"].([]interface{}); ok {
+		var firstErr error
+		for _, sub := range anyOf {
+			err := s.check(sub, value, at)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fail("must match a schema in anyOf; the first fails %s", firstErr.Error())
+		}
+	}
+	if oneOf, ok := sch["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if s.check(sub, value, at) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("must match exactly one schema in oneOf, not %d", matches)
+		}
+	}
+	if not, ok := sch["not"]; ok && s.check(not, value, at) == nil {
+		return fail("must not match the schema in not")
+	}
+	return nil
+}
+
+// jsonType returns the JSON Schema type name of value.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func hasJSONType(value interface{}, name string) bool {
+	actual := jsonType(value)
+	return actual == name || name == "number" && actual == "integer"
+}
+
+// jsonEqual compares values decoded from JSON. Numbers are all float64, so
+// 1 and 1.0 are equal, as JSON Schema wants.
+func jsonEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func compactJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
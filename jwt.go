@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JWTConfig enables bearer JWTs issued by an identity provider. Tokens are
+// verified with HMACSecret (HS256/384/512), or with the RSA key in
+// PublicKeyFile or from JWKSURL (RS256/384/512).
+type JWTConfig struct {
+	HMACSecret    string `json:"hmacSecret"`
+	PublicKeyFile string `json:"publicKeyFile"`
+	JWKSURL       string `json:"jwksUrl"`
+	// JWKSRefresh is how often the keys at JWKSURL are fetched again. An
+	// unknown key ID also triggers a fetch, at most once a minute.
+	JWKSRefresh Duration `json:"jwksRefresh"`
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// ScopesClaim names the claim holding the allowed operations, as a
+	// space-separated string or a list: read, write, delete, generate,
+	// coordinate and admin.
+	ScopesClaim string `json:"scopesClaim"`
+	// PathsClaim names the claim holding the path prefixes the token is
+	// limited to. Without it the token may use any path.
+	PathsClaim string `json:"pathsClaim"`
+	// TenantClaim names the claim holding the tenant the token is bound to.
+	TenantClaim string `json:"tenantClaim"`
+	// AllowNoExpiry accepts tokens without an exp claim, which are valid
+	// forever. They are refused by default.
+	AllowNoExpiry bool `json:"allowNoExpiry"`
+}
+
+func (c JWTConfig) enabled() bool {
+	return c.HMACSecret != "" || c.PublicKeyFile != "" || c.JWKSURL != ""
+}
+
+func (c JWTConfig) validate() error {
+	if c.PublicKeyFile != "" && c.JWKSURL != "" {
+		return errors.New("publicKeyFile and jwksUrl are mutually exclusive")
+	}
+	if c.JWKSRefresh <= 0 {
+		return errors.New("jwksRefresh must be positive")
+	}
+	if c.ScopesClaim == "" || c.PathsClaim == "" {
+		return errors.New("scopesClaim and pathsClaim must not be empty")
+	}
+	return nil
+}
+
+// jwtLeeway is the clock skew tolerated when checking exp and nbf.
+const jwtLeeway = 30 * time.Second
+
+// jwtKeys holds the RSA keys tokens are verified with, by key ID. A key
+// loaded from PublicKeyFile has the ID "".
+var jwtKeys struct {
+	sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// setupJWT loads the RSA keys configured for JWT verification and keeps
+// keys from a JWKS URL up to date.
+func setupJWT() error {
+	cfg := config.JWT
+	switch {
+	case cfg.PublicKeyFile != "":
+		key, err := readRSAPublicKey(cfg.PublicKeyFile)
+		if err != nil {
+			return err
+		}
+		jwtKeys.keys = map[string]*rsa.PublicKey{"": key}
+	case cfg.JWKSURL != "":
+		if err := fetchJWKS(); err != nil {
+			// The identity provider may come up after us; unknown key IDs
+			// make us try again.
+			logrus.WithFields(logrus.Fields{
+				"jwksUrl":  cfg.JWKSURL,
+				"serverId": serverId,
+			}).Warnf("Unable to fetch JWKS: %s", err.Error())
+		}
+		go func() {
+			for range time.Tick(time.Duration(cfg.JWKSRefresh)) {
+				if err := fetchJWKS(); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"jwksUrl":  cfg.JWKSURL,
+						"serverId": serverId,
+					}).Warnf("Unable to refresh JWKS: %s", err.Error())
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// readRSAPublicKey reads a PEM encoded RSA public key or certificate.
+func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// fetchJWKS replaces the keys with the RSA keys published at config.JWT.JWKSURL.
+func fetchJWKS() error {
+	jwtKeys.Lock()
+	jwtKeys.fetched = time.Now()
+	jwtKeys.Unlock()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(config.JWT.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", config.JWT.JWKSURL, res.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("invalid exponent of key %q: %w", k.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return fmt.Errorf("invalid exponent of key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+	jwtKeys.keys = keys
+	return nil
+}
+
+// jwtKey returns the RSA key with the given ID, fetching the JWKS again if
+// it is unknown.
+func jwtKey(kid string) (*rsa.PublicKey, error) {
+	jwtKeys.Lock()
+	key, ok := jwtKeys.keys[kid]
+	if !ok && config.JWT.PublicKeyFile != "" {
+		// A single configured key is used whatever the token's kid says.
+		key, ok = jwtKeys.keys[""]
+	}
+	stale := time.Since(jwtKeys.fetched) > time.Minute
+	jwtKeys.Unlock()
+	if ok {
+		return key, nil
+	}
+	if config.JWT.JWKSURL == "" || !stale {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if err := fetchJWKS(); err != nil {
+		return nil, err
+	}
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+	if key, ok := jwtKeys.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// verifyJWT checks the signature and time and issuer claims of token and
+// returns the caller it identifies. Tokens must expire unless
+// AllowNoExpiry is set.
+func verifyJWT(token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	if err := verifyJWTSignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok && (claims["exp"] != nil || !config.JWT.AllowNoExpiry) {
+		return nil, errors.New("exp claim is required")
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if config.JWT.Issuer != "" && claims["iss"] != config.JWT.Issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if config.JWT.Audience != "" && !containsString(claimStrings(claims["aud"]), config.JWT.Audience) {
+		return nil, errors.New("wrong audience")
+	}
+
+	tenant, _ := claims[config.JWT.TenantClaim].(string)
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("sub claim is required")
+	}
+	// Only a token without the paths claim may use any path; one holding
+	// no usable prefix must not end up unrestricted.
+	var paths []string
+	if claim, ok := claims[config.JWT.PathsClaim]; ok {
+		if paths, ok = claimPrefixes(claim); !ok {
+			return nil, fmt.Errorf("%s claim must list path prefixes", config.JWT.PathsClaim)
+		}
+	}
+	return &principal{
+		Name:   sub,
+		Scopes: claimStrings(claims[config.JWT.ScopesClaim]),
+		Paths:  paths,
+		Tenant: tenant,
+	}, nil
+}
+
+func verifyJWTSignature(alg string, kid string, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	switch alg[:2] {
+	case "HS":
+		if config.JWT.HMACSecret == "" {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		mac := hmac.New(hash.New, []byte(config.JWT.HMACSecret))
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "RS":
+		if config.JWT.PublicKeyFile == "" && config.JWT.JWKSURL == "" {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		key, err := jwtKey(kid)
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings returns a claim given as a space-separated string or a list
+// of strings.
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// claimPrefixes returns the path prefixes of a paths claim given like for
+// claimStrings. It reports false unless the claim holds at least one prefix
+// and nothing but non-empty strings.
+func claimPrefixes(claim interface{}) ([]string, bool) {
+	var prefixes []string
+	switch v := claim.(type) {
+	case string:
+		prefixes = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok || strings.TrimSpace(s) == "" {
+				return nil, false
+			}
+			prefixes = append(prefixes, s)
+		}
+	}
+	return prefixes, len(prefixes) > 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
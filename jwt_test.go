@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signHS256 returns a token with claims signed with secret.
+func signHS256(t *testing.T, secret string, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.JWT = JWTConfig{HMACSecret: "secret", ScopesClaim: "scope", PathsClaim: "paths", TenantClaim: "tenant"}
+	})
+	now := time.Now()
+	valid := func(change func(claims map[string]interface{})) map[string]interface{} {
+		claims := map[string]interface{}{"sub": "alice", "scope": "read write", "exp": now.Add(time.Hour).Unix()}
+		if change != nil {
+			change(claims)
+		}
+		return claims
+	}
+
+	for _, tt := range []struct {
+		name          string
+		token         string
+		allowNoExpiry bool
+		wantErr       bool
+	}{
+		{name: "valid", token: signHS256(t, "secret", "HS256", valid(nil))},
+		{name: "wrong secret", token: signHS256(t, "other", "HS256", valid(nil)), wantErr: true},
+		{name: "alg none", token: signHS256(t, "secret", "none", valid(nil)), wantErr: true},
+		{name: "expired", token: signHS256(t, "secret", "HS256", valid(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() })), wantErr: true},
+		{name: "within leeway", token: signHS256(t, "secret", "HS256", valid(func(c map[string]interface{}) { c["exp"] = now.Add(-jwtLeeway / 2).Unix() }))},
+		{name: "not valid yet", token: signHS256(t, "secret", "HS256", valid(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })), wantErr: true},
+		{name: "no exp", token: signHS256(t, "secret", "HS256", valid(func(c map[string]interface{}) { delete(c, "exp") })), wantErr: true},
+		{name: "no exp allowed", token: signHS256(t, "secret", "HS256", valid(func(c map[string]interface{}) { delete(c, "exp") })), allowNoExpiry: true},
+		{name: "exp not a number", token: signHS256(t, "secret", "HS256", valid(func(c map[string]interface{}) { c["exp"] = "never" })), allowNoExpiry: true, wantErr: true},
+		{name: "no sub", token: signHS256(t, "secret", "HS256", valid(func(c map[string]interface{}) { delete(c, "sub") })), wantErr: true},
+		{name: "malformed", token: "a.b", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config.JWT.AllowNoExpiry = tt.allowNoExpiry
+			p, err := verifyJWT(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (p.Name != "alice" || len(p.Scopes) != 2) {
+				t.Errorf("principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestVerifyJWTPaths(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.JWT = JWTConfig{HMACSecret: "secret", ScopesClaim: "scope", PathsClaim: "paths"}
+	})
+	for _, tt := range []struct {
+		name    string
+		paths   interface{}
+		want    []string
+		wantErr bool
+	}{
+		{name: "absent"},
+		{name: "string", paths: "/a /b", want: []string{"/a", "/b"}},
+		{name: "list", paths: []string{"/a"}, want: []string{"/a"}},
+		{name: "empty list", paths: []string{}, wantErr: true},
+		{name: "empty string", paths: " ", wantErr: true},
+		{name: "null", paths: nil, wantErr: true},
+		{name: "number", paths: 1, wantErr: true},
+		{name: "list of numbers", paths: []int{1}, wantErr: true},
+		{name: "empty prefix", paths: []string{"/a", ""}, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+			if tt.name != "absent" {
+				claims["paths"] = tt.paths
+			}
+			p, err := verifyJWT(signHS256(t, "secret", "HS256", claims))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && strings.Join(p.Paths, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("paths %q, want %q", p.Paths, tt.want)
+			}
+		})
+	}
+}
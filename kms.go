@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// KMSConfig has the master keys kept wrapped by an external key management
+// service, so the key file holds only ciphertext the service decrypts when
+// the server starts and on every refresh.
+type KMSConfig struct {
+	// Provider is aws, gcp or vault. Empty means the key file holds the
+	// master keys in the clear.
+	Provider string `json:"provider"`
+	// KeyId names the key the master keys are wrapped with: the ARN or
+	// alias for AWS, projects/.../cryptoKeys/... for GCP and the transit
+	// key name for Vault.
+	KeyId string `json:"keyId"`
+	// Region is the AWS region, by default AWS_REGION.
+	Region string `json:"region"`
+	// Address overrides the service endpoint. It is required for Vault,
+	// where it defaults to VAULT_ADDR.
+	Address string `json:"address"`
+	// Refresh is how often the service is authenticated with again and
+	// the master keys are unwrapped anew. In between the keys are served
+	// from memory, and a failed refresh keeps them.
+	Refresh Duration `json:"refresh"`
+	// VaultToken authenticates with Vault, by default VAULT_TOKEN. With
+	// VaultRoleId and VaultSecretId an AppRole login is used instead.
+	VaultToken    string `json:"vaultToken"`
+	VaultRoleId   string `json:"vaultRoleId"`
+	VaultSecretId string `json:"vaultSecretId"`
+	// VaultMount is the path the transit engine is mounted at.
+	VaultMount string `json:"vaultMount"`
+}
+
+func (c KMSConfig) validate() error {
+	switch c.Provider {
+	case "":
+		return nil
+	case "aws", "gcp":
+	case "vault":
+		if c.KeyId == "" {
+			return errors.New("keyId is required for vault")
+		}
+		if c.Address == "" && os.Getenv("VAULT_ADDR") == "" {
+			return errors.New("address or VAULT_ADDR is required for vault")
+		}
+		if (c.VaultRoleId == "") != (c.VaultSecretId == "") {
+			return errors.New("vaultRoleId and vaultSecretId must be set together")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q: must be aws, gcp or vault", c.Provider)
+	}
+	if c.Provider == "gcp" && c.KeyId == "" {
+		return errors.New("keyId is required for gcp")
+	}
+	if c.Refresh <= 0 {
+		return errors.New("refresh must be positive")
+	}
+	return nil
+}
+
+// kmsProvider decrypts master keys wrapped by a key management service.
+type kmsProvider interface {
+	// authenticate gets or renews the credentials decrypt uses.
+	authenticate() error
+	// decrypt returns the master key wrapped in ciphertext, as written in
+	// the key file.
+	decrypt(ciphertext string) ([]byte, error)
+}
+
+// kms is the configured provider, or nil.
+var kms kmsProvider
+
+var kmsClient = http.Client{Timeout: 10 * time.Second}
+
+// setupKMS creates the provider config.Encryption.KMS asks for and
+// authenticates with it.
+func setupKMS() error {
+	cfg := config.Encryption.KMS
+	switch cfg.Provider {
+	case "":
+		return nil
+	case "aws":
+		region := cfg.Region
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			return errors.New("kms: region or AWS_REGION is required for aws")
+		}
+		endpoint := cfg.Address
+		if endpoint == "" {
+			endpoint = "https://kms." + region + ".amazonaws.com"
+		}
+		kms = &awsKMS{endpoint: strings.TrimSuffix(endpoint, "/"), region: region, keyId: cfg.KeyId}
+	case "gcp":
+		endpoint := cfg.Address
+		if endpoint == "" {
+			endpoint = "https://cloudkms.googleapis.com"
+		}
+		kms = &gcpKMS{endpoint: strings.TrimSuffix(endpoint, "/"), keyId: cfg.KeyId}
+	case "vault":
+		address := cfg.Address
+		if address == "" {
+			address = os.Getenv("VAULT_ADDR")
+		}
+		token := cfg.VaultToken
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		mount := cfg.VaultMount
+		if mount == "" {
+			mount = "transit"
+		}
+		kms = &vaultKMS{
+			address:  strings.TrimSuffix(address, "/"),
+			mount:    strings.Trim(mount, "/"),
+			keyId:    cfg.KeyId,
+			token:    token,
+			roleId:   cfg.VaultRoleId,
+			secretId: cfg.VaultSecretId,
+		}
+	}
+	if err := kms.authenticate(); err != nil {
+		return fmt.Errorf("kms: %w", err)
+	}
+	return nil
+}
+
+// startKMSRefresh authenticates with the key management service again and
+// reloads the master keys every config.Encryption.KMS.Refresh.
+func startKMSRefresh() {
+	if kms == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Encryption.KMS.Refresh))
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := refreshMasterKeys(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"provider": config.Encryption.KMS.Provider,
+					"serverId": serverId,
+				}).Warnf("Unable to refresh master keys, keeping the cached ones: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// refreshMasterKeys authenticates with the key management service and
+// replaces the cached master keys with those it unwraps from the key file.
+func refreshMasterKeys() error {
+	if err := kms.authenticate(); err != nil {
+		return err
+	}
+	keys, err := readMasterKeys(config.Encryption.KeyFile)
+	if err != nil {
+		return err
+	}
+	masterKeys.Lock()
+	masterKeys.keys = keys
+	masterKeys.Unlock()
+	return nil
+}
+
+// kmsCall sends req, setting body as its JSON content, and decodes the JSON
+// answer into out.
+func kmsCall(req *http.Request, body []byte, out interface{}) error {
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	res, err := kmsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s: %s", req.URL.Host, res.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid answer from %s: %w", req.URL.Host, err)
+	}
+	return nil
+}
+
+// decodeMasterKey decodes the base64 plaintext a service answered with.
+func decodeMasterKey(plaintext string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("unwrapped key is not a 256-bit key")
+	}
+	return key, nil
+}
+
+// awsKMS decrypts with AWS KMS, signing requests with the credentials of the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables,
+// or of the ECS container credentials endpoint.
+type awsKMS struct {
+	endpoint string
+	region   string
+	keyId    string
+
+	mu           sync.Mutex
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func (a *awsKMS) authenticate() error {
+	accessKey, secretKey, token := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+	if accessKey == "" {
+		uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+		if uri == "" {
+			return errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://169.254.170.2"+uri, nil)
+		if err != nil {
+			return err
+		}
+		var creds struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			Token           string
+		}
+		if err := kmsCall(req, nil, &creds); err != nil {
+			return err
+		}
+		accessKey, secretKey, token = creds.AccessKeyId, creds.SecretAccessKey, creds.Token
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accessKey, a.secretKey, a.sessionToken = accessKey, secretKey, token
+	return nil
+}
+
+func (a *awsKMS) decrypt(ciphertext string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"CiphertextBlob": ciphertext, "KeyId": a.keyId})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.endpoint+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	a.sign(req, body, time.Now().UTC())
+	var res struct {
+		Plaintext string
+	}
+	if err := kmsCall(req, body, &res); err != nil {
+		return nil, err
+	}
+	return decodeMasterKey(res.Plaintext)
+}
+
+// sign adds the Signature Version 4 headers of a KMS request with body to
+// req.
+func (a *awsKMS) sign(req *http.Request, body []byte, now time.Time) {
+	a.mu.Lock()
+	accessKey, secretKey, token := a.accessKey, a.secretKey, a.sessionToken
+	a.mu.Unlock()
+
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	headers := []string{"content-type", "host", "x-amz-date"}
+	if token != "" {
+		headers = append(headers, "x-amz-security-token")
+	}
+	headers = append(headers, "x-amz-target")
+
+	var canonical strings.Builder
+	canonical.WriteString("POST\n/\n\n")
+	for _, h := range headers {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonical.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signed := strings.Join(headers, ";")
+	bodySum := sha256.Sum256(body)
+	canonical.WriteString("\n" + signed + "\n" + hex.EncodeToString(bodySum[:]))
+
+	scope := date + "/" + a.region + "/kms/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, a.region, "kms", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// gcpKMS decrypts with Cloud KMS, with an access token of the instance's
+// service account from the metadata server, or GOOGLE_OAUTH_ACCESS_TOKEN.
+type gcpKMS struct {
+	endpoint string
+	keyId    string
+
+	mu    sync.Mutex
+	token string
+}
+
+func (g *gcpKMS) authenticate() error {
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = "metadata.google.internal"
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		var res struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := kmsCall(req, nil, &res); err != nil {
+			return err
+		}
+		token = res.AccessToken
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.token = token
+	return nil
+}
+
+func (g *gcpKMS) decrypt(ciphertext string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"ciphertext": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, g.endpoint+"/v1/"+g.keyId+":decrypt", nil)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	g.mu.Unlock()
+	req.Header.Set("Content-Type", "application/json")
+	var res struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := kmsCall(req, body, &res); err != nil {
+		return nil, err
+	}
+	return decodeMasterKey(res.Plaintext)
+}
+
+// vaultKMS decrypts with the transit engine of HashiCorp Vault, logging in
+// with AppRole or renewing a given token.
+type vaultKMS struct {
+	address  string
+	mount    string
+	keyId    string
+	roleId   string
+	secretId string
+
+	mu    sync.Mutex
+	token string
+}
+
+func (v *vaultKMS) authenticate() error {
+	if v.roleId != "" {
+		body, err := json.Marshal(map[string]string{"role_id": v.roleId, "secret_id": v.secretId})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, v.address+"/v1/auth/approle/login", nil)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if err := kmsCall(req, body, &res); err != nil {
+			return err
+		}
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.token = res.Auth.ClientToken
+		return nil
+	}
+	if v.token == "" {
+		return errors.New("no Vault token: set vaultToken, VAULT_TOKEN or an AppRole")
+	}
+	req, err := http.NewRequest(http.MethodPost, v.address+"/v1/auth/token/renew-self", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	err = kmsCall(req, []byte("{}"), nil)
+	if err != nil && strings.Contains(err.Error(), "not renewable") {
+		// Root and other non-renewable tokens stay valid as they are.
+		return nil
+	}
+	return err
+}
+
+func (v *vaultKMS) decrypt(ciphertext string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"ciphertext": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, v.address+"/v1/"+v.mount+"/decrypt/"+url.PathEscape(v.keyId), nil)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	req.Header.Set("X-Vault-Token", v.token)
+	v.mu.Unlock()
+	var res struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := kmsCall(req, body, &res); err != nil {
+		return nil, err
+	}
+	return decodeMasterKey(res.Data.Plaintext)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeVault serves the Vault transit endpoints, decrypting "vault:<base64>"
+// ciphertexts to the base64 after the prefix while up is set.
+func fakeVault(t *testing.T, up *atomic.Bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "sealed", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/token/renew-self":
+			w.Write([]byte("{}"))
+		case "/v1/transit/decrypt/master":
+			var req struct {
+				Ciphertext string `json:"ciphertext"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			plaintext, ok := strings.CutPrefix(req.Ciphertext, "vault:")
+			if !ok {
+				http.Error(w, "invalid ciphertext", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": plaintext}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// withVault configures the Vault provider at address and a key file
+// holding lines.
+func withVault(t *testing.T, address string, lines ...string) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyFile, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(c *Config) {
+		c.Encryption.KeyFile = keyFile
+		c.Encryption.KMS = KMSConfig{Provider: "vault", KeyId: "master", Address: address, VaultToken: "token", Refresh: Duration(time.Hour)}
+	})
+	withMasterKeys(t)
+	t.Cleanup(func() { kms = nil })
+}
+
+func TestVaultKMS(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	var up atomic.Bool
+	up.Store(true)
+	srv := fakeVault(t, &up)
+
+	withVault(t, srv.URL, "current vault:"+encoded)
+	if err := setupEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := newMasterKey("current", key)
+	if k := currentMasterKey(); k.name != "current" || !bytes.Equal(k.id[:], want.id[:]) {
+		t.Fatalf("loaded key %s %x, want the unwrapped one", k.name, k.id)
+	}
+
+	// A failed refresh keeps the keys loaded.
+	up.Store(false)
+	if err := refreshMasterKeys(); err == nil {
+		t.Error("refreshed with the service down")
+	}
+	if k := currentMasterKey(); !bytes.Equal(k.id[:], want.id[:]) {
+		t.Error("failed refresh dropped the keys")
+	}
+}
+
+func TestVaultKMSRefusesBadKeys(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	srv := fakeVault(t, &up)
+	for name, line := range map[string]string{
+		"not wrapped":  "current " + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"short key":    "current vault:" + base64.StdEncoding.EncodeToString(make([]byte, 16)),
+		"not a key":    "current vault:%%%",
+		"missing name": "vault:abc",
+	} {
+		t.Run(name, func(t *testing.T) {
+			withVault(t, srv.URL, line)
+			if err := setupEncryption(); err == nil {
+				t.Error("loaded a bad key")
+			}
+			if atRestEnabled() {
+				t.Error("encryption enabled with a bad key")
+			}
+		})
+	}
+}
+
+func TestVaultKMSRefusesWrongToken(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	srv := fakeVault(t, &up)
+	withVault(t, srv.URL, "current vault:abc")
+	withConfig(t, func(c *Config) { c.Encryption.KMS.VaultToken = "wrong" })
+	if err := setupEncryption(); err == nil || !strings.Contains(err.Error(), "kms:") {
+		t.Errorf("set up with a wrong token: %v", err)
+	}
+}
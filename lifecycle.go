@@ -0,0 +1,339 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LifecycleConfig describes rules a background worker applies to files under
+// Dir as they age.
+type LifecycleConfig struct {
+	// Dir is the directory the rule patterns are matched against.
+	Dir string `json:"dir"`
+	// Interval is how often the rules are evaluated. Defaults to an hour.
+	Interval Duration        `json:"interval"`
+	Rules    []LifecycleRule `json:"rules"`
+}
+
+// LifecycleRule applies Action to files matching Pattern once they were last
+// modified at least AfterDays ago.
+type LifecycleRule struct {
+	// Pattern is a glob, see matchGlob, matched against the slash-separated
+	// path relative to LifecycleConfig.Dir.
+	Pattern   string `json:"pattern"`
+	AfterDays int    `json:"afterDays"`
+	// Action is compress, move or delete.
+	Action string `json:"action"`
+	// Target is the directory the move action moves files to, keeping their
+	// path relative to LifecycleConfig.Dir.
+	Target string `json:"target"`
+}
+
+func (c LifecycleConfig) validate() error {
+	if len(c.Rules) == 0 {
+		return nil
+	}
+	if c.Dir == "" {
+		return errors.New("dir is required")
+	}
+	for i, rule := range c.Rules {
+		if _, err := matchGlob(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("rule %d: invalid pattern %q: %w", i, rule.Pattern, err)
+		}
+		if rule.AfterDays < 0 {
+			return fmt.Errorf("rule %d: afterDays must not be negative", i)
+		}
+		switch rule.Action {
+		case "compress", "delete":
+		case "move":
+			if rule.Target == "" {
+				return fmt.Errorf("rule %d: target is required for move", i)
+			}
+		default:
+			return fmt.Errorf("rule %d: unknown action %q", i, rule.Action)
+		}
+	}
+	return nil
+}
+
+// ruleFor picks the rule to apply to relPath given its age. When several
+// rules are due the one with the largest AfterDays wins, so a file that is
+// old enough to be deleted isn't compressed first. Compressed files are not
+// compressed again.
+func (c LifecycleConfig) ruleFor(relPath string, age time.Duration) *LifecycleRule {
+	var due *LifecycleRule
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if age < time.Duration(rule.AfterDays)*24*time.Hour {
+			continue
+		}
+		if rule.Action == "compress" && strings.HasSuffix(relPath, ".gz") {
+			continue
+		}
+		if ok, _ := matchGlob(rule.Pattern, relPath); !ok {
+			continue
+		}
+		if due == nil || rule.AfterDays > due.AfterDays {
+			due = rule
+		}
+	}
+	return due
+}
+
+// startLifecycleWorker evaluates the lifecycle rules right away and then
+// every configured interval. It does nothing when no rules are configured.
+func startLifecycleWorker() {
+	if len(config.Lifecycle.Rules) == 0 {
+		return
+	}
+	interval := time.Duration(config.Lifecycle.Interval)
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	go func() {
+		for {
+			// Lifecycle actions change stored data, so they wait while the
+			// server is in maintenance or read-only mode.
+			if !inMaintenance() && !isReadOnly() {
+				j := startJob("lifecycle", "Apply lifecycle rules to "+config.Lifecycle.Dir, runLifecycle)
+				<-j.done
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+type lifecycleAction struct {
+	relPath string
+	size    int64
+	rule    *LifecycleRule
+}
+
+// planLifecycle finds the files under the lifecycle directory that have a
+// rule due.
+func planLifecycle(ctx context.Context) ([]lifecycleAction, error) {
+	lc := config.Lifecycle
+	now := time.Now()
+
+	var mu sync.Mutex
+	var due []lifecycleAction
+	err := walkTree(ctx, lc.Dir, 0, func(relPath string, entry fs.DirEntry) error {
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if rule := lc.ruleFor(relPath, now.Sub(info.ModTime())); rule != nil {
+			mu.Lock()
+			due = append(due, lifecycleAction{relPath: relPath, size: info.Size(), rule: rule})
+			mu.Unlock()
+		}
+		return nil
+	})
+	sort.Slice(due, func(a, b int) bool {
+		return due[a].relPath < due[b].relPath
+	})
+	return due, err
+}
+
+// runLifecycle applies every rule that is due.
+func runLifecycle(ctx context.Context, j *job) error {
+	due, err := planLifecycle(ctx)
+	if err != nil {
+		return err
+	}
+
+	j.logf("%d files due", len(due))
+	for i, action := range due {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := j.pauseForMaintenance(ctx); err != nil {
+			return err
+		}
+		if err := applyLifecycleAction(config.Lifecycle.Dir, action); err != nil {
+			j.logf("%s %s failed: %s", action.rule.Action, action.relPath, err.Error())
+		} else {
+			j.logf("%s %s", action.rule.Action, action.relPath)
+		}
+		j.setProgress(int64(i+1), int64(len(due)))
+	}
+	return nil
+}
+
+// runLifecycleNow applies the lifecycle rules right away as a background job,
+// or with dryRun=true reports which files they would affect.
+func runLifecycleNow(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"dryRun":    dryRun,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Running lifecycle rules")
+
+	if len(config.Lifecycle.Rules) == 0 {
+		http.Error(w, "No lifecycle rules are configured", http.StatusConflict)
+		return
+	}
+
+	if dryRun {
+		due, err := planLifecycle(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to evaluate lifecycle rules: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		entries := make([]dryRunEntry, 0, len(due))
+		for _, action := range due {
+			entries = append(entries, dryRunEntry{
+				Path:   filepath.Join(config.Lifecycle.Dir, filepath.FromSlash(action.relPath)),
+				Action: action.rule.Action,
+				Size:   action.size,
+			})
+		}
+		writeJSON(w, "Dry run: lifecycle rules not applied", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if isReadOnly() {
+		http.Error(w, "Server is in read-only mode", http.StatusForbidden)
+		return
+	}
+	if inMaintenance() {
+		w.Header().Set("Retry-After", strconv.Itoa(defaultRetryAfter))
+		http.Error(w, "Server is in maintenance mode", http.StatusServiceUnavailable)
+		return
+	}
+	j := startJob("lifecycle", "Apply lifecycle rules to "+config.Lifecycle.Dir, runLifecycle)
+	writeJSON(w, "Lifecycle run started", requestId, map[string]interface{}{
+		"jobId": j.id,
+	})
+}
+
+func applyLifecycleAction(dir string, action lifecycleAction) error {
+	rule := action.rule
+	src := filepath.Join(dir, filepath.FromSlash(action.relPath))
+	event := auditEvent{
+		Actor:  "lifecycle",
+		Action: rule.Action,
+		Path:   src,
+		Detail: fmt.Sprintf("rule %q after %d days", rule.Pattern, rule.AfterDays),
+	}
+
+	// Files are locked and backed up like for the requests doing the same,
+	// so the actions can be undone like them.
+	var err error
+	switch rule.Action {
+	case "compress":
+		dst := src + ".gz"
+		unlock := lockWrites(src, dst)
+		defer unlock()
+		if err = checkLifecycleDue(src, rule); err != nil {
+			break
+		}
+		// gzipFile doesn't replace an existing file.
+		if err = gzipFile(src, dst, gzip.DefaultCompression); err != nil {
+			break
+		}
+		recordOperation("lifecycle", "", "compress", dst, false, "")
+		var backup string
+		if backup, err = trashFile(src); err == nil {
+			recordOperation("lifecycle", "", "delete", src, true, backup)
+		}
+	case "move":
+		dst := filepath.Join(rule.Target, filepath.FromSlash(path.Clean(action.relPath)))
+		event.Detail += ", moved to " + dst
+		unlock := lockWrites(src, dst)
+		defer unlock()
+		if err = checkLifecycleDue(src, rule); err != nil {
+			break
+		}
+		err = lifecycleMove(src, dst)
+	case "delete":
+		unlock := lockWrites(src)
+		defer unlock()
+		if err = checkLifecycleDue(src, rule); err != nil {
+			break
+		}
+		var backup string
+		if backup, err = trashFile(src); err == nil {
+			recordOperation("lifecycle", "", "delete", src, true, backup)
+		}
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	recordAudit(event)
+	return err
+}
+
+// checkLifecycleDue checks that the file at src is still old enough for
+// rule, now that it is locked: it may have been written since the run found
+// it due.
+func checkLifecycleDue(src string, rule *LifecycleRule) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || time.Since(info.ModTime()) < time.Duration(rule.AfterDays)*24*time.Hour {
+		return errors.New("file changed since it became due")
+	}
+	return nil
+}
+
+// lifecycleMove moves src to dst the way moveFile does, saving a file it
+// replaces in the trash.
+func lifecycleMove(src string, dst string) error {
+	destInfo, err := os.Lstat(dst)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if destInfo != nil && !destInfo.Mode().IsRegular() {
+		return &fs.PathError{Op: "move", Path: dst, Err: fs.ErrExist}
+	}
+	if err := ensureParentDir(dst); err != nil {
+		return err
+	}
+	var backup string
+	if destInfo != nil && config.TrashDir != "" {
+		if backup, err = trashFile(dst); err != nil {
+			return err
+		}
+	}
+	if err := movePath(src, dst); err != nil {
+		if backup != "" {
+			movePath(backup, dst)
+		}
+		return err
+	}
+	recordMove("lifecycle", "", src, dst, destInfo != nil, backup)
+	return nil
+}
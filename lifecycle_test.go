@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLifecycleActionsUndo(t *testing.T) {
+	withJournal(t)
+	dir := testRoot(t)
+	target := testRoot(t)
+	old := time.Now().Add(-48 * time.Hour)
+	undo := func(filePath string) {
+		t.Helper()
+		if _, err := undoLatest(httptest.NewRequest("POST", "/undo", nil), "u", filePath); err != nil {
+			t.Fatalf("undo %s: %s", filePath, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		rule    LifecycleRule
+		changed string
+		// undone lists the paths to undo in turn.
+		undone []string
+	}{
+		{name: "delete", rule: LifecycleRule{Action: "delete"}, undone: []string{"f"}},
+		{name: "move", rule: LifecycleRule{Action: "move", Target: target}, changed: filepath.Join(target, "f"), undone: []string{filepath.Join(target, "f")}},
+		{name: "compress", rule: LifecycleRule{Action: "compress"}, changed: "f.gz", undone: []string{"f", "f.gz"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(dir, "f")
+			if err := os.WriteFile(src, []byte("aged"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(src, old, old)
+			rule := tt.rule
+			rule.AfterDays = 1
+			if err := applyLifecycleAction(dir, lifecycleAction{relPath: "f", rule: &rule}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(src); !os.IsNotExist(err) {
+				t.Fatalf("%s left in place: %v", src, err)
+			}
+			changed := tt.changed
+			if changed != "" && !filepath.IsAbs(changed) {
+				changed = filepath.Join(dir, changed)
+			}
+
+			for _, p := range tt.undone {
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(dir, p)
+				}
+				undo(p)
+			}
+			if got, err := os.ReadFile(src); err != nil || string(got) != "aged" {
+				t.Fatalf("after undo: %q, %v", got, err)
+			}
+			if changed != "" {
+				if _, err := os.Stat(changed); !os.IsNotExist(err) {
+					t.Errorf("%s left after undo: %v", changed, err)
+				}
+			}
+		})
+	}
+}
+
+// A file written after the run found it due is left alone.
+func TestLifecycleSkipsFilesWrittenSince(t *testing.T) {
+	withJournal(t)
+	dir := testRoot(t)
+	src := filepath.Join(dir, "f")
+	if err := os.WriteFile(src, []byte("fresh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rule := LifecycleRule{Action: "delete", AfterDays: 1}
+	if err := applyLifecycleAction(dir, lifecycleAction{relPath: "f", rule: &rule}); err == nil {
+		t.Fatal("a fresh file was deleted")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Fatal(err)
+	}
+}
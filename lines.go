@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// lineIndexStep is how many lines apart the offsets remembered in a
+	// line index are.
+	lineIndexStep = 4096
+	// maxLineIndexes bounds the number of files line indexes are kept for.
+	maxLineIndexes = 64
+)
+
+// lineIndex remembers where every lineIndexStep-th line of a file starts, so
+// a later read of lines far into the file can seek close to them instead of
+// scanning from the start. It is only valid for the size and modification
+// time it was built at.
+type lineIndex struct {
+	size    int64
+	modTime time.Time
+	// offsets[i] is where line i*lineIndexStep+1 starts.
+	offsets []int64
+}
+
+var lineIndexes = struct {
+	sync.Mutex
+	files map[string]*lineIndex
+}{files: map[string]*lineIndex{}}
+
+// lineIndexFor returns the remembered line index of filePath if it is still
+// valid for info.
+func lineIndexFor(filePath string, info os.FileInfo) *lineIndex {
+	lineIndexes.Lock()
+	defer lineIndexes.Unlock()
+	idx := lineIndexes.files[filePath]
+	if idx == nil || idx.size != info.Size() || !idx.modTime.Equal(info.ModTime()) {
+		return nil
+	}
+	return idx
+}
+
+// storeLineIndex remembers idx for filePath, dropping another file's index
+// when too many are kept.
+func storeLineIndex(filePath string, idx *lineIndex) {
+	lineIndexes.Lock()
+	defer lineIndexes.Unlock()
+	if _, ok := lineIndexes.files[filePath]; !ok && len(lineIndexes.files) >= maxLineIndexes {
+		for p := range lineIndexes.files {
+			delete(lineIndexes.files, p)
+			break
+		}
+	}
+	lineIndexes.files[filePath] = idx
+}
+
+// lineRange is the result of readLineRange.
+type lineRange struct {
+	content  []byte
+	offset   int64
+	fromLine int
+	toLine   int
+	eof      bool
+	limited  bool
+}
+
+// readLineRange reads lines fromLine to toLine, counted from 1 and
+// inclusive, of the file f described by info. toLine 0 reads to the end.
+// At most maxTailBytes are returned; limited tells whether that cut the
+// range short.
+func readLineRange(filePath string, f contentFile, info os.FileInfo, fromLine int, toLine int) (*lineRange, error) {
+	// The index is extended with what this scan finds. Remembered indexes
+	// are shared, so it works on a copy.
+	idx := &lineIndex{size: info.Size(), modTime: info.ModTime(), offsets: []int64{0}}
+	if known := lineIndexFor(filePath, info); known != nil {
+		idx.offsets = append([]int64(nil), known.offsets...)
+	}
+	known := len(idx.offsets)
+
+	// Start from the closest remembered line before fromLine.
+	step := (fromLine - 1) / lineIndexStep
+	if step >= len(idx.offsets) {
+		step = len(idx.offsets) - 1
+	}
+	line := step*lineIndexStep + 1
+	offset := idx.offsets[step]
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	res := &lineRange{fromLine: fromLine}
+	var content bytes.Buffer
+	br := bufio.NewReaderSize(f, 64<<10)
+	for toLine == 0 || line <= toLine {
+		lineStart := offset
+		wanted := line >= fromLine
+		before := content.Len()
+		var n int
+		var err error
+		for {
+			// ReadSlice rather than ReadBytes, so a huge line isn't held
+			// in memory unless it is wanted.
+			var data []byte
+			data, err = br.ReadSlice('\n')
+			n += len(data)
+			if wanted && !res.limited {
+				if content.Len()+len(data) > maxTailBytes {
+					res.limited = true
+				} else {
+					content.Write(data)
+				}
+			}
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				break
+			}
+		}
+		if n == 0 && err == io.EOF {
+			res.eof = true
+			break
+		}
+		if res.limited {
+			content.Truncate(before)
+			break
+		}
+		if wanted {
+			if line == fromLine {
+				res.offset = lineStart
+			}
+			res.toLine = line
+		}
+		offset += int64(n)
+		line++
+		if (line-1)%lineIndexStep == 0 && (line-1)/lineIndexStep == len(idx.offsets) {
+			idx.offsets = append(idx.offsets, offset)
+		}
+		if err == io.EOF {
+			res.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(idx.offsets) > known {
+		storeLineIndex(filePath, idx)
+	}
+	res.content = content.Bytes()
+	return res, nil
+}
+
+// readLines returns a range of lines of a text file without sending the
+// rest of it: lines fromLine (1 by default) to toLine, or count lines from
+// fromLine, so head is count=N. Offsets of lines found while scanning are
+// remembered, so reading further ranges of a large file seeks instead of
+// scanning from its start again.
+func readLines(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"fromLine":  r.FormValue("fromLine"),
+		"toLine":    r.FormValue("toLine"),
+		"count":     r.FormValue("count"),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Reading lines")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("toLine") != "" && r.FormValue("count") != "" {
+		http.Error(w, "toLine and count are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+	fromLine := 1
+	var err error
+	if r.FormValue("fromLine") != "" {
+		if fromLine, err = formPositiveInt(r, "fromLine"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	toLine := 0
+	if r.FormValue("toLine") != "" {
+		if toLine, err = formPositiveInt(r, "toLine"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if toLine < fromLine {
+			http.Error(w, "toLine must not be less than fromLine", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.FormValue("count") != "" {
+		count, err := formPositiveInt(r, "count")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		toLine = fromLine + count - 1
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	f, err := openFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if err := checkNotClientEncrypted(f); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	res, err := readLineRange(filePath, f, info, fromLine, toLine)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"fileContent": string(res.content),
+		"fromLine":    res.fromLine,
+		"toLine":      res.toLine,
+		"offset":      res.offset,
+		"eof":         res.eof,
+		"truncated":   res.limited,
+	}
+	writeJSON(w, "Lines read successfully", requestId, data)
+}
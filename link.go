@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// linkFile makes destPath a hard link to the regular file at sourcePath, so
+// both names share one copy of the content. They must be on the same
+// filesystem. An existing destPath is only replaced with overwrite=true.
+func linkFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sourcePath := r.FormValue("sourcePath")
+	destPath := r.FormValue("destPath")
+	logrus.WithFields(logrus.Fields{
+		"sourcePath": sourcePath,
+		"destPath":   destPath,
+		"requestId":  requestId,
+		"serverId":   serverId,
+	}).Info("Linking file")
+
+	if sourcePath == "" || destPath == "" {
+		http.Error(w, "sourcePath and destPath are required", http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// authorize checked the caller may do this to the source.
+	sourcePath, err = resolvePath(r, sourcePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sourcePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	destPath, err = resolvePath(r, destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	sourceInfo, err := statFile(sourcePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Source file not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", sourcePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !sourceInfo.Mode().IsRegular() {
+		http.Error(w, "sourcePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockWrites(destPath)
+	defer unlock()
+	destInfo, err := statFile(destPath)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", destPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if destInfo != nil {
+		if destInfo.IsDir() {
+			http.Error(w, "destPath is a directory", http.StatusBadRequest)
+			return
+		}
+		if sameFile(sourceInfo, destInfo) {
+			http.Error(w, "sourcePath and destPath are the same file", http.StatusBadRequest)
+			return
+		}
+		if !overwrite {
+			http.Error(w, "destPath already exists; set overwrite=true to replace it", http.StatusConflict)
+			return
+		}
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		action := "create"
+		if destInfo != nil {
+			action = "replace"
+		}
+		writeJSON(w, "Dry run: file not linked", requestId, dryRunReport(r, []dryRunEntry{
+			{Path: destPath, Action: action, Size: sourceInfo.Size()},
+		}))
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// Like a replaced symbolic link, the link is made under a temporary
+	// name and renamed over destPath.
+	tmp := filepath.Join(filepath.Dir(destPath), ".frw-link-"+requestId)
+	err = os.Link(sourcePath, tmp)
+	if err == nil {
+		if err = os.Rename(tmp, destPath); err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		discardBackup(backup)
+		if errors.Is(err, syscall.EXDEV) {
+			http.Error(w, "sourcePath and destPath are on different filesystems", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to link file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "link", destPath, existed, backup)
+	data := map[string]interface{}{
+		"size": sourceInfo.Size(),
+	}
+	if info, err := os.Lstat(destPath); err == nil {
+		var stat fileStat
+		addSysStat(&stat, info)
+		if stat.Links != nil {
+			data["links"] = *stat.Links
+		}
+	}
+	writeJSON(w, "File linked successfully", requestId, data)
+}
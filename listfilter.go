@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listOptions are the sorting and filtering options of listFiles. They work
+// on listing entries rather than on the files, so listings merged from
+// gateway upstreams can be sorted the same way.
+type listOptions struct {
+	sortBy         string
+	descending     bool
+	nameContains   string
+	exts           []string
+	minSize        int64
+	maxSize        int64
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+	includeHidden  bool
+	excludes       []string
+}
+
+// formListOptions parses the sorting and filtering form values of r: sort
+// (name, size or mtime) and order (asc or desc), and the filters
+// nameContains, ext (a comma-separated list), minSize, maxSize,
+// modifiedAfter, modifiedBefore, includeHidden and excludePatterns. The
+// last two default to config.ListHidden and config.ListExcludePatterns.
+func formListOptions(r *http.Request) (*listOptions, error) {
+	opts := &listOptions{
+		maxSize:       -1,
+		includeHidden: config.ListHidden,
+		excludes:      config.ListExcludePatterns,
+	}
+	switch opts.sortBy = r.FormValue("sort"); opts.sortBy {
+	case "", "name", "size", "mtime":
+	default:
+		return nil, fmt.Errorf("Invalid sort value: %s", opts.sortBy)
+	}
+	switch order := r.FormValue("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.descending = true
+	default:
+		return nil, fmt.Errorf("Invalid order value: %s", order)
+	}
+	opts.nameContains = r.FormValue("nameContains")
+	if value := r.FormValue("ext"); value != "" {
+		for _, ext := range strings.Split(value, ",") {
+			ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+			if ext == "" {
+				return nil, fmt.Errorf("Invalid ext value: %s", value)
+			}
+			opts.exts = append(opts.exts, "."+strings.ToLower(ext))
+		}
+	}
+	var err error
+	if opts.minSize, err = formSize(r, "minSize", 0); err != nil {
+		return nil, err
+	}
+	if opts.maxSize, err = formSize(r, "maxSize", -1); err != nil {
+		return nil, err
+	}
+	if opts.modifiedAfter, err = formTime(r, "modifiedAfter", time.Time{}); err != nil {
+		return nil, err
+	}
+	if opts.modifiedBefore, err = formTime(r, "modifiedBefore", time.Time{}); err != nil {
+		return nil, err
+	}
+	if r.FormValue("includeHidden") != "" {
+		if opts.includeHidden, err = formBool(r, "includeHidden"); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := r.Form["excludePatterns"]; ok {
+		if opts.excludes, err = formGlobs(r, "excludePatterns"); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// formGlobs parses the optional form value name as globs for matchPathGlob,
+// given comma-separated or as repeated values.
+func formGlobs(r *http.Request, name string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(strings.Join(r.Form[name], ","), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if err := checkGlob(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid %s value %s: %s", name, pattern, err.Error())
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matchPathGlob reports whether the entry at the slash-separated relative
+// path relPath matches pattern. Patterns without a slash are matched against
+// the last element, the others against the whole path.
+func matchPathGlob(pattern, relPath string) bool {
+	target := path.Base(relPath)
+	if strings.Contains(pattern, "/") {
+		target = relPath
+	}
+	ok, _ := matchGlob(pattern, target)
+	return ok
+}
+
+// formSize parses the optional size in bytes form value name, returning def
+// when it is missing.
+func formSize(r *http.Request, name string, def int64) (int64, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s value", name)
+	}
+	return n, nil
+}
+
+// sorted reports whether the options ask for a sorted listing.
+func (o *listOptions) sorted() bool {
+	return o.sortBy != ""
+}
+
+// hidden reports whether the entry at the slash-separated relative path
+// relPath is left out as a dotfile or by an exclude pattern, matched with
+// matchPathGlob. Recursive walks skip the contents of hidden directories.
+func (o *listOptions) hidden(relPath string) bool {
+	name := path.Base(relPath)
+	if !o.includeHidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, pattern := range o.excludes {
+		if matchPathGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the listing entry passes the filters. The name
+// filters look at the last element of fileName, which is a relative path
+// in recursive listings.
+func (o *listOptions) match(entry map[string]interface{}) bool {
+	if o.hidden(entryName(entry)) {
+		return false
+	}
+	name := path.Base(entryName(entry))
+	if o.nameContains != "" && !strings.Contains(name, o.nameContains) {
+		return false
+	}
+	if len(o.exts) > 0 {
+		ext := strings.ToLower(path.Ext(name))
+		found := false
+		for _, e := range o.exts {
+			if e == ext {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	size := entrySize(entry)
+	if size < o.minSize || (o.maxSize >= 0 && size > o.maxSize) {
+		return false
+	}
+	if !o.modifiedAfter.IsZero() || !o.modifiedBefore.IsZero() {
+		modTime := entryModTime(entry)
+		if !o.modifiedAfter.IsZero() && !modTime.After(o.modifiedAfter) {
+			return false
+		}
+		if !o.modifiedBefore.IsZero() && !modTime.Before(o.modifiedBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// filter returns the entries passing the filters.
+func (o *listOptions) filter(entries []map[string]interface{}) []map[string]interface{} {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if o.match(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// sort orders entries as asked for, by name when no order is given. Ties
+// are broken by name so the order is stable across requests.
+func (o *listOptions) sort(entries []map[string]interface{}) {
+	less := func(a, b map[string]interface{}) bool {
+		switch o.sortBy {
+		case "size":
+			if sa, sb := entrySize(a), entrySize(b); sa != sb {
+				return sa < sb
+			}
+		case "mtime":
+			if ta, tb := entryModTime(a), entryModTime(b); !ta.Equal(tb) {
+				return ta.Before(tb)
+			}
+		}
+		return entryName(a) < entryName(b)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if o.descending {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+// entryName returns the fileName of a listing entry.
+func entryName(entry map[string]interface{}) string {
+	name, _ := entry["fileName"].(string)
+	return name
+}
+
+// entrySize returns the size of a listing entry, which is a float64 in
+// entries decoded from an upstream's response.
+func entrySize(entry map[string]interface{}) int64 {
+	switch size := entry["size"].(type) {
+	case int64:
+		return size
+	case int:
+		return int64(size)
+	case float64:
+		return int64(size)
+	}
+	return 0
+}
+
+// entryModTime returns the modTime of a listing entry, which is a string in
+// entries decoded from an upstream's response.
+func entryModTime(entry map[string]interface{}) time.Time {
+	switch modTime := entry["modTime"].(type) {
+	case time.Time:
+		return modTime
+	case string:
+		t, _ := time.Parse(time.RFC3339Nano, modTime)
+		return t
+	}
+	return time.Time{}
+}
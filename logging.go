@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// setupLogging applies the configured log format and ships logs to syslog
+// when asked to.
+func setupLogging() error {
+	switch config.LogFormat {
+	case "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "journald":
+		logrus.SetFormatter(&journaldFormatter{})
+	default:
+		return fmt.Errorf("Invalid logFormat %q: must be text, json or journald", config.LogFormat)
+	}
+	if config.Syslog != "" {
+		if err := addSyslogHook(config.Syslog, config.SyslogTag); err != nil {
+			return fmt.Errorf("Unable to connect to syslog: %w", err)
+		}
+	}
+	return nil
+}
+
+// journaldFormatter writes text lines without a timestamp, which journald
+// adds itself, prefixed with the <N> syslog priority journald reads the
+// level from.
+type journaldFormatter struct {
+	logrus.TextFormatter
+}
+
+func (f *journaldFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	f.DisableTimestamp = true
+	f.DisableColors = true
+	line, err := f.TextFormatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(fmt.Sprintf("<%d>", journaldPriority(entry.Level))), bytes.TrimLeft(line, " ")...), nil
+}
+
+// journaldPriority maps a logrus level to the syslog priority of the same
+// severity.
+func journaldPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0
+	case logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7
+}
@@ -0,0 +1,66 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogHook sends every log entry to syslog as well, at the matching
+// severity. Entries are formatted on their own, as syslog adds the timestamp
+// and the console format may carry journald prefixes.
+type syslogHook struct {
+	writer    *syslog.Writer
+	formatter logrus.Formatter
+}
+
+// addSyslogHook sends every log entry to syslog as well. target is "local"
+// for the local syslog daemon, or a URL such as udp://loghost:514 or
+// tcp://loghost:601 for a remote one.
+func addSyslogHook(target string, tag string) error {
+	network, addr := "", ""
+	if target != "local" {
+		u, err := url.Parse(target)
+		if err != nil {
+			return err
+		}
+		network, addr = u.Scheme, u.Host
+	}
+	writer, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return err
+	}
+	logrus.AddHook(&syslogHook{
+		writer:    writer,
+		formatter: &logrus.TextFormatter{DisableTimestamp: true, DisableColors: true},
+	})
+	return nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	msg := string(line)
+	switch entry.Level {
+	case logrus.PanicLevel:
+		return h.writer.Emerg(msg)
+	case logrus.FatalLevel:
+		return h.writer.Crit(msg)
+	case logrus.ErrorLevel:
+		return h.writer.Err(msg)
+	case logrus.WarnLevel:
+		return h.writer.Warning(msg)
+	case logrus.InfoLevel:
+		return h.writer.Info(msg)
+	}
+	return h.writer.Debug(msg)
+}
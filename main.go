@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"mime"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -19,37 +24,224 @@ import (
 var serverId string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mount" {
+		if err := runMount(os.Args[2:]); err != nil {
+			logrus.Fatalf("Unable to mount: %s", err.Error())
+		}
+		return
+	}
+	loadConfig()
+	if err := setupLogging(); err != nil {
+		logrus.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	if err := openAccessLog(); err != nil {
+		logrus.Fatalf("Unable to open access log: %s", err.Error())
+	}
+	loadAPIKeys()
+	loadACL()
+	loadReadOnly()
+	if err := loadContentSchemas(); err != nil {
+		logrus.Fatalf("Unable to load content schemas: %s", err.Error())
+	}
+	if err := setupEncryption(); err != nil {
+		logrus.Fatalf("Unable to load master keys: %s", err.Error())
+	}
+	if err := setupSigningKey(); err != nil {
+		logrus.Fatalf("Unable to set up URL signing: %s", err.Error())
+	}
 	serverId = generateUUID()
 	logrus.WithFields(logrus.Fields{
 		"serverId": serverId,
 	}).Info("Starting server")
-	http.HandleFunc("/writeFile", writeFile)
-	http.HandleFunc("/readFile", readFile)
-	http.HandleFunc("/listFiles", listFiles)
-	http.HandleFunc("/deleteFile", deleteFile)
-	http.HandleFunc("/generateFiles", generateFiles)
+	if err := setupJWT(); err != nil {
+		logrus.Fatalf("Unable to set up JWT verification: %s", err.Error())
+	}
+	if err := loadJournal(); err != nil {
+		logrus.Fatalf("Unable to load operation journal: %s", err.Error())
+	}
+	handle("/writeFile", opWrite, writeFile)
+	handle("/readFile", opRead, compressed(readFile))
+	handle("/listFiles", opRead, compressed(listFiles))
+	handle("/findFiles", opRead, compressed(findFiles))
+	handle("/diskUsage", opRead, diskUsage)
+	handle("/df", opRead, diskFreeHandler)
+	handle("/tailFile", opRead, tailFile)
+	handle("/readLines", opRead, compressed(readLines))
+	handle("/checksum", opRead, compressed(checksum))
+	handle("/statFile", opRead, statFileHandler)
+	handle("/detectType", opRead, detectFileType)
+	handle("/convertEncoding", opWrite, convertEncoding)
+	handle("/convertEOL", opWrite, convertEOL)
+	handle("/appendFile", opWrite, appendFile)
+	handle("/writeAt", opWrite, writeAt)
+	handle("/patchFile", opWrite, patchFile)
+	handle("/copyFile", opWrite, copyFile)
+	handle("/concatFiles", opWrite, concatFiles)
+	handle("/splitFile", opWrite, splitFile)
+	handle("/compressFile", opWrite, compressFile)
+	handle("/decompressFile", opWrite, decompressFile)
+	handle("/archive", opRead, archive)
+	handle("/extract", opWrite, extract)
+	handle("/moveFile", opWrite, moveFile)
+	handle("/deleteFile", opDelete, deleteFile)
+	handle("/createDir", opWrite, createDir)
+	handle("/deleteDir", opDelete, deleteDir)
+	handle("/chmod", opWrite, chmodFile)
+	handle("/touch", opWrite, touchFile)
+	handle("/symlink", opWrite, createSymlink)
+	handle("/readLink", opRead, readLink)
+	handle("/linkFile", opWrite, linkFile)
+	handle("/xattr", opRead, getXattrs)
+	handle("/xattr/set", opWrite, setXattrHandler)
+	handle("/xattr/remove", opWrite, removeXattrHandler)
+	handle("/generateFiles", opGenerate, generateFiles)
+	handle("/generateFromTemplate", opGenerate, generateFromTemplate)
+	handle("/renderTemplate", opWrite, renderTemplate)
+	handle("/undo", opWrite, undo)
+	handle("/history", opRead, history)
+	handle("/seed", opWrite, seed)
+	handle("/upload", opWrite, uploadFiles)
+	handle("/upload/start", opWrite, startUpload)
+	handle("/upload/chunk", opWrite, uploadChunk)
+	handle("/upload/status", opRead, uploadStatus)
+	handle("/upload/complete", opWrite, completeUpload)
+	handle("/upload/abort", opWrite, abortUpload)
+	handle("/compare", opRead, compare)
+	handle("/diffFiles", opRead, compressed(diffFiles))
+	handle("/claim", opCoordinate, claimFile)
+	handle("/release", opCoordinate, finishClaimHandler(false))
+	handle("/complete", opCoordinate, finishClaimHandler(true))
+	handle("/renew", opCoordinate, renewClaimHandler)
+	handle("/coord/semaphore/acquire", opCoordinate, coordSemaphoreAcquire)
+	handle("/coord/semaphore/release", opCoordinate, coordSemaphoreRelease)
+	handle("/coord/counter", opCoordinate, coordCounter)
+	handle("/coord/barrier/wait", opCoordinate, coordBarrierWait)
+	handle("/download", opRead, compressed(downloadFile))
+	handle("/sign", opRead, signURL)
+	handle("/bulkWrite", opWrite, bulkWrite)
+	handle("/bulkRead", opRead, bulkRead)
+	handle("/admin/audit", opAdmin, listAudit)
+	handle("/admin/jobs", opAdmin, listJobs)
+	handle("/admin/jobs/cancel", opAdmin, cancelJob)
+	handle("/admin/maintenance", opAdmin, maintenanceMode)
+	handle("/admin/readOnly", opAdmin, readOnlyMode)
+	handle("/admin/lifecycle/run", opAdmin, runLifecycleNow)
+	handle("/admin/breaker", opAdmin, breakerStatus)
+	handle("/metrics", opAdmin, metricsHandler)
+	handle("/selftest", opAdmin, selftest)
+	handle("/admin/debug", opAdmin, debugMode)
+	handle("/admin/faults", opAdmin, faultInjection)
+	handle("/admin/faults/remove", opAdmin, removeFaultHandler)
+	handle("/admin/keys", opAdmin, apiKeysHandler)
+	handle("/admin/keys/revoke", opAdmin, revokeAPIKeyHandler)
+	handle("/admin/acl", opAdmin, aclHandler)
+	handle("/admin/acl/remove", opAdmin, removeACLRuleHandler)
+	handle("/admin/tenants", opAdmin, listTenants)
+	handle("/admin/encryption/keys", opAdmin, rotateKeysHandler)
+
+	startLifecycleWorker()
+	startBreakerProbe()
+	startMetricsPush()
+	startChaosScheduler()
 
-	http.ListenAndServe(":8081", nil)
+	tlsConfig, err := setupTLS()
+	if err != nil {
+		logrus.Fatalf("Unable to load TLS certificate: %s", err.Error())
+	}
+	server := &http.Server{
+		Addr:      config.Addr,
+		Handler:   withMiddleware(http.DefaultServeMux),
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	logrus.Fatalf("Server stopped: %s", err.Error())
 }
 
 func generateUUID() string {
 	id, _ := uuid.NewRandom()
 	return id.String()
 }
+
+// formBool parses the optional boolean form value name, which defaults to
+// false when missing.
+func formBool(r *http.Request, name string) (bool, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s value", name)
+	}
+	return b, nil
+}
+
+// formDuration parses the optional duration form value name, returning def
+// when it is missing.
+func formDuration(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid %s value", name)
+	}
+	return d, nil
+}
+
+// formPositiveInt parses the required positive integer form value name.
+func formPositiveInt(r *http.Request, name string) (int, error) {
+	n, err := strconv.Atoi(r.FormValue(name))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid %s value", name)
+	}
+	return n, nil
+}
+
+// formMode parses the optional octal permission form value name, such as
+// 0755, returning def when it is missing. Modes with bits outside
+// config.ModeMask are refused.
+func formMode(r *http.Request, name string, def os.FileMode) (os.FileMode, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid %s value", name)
+	}
+	if mask := os.FileMode(config.ModeMask); os.FileMode(mode)&^mask != 0 {
+		return 0, fmt.Errorf("Invalid %s value: %04o sets bits outside the allowed %04o", name, mode, mask)
+	}
+	return os.FileMode(mode), nil
+}
+
 func writeJSON(w http.ResponseWriter, msg string, requestId string, data interface{}) {
+	writeJSONStatus(w, http.StatusOK, msg, requestId, data)
+}
+
+// writeJSONStatus is writeJSON with a status code other than 200 OK.
+func writeJSONStatus(w http.ResponseWriter, status int, msg string, requestId string, data interface{}) {
 	res := map[string]interface{}{
 		"message":   msg,
 		"serverId":  serverId,
 		"requestId": requestId,
 		"data":      data,
 	}
-	responseData, err := json.Marshal(res)
-	if err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(res); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create JSON response: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(responseData))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
 }
 
 func writeFile(w http.ResponseWriter, r *http.Request) {
@@ -60,10 +252,75 @@ func writeFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filePath := r.FormValue("filePath")
-	fileContent := r.FormValue("fileContent")
+	body, size, err := streamedContent(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read fileContent: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	encoding, err := formEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body != nil && encoding != "" {
+		http.Error(w, "encoding only applies to the fileContent form value; streamed content is written as is", http.StatusBadRequest)
+		return
+	}
+	// Without a mode an existing file keeps its own and a new one gets 0644.
+	var mode *os.FileMode
+	if r.FormValue("mode") != "" {
+		m, err := formMode(r, "mode", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mode = &m
+	}
+	dirMode, err := formMode(r, "dirMode", 0755)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	owner, err := formOwner(r)
+	if errors.Is(err, errOwnerNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientKey, err := requestClientKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	eol, err := formEOL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fileContent := ""
+	if body == nil {
+		if fileContent, err = formFileContent(r, encoding); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		size = int64(len(fileContent))
+	}
+	loggedContent := fileContent
+	if clientKey != nil {
+		// Content the client encrypts stays out of the logs too.
+		loggedContent = ""
+	}
 	logrus.WithFields(logrus.Fields{
 		"filePath":    filePath,
-		"fileContent": fileContent,
+		"fileContent": loggedContent,
+		"streamed":    body != nil,
+		"size":        size,
 		"requestId":   requestId,
 		"serverId":    serverId,
 	}).Info("Writing file")
@@ -72,28 +329,247 @@ func writeFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "filePath is required", http.StatusBadRequest)
 		return
 	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	if size >= 0 {
+		if err := checkFileSize(r, filePath, size); err != nil {
+			http.Error(w, fmt.Sprintf("File %s", err.Error()), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	validate, err := formBool(r, "validate")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	check, err := contentCheck(r, filePath, validate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if !preconditionsHold(w, r, filePath) {
+		return
+	}
 
-	// Ensure parent directory exists. If filePath is just a filename in the
-	// current working directory, Dir will be "." and we don't need to create it.
-	dir := filepath.Dir(filePath)
-	if dir != "." {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		// Only an existing file is affected, by being replaced.
+		var replaced []dryRunEntry
+		if fileInfo, err := statFile(filePath); err == nil {
+			replaced = append(replaced, dryRunEntry{Path: filePath, Action: "replace", Size: fileInfo.Size()})
+		} else if !os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
 			return
 		}
+		writeJSON(w, "Dry run: file not written", requestId, dryRunReport(r, replaced))
+		return
 	}
 
-	err := os.WriteFile(filePath, []byte(fileContent), 0644)
+	if err := ensureParentDirMode(filePath, dirMode); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	existed, backup, err := backupFile(filePath)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
+	// With a client key only the ciphertext is stored, and the content is
+	// validated and scanned before it is encrypted. Normalized line endings
+	// can make it larger than was checked above.
+	store := func(src io.Reader) error {
+		if eol != "" {
+			src = &cappedReader{r: normalizeEOL(src, eol), limit: sizeLimit(r, filePath)}
+		}
+		if check != nil {
+			src = &validatingReader{src: src, check: check}
+		}
+		scanned := scanUpload(src, filePath, requestActor(r))
+		defer scanned.Close()
+		src = scanned
+		if clientKey != nil {
+			if src, err = newEncryptReader(src, clientKey); err != nil {
+				return err
+			}
+		}
+		_, err := storeFileMode(filePath, src, mode, owner)
+		return err
+	}
+	if body != nil {
+		err = store(body)
+	} else {
+		err = retryFS("write", func() error {
+			return store(strings.NewReader(fileContent))
+		})
+	}
+	if err != nil {
+		discardBackup(backup)
+		status := scanStatus(err)
+		switch {
+		case errors.Is(err, errTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, errInvalidContent):
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), status)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "write", filePath, existed, backup)
+	// The new tag lets the client make its next write conditional without
+	// reading the file again.
+	if fileInfo, err := statFile(filePath); err == nil {
+		w.Header().Set("ETag", fileETag(fileInfo))
+	}
+	if clientKey != nil {
+		w.Header().Set(clientKeyFingerprintHeader, keyFingerprint(clientKey))
+	}
 	writeJSON(w, "File written successfully", requestId, nil)
 }
 
+// streamedContent returns the content of a writeFile request that is
+// streamed rather than held in memory, along with its size or -1 if unknown:
+// a fileContent file part of a multipart form, or the request body itself
+// when it isn't a form. It returns a nil reader when the content is the
+// fileContent form value.
+func streamedContent(r *http.Request) (io.ReadCloser, int64, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "", "application/x-www-form-urlencoded":
+		return nil, 0, nil
+	case "multipart/form-data":
+		// Parts larger than the memory limit of ParseMultipartForm are
+		// spooled to temporary files.
+		f, header, err := r.FormFile("fileContent")
+		if errors.Is(err, http.ErrMissingFile) {
+			return nil, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, header.Size, nil
+	}
+	return r.Body, r.ContentLength, nil
+}
+
+// ensureParentDir makes sure the parent directory of filePath exists. If
+// filePath is just a filename in the current working directory, Dir will be
+// "." and we don't need to create it.
+func ensureParentDir(filePath string) error {
+	return ensureParentDirMode(filePath, 0755)
+}
+
+// ensureParentDirMode is ensureParentDir creating missing directories with
+// mode.
+func ensureParentDirMode(filePath string, mode os.FileMode) error {
+	dir := filepath.Dir(filePath)
+	if dir == "." {
+		return nil
+	}
+	return os.MkdirAll(dir, mode)
+}
+
+// storeFile writes content to filePath, replacing the file if it exists.
+func storeFile(filePath string, content string) error {
+	return retryFS("write", func() error {
+		_, err := storeFileFrom(filePath, strings.NewReader(content))
+		return err
+	})
+}
+
+// storeFileFrom streams src into filePath, replacing the file if it exists,
+// and returns the number of bytes written. The content goes to a temporary
+// file next to filePath, which is synced and then renamed over it, so
+// readers see the old content or the new one but never part of it, and
+// neither a transfer failing halfway nor a crash leaves a truncated file.
+// With config.SyncDir the directory is synced too, making the rename itself
+// durable.
+func storeFileFrom(filePath string, src io.Reader) (int64, error) {
+	return storeFileMode(filePath, src, nil, nil)
+}
+
+// storeFileMode is storeFileFrom giving the file mode and owner, unless they
+// are nil. The file never has any other mode, not even while it is written.
+func storeFileMode(filePath string, src io.Reader, mode *os.FileMode, owner *fileOwner) (int64, error) {
+	// Write through symlinks instead of replacing them, and keep the mode
+	// and owner of the file being replaced unless told otherwise.
+	if target, err := filepath.EvalSymlinks(filePath); err == nil {
+		filePath = target
+	}
+	replaced, _ := os.Stat(filePath)
+	perm := os.FileMode(0644)
+	if mode != nil {
+		perm = *mode
+	} else if replaced != nil {
+		perm = replaced.Mode().Perm()
+	}
+
+	// With encryption at rest the ciphertext is written, but the size of
+	// the content returned.
+	var counted *cappedReader
+	if atRestEnabled() {
+		counted = &cappedReader{r: src}
+		encrypted, err := encryptAtRest(counted)
+		if err != nil {
+			return 0, err
+		}
+		src = encrypted
+	}
+
+	dir := filepath.Dir(filePath)
+	tmp, err := os.CreateTemp(dir, ".frw-write-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, src)
+	if counted != nil {
+		size = counted.read
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = chownWritten(tmp.Name(), replaced, owner)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err == nil && config.SyncDir {
+		err = syncDir(dir)
+	}
+	return size, err
+}
+
+// syncDir flushes the entries of dir to disk, so files just created or
+// renamed in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func readFile(w http.ResponseWriter, r *http.Request) {
 	requestId := generateUUID()
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -105,7 +581,108 @@ func readFile(w http.ResponseWriter, r *http.Request) {
 		"serverId":  serverId,
 	}).Info("Reading file")
 
-	data, err := os.ReadFile(filePath)
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	reportLinks, err := formSymlinks(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reportLinks {
+		// A link is described rather than read through.
+		if info, err := os.Lstat(filePath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Unable to read link: %s", err.Error()), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, "File is a symbolic link", requestId, map[string]interface{}{
+				"symlink":    true,
+				"linkTarget": clientLinkTarget(r, target),
+			})
+			return
+		}
+	}
+
+	// A file written with a client key is only read with that key.
+	clientKey, err := requestClientKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encrypted, err := clientEncrypted(filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if encrypted && clientKey == nil {
+		http.Error(w, errNoClientKey.Error(), clientKeyStatus(errNoClientKey))
+		return
+	}
+
+	if r.Method == http.MethodHead && clientKey == nil {
+		// The headers of the raw content tell the file's size, type,
+		// modification time and ETag.
+		streamFile(w, r, filePath, requestId)
+		return
+	}
+	encoding, err := formEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// charset names the charset of a text file to decode to UTF-8 for the
+	// JSON envelope, or auto to detect it.
+	charset := r.FormValue("charset")
+	if charset != "" && encoding != "" {
+		http.Error(w, "charset and encoding are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+	// Large files are streamed raw unless the JSON envelope is asked for,
+	// explicitly or by asking for an encoding or charset, since embedding
+	// them in a JSON string means holding them in memory.
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "json"
+		if fileInfo, err := statFile(filePath); err == nil && encoding == "" && charset == "" && config.StreamThreshold > 0 && fileInfo.Size() > config.StreamThreshold {
+			format = "raw"
+		}
+	case "json", "raw":
+	default:
+		http.Error(w, fmt.Sprintf("Invalid format: %s", format), http.StatusBadRequest)
+		return
+	}
+	if charset != "" && format == "raw" {
+		http.Error(w, "charset only applies to the JSON envelope", http.StatusBadRequest)
+		return
+	}
+	eol, err := formEOL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	content := contentOptions{encoding: encoding, charset: charset, eol: eol}
+	if clientKey != nil {
+		readEncryptedFile(w, r, filePath, clientKey, format, content, requestId)
+		return
+	}
+	if format == "raw" && eol != "" {
+		streamNormalized(w, r, filePath, eol, requestId)
+		return
+	}
+	if format == "raw" {
+		streamFile(w, r, filePath, requestId)
+		return
+	}
+	if fileInfo, err := statFile(filePath); err == nil && !fileInfo.IsDir() && notModified(w, r, fileInfo) {
+		return
+	}
+
+	data, release, err := readFileMapped(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			http.Error(w, "File not found", http.StatusNotFound)
@@ -114,11 +691,100 @@ func readFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
+	defer release()
+	if offset, length, ok, err := formRange(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if ok {
+		if offset > int64(len(data)) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			http.Error(w, "offset is beyond the end of the file", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		data = data[offset:]
+		if length >= 0 && length < int64(len(data)) {
+			data = data[:length]
+		}
+	}
+	// The JSON envelope is built before anything is written, so a file
+	// truncated under its mapping can still be answered with an error.
+	if err := readMapped(func() { writeFileContent(w, data, content, requestId) }); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// contentOptions say how readFile puts file content in the JSON envelope.
+type contentOptions struct {
+	// encoding is base64 or "" for text.
+	encoding string
+	// charset is the charset to decode text from, auto to detect it, or
+	// "" to send it as it is.
+	charset string
+	// eol is the line ending to normalize to, or "" to keep them.
+	eol string
+}
+
+// writeFileContent answers a readFile request with data in the JSON
+// envelope, as opts say.
+func writeFileContent(w http.ResponseWriter, data []byte, opts contentOptions, requestId string) {
+	if opts.encoding == "base64" {
+		writeJSON(w, "File read successfully", requestId, map[string]interface{}{
+			"fileContent": base64.StdEncoding.EncodeToString(normalizeEOLBytes(data, opts.eol)),
+			"encoding":    opts.encoding,
+		})
+		return
+	}
+	if opts.charset != "" {
+		// Line endings are found in the decoded text, since a UTF-16
+		// newline is two bytes.
+		text, name, err := decodeCharset(data, opts.charset)
+		if err != nil {
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, errUnknownCharset) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, fmt.Sprintf("Unable to decode file: %s", err.Error()), status)
+			return
+		}
+		writeJSON(w, "File read successfully", requestId, map[string]interface{}{
+			"fileContent": string(normalizeEOLBytes([]byte(text), opts.eol)),
+			"charset":     name,
+		})
+		return
+	}
 	writeJSON(w, "File read successfully", requestId, map[string]interface{}{
-		"fileContent": string(data),
+		"fileContent": string(normalizeEOLBytes(data, opts.eol)),
 	})
 }
 
+// formFileContent returns the fileContent form value, decoded as encoding
+// says.
+func formFileContent(r *http.Request, encoding string) (string, error) {
+	fileContent := r.FormValue("fileContent")
+	if encoding != "base64" {
+		return fileContent, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(fileContent)
+	if err != nil {
+		return "", fmt.Errorf("Invalid base64 fileContent: %s", err.Error())
+	}
+	return string(decoded), nil
+}
+
+// formEncoding parses the optional encoding form value, which says how
+// fileContent is encoded in form values and JSON: text, the default, or
+// base64 for binary content. Empty means text.
+func formEncoding(r *http.Request) (string, error) {
+	switch encoding := r.FormValue("encoding"); encoding {
+	case "", "text":
+		return "", nil
+	case "base64":
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("Invalid encoding: %s", encoding)
+	}
+}
+
 func listFiles(w http.ResponseWriter, r *http.Request) {
 	requestId := generateUUID()
 	if r.Method != http.MethodGet {
@@ -133,7 +799,99 @@ func listFiles(w http.ResponseWriter, r *http.Request) {
 		"serverId":  serverId,
 	}).Info("Listing files")
 
-	files, err := os.ReadDir(dirPath)
+	dirPath, err := resolvePath(r, dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	// A missing dirPath means the root, which authorize doesn't see.
+	if err := checkPathScope(r, dirPath); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), http.StatusForbidden)
+		return
+	}
+
+	if _, err := formSymlinks(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := formListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recursive, err := formBool(r, "recursive")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxDepth := 0
+	if r.FormValue("maxDepth") != "" {
+		if maxDepth, err = formPositiveInt(r, "maxDepth"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !recursive {
+			http.Error(w, "maxDepth only applies with recursive=true", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch format := r.FormValue("format"); format {
+	case "", "json":
+	case "ndjson":
+		if opts.sorted() {
+			http.Error(w, "sort is not supported with format=ndjson", http.StatusBadRequest)
+			return
+		}
+		if recursive {
+			streamFileTree(w, r, dirPath, maxDepth, opts, requestId)
+			return
+		}
+		streamFileList(w, r, dirPath, opts, requestId)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("Invalid format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	if recursive {
+		var mu sync.Mutex
+		var fileInfoList []map[string]interface{}
+		err := walkTree(r.Context(), dirPath, maxDepth, func(relPath string, entry fs.DirEntry) error {
+			if opts.hidden(relPath) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			fileInfo, err := fileListEntry(r, dirPath, relPath)
+			if err != nil {
+				return err
+			}
+			if !opts.match(fileInfo) {
+				return nil
+			}
+			mu.Lock()
+			fileInfoList = append(fileInfoList, fileInfo)
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read directory: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		// The tree is walked concurrently, so entries come in no particular
+		// order and are sorted by path unless asked otherwise.
+		opts.sort(fileInfoList)
+		writeJSON(w, "Files listed successfully", requestId, fileInfoList)
+		return
+	}
+
+	var files []os.DirEntry
+	err = retryFS("readDir", func() (err error) {
+		files, err = os.ReadDir(dirPath)
+		return err
+	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unable to read directory: %s", err.Error()), http.StatusInternalServerError)
 		return
@@ -141,21 +899,59 @@ func listFiles(w http.ResponseWriter, r *http.Request) {
 
 	var fileInfoList []map[string]interface{}
 	for _, file := range files {
-		filePath := path.Join(dirPath, file.Name())
-		fileInfo, err := os.Stat(filePath)
+		fileInfo, err := fileListEntry(r, dirPath, file.Name())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fileInfoList = append(fileInfoList, map[string]interface{}{
-			"fileName": file.Name(),
-			"size":     fileInfo.Size(), // Size in bytes
-		})
+		if opts.match(fileInfo) {
+			fileInfoList = append(fileInfoList, fileInfo)
+		}
+	}
+	if opts.sorted() {
+		opts.sort(fileInfoList)
 	}
 
 	writeJSON(w, "Files listed successfully", requestId, fileInfoList)
 }
 
+// fileListEntry describes the file name inside dirPath for listFiles; name
+// is a slash-separated path relative to dirPath in recursive listings. It
+// carries what clients would otherwise stat each file for: type, size, mode
+// and modification time. Symbolic links are followed unless r asks for
+// symlinks=report; either way a link is marked as one, and one leading
+// nowhere is listed as the link.
+func fileListEntry(r *http.Request, dirPath string, name string) (map[string]interface{}, error) {
+	filePath := filepath.Join(dirPath, filepath.FromSlash(name))
+	report, _ := formSymlinks(r)
+	fileInfo, err := os.Lstat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get info for file %s: %w", filePath, err)
+	}
+	isLink := fileInfo.Mode()&fs.ModeSymlink != 0
+	if isLink && !report {
+		if targetInfo, err := statFile(filePath); err == nil {
+			fileInfo = targetInfo
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("Unable to get info for file %s: %s", filePath, err.Error())
+		}
+	}
+	entry := map[string]interface{}{
+		"fileName": name,
+		"size":     fileInfo.Size(), // Size in bytes
+		"isDir":    fileInfo.IsDir(),
+		"modTime":  fileInfo.ModTime(),
+		"mode":     fmt.Sprintf("%04o", fileInfo.Mode().Perm()),
+		"symlink":  isLink,
+	}
+	if isLink {
+		if target, err := os.Readlink(filePath); err == nil {
+			entry["linkTarget"] = clientLinkTarget(r, target)
+		}
+	}
+	return entry, nil
+}
+
 // New function to handle file deletion
 func deleteFile(w http.ResponseWriter, r *http.Request) {
 	requestId := generateUUID()
@@ -171,7 +967,39 @@ func deleteFile(w http.ResponseWriter, r *http.Request) {
 		"serverId":  serverId,
 	}).Info("Deleting file")
 
-	err := os.Remove(filePath)
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if !preconditionsHold(w, r, filePath) {
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		fileInfo, err := os.Lstat(filePath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, fmt.Sprintf("File not found: %s", err), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "Dry run: file not deleted", requestId, dryRunReport(r, []dryRunEntry{
+			{Path: filePath, Action: "delete", Size: fileInfo.Size()},
+		}))
+		return
+	}
+
+	backup, err := trashFile(filePath)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, fmt.Sprintf("File not found: %s", err), http.StatusNotFound)
@@ -180,6 +1008,7 @@ func deleteFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Unable to delete file: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
+	recordOperation(requestActor(r), requestId, "delete", filePath, true, backup)
 	writeJSON(w, "File deleted successfully", requestId, nil)
 }
 
@@ -190,46 +1019,141 @@ func generateFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dirPath := r.FormValue("dirPath")
-	sizeInMBStr := r.FormValue("sizeInMB")
-	sizeInMB, err := strconv.Atoi(sizeInMBStr)
+	dirPath, err := resolvePath(r, r.FormValue("dirPath"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	// A missing dirPath means the root, which authorize doesn't see.
+	if err := checkPathScope(r, dirPath); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dirPath: %s", err.Error()), http.StatusForbidden)
+		return
+	}
+	prefix := strings.ReplaceAll(generateUUID(), "-", "")
+	files, err := formGeneratePlan(r, prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sparse, err := formBool(r, "sparse")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind, err := formContentKind(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	async, err := formBool(r, "async")
 	if err != nil {
-		http.Error(w, "Invalid size value", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var totalSize int64
+	for _, file := range files {
+		totalSize += file.Size
+	}
 
-	filesToGenerate := sizeInMB / 10
-	remainingSize := sizeInMB % 10
+	if async {
+		description := fmt.Sprintf("Generate %d files, %d bytes, in %s", len(files), totalSize, dirPath)
+		j := startJob("generateFiles", description, func(ctx context.Context, j *job) error {
+			err := generateFileSet(ctx, dirPath, files, kind, sparse, j.pauseForMaintenance, j.setProgress)
+			if err == nil {
+				for _, file := range files {
+					j.logf("Generated %s, %d bytes", file.Name, file.Size)
+				}
+			}
+			return err
+		})
+		writeJSON(w, "File generation started", requestId, map[string]interface{}{
+			"jobId": j.id,
+		})
+		return
+	}
 
-	prefix := strings.ReplaceAll(generateUUID(), "-", "")
+	err = generateFileSet(r.Context(), dirPath, files, kind, sparse, nil, func(done, total int64) {
+		setRequestProgress(r.Context(), "filesGenerated", done)
+		setRequestProgress(r.Context(), "filesTotal", total)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
 
-	for i := 0; i < filesToGenerate; i++ {
-		filePath := path.Join(dirPath, fmt.Sprintf("%s_file_%d.txt", prefix, i+1))
-		content := generateContentSize(10) // 10 MB
-		err = os.WriteFile(filePath, []byte(content), 0644)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), http.StatusInternalServerError)
-			return
-		}
+	// The manifest has the sizes actually written.
+	totalSize = 0
+	for _, file := range files {
+		totalSize += file.Size
 	}
+	writeJSON(w, "Files generated successfully", requestId, map[string]interface{}{
+		"files":     files,
+		"count":     len(files),
+		"totalSize": totalSize,
+	})
+}
+
+// generateFileSet writes files, with content of the kind generatedContent
+// names, into dirPath, recording the size each actually has. pause, if not
+// nil, is called before each file is written, and progress, if not nil,
+// after. If ctx is cancelled,
+// because the client went away or the job was cancelled, the files written
+// so far are removed again.
+func generateFileSet(ctx context.Context, dirPath string, files []generatedFile, kind string, sparse bool, pause func(context.Context) error, progress func(done, total int64)) (err error) {
+	var created []string
+	defer func() {
+		if errors.Is(err, context.Canceled) {
+			for _, filePath := range created {
+				os.Remove(filePath)
+			}
+			logrus.WithFields(logrus.Fields{
+				"dirPath": dirPath,
+				"removed": len(created),
+			}).Info("File generation aborted, partial files removed")
+		}
+	}()
 
-	if remainingSize > 0 {
-		filePath := path.Join(dirPath, fmt.Sprintf("%s_file_last.txt", prefix))
-		content := generateContentSize(remainingSize)
-		err = os.WriteFile(filePath, []byte(content), 0644)
+	for i := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if pause != nil {
+			if err := pause(ctx); err != nil {
+				return err
+			}
+		}
+		filePath := filepath.Join(dirPath, files[i].Name)
+		created = append(created, filePath)
+		size, err := writeGeneratedFile(filePath, files[i].Size, kind, sparse)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), http.StatusInternalServerError)
-			return
+			return err
+		}
+		files[i].Size = size
+		if progress != nil {
+			progress(int64(i+1), int64(len(files)))
 		}
 	}
-
-	writeJSON(w, "Files generated successfully", requestId, nil)
+	return nil
 }
 
-func generateContentSize(sizeInMB int) string {
-	const chunk = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789" // 36 bytes
-	chunkSize := len(chunk)
-	totalSize := sizeInMB * 1024 * 1024
-	repeatCount := totalSize / chunkSize
-	return strings.Repeat(chunk, repeatCount)
+// writeGeneratedFile creates filePath with size bytes of generated content
+// of the kind generatedContent names, streamed to disk, and returns the size
+// written. A sparse file is only truncated to the requested size, so no data
+// blocks are written and it is created instantly.
+func writeGeneratedFile(filePath string, size int64, kind string, sparse bool) (int64, error) {
+	if !sparse {
+		return storeFileFrom(filePath, io.LimitReader(generatedContent(kind), size))
+	}
+	if atRestEnabled() {
+		return 0, errors.New("Sparse files can't be encrypted at rest")
+	}
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return size, f.Close()
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRetryAfter is the Retry-After, in seconds, sent while in
+	// maintenance mode when none was given.
+	defaultRetryAfter = 60
+	// defaultDrainWait is how many seconds enabling maintenance mode waits,
+	// when not told otherwise, for the writes in progress to finish.
+	defaultDrainWait = 30
+)
+
+// maintenance is the state of maintenance mode. While it is enabled reads
+// keep working but every mutating request is turned away, so the storage can
+// be snapshotted or migrated safely. Writes already in progress when it is
+// enabled are counted in writers, and the storage is only consistent once
+// they have drained.
+var maintenance struct {
+	sync.RWMutex
+	enabled    bool
+	since      time.Time
+	reason     string
+	retryAfter int
+	writers    int
+	// drained is closed when writers drops to zero after maintenance mode
+	// was enabled with writes still in progress.
+	drained chan struct{}
+}
+
+func inMaintenance() bool {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.enabled
+}
+
+// maintenanceGuard answers mutating requests with 503 while maintenance mode
+// is enabled. Dry runs of endpoints implementing them don't change anything
+// and are let through.
+func maintenanceGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMutating(requestOp(r)) && !isHarmlessDryRun(r) {
+			if !beginWrite() {
+				refuseMaintenance(w)
+				return
+			}
+			defer endWrite()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// beginWrite counts a write as in progress until endWrite is called, so
+// enabling maintenance mode can wait for it. It returns false, counting
+// nothing, while maintenance mode is enabled.
+func beginWrite() bool {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if maintenance.enabled {
+		return false
+	}
+	maintenance.writers++
+	return true
+}
+
+// endWrite ends a write counted by beginWrite.
+func endWrite() {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	maintenance.writers--
+	if maintenance.writers == 0 && maintenance.drained != nil {
+		close(maintenance.drained)
+		maintenance.drained = nil
+	}
+}
+
+// refuseInMaintenance answers with 503 and returns true while maintenance
+// mode is enabled, for handlers that only need to check the mode. Handlers
+// that write on an endpoint the guard lets through use beginWrite instead.
+func refuseInMaintenance(w http.ResponseWriter) bool {
+	if !inMaintenance() {
+		return false
+	}
+	refuseMaintenance(w)
+	return true
+}
+
+// refuseMaintenance answers with 503 and the configured Retry-After.
+func refuseMaintenance(w http.ResponseWriter) {
+	maintenance.RLock()
+	retryAfter := maintenance.retryAfter
+	maintenance.RUnlock()
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Server is in maintenance mode", http.StatusServiceUnavailable)
+}
+
+func maintenanceStatus() map[string]interface{} {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	status := map[string]interface{}{
+		"enabled": maintenance.enabled,
+	}
+	if maintenance.enabled {
+		status["since"] = maintenance.since
+		status["reason"] = maintenance.reason
+		status["retryAfter"] = maintenance.retryAfter
+		status["draining"] = maintenance.writers > 0
+		status["writesInProgress"] = maintenance.writers
+	}
+	return status
+}
+
+// maintenanceMode reports the maintenance mode state on GET and switches it
+// on or off on POST. Enabling it waits up to wait seconds for the writes in
+// progress to finish; if some still haven't, the state is reported as
+// draining until they do.
+func maintenanceMode(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, "Maintenance mode retrieved successfully", requestId, maintenanceStatus())
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled value", http.StatusBadRequest)
+		return
+	}
+	retryAfter := defaultRetryAfter
+	if retryAfterStr := r.FormValue("retryAfter"); retryAfterStr != "" {
+		retryAfter, err = strconv.Atoi(retryAfterStr)
+		if err != nil || retryAfter < 0 {
+			http.Error(w, "Invalid retryAfter value", http.StatusBadRequest)
+			return
+		}
+	}
+	wait := defaultDrainWait
+	if waitStr := r.FormValue("wait"); waitStr != "" {
+		wait, err = strconv.Atoi(waitStr)
+		if err != nil || wait < 0 {
+			http.Error(w, "Invalid wait value", http.StatusBadRequest)
+			return
+		}
+	}
+	reason := r.FormValue("reason")
+	logrus.WithFields(logrus.Fields{
+		"enabled":    enabled,
+		"retryAfter": retryAfter,
+		"reason":     reason,
+		"requestId":  requestId,
+		"serverId":   serverId,
+	}).Info("Setting maintenance mode")
+
+	maintenance.Lock()
+	if enabled && !maintenance.enabled {
+		maintenance.since = time.Now()
+	}
+	maintenance.enabled = enabled
+	maintenance.reason = reason
+	maintenance.retryAfter = retryAfter
+	if enabled && maintenance.writers > 0 && maintenance.drained == nil {
+		maintenance.drained = make(chan struct{})
+	}
+	drained := maintenance.drained
+	maintenance.Unlock()
+
+	recordAudit(auditEvent{
+		Actor:  "admin",
+		Action: "maintenance",
+		Detail: fmt.Sprintf("enabled=%t reason=%q", enabled, reason),
+	})
+
+	if enabled && drained != nil {
+		timer := time.NewTimer(time.Duration(wait) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-drained:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+	status := maintenanceStatus()
+	if draining, _ := status["draining"].(bool); draining {
+		writeJSON(w, "Maintenance mode enabled, writes still in progress", requestId, status)
+		return
+	}
+	writeJSON(w, "Maintenance mode updated successfully", requestId, status)
+}
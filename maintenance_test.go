@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// guardTests are requests to the read-only and maintenance guards, and
+// whether they must be let through while the mode is on. Only dry runs of
+// endpoints that implement them may pass; elsewhere dryRun is ignored and
+// the request would write.
+var guardTests = []struct {
+	name    string
+	method  string
+	target  string
+	form    string
+	through bool
+}{
+	{name: "read", method: "GET", target: "/readFile?filePath=f", through: true},
+	{name: "read with dryRun", method: "GET", target: "/readFile?filePath=f&dryRun=true", through: true},
+	{name: "write", method: "POST", target: "/writeFile", form: "filePath=f"},
+	{name: "write with dryRun=false", method: "POST", target: "/writeFile?dryRun=false"},
+	{name: "dry run in the query", method: "POST", target: "/writeFile?dryRun=true", through: true},
+	{name: "dry run in the body", method: "POST", target: "/writeFile", form: "filePath=f&dryRun=true", through: true},
+	{name: "dry run in a multipart body", method: "POST", target: "/upload", form: "multipart"},
+	{name: "dry run in the query, not in the body", method: "POST", target: "/writeFile?dryRun=true", form: "filePath=f&dryRun=false"},
+	{name: "invalid dryRun in the body", method: "POST", target: "/writeFile?dryRun=true", form: "dryRun=maybe"},
+	{name: "dry run of a delete", method: "POST", target: "/deleteFile?dryRun=1", through: true},
+	{name: "delete", method: "POST", target: "/deleteFile?filePath=f"},
+	{name: "generateFiles ignores dryRun", method: "POST", target: "/generateFiles?dryRun=true"},
+	{name: "bulkWrite ignores dryRun", method: "POST", target: "/bulkWrite?dryRun=true"},
+	{name: "xattr/set ignores dryRun", method: "POST", target: "/xattr/set?dryRun=true"},
+	{name: "xattr/remove ignores dryRun", method: "POST", target: "/xattr/remove?dryRun=true"},
+	{name: "undo ignores dryRun", method: "POST", target: "/undo", form: "dryRun=true"},
+	{name: "upload/chunk ignores dryRun", method: "PUT", target: "/upload/chunk?dryRun=true"},
+	{name: "upload/complete ignores dryRun", method: "POST", target: "/upload/complete?dryRun=true"},
+	{name: "admin", method: "POST", target: "/admin/maintenance", through: true},
+}
+
+// withGuardRoutes registers the endpoints of guardTests.
+func withGuardRoutes(t *testing.T) {
+	t.Helper()
+	for pattern, op := range map[string]string{
+		"/readFile":          opRead,
+		"/writeFile":         opWrite,
+		"/upload":            opWrite,
+		"/deleteFile":        opDelete,
+		"/generateFiles":     opGenerate,
+		"/bulkWrite":         opWrite,
+		"/xattr/set":         opWrite,
+		"/xattr/remove":      opWrite,
+		"/undo":              opWrite,
+		"/upload/chunk":      opWrite,
+		"/upload/complete":   opWrite,
+		"/admin/maintenance": opAdmin,
+	} {
+		withRoute(t, pattern, op)
+	}
+}
+
+// guardRequest builds the request of a guardTests entry.
+func guardRequest(t *testing.T, method, target, form string) *http.Request {
+	t.Helper()
+	if form != "multipart" {
+		r := httptest.NewRequest(method, target, strings.NewReader(form))
+		if form != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		return r
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("dryRun", "true")
+	mw.Close()
+	r := httptest.NewRequest(method, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// runGuard reports whether guard lets r through to the handler, and the
+// status it answered with otherwise.
+func runGuard(guard func(http.Handler) http.Handler, r *http.Request) (bool, *httptest.ResponseRecorder) {
+	reached := false
+	w := httptest.NewRecorder()
+	guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true })).ServeHTTP(w, r)
+	return reached, w
+}
+
+func TestMaintenanceGuard(t *testing.T) {
+	withGuardRoutes(t)
+	maintenance.Lock()
+	maintenance.enabled, maintenance.retryAfter = true, 30
+	maintenance.Unlock()
+	t.Cleanup(func() {
+		maintenance.Lock()
+		maintenance.enabled = false
+		maintenance.Unlock()
+	})
+
+	for _, tt := range guardTests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached, w := runGuard(maintenanceGuard, guardRequest(t, tt.method, tt.target, tt.form))
+			if reached != tt.through {
+				t.Fatalf("let through %t, want %t", reached, tt.through)
+			}
+			if !reached && (w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30") {
+				t.Fatalf("refused with %d, Retry-After %q, want 503 and 30", w.Code, w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestMaintenanceGuardOff(t *testing.T) {
+	withGuardRoutes(t)
+	for _, tt := range guardTests {
+		if reached, _ := runGuard(maintenanceGuard, guardRequest(t, tt.method, tt.target, tt.form)); !reached {
+			t.Errorf("%s: refused outside maintenance mode", tt.name)
+		}
+	}
+}
+
+// setMaintenance switches maintenance mode through /admin/maintenance and
+// returns the state it reports.
+func setMaintenance(t *testing.T, form string) map[string]interface{} {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	maintenanceMode(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("maintenance answered %d: %s", w.Code, w.Body.String())
+	}
+	var res struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Data
+}
+
+func TestMaintenanceDrainsWrites(t *testing.T) {
+	withGuardRoutes(t)
+	t.Cleanup(func() { setMaintenance(t, "enabled=false") })
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	handler := maintenanceGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	go func() {
+		defer close(finished)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/writeFile?filePath=f", nil))
+	}()
+	<-started
+
+	status := setMaintenance(t, "enabled=true&wait=0")
+	if status["draining"] != true || status["writesInProgress"] != float64(1) {
+		t.Fatalf("got %v, want draining with 1 write in progress", status)
+	}
+	if reached, _ := runGuard(maintenanceGuard, httptest.NewRequest("POST", "/writeFile?filePath=f", nil)); reached {
+		t.Fatal("new write let through while draining")
+	}
+
+	done := make(chan map[string]interface{})
+	go func() { done <- setMaintenance(t, "enabled=true&wait=10") }()
+	close(release)
+	<-finished
+	if status := <-done; status["draining"] != false || status["writesInProgress"] != float64(0) {
+		t.Fatalf("got %v after the write finished, want drained", status)
+	}
+}
+
+func TestJobPausesForMaintenance(t *testing.T) {
+	t.Cleanup(func() { setMaintenance(t, "enabled=false") })
+
+	inUnit, units := make(chan struct{}), make(chan struct{})
+	j := startJob("test", "Pause for maintenance", func(ctx context.Context, j *job) error {
+		for i := 0; i < 2; i++ {
+			if err := j.pauseForMaintenance(ctx); err != nil {
+				return err
+			}
+			inUnit <- struct{}{}
+			<-units
+		}
+		return nil
+	})
+	<-inUnit
+
+	// The job is in the middle of its first unit, so it counts as writing
+	// until it gets to pause before the second.
+	status := setMaintenance(t, "enabled=true&wait=0")
+	if status["draining"] != true {
+		t.Fatalf("got %v, want draining while the job writes", status)
+	}
+	units <- struct{}{}
+	status = setMaintenance(t, "enabled=true&wait=10")
+	if status["draining"] != false {
+		t.Fatalf("got %v, want the paused job not to count as writing", status)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for j.summary(false)["status"] != "paused" {
+		if time.Now().After(deadline) {
+			t.Fatalf("job is %v, want paused", j.summary(false)["status"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	setMaintenance(t, "enabled=false")
+	<-inUnit
+	units <- struct{}{}
+	<-j.done
+	if status := j.summary(false)["status"]; status != "completed" {
+		t.Fatalf("job is %v, want completed", status)
+	}
+}
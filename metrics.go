@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is a counter or gauge exported on /metrics in the Prometheus text
+// format. Values are kept per value of an optional single label.
+type metric struct {
+	name  string
+	help  string
+	kind  string // "counter" or "gauge"
+	label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+)
+
+// newMetric registers a metric. label is the name of its label, or "" for a
+// metric with a single value.
+func newMetric(kind, name, help, label string) *metric {
+	m := &metric{name: name, help: help, kind: kind, label: label, values: map[string]float64{}}
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+	return m
+}
+
+func (m *metric) add(labelValue string, delta float64) {
+	m.mu.Lock()
+	m.values[labelValue] += delta
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(labelValue string) {
+	m.add(labelValue, 1)
+}
+
+func (m *metric) set(labelValue string, value float64) {
+	m.mu.Lock()
+	m.values[labelValue] = value
+	m.mu.Unlock()
+}
+
+func (m *metric) value(labelValue string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[labelValue]
+}
+
+// metricSample is one value of a metric, identified by its label value.
+type metricSample struct {
+	labelValue string
+	value      float64
+}
+
+// samples returns the current values sorted by label value.
+func (m *metric) samples() []metricSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	samples := make([]metricSample, 0, len(m.values))
+	for labelValue, value := range m.values {
+		samples = append(samples, metricSample{labelValue, value})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labelValue < samples[j].labelValue })
+	return samples
+}
+
+func registeredMetrics() []*metric {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return append([]*metric(nil), registry...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsHandler serves every registered metric in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for _, m := range registeredMetrics() {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range m.samples() {
+			if m.label == "" {
+				fmt.Fprintf(buf, "%s %g\n", m.name, s.value)
+			} else {
+				fmt.Fprintf(buf, "%s{%s=\"%s\"} %g\n", m.name, m.label, labelEscaper.Replace(s.labelValue), s.value)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MetricsPushConfig configures pushing the metrics served on /metrics to
+// push-based monitoring.
+type MetricsPushConfig struct {
+	// StatsD is the host:port of a StatsD server, reached over UDP.
+	StatsD string `json:"statsd"`
+	// Graphite is the host:port of a Graphite plaintext listener, reached
+	// over TCP.
+	Graphite string `json:"graphite"`
+	// Prefix is put in front of every pushed metric name, e.g. "lab.frw1".
+	Prefix   string   `json:"prefix"`
+	Interval Duration `json:"interval"`
+}
+
+// startMetricsPush pushes the metrics every interval to the configured
+// StatsD and Graphite endpoints.
+func startMetricsPush() {
+	cfg := config.MetricsPush
+	if cfg.StatsD == "" && cfg.Graphite == "" {
+		return
+	}
+	go func() {
+		// StatsD counters are sent as the increase since the last push.
+		pushed := map[string]float64{}
+		ticker := time.NewTicker(time.Duration(cfg.Interval))
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if cfg.StatsD != "" {
+				if err := pushStatsD(cfg.StatsD, cfg.Prefix, pushed); err != nil {
+					logrus.WithError(err).Warn("Unable to push metrics to StatsD")
+				}
+			}
+			if cfg.Graphite != "" {
+				if err := pushGraphite(cfg.Graphite, cfg.Prefix, now); err != nil {
+					logrus.WithError(err).Warn("Unable to push metrics to Graphite")
+				}
+			}
+		}
+	}()
+}
+
+// pushedName returns the dotted name a metric sample is pushed under.
+func pushedName(prefix string, m *metric, s metricSample) string {
+	name := m.name
+	if m.label != "" {
+		name += "." + sanitizeMetricPart(s.labelValue)
+	}
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	return name
+}
+
+// sanitizeMetricPart replaces the characters that separate fields in the
+// StatsD and Graphite line formats.
+func sanitizeMetricPart(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', ' ', '\t', '\n', '/':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func pushStatsD(addr string, prefix string, pushed map[string]float64) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, m := range registeredMetrics() {
+		for _, s := range m.samples() {
+			name := pushedName(prefix, m, s)
+			var line string
+			if m.kind == "counter" {
+				delta := s.value - pushed[name]
+				pushed[name] = s.value
+				if delta == 0 {
+					continue
+				}
+				line = fmt.Sprintf("%s:%g|c\n", name, delta)
+			} else {
+				line = fmt.Sprintf("%s:%g|g\n", name, s.value)
+			}
+			// Keep each datagram below a typical MTU.
+			if buf.Len()+len(line) > 1400 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			buf.WriteString(line)
+		}
+	}
+	return flush()
+}
+
+func pushGraphite(addr string, prefix string, now time.Time) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(now.Add(10 * time.Second))
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for _, m := range registeredMetrics() {
+		for _, s := range m.samples() {
+			fmt.Fprintf(buf, "%s %g %d\n", pushedName(prefix, m, s), s.value, now.Unix())
+		}
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
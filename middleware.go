@@ -0,0 +1,43 @@
+package main
+
+import "net/http"
+
+// Kinds of operation an endpoint performs. Server modes and access checks
+// decide what to allow based on them.
+const (
+	opRead     = "read"
+	opWrite    = "write"
+	opDelete   = "delete"
+	opGenerate = "generate"
+	opAdmin    = "admin"
+	// opCoordinate is for claims and coordination primitives, which don't
+	// touch stored data.
+	opCoordinate = "coordinate"
+)
+
+// routeOps maps each registered pattern to the kind of operation it performs.
+var routeOps = map[string]string{}
+
+// handle registers handler for pattern and records the kind of operation the
+// endpoint performs.
+func handle(pattern string, op string, handler http.HandlerFunc) {
+	routeOps[pattern] = op
+	http.HandleFunc(pattern, handler)
+}
+
+// requestOp returns the kind of operation r is asking for, or "" for paths no
+// endpoint is registered for.
+func requestOp(r *http.Request) string {
+	return routeOps[r.URL.Path]
+}
+
+// isMutating reports whether op changes stored data.
+func isMutating(op string) bool {
+	return op == opWrite || op == opDelete || op == opGenerate
+}
+
+// withMiddleware wraps the server mux with the checks every request goes
+// through before reaching a handler.
+func withMiddleware(h http.Handler) http.Handler {
+	return logAccess(logBodies(authenticate(assignTenant(limitBody(authorize(rateLimit(deadlineGuard(readOnlyGuard(maintenanceGuard(routeGateway(breakerGuard(prioritize(injectFaults(authorizeBody(h)))))))))))))))
+}
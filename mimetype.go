@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sniffLen is how much of a file is looked at to tell its type, as much as
+// http.DetectContentType considers.
+const sniffLen = 512
+
+// extensionTypes adds types for extensions the system's MIME table may not
+// know, which minimal container images often lack.
+var extensionTypes = map[string]string{
+	".csv":     "text/csv; charset=utf-8",
+	".log":     "text/plain; charset=utf-8",
+	".md":      "text/markdown; charset=utf-8",
+	".txt":     "text/plain; charset=utf-8",
+	".yaml":    "application/yaml",
+	".yml":     "application/yaml",
+	".toml":    "application/toml",
+	".ndjson":  "application/x-ndjson",
+	".jsonl":   "application/x-ndjson",
+	".tar":     "application/x-tar",
+	".gz":      "application/gzip",
+	".tgz":     "application/gzip",
+	".zst":     "application/zstd",
+	".bz2":     "application/x-bzip2",
+	".xz":      "application/x-xz",
+	".7z":      "application/x-7z-compressed",
+	".zip":     "application/zip",
+	".parquet": "application/vnd.apache.parquet",
+	".sqlite":  "application/vnd.sqlite3",
+	".db":      "application/vnd.sqlite3",
+	".mp4":     "video/mp4",
+	".mp3":     "audio/mpeg",
+	".docx":    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx":    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx":    "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".jar":     "application/java-archive",
+}
+
+// contentMagic lists signatures of formats http.DetectContentType doesn't
+// know, checked before it.
+var contentMagic = []struct {
+	offset int
+	magic  []byte
+	typ    string
+}{
+	{0, []byte{0x28, 0xB5, 0x2F, 0xFD}, "application/zstd"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, "application/x-xz"},
+	{0, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}, "application/x-7z-compressed"},
+	{0, []byte("\x7fELF"), "application/x-elf"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{0, []byte("PAR1"), "application/vnd.apache.parquet"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+// extensionType returns the type the extension of name stands for, or "".
+func extensionType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		return typ
+	}
+	return extensionTypes[ext]
+}
+
+// sniffType returns the type the content starting with head has, going by
+// its first bytes.
+func sniffType(head []byte) string {
+	for _, m := range contentMagic {
+		if len(head) >= m.offset+len(m.magic) && bytes.Equal(head[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.typ
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+// genericType reports whether the sniffed type typ only names a container
+// or an encoding, which the extension can tell more precisely, like a .docx
+// sniffed as zip or a .json sniffed as text.
+func genericType(typ string) bool {
+	mediaType, _, _ := mime.ParseMediaType(typ)
+	switch mediaType {
+	case "text/plain", "application/octet-stream", "application/zip", "text/xml", "application/gzip", "application/x-gzip":
+		return true
+	}
+	return false
+}
+
+// detectType returns the MIME type of the file called name whose content
+// starts with head, and whether the content or the extension decided it.
+// The content wins unless it only says what the extension says better, and
+// an extension naming text doesn't make binary content text.
+func detectType(name string, head []byte) (typ string, source string) {
+	byExtension := extensionType(name)
+	sniffed := sniffType(head)
+	switch {
+	case bytes.HasPrefix(head, encryptedMagic):
+		// Without the client's key the content is opaque, whatever its
+		// name says.
+		return "application/octet-stream", "content"
+	case byExtension == "", strings.HasPrefix(byExtension, "application/octet-stream"):
+		// An extension naming no type leaves it to the content.
+		return sniffed, "content"
+	case len(head) == 0:
+		return byExtension, "extension"
+	case !genericType(sniffed):
+		return sniffed, "content"
+	case strings.HasPrefix(byExtension, "text/") && strings.HasPrefix(sniffed, "application/octet-stream"):
+		return sniffed, "content"
+	}
+	return byExtension, "extension"
+}
+
+// fileType returns the MIME type of the file f called name, reading its
+// first bytes.
+func fileType(f io.ReaderAt, name string) (string, error) {
+	head := make([]byte, sniffLen)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	typ, _ := detectType(name, head[:n])
+	return typ, nil
+}
+
+// detectFileType tells the MIME type of a stored file from its extension
+// and its first bytes, so clients don't have to guess it.
+func detectFileType(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Detecting file type")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	f, err := openFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+	head := make([]byte, sniffLen)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	head = head[:n]
+	typ, source := detectType(filePath, head)
+	writeJSON(w, "File type detected successfully", requestId, map[string]interface{}{
+		"mimeType":      typ,
+		"source":        source,
+		"extensionType": extensionType(filePath),
+		"contentType":   sniffType(head),
+	})
+}
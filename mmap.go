@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// errFileTruncated is returned when a mapped file shrank while it was
+	// read.
+	errFileTruncated   = errors.New("file was truncated while being read")
+	errMmapUnsupported = errors.New("memory mapping is not supported on this platform")
+)
+
+// mappedFile is the content of a file mapped read-only into memory.
+type mappedFile struct {
+	data []byte
+	// unmap releases the mapping. data must not be used afterwards.
+	unmap func()
+}
+
+// mapContent maps f, whose info is given, into memory if it is a regular
+// file of at least config.MmapThreshold bytes. It returns nil when mapping is
+// disabled or doesn't apply, and the caller reads f instead: a file
+// decrypted as it is read can't be served from its mapping.
+func mapContent(f contentFile, info os.FileInfo) (*mappedFile, error) {
+	file, ok := f.(*os.File)
+	if config.MmapThreshold == 0 || !ok || !info.Mode().IsRegular() || info.Size() < config.MmapThreshold {
+		return nil, nil
+	}
+	data, unmap, err := mapFile(file, info.Size())
+	if errors.Is(err, errMmapUnsupported) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: file.Name(), Err: err}
+	}
+	return &mappedFile{data: data, unmap: unmap}, nil
+}
+
+// readFileMapped returns the content of filePath like readFileContent, from
+// a mapping when mapContent applies to it. The data must only be used
+// inside readMapped.
+func readFileMapped(filePath string) ([]byte, func(), error) {
+	f, err := openFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The mapping outlives the descriptor.
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	mapped, err := mapContent(f, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mapped != nil {
+		return mapped.data, mapped.unmap, nil
+	}
+	return readBuffered(f)
+}
+
+// serveMapped answers a GET of the whole of f straight from its mapping,
+// without copying it through a read buffer, and reports whether it did.
+// Ranges and preconditions are left to http.ServeContent.
+func serveMapped(w http.ResponseWriter, r *http.Request, f contentFile, info os.FileInfo, requestId string) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for _, header := range []string{"Range", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+	mapped, err := mapContent(f, info)
+	if err != nil || mapped == nil {
+		// Errors are reported by reading the file instead.
+		return false
+	}
+	defer mapped.unmap()
+	if notModified(w, r, info) {
+		return true
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(mapped.data)), 10))
+	err = readMapped(func() {
+		w.Write(mapped.data)
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"filePath":  info.Name(),
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).WithError(err).Warn("Serving mapped file failed")
+		// Part of the content is already sent: cut the connection so the
+		// client doesn't take it for the whole file.
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
+
+// readMapped runs fn, which reads a mapping, and returns errFileTruncated if
+// the file shrank under it. Touching a page past the new end of a mapped
+// file raises SIGBUS, which would otherwise bring the whole server down.
+func readMapped(fn func()) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if p := recover(); p != nil {
+			// Memory faults are runtime errors telling the faulting address.
+			if _, ok := p.(interface{ Addr() uintptr }); ok {
+				err = errFileTruncated
+				return
+			}
+			panic(p)
+		}
+	}()
+	fn()
+	return nil
+}
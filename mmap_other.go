@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapFile can't map files on this platform; they are read instead.
+func mapFile(f *os.File, size int64) ([]byte, func(), error) {
+	return nil, nil, errMmapUnsupported
+}
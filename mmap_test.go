@@ -0,0 +1,114 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mapTestFile writes size bytes to a new file and maps it.
+func mapTestFile(t *testing.T, size int) (string, *mappedFile) {
+	t.Helper()
+	withConfig(t, func(c *Config) { c.MmapThreshold = 1 })
+	filePath := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(filePath, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := mapContent(f, info)
+	if err != nil || mapped == nil {
+		t.Fatalf("mapContent = %v, %v", mapped, err)
+	}
+	t.Cleanup(mapped.unmap)
+	return filePath, mapped
+}
+
+func TestReadMappedTruncated(t *testing.T) {
+	size := 4 * os.Getpagesize()
+	filePath, mapped := mapTestFile(t, size)
+	if err := os.Truncate(filePath, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var sum int
+	err := readMapped(func() {
+		for _, b := range mapped.data {
+			sum += int(b)
+		}
+	})
+	if !errors.Is(err, errFileTruncated) {
+		t.Fatalf("readMapped = %v, want %v", err, errFileTruncated)
+	}
+}
+
+func TestReadMappedPanics(t *testing.T) {
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Fatalf("recovered %v, want the panic of fn", p)
+		}
+	}()
+	readMapped(func() { panic("boom") })
+}
+
+func TestMapContentThreshold(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "small.txt")
+	if err := os.WriteFile(filePath, []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+
+	for _, threshold := range []int64{0, 6} {
+		withConfig(t, func(c *Config) { c.MmapThreshold = threshold })
+		if mapped, err := mapContent(f, info); mapped != nil || err != nil {
+			t.Errorf("threshold %d: mapContent = %v, %v, want the file read", threshold, mapped, err)
+		}
+	}
+}
+
+func TestReadFileFromMapping(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) {
+		c.RootDir = root
+		c.MmapThreshold = 1
+	})
+	content := bytes.Repeat([]byte("mapped\n"), 1000)
+	if err := os.WriteFile(filepath.Join(root, "f.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	readFile(w, httptest.NewRequest("GET", "/readFile?filePath=f.txt&format=raw", nil))
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("raw: %d, %d bytes, want 200 and the file", w.Code, w.Body.Len())
+	}
+
+	w = httptest.NewRecorder()
+	readFile(w, httptest.NewRequest("GET", "/readFile?filePath=f.txt&format=json&offset=7&length=6", nil))
+	var res struct {
+		Data struct {
+			FileContent string `json:"fileContent"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Data.FileContent != "mapped" {
+		t.Errorf("json: %d %s, want the range of the file", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runMount implements "frw mount [flags] <server> <mountpoint>", which mounts
+// the root of a remote server as a local filesystem.
+func runMount(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	cacheTTL := flags.Duration("cacheTTL", 5*time.Second, "How long listings and file contents are cached")
+	apiKey := flags.String("apiKey", os.Getenv("FRW_API_KEY"), "API key to authenticate with (default $FRW_API_KEY)")
+	tenant := flags.String("tenant", "", "Tenant to mount, sent as X-Tenant")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: frw mount [flags] <server URL> <mountpoint>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("server URL and mountpoint are required")
+	}
+	client := &mountClient{
+		server:   strings.TrimSuffix(flags.Arg(0), "/"),
+		ttl:      *cacheTTL,
+		apiKey:   *apiKey,
+		tenant:   *tenant,
+		listings: map[string]*cachedListing{},
+	}
+	return mountRemote(client, flags.Arg(1))
+}
+
+// remoteEntry is a file or directory in a remote listing.
+type remoteEntry struct {
+	Name  string `json:"fileName"`
+	Size  int64  `json:"size"`
+	IsDir bool   `json:"-"`
+}
+
+type cachedListing struct {
+	entries []remoteEntry
+	expires time.Time
+}
+
+// errRemoteNotFound is returned for paths the server doesn't have.
+var errRemoteNotFound = errors.New("not found")
+
+// mountClient talks to the server backing a mount and caches its listings.
+type mountClient struct {
+	server string
+	ttl    time.Duration
+	apiKey string
+	tenant string
+
+	mu       sync.Mutex
+	listings map[string]*cachedListing
+}
+
+func (c *mountClient) do(req *http.Request) ([]byte, error) {
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant", c.tenant)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, errRemoteNotFound
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (c *mountClient) get(endpoint string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.server+endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+// list returns the entries of the remote directory dir. A listing that
+// fails is reported as errRemoteNotFound, as the server answers 500 for
+// paths that aren't directories.
+func (c *mountClient) list(dir string) ([]remoteEntry, error) {
+	c.mu.Lock()
+	cached := c.listings[dir]
+	c.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.entries, nil
+	}
+
+	body, err := c.get("/listFiles", url.Values{"dirPath": {dir}})
+	if err != nil {
+		return nil, errRemoteNotFound
+	}
+	var res struct {
+		Data []remoteEntry `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	// Listings don't say which entries are directories, so ask for each
+	// entry's own listing, which only succeeds for directories.
+	for i := range res.Data {
+		_, err := c.get("/listFiles", url.Values{"dirPath": {path.Join(dir, res.Data[i].Name)}})
+		res.Data[i].IsDir = err == nil
+	}
+
+	c.mu.Lock()
+	c.listings[dir] = &cachedListing{entries: res.Data, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return res.Data, nil
+}
+
+// invalidate drops the cached listing of dir after a change to it.
+func (c *mountClient) invalidate(dir string) {
+	c.mu.Lock()
+	delete(c.listings, dir)
+	c.mu.Unlock()
+}
+
+func (c *mountClient) read(filePath string) ([]byte, error) {
+	return c.get("/download", url.Values{"filePath": {filePath}})
+}
+
+func (c *mountClient) write(filePath string, data []byte) error {
+	form := url.Values{"filePath": {filePath}, "fileContent": {string(data)}}
+	req, err := http.NewRequest(http.MethodPost, c.server+"/writeFile", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = c.do(req)
+	c.invalidate(path.Dir(filePath))
+	return err
+}
+
+func (c *mountClient) remove(filePath string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.server+"/deleteFile?"+url.Values{"filePath": {filePath}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req)
+	c.invalidate(path.Dir(filePath))
+	return err
+}
@@ -0,0 +1,274 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sirupsen/logrus"
+)
+
+// mountRemote serves the remote root at mountpoint until the process is
+// interrupted or the filesystem is unmounted.
+func mountRemote(client *mountClient, mountpoint string) error {
+	ttl := client.ttl
+	server, err := fs.Mount(mountpoint, &remoteDir{client: client, path: "."}, &fs.Options{
+		EntryTimeout: &ttl,
+		AttrTimeout:  &ttl,
+		MountOptions: fuse.MountOptions{
+			FsName:      client.server,
+			Name:        "frw",
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"server":     client.server,
+		"mountpoint": mountpoint,
+	}).Info("Mounted remote server")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Unmount()
+	}()
+	server.Wait()
+	return nil
+}
+
+func remoteErrno(err error) syscall.Errno {
+	if err == errRemoteNotFound {
+		return syscall.ENOENT
+	}
+	logrus.WithError(err).Warn("Remote request failed")
+	return syscall.EIO
+}
+
+// remoteDir is a directory on the server.
+type remoteDir struct {
+	fs.Inode
+	client *mountClient
+	path   string
+}
+
+var (
+	_ fs.NodeGetattrer = (*remoteDir)(nil)
+	_ fs.NodeReaddirer = (*remoteDir)(nil)
+	_ fs.NodeLookuper  = (*remoteDir)(nil)
+	_ fs.NodeCreater   = (*remoteDir)(nil)
+	_ fs.NodeUnlinker  = (*remoteDir)(nil)
+)
+
+func (d *remoteDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0755
+	return 0
+}
+
+func (d *remoteDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, err := d.client.list(d.path)
+	if err != nil {
+		return nil, remoteErrno(err)
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		mode := uint32(fuse.S_IFREG)
+		if entry.IsDir {
+			mode = fuse.S_IFDIR
+		}
+		list = append(list, fuse.DirEntry{Name: entry.Name, Mode: mode})
+	}
+	return fs.NewListDirStream(list), 0
+}
+
+func (d *remoteDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	entries, err := d.client.list(d.path)
+	if err != nil {
+		return nil, remoteErrno(err)
+	}
+	for _, entry := range entries {
+		if entry.Name != name {
+			continue
+		}
+		childPath := path.Join(d.path, name)
+		if entry.IsDir {
+			out.Mode = fuse.S_IFDIR | 0755
+			return d.NewInode(ctx, &remoteDir{client: d.client, path: childPath}, fs.StableAttr{Mode: fuse.S_IFDIR}), 0
+		}
+		out.Mode = fuse.S_IFREG | 0644
+		out.Size = uint64(entry.Size)
+		file := &remoteFile{client: d.client, path: childPath, size: entry.Size}
+		return d.NewInode(ctx, file, fs.StableAttr{Mode: fuse.S_IFREG}), 0
+	}
+	return nil, syscall.ENOENT
+}
+
+func (d *remoteDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	childPath := path.Join(d.path, name)
+	if err := d.client.write(childPath, nil); err != nil {
+		return nil, nil, 0, remoteErrno(err)
+	}
+	d.client.invalidate(d.path)
+	file := &remoteFile{client: d.client, path: childPath, loaded: time.Now()}
+	out.Mode = fuse.S_IFREG | 0644
+	return d.NewInode(ctx, file, fs.StableAttr{Mode: fuse.S_IFREG}), nil, 0, 0
+}
+
+func (d *remoteDir) Unlink(ctx context.Context, name string) syscall.Errno {
+	if err := d.client.remove(path.Join(d.path, name)); err != nil {
+		return remoteErrno(err)
+	}
+	return 0
+}
+
+// remoteFile is a file on the server. Its content is fetched whole on open
+// and cached for the client TTL; writes change the cached copy, which is
+// written back on flush.
+type remoteFile struct {
+	fs.Inode
+	client *mountClient
+	path   string
+
+	mu     sync.Mutex
+	size   int64
+	data   []byte
+	loaded time.Time
+	dirty  bool
+}
+
+var (
+	_ fs.NodeGetattrer = (*remoteFile)(nil)
+	_ fs.NodeSetattrer = (*remoteFile)(nil)
+	_ fs.NodeOpener    = (*remoteFile)(nil)
+	_ fs.NodeReader    = (*remoteFile)(nil)
+	_ fs.NodeWriter    = (*remoteFile)(nil)
+	_ fs.NodeFlusher   = (*remoteFile)(nil)
+	_ fs.NodeFsyncer   = (*remoteFile)(nil)
+)
+
+func (f *remoteFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(f.size)
+	return 0
+}
+
+func (f *remoteFile) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size, ok := in.GetSize(); ok {
+		if errno := f.loadLocked(); errno != 0 {
+			return errno
+		}
+		f.resizeLocked(int64(size))
+		f.dirty = true
+	}
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(f.size)
+	return 0
+}
+
+// loadLocked fetches the content unless a fresh or modified copy is cached.
+func (f *remoteFile) loadLocked() syscall.Errno {
+	if f.dirty || time.Since(f.loaded) < f.client.ttl {
+		return 0
+	}
+	data, err := f.client.read(f.path)
+	if err != nil {
+		return remoteErrno(err)
+	}
+	f.data = data
+	f.size = int64(len(data))
+	f.loaded = time.Now()
+	return 0
+}
+
+func (f *remoteFile) resizeLocked(size int64) {
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	f.size = size
+}
+
+func (f *remoteFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if flags&syscall.O_TRUNC != 0 {
+		f.data = nil
+		f.size = 0
+		f.dirty = true
+		return nil, fuse.FOPEN_DIRECT_IO, 0
+	}
+	if errno := f.loadLocked(); errno != 0 {
+		return nil, 0, errno
+	}
+	return nil, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (f *remoteFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if errno := f.loadLocked(); errno != 0 {
+		return nil, errno
+	}
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return fuse.ReadResultData(append([]byte(nil), f.data[off:end]...)), 0
+}
+
+func (f *remoteFile) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if errno := f.loadLocked(); errno != 0 {
+		return 0, errno
+	}
+	if end := off + int64(len(data)); end > int64(len(f.data)) {
+		f.resizeLocked(end)
+	}
+	copy(f.data[off:], data)
+	f.dirty = true
+	return uint32(len(data)), 0
+}
+
+// writeBackLocked sends modified content to the server.
+func (f *remoteFile) writeBackLocked() syscall.Errno {
+	if !f.dirty {
+		return 0
+	}
+	if err := f.client.write(f.path, f.data); err != nil {
+		return remoteErrno(err)
+	}
+	f.dirty = false
+	f.loaded = time.Now()
+	return 0
+}
+
+func (f *remoteFile) Flush(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeBackLocked()
+}
+
+func (f *remoteFile) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeBackLocked()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func mountRemote(client *mountClient, mountpoint string) error {
+	return errors.New("mounting is only supported on Linux")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// moveFile renames the file or directory at sourcePath to destPath. Across
+// filesystems, where a rename isn't possible, it is copied and the source
+// removed instead. An existing destPath is only replaced with
+// overwrite=true.
+func moveFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sourcePath := r.FormValue("sourcePath")
+	destPath := r.FormValue("destPath")
+	logrus.WithFields(logrus.Fields{
+		"sourcePath": sourcePath,
+		"destPath":   destPath,
+		"requestId":  requestId,
+		"serverId":   serverId,
+	}).Info("Moving file")
+
+	if sourcePath == "" || destPath == "" {
+		http.Error(w, "sourcePath and destPath are required", http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// authorize checked the caller may do this to the source.
+	sourcePath, err = resolvePath(r, sourcePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sourcePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	destPath, err = resolvePath(r, destPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(sourcePath, destPath)
+	defer unlock()
+	// The source itself is moved, not what a symbolic link points to.
+	sourceInfo, err := os.Lstat(sourcePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Source file not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", sourcePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if isRootPath(r, sourcePath) {
+		http.Error(w, "Cannot move the root directory", http.StatusBadRequest)
+		return
+	}
+	if sourceInfo.IsDir() && isWithin(sourcePath, destPath) {
+		http.Error(w, "Cannot move a directory into itself", http.StatusBadRequest)
+		return
+	}
+	destInfo, err := os.Lstat(destPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", destPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if destInfo != nil {
+		if sameFile(sourceInfo, destInfo) {
+			http.Error(w, "sourcePath and destPath are the same file", http.StatusBadRequest)
+			return
+		}
+		if !overwrite {
+			http.Error(w, "destPath already exists; set overwrite=true to replace it", http.StatusConflict)
+			return
+		}
+		if destInfo.IsDir() != sourceInfo.IsDir() {
+			http.Error(w, "Cannot replace a directory with a file or a file with a directory", http.StatusConflict)
+			return
+		}
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		entries := []dryRunEntry{{Path: sourcePath, Action: "move", Size: sourceInfo.Size()}}
+		if destInfo != nil {
+			entries = append(entries, dryRunEntry{Path: destPath, Action: "replace", Size: destInfo.Size()})
+		}
+		writeJSON(w, "Dry run: file not moved", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := ensureParentDir(destPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// The move is undone by moving the file back, so only a file it
+	// replaces needs saving, and it is moved to the trash rather than
+	// copied.
+	var backup string
+	if destInfo != nil && destInfo.Mode().IsRegular() && config.TrashDir != "" {
+		if backup, err = trashFile(destPath); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := movePath(sourcePath, destPath); err != nil {
+		if backup != "" {
+			movePath(backup, destPath)
+		}
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			http.Error(w, "destPath is a directory that isn't empty", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to move file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if config.SyncDir {
+		syncDir(filepath.Dir(sourcePath))
+		syncDir(filepath.Dir(destPath))
+	}
+	recordMove(requestActor(r), requestId, sourcePath, destPath, destInfo != nil, backup)
+	writeJSON(w, "File moved successfully", requestId, nil)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveUndo(t *testing.T) {
+	for _, undoPath := range []string{"dest.txt", "src.txt"} {
+		t.Run("undo on "+undoPath, func(t *testing.T) {
+			_, trashDir := withJournal(t)
+			root := testRoot(t)
+			withConfig(t, func(c *Config) { c.RootDir = root })
+			source, dest := filepath.Join(root, "src.txt"), filepath.Join(root, "dest.txt")
+			if err := os.WriteFile(source, []byte("moved"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(dest, []byte("replaced"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			w := postForm(moveFile, "/moveFile", url.Values{"sourcePath": {"src.txt"}, "destPath": {"dest.txt"}, "overwrite": {"true"}})
+			if w.Code != 200 {
+				t.Fatalf("move: %d %s", w.Code, w.Body.String())
+			}
+			// Only the replaced file is kept, not a copy of the moved one.
+			if files, _ := os.ReadDir(trashDir); len(files) != 1 {
+				t.Fatalf("trash holds %d files, want the replaced one", len(files))
+			}
+
+			if w := postForm(undo, "/undo", url.Values{"filePath": {undoPath}}); w.Code != 200 {
+				t.Fatalf("undo: %d %s", w.Code, w.Body.String())
+			}
+			if got, _ := os.ReadFile(source); string(got) != "moved" {
+				t.Errorf("source holds %q after undo", got)
+			}
+			if got, _ := os.ReadFile(dest); string(got) != "replaced" {
+				t.Errorf("destination holds %q after undo", got)
+			}
+			if w := postForm(undo, "/undo", url.Values{"filePath": {undoPath}}); w.Code != 409 {
+				t.Errorf("second undo: %d, want 409", w.Code)
+			}
+		})
+	}
+}
+
+func TestMoveUndoRefusedWhenSourceReused(t *testing.T) {
+	withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	source := filepath.Join(root, "src.txt")
+	if err := os.WriteFile(source, []byte("moved"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := postForm(moveFile, "/moveFile", url.Values{"sourcePath": {"src.txt"}, "destPath": {"dest.txt"}}); w.Code != 200 {
+		t.Fatalf("move: %d %s", w.Code, w.Body.String())
+	}
+	if err := os.WriteFile(source, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := postForm(undo, "/undo", url.Values{"filePath": {"dest.txt"}}); w.Code != 409 {
+		t.Fatalf("undo over a new source: %d, want 409", w.Code)
+	}
+	if got, _ := os.ReadFile(source); string(got) != "new" {
+		t.Errorf("undo replaced the new source with %q", got)
+	}
+}
+
+func TestLockWritesOrder(t *testing.T) {
+	done := make(chan struct{})
+	for _, paths := range [][]string{{"/a", "/b"}, {"/b", "/a"}} {
+		paths := paths
+		go func() {
+			for i := 0; i < 1000; i++ {
+				lockWrites(paths...)()
+			}
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listBatchSize is the number of directory entries read at a time when
+// streaming a listing.
+const listBatchSize = 256
+
+// streamFileList writes the entries of dirPath passing the filters of opts
+// as newline-delimited JSON, flushing each one as soon as it has been read. Entries come in directory
+// order rather than sorted, so the full listing is never held in memory.
+// Once the first entry has been sent the status can no longer change, so a
+// later failure is reported as a final {"error": ...} line.
+func streamFileList(w http.ResponseWriter, r *http.Request, dirPath string, opts *listOptions, requestId string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer dir.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	fail := func(err error) {
+		logrus.WithFields(logrus.Fields{
+			"dirPath":   dirPath,
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).WithError(err).Warn("Streaming file list failed")
+		enc.Encode(map[string]interface{}{"error": err.Error()})
+	}
+
+	for {
+		files, readErr := dir.ReadDir(listBatchSize)
+		for _, file := range files {
+			if r.Context().Err() != nil {
+				return
+			}
+			fileInfo, err := fileListEntry(r, dirPath, file.Name())
+			if err != nil {
+				fail(err)
+				return
+			}
+			if !opts.match(fileInfo) {
+				continue
+			}
+			if err := enc.Encode(fileInfo); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return
+		}
+		if readErr != nil {
+			fail(fmt.Errorf("Unable to read directory: %s", readErr.Error()))
+			return
+		}
+	}
+}
+
+// streamFileTree is streamFileList for recursive listings: the entries of
+// the tree below dirPath, down to maxDepth levels unless it is 0, with
+// their paths relative to dirPath. The tree is walked concurrently, so
+// entries come in no particular order.
+func streamFileTree(w http.ResponseWriter, r *http.Request, dirPath string, maxDepth int, opts *listOptions, requestId string) {
+	info, err := statFile(dirPath)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dirPath)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	var mu sync.Mutex
+	err = walkTree(r.Context(), dirPath, maxDepth, func(relPath string, entry fs.DirEntry) error {
+		if opts.hidden(relPath) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fileInfo, err := fileListEntry(r, dirPath, relPath)
+		if err != nil {
+			return err
+		}
+		if !opts.match(fileInfo) {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(fileInfo); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		logrus.WithFields(logrus.Fields{
+			"dirPath":   dirPath,
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).WithError(err).Warn("Streaming file list failed")
+		enc.Encode(map[string]interface{}{"error": err.Error()})
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// errInvalidPatch is returned for a patch that isn't a unified diff of
+	// a single file.
+	errInvalidPatch = errors.New("invalid patch")
+	// errPatchConflict is returned when the lines a patch removes or keeps
+	// are not those of the file.
+	errPatchConflict = errors.New("patch does not apply")
+)
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// patchLine is one line of a hunk: kind is ' ' for a line kept, '-' for one
+// removed and '+' for one added. noNewline marks a line the patch says has
+// no newline after it.
+type patchLine struct {
+	kind      byte
+	text      string
+	noNewline bool
+}
+
+// patchHunk is one hunk of a unified diff. oldStart counts from 1, or names
+// the line before the hunk when it removes and keeps no lines.
+type patchHunk struct {
+	oldStart, oldCount int
+	newStart, newCount int
+	lines              []patchLine
+}
+
+// parsePatch parses a unified diff of a single file, as /diffFiles and diff
+// -u produce. Anything before the first hunk, such as the --- and +++
+// headers, is ignored.
+func parsePatch(patch string) ([]patchHunk, error) {
+	lines := strings.Split(strings.TrimSuffix(patch, "\n"), "\n")
+	var hunks []patchHunk
+	var oldLeft, newLeft int
+	for i, line := range lines {
+		lineNo := i + 1
+		if oldLeft > 0 || newLeft > 0 {
+			h := &hunks[len(hunks)-1]
+			kind := byte(' ')
+			text := ""
+			if line != "" {
+				// Some editors strip the space of empty kept lines.
+				kind, text = line[0], line[1:]
+			}
+			switch kind {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			case '\\':
+				if len(h.lines) > 0 {
+					h.lines[len(h.lines)-1].noNewline = true
+				}
+				continue
+			default:
+				return nil, fmt.Errorf("%w: unexpected line %d in hunk %d", errInvalidPatch, lineNo, len(hunks))
+			}
+			if oldLeft < 0 || newLeft < 0 {
+				return nil, fmt.Errorf("%w: hunk %d has more lines than its header counts", errInvalidPatch, len(hunks))
+			}
+			h.lines = append(h.lines, patchLine{kind: kind, text: text})
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("%w: malformed hunk header on line %d", errInvalidPatch, lineNo)
+			}
+			h := patchHunk{oldCount: 1, newCount: 1}
+			h.oldStart, _ = strconv.Atoi(m[1])
+			h.newStart, _ = strconv.Atoi(m[3])
+			if m[2] != "" {
+				h.oldCount, _ = strconv.Atoi(m[2])
+			}
+			if m[4] != "" {
+				h.newCount, _ = strconv.Atoi(m[4])
+			}
+			hunks = append(hunks, h)
+			oldLeft, newLeft = h.oldCount, h.newCount
+		case strings.HasPrefix(line, "\\") && len(hunks) > 0:
+			// A marker after the last line of a hunk.
+			if h := &hunks[len(hunks)-1]; len(h.lines) > 0 {
+				h.lines[len(h.lines)-1].noNewline = true
+			}
+		case len(hunks) > 0 && (strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "diff ")):
+			return nil, fmt.Errorf("%w: a patch may only change a single file", errInvalidPatch)
+		}
+	}
+	if oldLeft > 0 || newLeft > 0 {
+		return nil, fmt.Errorf("%w: hunk %d is cut short", errInvalidPatch, len(hunks))
+	}
+	if len(hunks) == 0 {
+		return nil, fmt.Errorf("%w: no hunks", errInvalidPatch)
+	}
+	return hunks, nil
+}
+
+// applyPatch writes src with hunks applied to dst, streaming the lines
+// between hunks through. It returns errPatchConflict if a line the patch
+// keeps or removes differs from that of src.
+func applyPatch(dst io.Writer, src io.Reader, hunks []patchHunk) error {
+	br := bufio.NewReaderSize(src, 64<<10)
+	consumed := 0
+	// A kept last line without a newline needs one if lines are added after
+	// it.
+	pendingNewline := false
+	write := func(s string) error {
+		if pendingNewline {
+			pendingNewline = false
+			if _, err := io.WriteString(dst, "\n"); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(dst, s)
+		return err
+	}
+	readLine := func() (string, error) {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		if err == nil {
+			consumed++
+		}
+		return line, err
+	}
+
+	for i, h := range hunks {
+		target := h.oldStart - 1
+		if h.oldCount == 0 {
+			target = h.oldStart
+		}
+		if target < consumed {
+			return fmt.Errorf("%w: hunk %d overlaps the one before it", errInvalidPatch, i+1)
+		}
+		for consumed < target {
+			line, err := readLine()
+			if err == io.EOF {
+				return fmt.Errorf("%w: hunk %d starts past the end of the file", errPatchConflict, i+1)
+			}
+			if err != nil {
+				return err
+			}
+			if err := write(line); err != nil {
+				return err
+			}
+		}
+		for _, pl := range h.lines {
+			if pl.kind == '+' {
+				text := pl.text
+				if !pl.noNewline {
+					text += "\n"
+				}
+				if err := write(text); err != nil {
+					return err
+				}
+				continue
+			}
+			line, err := readLine()
+			if err == io.EOF {
+				return fmt.Errorf("%w: hunk %d runs past the end of the file", errPatchConflict, i+1)
+			}
+			if err != nil {
+				return err
+			}
+			if got := strings.TrimSuffix(line, "\n"); got != pl.text {
+				return fmt.Errorf("%w: hunk %d expects %q at line %d, found %q", errPatchConflict, i+1, pl.text, consumed, got)
+			}
+			if pl.kind == ' ' {
+				if err := write(line); err != nil {
+					return err
+				}
+				pendingNewline = !strings.HasSuffix(line, "\n")
+			}
+		}
+	}
+	_, err := io.Copy(dst, br)
+	return err
+}
+
+// patchStatus returns the status code to answer a failed patch with.
+func patchStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidPatch):
+		return http.StatusBadRequest
+	case errors.Is(err, errPatchConflict):
+		return http.StatusConflict
+	}
+	return scanStatus(err)
+}
+
+// patchFile applies patch, a unified diff such as /diffFiles returns, to the
+// file at filePath. The lines the patch keeps and removes must match the
+// file, or it is left alone and 409 Conflict returned. The patched file is
+// streamed to a temporary file that then replaces it, like writeFile, so
+// small edits to large files don't need to send the whole file.
+func patchFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPatch && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	patch := r.FormValue("patch")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"patchSize": len(patch),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Patching file")
+
+	if filePath == "" || patch == "" {
+		http.Error(w, "filePath and patch are required", http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hunks, err := parsePatch(patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if !preconditionsHold(w, r, filePath) {
+		return
+	}
+	fileInfo, err := statFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !fileInfo.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+	growth := int64(0)
+	for _, h := range hunks {
+		for _, pl := range h.lines {
+			switch pl.kind {
+			case '+':
+				growth += int64(len(pl.text)) + 1
+			case '-':
+				growth -= int64(len(pl.text)) + 1
+			}
+		}
+	}
+	if err := checkFileSize(r, filePath, fileInfo.Size()+growth); err != nil {
+		http.Error(w, fmt.Sprintf("File %s", err.Error()), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	f, err := openFile(filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if err := checkNotClientEncrypted(f); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+
+	if dryRun {
+		// The patch is applied without keeping the result, to check it
+		// would.
+		if err := applyPatch(io.Discard, f, hunks); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to patch file: %s", err.Error()), patchStatus(err))
+			return
+		}
+		writeJSON(w, "Dry run: file not patched", requestId, dryRunReport(r, []dryRunEntry{
+			{Path: filePath, Action: "patch", Size: fileInfo.Size()},
+		}))
+		return
+	}
+
+	existed, backup, err := backupFile(filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	pr, pw := io.Pipe()
+	applied := make(chan error, 1)
+	go func() {
+		err := applyPatch(pw, f, hunks)
+		pw.CloseWithError(err)
+		applied <- err
+	}()
+	scanned := scanUpload(pr, filePath, requestActor(r))
+	size, err := storeFileMode(filePath, scanned, nil, nil)
+	scanned.Close()
+	// Stops the patch being applied if storing failed before reading it all.
+	pr.Close()
+	if applyErr := <-applied; applyErr != nil && !errors.Is(applyErr, io.ErrClosedPipe) {
+		err = applyErr
+	}
+	if err != nil {
+		discardBackup(backup)
+		http.Error(w, fmt.Sprintf("Unable to patch file: %s", err.Error()), patchStatus(err))
+		return
+	}
+	recordOperation(requestActor(r), requestId, "patch", filePath, existed, backup)
+	if fileInfo, err := statFile(filePath); err == nil {
+		w.Header().Set("ETag", fileETag(fileInfo))
+	}
+	writeJSON(w, "File patched successfully", requestId, map[string]interface{}{
+		"size":  size,
+		"hunks": len(hunks),
+	})
+}
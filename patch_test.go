@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePatchRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		patch string
+	}{
+		{name: "no hunks", patch: "--- a\n+++ b\n"},
+		{name: "malformed header", patch: "@@ -1 +1 @\n-a\n+b\n"},
+		{name: "cut short", patch: "@@ -1,2 +1,2 @@\n a\n-b\n"},
+		{name: "too many lines", patch: "@@ -1 +1 @@\n-a\n-b\n+c\n"},
+		{name: "unexpected line", patch: "@@ -1 +1 @@\n*a\n"},
+		{name: "second file", patch: "--- a\n+++ a\n@@ -1 +1 @@\n-a\n+b\n--- c\n+++ c\n@@ -1 +1 @@\n-c\n+d\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePatch(tt.patch); !errors.Is(err, errInvalidPatch) {
+				t.Errorf("err %v, want errInvalidPatch", err)
+			}
+		})
+	}
+}
+
+// Patches /diffFiles produces apply to the file they were made from.
+func TestApplyPatchRoundTrip(t *testing.T) {
+	old := strings.Repeat("line\n", 20) + "a\nb\nc\n" + strings.Repeat("more\n", 20) + "end\n"
+	for _, tt := range []struct {
+		name string
+		new  string
+	}{
+		{name: "changed line", new: strings.Replace(old, "b\n", "B\n", 1)},
+		{name: "added at the start", new: "first\n" + old},
+		{name: "removed at the end", new: strings.TrimSuffix(old, "end\n")},
+		{name: "several hunks", new: strings.Replace(strings.Replace(old, "a\n", "", 1), "end\n", "finish\n", 1)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, ok := diffLines(splitLines(old), splitLines(tt.new), 100)
+			if !ok {
+				t.Fatal("diff gave up")
+			}
+			lines, _ := unifiedDiff(ops, 3, 1000)
+			hunks, err := parsePatch(strings.Join(lines, "\n") + "\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := applyPatch(&got, strings.NewReader(old), hunks); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.new {
+				t.Errorf("patched to %q, want %q", got.String(), tt.new)
+			}
+		})
+	}
+}
+
+func TestApplyPatchNoNewline(t *testing.T) {
+	hunks, err := parsePatch("@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := applyPatch(&got, strings.NewReader("a\nb"), hunks); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "a\nc" {
+		t.Errorf("patched to %q", got.String())
+	}
+}
+
+func TestPatchFile(t *testing.T) {
+	withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	filePath := filepath.Join(root, "app.conf")
+	patch := "--- app.conf\n+++ app.conf\n@@ -1,2 +1,2 @@\n name=app\n-debug=false\n+debug=true\n"
+
+	for _, tt := range []struct {
+		name    string
+		content string
+		path    string
+		want    int
+		result  string
+	}{
+		{name: "applies", content: "name=app\ndebug=false\n", path: "app.conf", want: http.StatusOK, result: "name=app\ndebug=true\n"},
+		{name: "conflict", content: "name=other\ndebug=false\n", path: "app.conf", want: http.StatusConflict, result: "name=other\ndebug=false\n"},
+		{name: "outside the root", content: "name=app\ndebug=false\n", path: "../app.conf", want: http.StatusForbidden, result: "name=app\ndebug=false\n"},
+		{name: "missing", path: "gone.conf", want: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.content != "" {
+				if err := os.WriteFile(filePath, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w := postForm(patchFile, "/patchFile", url.Values{"filePath": {tt.path}, "patch": {patch}})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.result == "" {
+				return
+			}
+			if got, _ := os.ReadFile(filePath); string(got) != tt.result {
+				t.Errorf("file holds %q, want %q", got, tt.result)
+			}
+		})
+	}
+
+	// The patch can be undone.
+	os.WriteFile(filePath, []byte("name=app\ndebug=false\n"), 0644)
+	if w := postForm(patchFile, "/patchFile", url.Values{"filePath": {"app.conf"}, "patch": {patch}}); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := undoLatest(httptest.NewRequest("POST", "/undo", nil), "u", filePath); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filePath); string(got) != "name=app\ndebug=false\n" {
+		t.Errorf("after undo the file holds %q", got)
+	}
+}
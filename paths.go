@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// errPathConflict is returned when a path can't be resolved unambiguously,
+// e.g. two entries in a directory differ only by case.
+var errPathConflict = errors.New("path conflict")
+
+// errOutsideRoot is returned for paths that lead out of the root directory,
+// through ".." components or a symbolic link.
+var errOutsideRoot = errors.New("path is outside the root directory")
+
+// resolvePath maps a path supplied by the client of r onto the local
+// filesystem, confining it to the tenant's directory or the root directory.
+// An empty path names the root itself. Every handler must go through it
+// before touching the disk.
+func resolvePath(r *http.Request, p string) (string, error) {
+	p = normalizeUnicode(cleanPath(p))
+	root, err := requestRoot(r)
+	if err != nil {
+		return "", err
+	}
+	if root == "" {
+		return matchPath(p)
+	}
+	jailed, err := jailPath(root, p)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := matchPath(jailed)
+	if err != nil {
+		return "", err
+	}
+	if err := checkInsideRoot(root, resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// requestRoot returns the directory the paths of r are confined to: its
+// tenant's directory, config.RootDir, or "" for no confinement.
+func requestRoot(r *http.Request) (string, error) {
+	if !config.Tenants.enabled() {
+		return config.RootDir, nil
+	}
+	tenant := requestTenant(r)
+	if tenant == "" {
+		return "", errTenantRequired
+	}
+	return tenantRoot(tenant)
+}
+
+// clientPath returns filePath, a path resolvePath returned, as the client
+// of r sees it: relative to its root, with a leading separator like the paths
+// the client sends. Paths outside the root are returned unchanged.
+func clientPath(r *http.Request, filePath string) string {
+	root, err := requestRoot(r)
+	if err != nil || root == "" || !isWithin(root, filePath) {
+		return filePath
+	}
+	rel, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return filePath
+	}
+	return string(filepath.Separator) + filepath.Clean(rel)
+}
+
+// matchPath applies the configured case and Unicode rules to the clean path p.
+func matchPath(p string) (string, error) {
+	if config.CaseInsensitivePaths {
+		return matchComponents(p)
+	}
+	if config.UnicodeNormalization != "none" && hasOtherNormalForm(p) {
+		// Names created outside the server may use a different normal form.
+		// Only fall back to matching them when the path isn't there verbatim.
+		if _, err := os.Lstat(p); err != nil {
+			return matchComponents(p)
+		}
+	}
+	return p, nil
+}
+
+// hasOtherNormalForm reports whether p is written differently in NFC and
+// NFD, so a name created outside the server could spell it another way.
+// Other paths, like plain ASCII ones, can only be on disk verbatim and
+// matchPath doesn't list the directories leading to them.
+func hasOtherNormalForm(p string) bool {
+	return !norm.NFC.IsNormalString(p) || !norm.NFD.IsNormalString(p)
+}
+
+// realDir makes dir absolute and resolves symbolic links in it, so resolved
+// paths can be compared against it. dir must be an existing directory.
+func realDir(dir string) (string, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", root)
+	}
+	return root, nil
+}
+
+// jailPath maps the clean path p into root. Absolute paths are taken relative
+// to the root, as in a chroot; relative paths climbing above it are rejected.
+func jailPath(root string, p string) (string, error) {
+	rel := p[len(filepath.VolumeName(p)):]
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", errOutsideRoot, p)
+	}
+	return filepath.Join(root, strings.TrimLeft(rel, string(filepath.Separator))), nil
+}
+
+// checkInsideRoot makes sure p doesn't lead out of root through a symbolic
+// link. For a path that doesn't exist yet, the deepest existing
+// ancestor is checked, and so is the target of a dangling link, since writing
+// through it would create the target.
+func checkInsideRoot(root string, p string) error {
+	real, err := filepath.EvalSymlinks(p)
+	if err == nil {
+		if !isWithin(root, real) {
+			return errOutsideRoot
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+		return err
+	}
+	if target, err := os.Readlink(p); err == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		return checkInsideRoot(root, target)
+	}
+	parent := filepath.Dir(p)
+	if parent == p {
+		return nil
+	}
+	return checkInsideRoot(root, parent)
+}
+
+// isWithin reports whether p is dir or lies below it.
+func isWithin(dir string, p string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if p, err = filepath.Abs(p); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// cleanPath accepts both '/' and '\' as separators, converts them to the
+// host separator and cleans the result, so clients get the same behaviour
+// whether the server runs on Windows or Linux.
+func cleanPath(p string) string {
+	return filepath.Clean(filepath.FromSlash(strings.ReplaceAll(p, `\`, "/")))
+}
+
+// normalizeUnicode converts s to the configured Unicode normal form.
+func normalizeUnicode(s string) string {
+	switch config.UnicodeNormalization {
+	case "NFC":
+		return norm.NFC.String(s)
+	case "NFD":
+		return norm.NFD.String(s)
+	}
+	return s
+}
+
+// sameName reports whether the directory entry name refers to the path
+// component part under the configured case and Unicode rules.
+func sameName(name, part string) bool {
+	name = normalizeUnicode(name)
+	if config.CaseInsensitivePaths {
+		return strings.EqualFold(name, part)
+	}
+	return name == part
+}
+
+// pathErrorStatus returns the HTTP status code for an error from resolvePath.
+func pathErrorStatus(err error) int {
+	if errors.Is(err, errPathConflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, errOutsideRoot) || errors.Is(err, errPathNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// matchComponents walks the clean path p one component at a time and replaces each
+// component with the directory entry matching it according to sameName.
+// Components that don't exist yet are kept as given so new files can still be
+// created. More than one matching entry is reported as errPathConflict.
+func matchComponents(p string) (string, error) {
+	resolved := filepath.VolumeName(p)
+	rest := p[len(resolved):]
+	if strings.HasPrefix(rest, string(filepath.Separator)) {
+		resolved += string(filepath.Separator)
+		rest = rest[1:]
+	}
+
+	parts := strings.Split(rest, string(filepath.Separator))
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			resolved = filepath.Join(resolved, part)
+			continue
+		}
+
+		dir := resolved
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			// The directory doesn't exist (yet), so nothing below it can match.
+			return filepath.Join(append([]string{resolved}, parts[i:]...)...), nil
+		}
+
+		var matches []string
+		for _, entry := range entries {
+			if sameName(entry.Name(), part) {
+				matches = append(matches, entry.Name())
+			}
+		}
+		switch len(matches) {
+		case 0:
+			resolved = filepath.Join(resolved, part)
+		case 1:
+			resolved = filepath.Join(resolved, matches[0])
+		default:
+			return "", fmt.Errorf("%w: %q matches %s in %s", errPathConflict, part, strings.Join(matches, ", "), dir)
+		}
+	}
+	return resolved, nil
+}
+
+// isRootPath reports whether the resolved path is the directory the paths of
+// r are confined to, or the filesystem root, which requests must not remove
+// or move away.
+func isRootPath(r *http.Request, resolved string) bool {
+	root, err := requestRoot(r)
+	if err != nil || root == "" {
+		root = string(filepath.Separator)
+	}
+	root, _ = filepath.Abs(root)
+	resolved, _ = filepath.Abs(resolved)
+	return resolved == root || resolved == filepath.VolumeName(resolved)+string(filepath.Separator)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withConfig changes config for the duration of the test.
+func withConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.UnicodeNormalization = "none"
+	change(&config)
+}
+
+// testRoot returns a new root directory, with symbolic links resolved so
+// paths can be compared with what resolvePath returns.
+func testRoot(t *testing.T) string {
+	t.Helper()
+	root, err := realDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestResolvePathConfinesToRoot(t *testing.T) {
+	root := testRoot(t)
+	outside := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"escape":      outside,
+		"dangling":    filepath.Join(outside, "missing"),
+		"inside":      filepath.Join(root, "dir"),
+		"dir/relback": "..",
+		"dir/relout":  "../../" + filepath.Base(outside),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr error
+	}{
+		{name: "empty path is the root", path: "", want: root},
+		{name: "dot is the root", path: ".", want: root},
+		{name: "slash is the root", path: "/", want: root},
+		{name: "relative", path: "dir/file.txt", want: filepath.Join(root, "dir", "file.txt")},
+		{name: "absolute is taken from the root", path: "/dir/file.txt", want: filepath.Join(root, "dir", "file.txt")},
+		{name: "absolute climbing stops at the root", path: "/../../etc/passwd", want: filepath.Join(root, "etc", "passwd")},
+		{name: "dot dot", path: "..", wantErr: errOutsideRoot},
+		{name: "climbing out", path: "../etc/passwd", wantErr: errOutsideRoot},
+		{name: "climbing out after a component", path: "dir/../../etc", wantErr: errOutsideRoot},
+		{name: "backslashes", path: `..\etc\passwd`, wantErr: errOutsideRoot},
+		{name: "link leading out", path: "escape", wantErr: errOutsideRoot},
+		{name: "below a link leading out", path: "escape/new.txt", wantErr: errOutsideRoot},
+		{name: "dangling link leading out", path: "dangling", wantErr: errOutsideRoot},
+		{name: "relative link leading out", path: "dir/relout/x", wantErr: errOutsideRoot},
+		{name: "link staying inside", path: "inside/file.txt", want: filepath.Join(root, "inside", "file.txt")},
+		{name: "relative link staying inside", path: "dir/relback/dir", want: filepath.Join(root, "dir", "relback", "dir")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolvePath(httptest.NewRequest("GET", "/", nil), tt.path)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("resolvePath(%q) = %q, %v, want error %v", tt.path, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("resolvePath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJailPath(t *testing.T) {
+	root := filepath.FromSlash("/srv/root")
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: ".", want: root},
+		{path: string(filepath.Separator), want: root},
+		{path: filepath.FromSlash("a/b"), want: filepath.FromSlash("/srv/root/a/b")},
+		{path: filepath.FromSlash("/a/b"), want: filepath.FromSlash("/srv/root/a/b")},
+		{path: "..", wantErr: true},
+		{path: filepath.FromSlash("../a"), wantErr: true},
+		{path: "..a", want: filepath.FromSlash("/srv/root/..a")},
+	}
+	for _, tt := range tests {
+		got, err := jailPath(root, tt.path)
+		if tt.wantErr {
+			if !errors.Is(err, errOutsideRoot) {
+				t.Errorf("jailPath(%q) = %q, %v, want errOutsideRoot", tt.path, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("jailPath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckInsideRoot(t *testing.T) {
+	root := testRoot(t)
+	outside := testRoot(t)
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{path: root, ok: true},
+		{path: filepath.Join(root, "new", "deep", "file"), ok: true},
+		{path: filepath.Join(root, "inner"), ok: true},
+		{path: filepath.Join(root, "out"), ok: false},
+		{path: filepath.Join(root, "out", "new", "file"), ok: false},
+		{path: filepath.Join(root, "dangling"), ok: false},
+		{path: outside, ok: false},
+		{path: root + "-sibling", ok: false},
+	}
+	for _, tt := range tests {
+		err := checkInsideRoot(root, tt.path)
+		if tt.ok && err != nil {
+			t.Errorf("checkInsideRoot(%q) = %v, want nil", tt.path, err)
+		}
+		if !tt.ok && !errors.Is(err, errOutsideRoot) {
+			t.Errorf("checkInsideRoot(%q) = %v, want errOutsideRoot", tt.path, err)
+		}
+	}
+}
+
+func TestMatchPathUnicode(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root; c.UnicodeNormalization = "NFC" })
+	nfc, nfd := "caf\u00e9", "cafe\u0301"
+	if err := os.WriteFile(filepath.Join(root, nfd), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		want  string
+		other bool
+	}{
+		{path: nfc, want: nfd, other: true},
+		{path: nfd, want: nfd, other: true},
+		{path: "new.txt", want: "new.txt"},
+		{path: filepath.Join("dir", "new.txt"), want: filepath.Join("dir", "new.txt")},
+	}
+	for _, tt := range tests {
+		if got := hasOtherNormalForm(normalizeUnicode(tt.path)); got != tt.other {
+			t.Errorf("hasOtherNormalForm(%q) = %t, want %t", tt.path, got, tt.other)
+		}
+		got, err := resolvePath(httptest.NewRequest("GET", "/", nil), tt.path)
+		if err != nil || got != filepath.Join(root, tt.want) {
+			t.Errorf("resolvePath(%q) = %q, %v, want %q", tt.path, got, err, filepath.Join(root, tt.want))
+		}
+	}
+}
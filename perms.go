@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// chmodFile changes the permissions of the file or directory at filePath to
+// the octal mode given, within config.ModeMask.
+func chmodFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"mode":      r.FormValue("mode"),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Changing file mode")
+
+	if filePath == "" || r.FormValue("mode") == "" {
+		http.Error(w, "filePath and mode are required", http.StatusBadRequest)
+		return
+	}
+	mode, err := formMode(r, "mode", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	info, err := statFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		writeJSON(w, "Dry run: mode not changed", requestId, dryRunReport(r, []dryRunEntry{
+			{Path: filePath, Action: "chmod", Size: info.Size()},
+		}))
+		return
+	}
+
+	if err := os.Chmod(filePath, mode); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to change mode: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "Mode changed successfully", requestId, map[string]interface{}{
+		"previousMode": fmt.Sprintf("%04o", info.Mode().Perm()),
+		"mode":         fmt.Sprintf("%04o", mode),
+	})
+}
+
+// fileOwner is the owner and group to give a file, by numeric id. -1 leaves
+// either as it is.
+type fileOwner struct {
+	UID int
+	GID int
+}
+
+func (o fileOwner) set() bool {
+	return o.UID >= 0 || o.GID >= 0
+}
+
+// defaultOwner is the owner given to files the server creates, from
+// config.FileOwner and config.FileGroup.
+var defaultOwner = fileOwner{UID: -1, GID: -1}
+
+// lookupOwner resolves a user and group, given by name or numeric id, to a
+// fileOwner. Empty names are left as they are.
+func lookupOwner(owner, group string) (fileOwner, error) {
+	o := fileOwner{UID: -1, GID: -1}
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			if u, err = user.LookupId(owner); err != nil {
+				return o, fmt.Errorf("unknown user %s", owner)
+			}
+		}
+		if o.UID, err = strconv.Atoi(u.Uid); err != nil {
+			return o, fmt.Errorf("user %s has no numeric id", owner)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return o, fmt.Errorf("unknown group %s", group)
+			}
+		}
+		if o.GID, err = strconv.Atoi(g.Gid); err != nil {
+			return o, fmt.Errorf("group %s has no numeric id", group)
+		}
+	}
+	return o, nil
+}
+
+// formOwner parses the optional owner and group form values. Giving files
+// away is reserved to admins, so other callers get errOwnerNotAllowed.
+func formOwner(r *http.Request) (*fileOwner, error) {
+	owner, group := r.FormValue("owner"), r.FormValue("group")
+	if owner == "" && group == "" {
+		return nil, nil
+	}
+	if !isAdmin(r) {
+		return nil, errOwnerNotAllowed
+	}
+	o, err := lookupOwner(owner, group)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid owner: %s", err.Error())
+	}
+	// Whichever isn't given is the configured default.
+	if owner == "" {
+		o.UID = defaultOwner.UID
+	}
+	if group == "" {
+		o.GID = defaultOwner.GID
+	}
+	return &o, nil
+}
+
+var errOwnerNotAllowed = errors.New("Only admins may set the owner and group of files")
+
+// chownWritten gives the file p, written to replace the file described by
+// replaced or nil for a new one, the owner asked for, else the owner of
+// the file it replaces, else defaultOwner.
+func chownWritten(p string, replaced os.FileInfo, owner *fileOwner) error {
+	if owner != nil {
+		return os.Chown(p, owner.UID, owner.GID)
+	}
+	if replaced != nil {
+		// Only root can give a file away, so the owner is kept when
+		// possible but failing to isn't an error.
+		if uid, gid, ok := fileOwnerOf(replaced); ok {
+			os.Chown(p, uid, gid)
+		}
+		return nil
+	}
+	return chownCreated(p)
+}
+
+// chownCreated gives the file or directory p, just created, defaultOwner.
+func chownCreated(p string) error {
+	if !defaultOwner.set() {
+		return nil
+	}
+	return os.Chown(p, defaultOwner.UID, defaultOwner.GID)
+}
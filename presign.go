@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSignedURLExpiry = 15 * time.Minute
+	maxSignedURLExpiry     = 7 * 24 * time.Hour
+)
+
+// signingKey is the HMAC key of pre-signed URLs: config.SigningKey, or a
+// random key when none is configured, which invalidates the URLs on restart.
+var signingKey []byte
+
+func setupSigningKey() error {
+	if config.SigningKey != "" {
+		signingKey = []byte(config.SigningKey)
+		return nil
+	}
+	signingKey = make([]byte, 32)
+	_, err := rand.Read(signingKey)
+	return err
+}
+
+// usedNonces holds the nonces of signed URLs that have been used, until
+// they expire, so each URL works only once.
+var usedNonces struct {
+	sync.Mutex
+	expires map[string]time.Time
+}
+
+// useNonce marks nonce as used and reports false if it already was.
+func useNonce(nonce string, expires time.Time) bool {
+	usedNonces.Lock()
+	defer usedNonces.Unlock()
+	now := time.Now()
+	if usedNonces.expires == nil {
+		usedNonces.expires = map[string]time.Time{}
+	}
+	for n, exp := range usedNonces.expires {
+		if now.After(exp) {
+			delete(usedNonces.expires, n)
+		}
+	}
+	if _, used := usedNonces.expires[nonce]; used {
+		return false
+	}
+	usedNonces.expires[nonce] = expires
+	return true
+}
+
+// releaseNonce forgets that nonce was used, so its URL works again.
+func releaseNonce(nonce string) {
+	usedNonces.Lock()
+	defer usedNonces.Unlock()
+	delete(usedNonces.expires, nonce)
+}
+
+// urlSignature signs the endpoint and parameters of a pre-signed URL.
+func urlSignature(endpoint, access, filePath, tenant, signer, expires, nonce string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(strings.Join([]string{endpoint, access, filePath, tenant, signer, expires, nonce}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL checks the signature, expiry and op of a pre-signed URL and
+// uses it up; serveSigned gives it back if the request doesn't succeed. It
+// returns a caller allowed only what the URL grants: the signed endpoint, on
+// the signed file and nothing else.
+func verifySignedURL(r *http.Request) (*principal, error) {
+	query := r.URL.Query()
+	access := query.Get("access")
+	filePath := query.Get("filePath")
+	tenant := query.Get("tenant")
+	signer := query.Get("signer")
+	expires := query.Get("expires")
+	nonce := query.Get("nonce")
+	expected := urlSignature(r.URL.Path, access, filePath, tenant, signer, expires, nonce)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		return nil, errors.New("bad signature")
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, errors.New("bad expiry")
+	}
+	expiry := time.Unix(unix, 0)
+	if time.Now().After(expiry) {
+		return nil, errors.New("expired")
+	}
+	if op := requestOp(r); op != access {
+		return nil, fmt.Errorf("grants %s access, not %s", access, op)
+	}
+	if !useNonce(nonce, expiry) {
+		return nil, errors.New("already used")
+	}
+	return &principal{Name: signer, Scopes: []string{access}, Paths: []string{filePath}, Exact: true, Tenant: tenant}, nil
+}
+
+// serveSigned serves r, made with a pre-signed URL verifySignedURL used up,
+// and gives the URL back unless the request succeeds: a HEAD, or a request
+// refused or failing further on, leaves it usable. It stays used up while
+// the request is served so it can't be used twice at once.
+func serveSigned(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	sw := &statusWriter{ResponseWriter: w}
+	served := false
+	defer func() {
+		if !served || r.Method == http.MethodHead || sw.status >= http.StatusBadRequest {
+			releaseNonce(r.URL.Query().Get("nonce"))
+		}
+	}()
+	next.ServeHTTP(sw, r)
+	served = true
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return io.Copy(sw.ResponseWriter, src)
+}
+
+func (sw *statusWriter) Flush() {
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// signURL returns a time-limited URL granting one-off read or write access to
+// a file, for handing to clients without credentials. The caller must itself
+// be allowed the access it grants.
+func signURL(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	access := r.FormValue("access")
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	var endpoint string
+	switch access {
+	case opRead:
+		endpoint = "/download"
+	case opWrite:
+		endpoint = "/writeFile"
+	default:
+		http.Error(w, "access must be read or write", http.StatusBadRequest)
+		return
+	}
+	expiresIn, err := formDuration(r, "expiresIn", defaultSignedURLExpiry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if expiresIn <= 0 || expiresIn > maxSignedURLExpiry {
+		http.Error(w, fmt.Sprintf("expiresIn must be positive and at most %s", maxSignedURLExpiry), http.StatusBadRequest)
+		return
+	}
+
+	if p := requestPrincipal(r); p != nil && !p.allows(access) {
+		http.Error(w, fmt.Sprintf("%s does not have the %s scope", p.Name, access), http.StatusForbidden)
+		return
+	}
+	resolved, err := resolvePath(r, filePath)
+	if err == nil {
+		err = checkPathScopeFor(r, access, resolved)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	expires := time.Now().Add(expiresIn).Truncate(time.Second)
+	nonce := generateUUID()
+	signer := requestActor(r)
+	tenant := requestTenant(r)
+	expiresParam := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{
+		"filePath":  {filePath},
+		"access":    {access},
+		"tenant":    {tenant},
+		"signer":    {signer},
+		"expires":   {expiresParam},
+		"nonce":     {nonce},
+		"signature": {urlSignature(endpoint, access, filePath, tenant, signer, expiresParam, nonce)},
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	signed := url.URL{Scheme: scheme, Host: r.Host, Path: endpoint, RawQuery: query.Encode()}
+	recordAudit(auditEvent{
+		Actor:  signer,
+		Action: "signURL",
+		Path:   filePath,
+		Detail: fmt.Sprintf("%s access until %s", access, expires.UTC().Format(time.RFC3339)),
+	})
+	writeJSON(w, "URL signed successfully", requestId, map[string]interface{}{
+		"url":     signed.String(),
+		"expires": expires,
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedQuery returns the query of a URL signed for endpoint.
+func signedQuery(endpoint, access, filePath string, expires time.Time) url.Values {
+	expiresParam := strconv.FormatInt(expires.Unix(), 10)
+	nonce := generateUUID()
+	return url.Values{
+		"filePath":  {filePath},
+		"access":    {access},
+		"tenant":    {""},
+		"signer":    {"signer"},
+		"expires":   {expiresParam},
+		"nonce":     {nonce},
+		"signature": {urlSignature(endpoint, access, filePath, "", "signer", expiresParam, nonce)},
+	}
+}
+
+// withSigningKey signs URLs with a fixed key for the duration of the test.
+func withSigningKey(t *testing.T) {
+	saved := signingKey
+	t.Cleanup(func() { signingKey = saved })
+	signingKey = []byte("test signing key")
+}
+
+func TestVerifySignedURL(t *testing.T) {
+	withSigningKey(t)
+	withRoute(t, "/download", opRead)
+	withRoute(t, "/stat", opRead)
+	withRoute(t, "/writeFile", opWrite)
+	withRoute(t, "/deleteFile", opDelete)
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		path    string
+		query   url.Values
+		change  func(q url.Values)
+		wantErr string
+	}{
+		{name: "valid read", path: "/download", query: signedQuery("/download", opRead, "a/f", later)},
+		{name: "valid write", path: "/writeFile", query: signedQuery("/writeFile", opWrite, "a/f", later)},
+		{name: "other endpoint with the same op", path: "/stat", query: signedQuery("/download", opRead, "a/f", later), wantErr: "bad signature"},
+		{name: "other op", path: "/deleteFile", query: signedQuery("/deleteFile", opWrite, "a/f", later), wantErr: "grants write access, not delete"},
+		{name: "changed file", path: "/download", query: signedQuery("/download", opRead, "a/f", later), change: func(q url.Values) { q.Set("filePath", "a/g") }, wantErr: "bad signature"},
+		{name: "changed access", path: "/download", query: signedQuery("/download", opRead, "a/f", later), change: func(q url.Values) { q.Set("access", opWrite) }, wantErr: "bad signature"},
+		{name: "extended expiry", path: "/download", query: signedQuery("/download", opRead, "a/f", later), change: func(q url.Values) { q.Set("expires", strconv.FormatInt(later.Add(time.Hour).Unix(), 10)) }, wantErr: "bad signature"},
+		{name: "changed tenant", path: "/download", query: signedQuery("/download", opRead, "a/f", later), change: func(q url.Values) { q.Set("tenant", "other") }, wantErr: "bad signature"},
+		{name: "expired", path: "/download", query: signedQuery("/download", opRead, "a/f", time.Now().Add(-time.Minute)), wantErr: "expired"},
+		{name: "missing signature", path: "/download", query: signedQuery("/download", opRead, "a/f", later), change: func(q url.Values) { q.Set("signature", "") }, wantErr: "bad signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				tt.change(tt.query)
+			}
+			r := httptest.NewRequest("GET", tt.path+"?"+tt.query.Encode(), nil)
+			p, err := verifySignedURL(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifySignedURL = %v, want error %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifySignedURL = %v", err)
+			}
+			if !p.Exact || len(p.Paths) != 1 || p.Paths[0] != tt.query.Get("filePath") {
+				t.Fatalf("principal %+v isn't limited to %s", p, tt.query.Get("filePath"))
+			}
+			if _, err := verifySignedURL(r); err == nil || !strings.Contains(err.Error(), "already used") {
+				t.Fatalf("second use = %v, want already used", err)
+			}
+		})
+	}
+}
+
+// TestSignedURLScope checks that a pre-signed URL grants its own file and
+// nothing below or beside it, however the request names other paths.
+func TestSignedURLScope(t *testing.T) {
+	withSigningKey(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root })
+	withACL(t, nil)
+	withRoute(t, "/writeFile", opWrite)
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		signed string
+		body   url.Values
+		want   int
+	}{
+		{name: "signed file", signed: "dir/f", want: http.StatusOK},
+		{name: "file below a signed directory", signed: "dir", body: url.Values{"filePath": {"dir/f"}}, want: http.StatusForbidden},
+		{name: "other file in the body", signed: "dir/f", body: url.Values{"filePath": {"dir/g"}}, want: http.StatusForbidden},
+		{name: "other path parameter", signed: "dir/f", body: url.Values{"destPath": {"dir/f/x"}}, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := signedQuery("/writeFile", opWrite, tt.signed, later)
+			r := httptest.NewRequest("POST", "/writeFile?"+query.Encode(), strings.NewReader(tt.body.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			authenticate(authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The handler checks the path it writes, as writeFile does.
+				resolved, err := resolvePath(r, r.FormValue("filePath"))
+				if err == nil {
+					err = checkPathScope(r, resolved)
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusForbidden)
+				}
+			}))).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestSignedURLUsedUpOnSuccess checks that a pre-signed URL is only used up
+// by a request that succeeds, not by a HEAD or a failing one.
+func TestSignedURLUsedUpOnSuccess(t *testing.T) {
+	withSigningKey(t)
+	withRoute(t, "/download", opRead)
+	query := signedQuery("/download", opRead, "f", time.Now().Add(time.Hour))
+
+	status := http.StatusNotFound
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/download?"+query.Encode(), nil))
+		return w.Code
+	}
+
+	if code := serve("GET"); code != http.StatusNotFound {
+		t.Fatalf("failing request: %d", code)
+	}
+	status = http.StatusOK
+	if code := serve("HEAD"); code != http.StatusOK {
+		t.Fatalf("HEAD after a failing request: %d", code)
+	}
+	if code := serve("GET"); code != http.StatusOK {
+		t.Fatalf("GET after a HEAD: %d", code)
+	}
+	if code := serve("GET"); code != http.StatusForbidden {
+		t.Fatalf("second GET: %d, want 403", code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Priority classes for requests competing for a slot. Interactive reads are
+// served before bulk traffic such as generateFiles once the concurrency limit
+// is reached, instead of first come first served.
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	priorityLevels
+)
+
+var priorityNames = map[string]int{
+	"high":   priorityHigh,
+	"normal": priorityNormal,
+	"low":    priorityLow,
+}
+
+// requestPriority returns the priority class of r. Clients can choose it
+// with the X-Priority header, otherwise reads are high and generation is low
+// priority.
+func requestPriority(r *http.Request) int {
+	if priority, ok := priorityNames[r.Header.Get("X-Priority")]; ok {
+		return priority
+	}
+	switch requestOp(r) {
+	case opRead:
+		return priorityHigh
+	case opGenerate:
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+// limiter hands out a limited number of slots, serving waiters of a higher
+// priority first and waiters of the same priority in arrival order.
+type limiter struct {
+	mu     sync.Mutex
+	active int
+	queues [priorityLevels][]chan struct{}
+}
+
+var requestLimiter limiter
+
+// acquire waits for a slot until ctx is done. It reports whether a slot was
+// obtained, which must then be given back with release.
+func (l *limiter) acquire(ctx context.Context, max int, priority int) bool {
+	l.mu.Lock()
+	if l.active < max && l.queued() == 0 {
+		l.active++
+		l.mu.Unlock()
+		return true
+	}
+	ready := make(chan struct{})
+	l.queues[priority] = append(l.queues[priority], ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ch := range l.queues[priority] {
+		if ch == ready {
+			l.queues[priority] = append(l.queues[priority][:i], l.queues[priority][i+1:]...)
+			return false
+		}
+	}
+	// The slot was handed over just as we gave up, pass it on.
+	l.releaseLocked()
+	return false
+}
+
+func (l *limiter) queued() int {
+	n := 0
+	for _, queue := range l.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// release gives a slot back, handing it straight to the first waiter of the
+// highest priority if there is one.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+func (l *limiter) releaseLocked() {
+	for priority := range l.queues {
+		if queue := l.queues[priority]; len(queue) > 0 {
+			close(queue[0])
+			l.queues[priority] = queue[1:]
+			return
+		}
+	}
+	l.active--
+}
+
+// prioritize limits the number of concurrent storage requests to
+// config.MaxConcurrentRequests, queueing the rest by priority. Requests that
+// wait longer than config.QueueTimeout get a 503. Admin and coordination
+// endpoints are never queued so they stay reachable under load.
+func prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := requestOp(r)
+		if config.MaxConcurrentRequests <= 0 || op == "" || op == opAdmin || op == opCoordinate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.QueueTimeout))
+		defer cancel()
+		if !requestLimiter.acquire(ctx, config.MaxConcurrentRequests, requestPriority(r)) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(config.QueueTimeout).Seconds())))
+			http.Error(w, "Server is busy", http.StatusServiceUnavailable)
+			return
+		}
+		defer requestLimiter.release()
+		next.ServeHTTP(w, r)
+	})
+}
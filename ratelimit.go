@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits how many requests each client may send. Clients are
+// told apart by their API key, token subject or client certificate, or else
+// by their address.
+type RateLimitConfig struct {
+	// RPS is the sustained number of requests per second allowed. Zero
+	// disables rate limiting.
+	RPS float64 `json:"rps"`
+	// Burst is how many requests can be sent at once after a quiet period.
+	Burst int `json:"burst"`
+	// GenerateRPS and GenerateBurst additionally limit file generation, which
+	// is far more expensive than other requests. Zero GenerateRPS disables
+	// the extra limit.
+	GenerateRPS   float64 `json:"generateRps"`
+	GenerateBurst int     `json:"generateBurst"`
+}
+
+func (c RateLimitConfig) validate() error {
+	if c.RPS < 0 || c.GenerateRPS < 0 {
+		return errors.New("rates must not be negative")
+	}
+	if (c.RPS > 0 && c.Burst < 1) || (c.GenerateRPS > 0 && c.GenerateBurst < 1) {
+		return errors.New("bursts must be at least 1")
+	}
+	return nil
+}
+
+var rateLimited = newMetric("counter", "frw_rate_limited_total",
+	"Requests rejected because the client exceeded its rate limit.", "op")
+
+// tokenBucket holds the requests a client may still send. It gains rps
+// tokens per second up to burst; every request takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if one is available, or else returns how long until
+// one will be.
+func (b *tokenBucket) take(now time.Time, rps float64, burst int) (bool, time.Duration) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rps)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely by now, so it can
+// be dropped and created afresh when the client comes back.
+func (b *tokenBucket) full(now time.Time, rps float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rps >= float64(burst)
+}
+
+// rateLimitSweepInterval is how often buckets of clients that went quiet are
+// removed.
+const rateLimitSweepInterval = time.Minute
+
+var rateBuckets struct {
+	sync.Mutex
+	all       map[string]*tokenBucket
+	generate  map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// takeToken takes a token from client's bucket in buckets.
+func takeToken(buckets map[string]*tokenBucket, client string, now time.Time, rps float64, burst int) (bool, time.Duration) {
+	b, ok := buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		buckets[client] = b
+	}
+	return b.take(now, rps, burst)
+}
+
+func sweepBuckets(buckets map[string]*tokenBucket, now time.Time, rps float64, burst int) {
+	for client, b := range buckets {
+		if b.full(now, rps, burst) {
+			delete(buckets, client)
+		}
+	}
+}
+
+// allowRequest takes tokens for a request by client for op and returns how
+// long the client has to wait if it is over its limit.
+func allowRequest(client string, op string) (bool, time.Duration) {
+	cfg := config.RateLimit
+	now := time.Now()
+	rateBuckets.Lock()
+	defer rateBuckets.Unlock()
+	if rateBuckets.all == nil {
+		rateBuckets.all = map[string]*tokenBucket{}
+		rateBuckets.generate = map[string]*tokenBucket{}
+	}
+	if now.Sub(rateBuckets.lastSweep) > rateLimitSweepInterval {
+		sweepBuckets(rateBuckets.all, now, cfg.RPS, cfg.Burst)
+		sweepBuckets(rateBuckets.generate, now, cfg.GenerateRPS, cfg.GenerateBurst)
+		rateBuckets.lastSweep = now
+	}
+
+	// Check the generate limit first so a rejected generation doesn't use
+	// up the client's general allowance.
+	if op == opGenerate && cfg.GenerateRPS > 0 {
+		if ok, wait := takeToken(rateBuckets.generate, client, now, cfg.GenerateRPS, cfg.GenerateBurst); !ok {
+			return false, wait
+		}
+	}
+	if cfg.RPS > 0 {
+		return takeToken(rateBuckets.all, client, now, cfg.RPS, cfg.Burst)
+	}
+	return true, 0
+}
+
+// rateLimit answers requests from clients over their rate limit with 429.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.RateLimit.RPS == 0 && config.RateLimit.GenerateRPS == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		op := requestOp(r)
+		if ok, wait := allowRequest(requestActor(r), op); !ok {
+			rateLimited.inc(op)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// readOnly is the state of read-only mode. Unlike maintenance mode it isn't
+// expected to end soon: mutating requests are refused with 403 rather than
+// asked to come back later, so a directory can be exposed safely.
+var readOnly struct {
+	sync.RWMutex
+	enabled bool
+	since   time.Time
+}
+
+func loadReadOnly() {
+	readOnly.Lock()
+	defer readOnly.Unlock()
+	readOnly.enabled = config.ReadOnly
+	if readOnly.enabled {
+		readOnly.since = time.Now()
+	}
+}
+
+func isReadOnly() bool {
+	readOnly.RLock()
+	defer readOnly.RUnlock()
+	return readOnly.enabled
+}
+
+// readOnlyGuard answers mutating requests with 403 while read-only mode is
+// enabled. Dry runs of endpoints implementing them don't change anything and
+// are let through.
+func readOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMutating(requestOp(r)) && !isHarmlessDryRun(r) && isReadOnly() {
+			http.Error(w, "Server is in read-only mode", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func readOnlyStatus() map[string]interface{} {
+	readOnly.RLock()
+	defer readOnly.RUnlock()
+	status := map[string]interface{}{
+		"enabled": readOnly.enabled,
+	}
+	if readOnly.enabled {
+		status["since"] = readOnly.since
+	}
+	return status
+}
+
+// readOnlyMode reports the read-only mode state on GET and switches it on or
+// off on POST.
+func readOnlyMode(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, "Read-only mode retrieved successfully", requestId, readOnlyStatus())
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled value", http.StatusBadRequest)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"enabled":   enabled,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Setting read-only mode")
+
+	readOnly.Lock()
+	if enabled && !readOnly.enabled {
+		readOnly.since = time.Now()
+	}
+	readOnly.enabled = enabled
+	readOnly.Unlock()
+
+	recordAudit(auditEvent{
+		Actor:  requestActor(r),
+		Action: "readOnly",
+		Detail: fmt.Sprintf("enabled=%t", enabled),
+	})
+	writeJSON(w, "Read-only mode updated successfully", requestId, readOnlyStatus())
+}
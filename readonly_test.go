@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReadOnlyGuard(t *testing.T) {
+	withGuardRoutes(t)
+	readOnly.Lock()
+	readOnly.enabled = true
+	readOnly.Unlock()
+	t.Cleanup(func() {
+		readOnly.Lock()
+		readOnly.enabled = false
+		readOnly.Unlock()
+	})
+
+	for _, tt := range guardTests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached, w := runGuard(readOnlyGuard, guardRequest(t, tt.method, tt.target, tt.form))
+			if reached != tt.through {
+				t.Fatalf("let through %t, want %t", reached, tt.through)
+			}
+			if !reached && w.Code != http.StatusForbidden {
+				t.Fatalf("refused with %d, want 403", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	fsRetries = newMetric("counter", "frw_fs_retries_total",
+		"Filesystem operations retried after a transient error.", "op")
+	fsRetriesExhausted = newMetric("counter", "frw_fs_retries_exhausted_total",
+		"Filesystem operations that still failed with a transient error after all retries.", "op")
+)
+
+// isTransient reports whether err is a filesystem error that is likely to go
+// away when the operation is simply tried again, such as an interrupted
+// syscall or a stale NFS handle.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ESTALE) ||
+		errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// retryFS runs fn, trying it again up to config.FSRetries times with
+// exponential backoff while it fails with a transient error. op names the
+// operation in the metrics.
+func retryFS(op string, fn func() error) error {
+	delay := time.Duration(config.FSRetryDelay)
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt >= config.FSRetries {
+			if attempt > 0 {
+				fsRetriesExhausted.inc(op)
+			}
+			return err
+		}
+		fsRetries.inc(op)
+		logrus.WithFields(logrus.Fields{
+			"op":      op,
+			"attempt": attempt + 1,
+			"error":   err.Error(),
+		}).Warn("Retrying filesystem operation")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// statFile is os.Stat retried on transient errors.
+func statFile(filePath string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := retryFS("stat", func() (err error) {
+		info, err = os.Stat(filePath)
+		return err
+	})
+	return info, err
+}
+
+// openFile is os.Open retried on transient errors, decrypting files
+// encrypted at rest.
+func openFile(filePath string) (contentFile, error) {
+	var f *os.File
+	err := retryFS("open", func() (err error) {
+		f, err = os.Open(filePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return openContent(f)
+}
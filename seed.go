@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// maxSeedSpecSize bounds the size of a /seed request body.
+const maxSeedSpecSize = 16 << 20
+
+// seedSpec describes a directory tree for /seed. It is read as YAML, which
+// also accepts JSON.
+type seedSpec struct {
+	// Root is the directory the tree is created as.
+	Root string `yaml:"root"`
+	// Replace allows replacing an existing Root.
+	Replace bool        `yaml:"replace"`
+	Entries []seedEntry `yaml:"entries"`
+}
+
+// seedEntry is a file or directory inside the seeded tree. A file gets
+// either the literal Content or Size bytes of generated content.
+type seedEntry struct {
+	Path    string    `yaml:"path"`
+	Dir     bool      `yaml:"dir"`
+	Content *string   `yaml:"content"`
+	Size    int64     `yaml:"size"`
+	Mode    string    `yaml:"mode"`
+	Mtime   time.Time `yaml:"mtime"`
+
+	relPath string
+	mode    os.FileMode
+}
+
+func (spec *seedSpec) validate() error {
+	if spec.Root == "" {
+		return errors.New("root is required")
+	}
+	seen := map[string]bool{}
+	for i := range spec.Entries {
+		entry := &spec.Entries[i]
+		if entry.Path == "" {
+			return fmt.Errorf("entry %d: path is required", i)
+		}
+		relPath := cleanPath(entry.Path)
+		if filepath.IsAbs(relPath) || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("entry %d: path %s must stay inside root", i, entry.Path)
+		}
+		if seen[relPath] {
+			return fmt.Errorf("entry %d: duplicate path %s", i, entry.Path)
+		}
+		seen[relPath] = true
+		entry.relPath = relPath
+
+		if entry.Dir && (entry.Content != nil || entry.Size != 0) {
+			return fmt.Errorf("entry %d: a directory has no content or size", i)
+		}
+		if entry.Content != nil && entry.Size != 0 {
+			return fmt.Errorf("entry %d: give either content or size", i)
+		}
+		if entry.Size < 0 {
+			return fmt.Errorf("entry %d: size must not be negative", i)
+		}
+		if entry.Mode != "" {
+			mode, err := strconv.ParseUint(entry.Mode, 8, 32)
+			if err != nil || mode > 0777 {
+				return fmt.Errorf("entry %d: invalid mode %s", i, entry.Mode)
+			}
+			entry.mode = os.FileMode(mode)
+		}
+	}
+	return nil
+}
+
+func (entry *seedEntry) size() int64 {
+	if entry.Content != nil {
+		return int64(len(*entry.Content))
+	}
+	return entry.Size
+}
+
+// seed materializes the directory tree described by the request body. The
+// tree is built next to its root and renamed into place once complete, so
+// clients never see a half-seeded tree.
+func seed(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSeedSpecSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read spec: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	var spec seedSpec
+	if err := yaml.Unmarshal(body, &spec); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid spec: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err := spec.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid spec: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"root":      spec.Root,
+		"entries":   len(spec.Entries),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Seeding fixtures")
+
+	root, err := resolvePath(r, spec.Root)
+	if err == nil {
+		err = checkPathScope(r, root)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid root: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	// The tree is staged next to root, which can't be outside the jail.
+	if jail, _ := requestRoot(r); jail != "" && root == jail {
+		http.Error(w, "Invalid root: must be below the root directory", http.StatusBadRequest)
+		return
+	}
+	_, err = os.Lstat(root)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for root: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if exists && !spec.Replace {
+		http.Error(w, fmt.Sprintf("Root %s already exists", spec.Root), http.StatusConflict)
+		return
+	}
+
+	if isDryRun(r) {
+		var entries []dryRunEntry
+		if exists {
+			entries = append(entries, dryRunEntry{Path: root, Action: "replace"})
+		}
+		for _, entry := range spec.Entries {
+			entries = append(entries, dryRunEntry{Path: filepath.Join(root, entry.relPath), Action: "create", Size: entry.size()})
+		}
+		writeJSON(w, "Dry run: fixtures not seeded", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := ensureParentDir(root); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	staging := root + ".seed-" + requestId
+	if err := buildSeedTree(staging, spec.Entries); err != nil {
+		os.RemoveAll(staging)
+		http.Error(w, fmt.Sprintf("Unable to seed fixtures: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if err := swapInTree(staging, root, exists, requestId); err != nil {
+		os.RemoveAll(staging)
+		http.Error(w, fmt.Sprintf("Unable to seed fixtures: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	var total int64
+	for _, entry := range spec.Entries {
+		total += entry.size()
+	}
+	recordAudit(auditEvent{
+		Actor:  requestActor(r),
+		Action: "seed",
+		Path:   root,
+		Detail: fmt.Sprintf("%d entries, %d bytes, replaced=%t", len(spec.Entries), total, exists),
+	})
+	writeJSON(w, "Fixtures seeded successfully", requestId, map[string]interface{}{
+		"root":     root,
+		"entries":  len(spec.Entries),
+		"bytes":    total,
+		"replaced": exists,
+	})
+}
+
+// buildSeedTree creates entries below dir. Modification times are set last,
+// deepest first, as creating entries changes the times of their parents.
+func buildSeedTree(dir string, entries []seedEntry) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := range entries {
+		entry := &entries[i]
+		target := filepath.Join(dir, entry.relPath)
+		if entry.Dir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		} else {
+			if err := ensureParentDir(target); err != nil {
+				return err
+			}
+			if err := writeSeedFile(target, entry); err != nil {
+				return fmt.Errorf("%s: %w", entry.Path, err)
+			}
+		}
+		if entry.mode != 0 {
+			if err := os.Chmod(target, entry.mode); err != nil {
+				return err
+			}
+		}
+	}
+
+	ordered := make([]*seedEntry, 0, len(entries))
+	for i := range entries {
+		if !entries[i].Mtime.IsZero() {
+			ordered = append(ordered, &entries[i])
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return strings.Count(ordered[i].relPath, string(filepath.Separator)) > strings.Count(ordered[j].relPath, string(filepath.Separator))
+	})
+	for _, entry := range ordered {
+		if err := os.Chtimes(filepath.Join(dir, entry.relPath), entry.Mtime, entry.Mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSeedFile(filePath string, entry *seedEntry) error {
+	if entry.Content != nil {
+		return storeFile(filePath, *entry.Content)
+	}
+	// The content goes through storeFileFrom to be encrypted at rest like
+	// any other.
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		const chunk = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+		for remaining := entry.Size; remaining > 0; remaining -= int64(len(chunk)) {
+			n := int64(len(chunk))
+			if remaining < n {
+				n = remaining
+			}
+			bw.WriteString(chunk[:n])
+		}
+		pw.CloseWithError(bw.Flush())
+	}()
+	_, err := storeFileFrom(filePath, pr)
+	pr.Close()
+	return err
+}
+
+// swapInTree renames the staged tree to root. An existing root is moved
+// aside first and removed once the new tree is in place, or put back if that
+// fails.
+func swapInTree(staging string, root string, exists bool, requestId string) error {
+	if !exists {
+		return os.Rename(staging, root)
+	}
+	old := root + ".seed-old-" + requestId
+	if err := os.Rename(root, old); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, root); err != nil {
+		os.Rename(old, root)
+		return err
+	}
+	return os.RemoveAll(old)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// selftestStep is the outcome of one step of the storage self-test.
+type selftestStep struct {
+	Step      string  `json:"step"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// selftest writes a probe file, reads it back, verifies its content and
+// deletes it again, timing each step. It answers 503 when a step fails, so
+// monitoring can tell a running process from storage that actually works.
+func selftest(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	probePath := filepath.Join(config.RootDir, ".selftest-"+requestId)
+	content := fmt.Sprintf("selftest %s %s", serverId, time.Now().UTC().Format(time.RFC3339Nano))
+
+	var steps []selftestStep
+	var total time.Duration
+	run := func(step string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		latency := time.Since(start)
+		total += latency
+		s := selftestStep{Step: step, LatencyMs: latencyMs(latency)}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		steps = append(steps, s)
+		return err == nil
+	}
+
+	var read []byte
+	written := run("write", func() error {
+		return storeFile(probePath, content)
+	})
+	healthy := written &&
+		run("read", func() error {
+			data, release, err := readFileContent(probePath)
+			if err != nil {
+				return err
+			}
+			read = append(read, data...)
+			release()
+			return nil
+		}) &&
+		run("verify", func() error {
+			if !bytes.Equal(read, []byte(content)) {
+				return fmt.Errorf("read back %d bytes that differ from the %d written", len(read), len(content))
+			}
+			return nil
+		})
+	if written {
+		// Clean up even when reading failed, but only count it as healthy
+		// when everything before it passed.
+		removed := run("delete", func() error {
+			return os.Remove(probePath)
+		})
+		healthy = healthy && removed
+	}
+
+	result := map[string]interface{}{
+		"healthy":        healthy,
+		"steps":          steps,
+		"totalLatencyMs": latencyMs(total),
+	}
+	if !healthy {
+		logrus.WithFields(logrus.Fields{
+			"steps":     steps,
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).Warn("Storage self-test failed")
+		writeJSONStatus(w, http.StatusServiceUnavailable, "Storage self-test failed", requestId, result)
+		return
+	}
+	writeJSON(w, "Storage self-test passed", requestId, result)
+}
+
+func latencyMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// SizeLimit caps the size of request bodies and of the files written below
+// a path prefix, overriding maxBodySize there.
+type SizeLimit struct {
+	Prefix   string `json:"prefix"`
+	MaxBytes int64  `json:"maxBytes"`
+}
+
+func validateSizeLimits(limits []SizeLimit) error {
+	for i, limit := range limits {
+		if limit.MaxBytes < 0 {
+			return fmt.Errorf("limit %d: maxBytes must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// errTooLarge is returned when a file would exceed the size limit of its
+// path.
+var errTooLarge = errors.New("too large")
+
+// sizeLimit returns the size limit of the resolved path of r: that of the
+// longest matching prefix in config.SizeLimits, or else config.MaxBodySize.
+// Zero means no limit.
+func sizeLimit(r *http.Request, resolved string) int64 {
+	limit, matched := config.MaxBodySize, -1
+	for _, l := range config.SizeLimits {
+		if len(l.Prefix) > matched && withinAny(r, []string{l.Prefix}, resolved) {
+			limit, matched = l.MaxBytes, len(l.Prefix)
+		}
+	}
+	return limit
+}
+
+// maxSizeLimit returns the largest size limit of any path, or zero if some
+// path has none.
+func maxSizeLimit() int64 {
+	max := config.MaxBodySize
+	for _, l := range config.SizeLimits {
+		if max == 0 || l.MaxBytes == 0 {
+			return 0
+		}
+		if l.MaxBytes > max {
+			max = l.MaxBytes
+		}
+	}
+	return max
+}
+
+// checkFileSize returns errTooLarge if size bytes exceed the size limit of
+// the resolved path of r.
+func checkFileSize(r *http.Request, resolved string, size int64) error {
+	if limit := sizeLimit(r, resolved); limit > 0 && size > limit {
+		return fmt.Errorf("%w: %d bytes exceed the limit of %d bytes", errTooLarge, size, limit)
+	}
+	return nil
+}
+
+// cappedReader reads from r but fails with errTooLarge once more than
+// limit bytes come out of it, for content whose size is only known once it
+// has been produced. A limit of zero or less means none.
+type cappedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.limit > 0 && c.read > c.limit {
+		return n, fmt.Errorf("%w: more than the limit of %d bytes", errTooLarge, c.limit)
+	}
+	return n, err
+}
+
+// limitedBody notes when a request body was cut off at its size limit.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// limitWriter replaces the response with 413 if the request body was cut
+// off before the handler started it. Handlers parsing forms with FormValue
+// never see the error, and fail on the missing values instead.
+type limitWriter struct {
+	http.ResponseWriter
+	body        *limitedBody
+	limit       int64
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *limitWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.body.exceeded {
+		w.replaced = true
+		bodyTooLarge(w.ResponseWriter, w.limit)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom passes src through, so downloads keep using sendfile.
+func (w *limitWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return io.Copy(io.Discard, src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *limitWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.replaced {
+		f.Flush()
+	}
+}
+
+func (w *limitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// limitBody refuses request bodies larger than the size limit with 413. The
+// limit is that of the filePath in the query string if there is one, or
+// else the largest of any path; handlers check the limit of the path a body
+// names with checkFileSize once they have read it.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxSizeLimit()
+		if filePath := r.URL.Query().Get("filePath"); filePath != "" {
+			if resolved, err := resolvePath(r, filePath); err == nil {
+				limit = sizeLimit(r, resolved)
+			}
+		}
+		if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			bodyTooLarge(w, limit)
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit)}
+		r.Body = body
+		next.ServeHTTP(&limitWriter{ResponseWriter: w, body: body, limit: limit}, r)
+	})
+}
+
+func bodyTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("Request body too large: the limit is %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxSplitParts bounds how many parts one file may be split into.
+const maxSplitParts = 10000
+
+// splitPart is one part /splitFile writes.
+type splitPart struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	resolved string
+}
+
+// lineLimitReader reads from br up to the end of the next left lines.
+type lineLimitReader struct {
+	br   *bufio.Reader
+	left int
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if l.left == 0 || len(p) == 0 {
+		return 0, io.EOF
+	}
+	if _, err := l.br.Peek(1); err != nil {
+		return 0, err
+	}
+	buf, _ := l.br.Peek(min(len(p), l.br.Buffered()))
+	n := len(buf)
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		n = i + 1
+		l.left--
+	}
+	copy(p, buf[:n])
+	l.br.Discard(n)
+	return n, nil
+}
+
+// splitSizes returns the sizes of the parts of the file f when split every
+// partLines lines, reading it through once.
+func splitSizes(f contentFile, partLines int) ([]int64, error) {
+	br := bufio.NewReaderSize(f, 64<<10)
+	var sizes []int64
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return sizes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(sizes) == maxSplitParts {
+			return nil, fmt.Errorf("more than %d parts", maxSplitParts)
+		}
+		n, err := io.Copy(io.Discard, &lineLimitReader{br: br, left: partLines})
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, n)
+	}
+}
+
+// splitFile cuts the file at filePath into parts of bytes bytes, or of lines
+// lines, so a huge file can pass through channels limiting the size of a
+// file; /concatFiles puts them back together. The parts are named by
+// namePattern, a template like for /generateFromTemplate in which .n is the
+// number of the part counted from 1; it defaults to the name of the file
+// followed by .part{{pad 3 .n}}. Existing parts are only replaced with
+// overwrite=true. The file itself is left as it is.
+func splitFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	namePattern := r.FormValue("namePattern")
+	logrus.WithFields(logrus.Fields{
+		"filePath":    filePath,
+		"bytes":       r.FormValue("bytes"),
+		"lines":       r.FormValue("lines"),
+		"namePattern": namePattern,
+		"requestId":   requestId,
+		"serverId":    serverId,
+	}).Info("Splitting file")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if (r.FormValue("bytes") == "") == (r.FormValue("lines") == "") {
+		http.Error(w, "Exactly one of bytes and lines is required", http.StatusBadRequest)
+		return
+	}
+	var partBytes int64
+	var partLines int
+	var err error
+	if r.FormValue("bytes") != "" {
+		if partBytes, err = formSize(r, "bytes", 0); err == nil && partBytes == 0 {
+			err = errors.New("Invalid bytes value")
+		}
+	} else {
+		partLines, err = formPositiveInt(r, "lines")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if namePattern == "" {
+		namePattern = filePath + ".part{{pad 3 .n}}"
+	}
+	nameTmpl, err := template.New("name").Funcs(templateFuncs).Option("missingkey=error").Parse(namePattern)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid namePattern: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	f, err := openFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if err := checkNotClientEncrypted(f); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	// Work out every part up front, so bad names or existing parts fail
+	// before anything is written.
+	var sizes []int64
+	if partBytes > 0 {
+		if (info.Size()+partBytes-1)/partBytes > maxSplitParts {
+			http.Error(w, fmt.Sprintf("Splitting into more than %d parts is not allowed", maxSplitParts), http.StatusBadRequest)
+			return
+		}
+		for left := info.Size(); left > 0; left -= partBytes {
+			sizes = append(sizes, min(left, partBytes))
+		}
+	} else {
+		if sizes, err = splitSizes(f, partLines); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to split file: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	parts := make([]splitPart, 0, len(sizes))
+	seen := map[string]bool{}
+	var buf bytes.Buffer
+	for i, size := range sizes {
+		buf.Reset()
+		if err := nameTmpl.Execute(&buf, map[string]interface{}{"n": i + 1}); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid namePattern: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		partPath, err := resolvePath(r, buf.String())
+		if err == nil {
+			err = checkPathScope(r, partPath)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid namePattern %s: %s", buf.String(), err.Error()), pathErrorStatus(err))
+			return
+		}
+		if seen[partPath] || partPath == filePath {
+			http.Error(w, fmt.Sprintf("namePattern must render to a different path for every part, got %q twice", buf.String()), http.StatusBadRequest)
+			return
+		}
+		seen[partPath] = true
+		if err := checkFileSize(r, partPath, size); err != nil {
+			http.Error(w, fmt.Sprintf("Part %s", err.Error()), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !overwrite {
+			if _, err := os.Lstat(partPath); err == nil {
+				http.Error(w, fmt.Sprintf("Part %s already exists; set overwrite=true to replace it", buf.String()), http.StatusConflict)
+				return
+			}
+		}
+		parts = append(parts, splitPart{Path: buf.String(), Size: size, resolved: partPath})
+	}
+
+	if dryRun {
+		entries := make([]dryRunEntry, 0, len(parts))
+		for _, part := range parts {
+			action := "create"
+			if _, err := os.Lstat(part.resolved); err == nil {
+				action = "replace"
+			}
+			entries = append(entries, dryRunEntry{Path: part.resolved, Action: action, Size: part.Size})
+		}
+		writeJSON(w, "Dry run: file not split", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	for _, part := range parts {
+		if err := writeSplitPart(r, requestId, part, f); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to write part %s: %s", part.Path, err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, "File split successfully", requestId, map[string]interface{}{
+		"parts": parts,
+	})
+}
+
+// writeSplitPart writes the next part.Size bytes of src to part, which can
+// be undone like other writes.
+func writeSplitPart(r *http.Request, requestId string, part splitPart, src io.Reader) error {
+	unlock := lockWrites(part.resolved)
+	defer unlock()
+	if err := ensureParentDir(part.resolved); err != nil {
+		return err
+	}
+	existed, backup, err := backupFile(part.resolved)
+	if err != nil {
+		return err
+	}
+	if _, err := storeFileFrom(part.resolved, io.LimitReader(src, part.Size)); err != nil {
+		discardBackup(backup)
+		return err
+	}
+	recordOperation(requestActor(r), requestId, "split", part.resolved, existed, backup)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitFile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		form url.Values
+		want int
+		// parts maps the parts written to their content.
+		parts map[string]string
+	}{
+		{name: "by bytes", form: url.Values{"bytes": {"4"}}, want: http.StatusOK,
+			parts: map[string]string{"data.part001": "one\n", "data.part002": "two\n", "data.part003": "thre", "data.part004": "e\n"}},
+		{name: "by lines", form: url.Values{"lines": {"2"}, "namePattern": {"out/{{.n}}.txt"}}, want: http.StatusOK,
+			parts: map[string]string{"out/1.txt": "one\ntwo\n", "out/2.txt": "three\n"}},
+		{name: "both sizes", form: url.Values{"bytes": {"4"}, "lines": {"2"}}, want: http.StatusBadRequest},
+		{name: "same name for every part", form: url.Values{"lines": {"1"}, "namePattern": {"part"}}, want: http.StatusBadRequest},
+		{name: "part is the file", form: url.Values{"lines": {"1"}, "namePattern": {"{{if eq .n 2}}data{{else}}part{{.n}}{{end}}"}}, want: http.StatusBadRequest},
+		{name: "part outside the root", form: url.Values{"lines": {"1"}, "namePattern": {"../part{{.n}}"}}, want: http.StatusForbidden},
+		{name: "existing part", form: url.Values{"lines": {"2"}, "namePattern": {"taken{{.n}}"}}, want: http.StatusConflict},
+		{name: "overwrite", form: url.Values{"lines": {"2"}, "namePattern": {"taken{{.n}}"}, "overwrite": {"true"}}, want: http.StatusOK,
+			parts: map[string]string{"taken1": "one\ntwo\n", "taken2": "three\n"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := testRoot(t)
+			withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = "" })
+			if err := os.WriteFile(filepath.Join(root, "data"), []byte("one\ntwo\nthree\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "taken2"), []byte("kept"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			form := url.Values{"filePath": {"data"}}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			w := postForm(splitFile, "/splitFile", form)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+
+			for name, want := range tt.parts {
+				if got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name))); string(got) != want {
+					t.Errorf("part %s holds %q (%v), want %q", name, got, err, want)
+				}
+			}
+			if tt.want != http.StatusOK {
+				if got, _ := os.ReadFile(filepath.Join(root, "taken2")); string(got) != "kept" {
+					t.Errorf("failed split replaced a file with %q", got)
+				}
+				if matches, _ := filepath.Glob(filepath.Join(root, "part*")); len(matches) > 0 {
+					t.Errorf("failed split wrote %v", matches)
+				}
+			}
+			if got, _ := os.ReadFile(filepath.Join(root, "data")); string(got) != "one\ntwo\nthree\n" {
+				t.Errorf("file changed to %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileStat is the metadata of a file returned by /statFile. The fields
+// filled in from the platform's stat structure are left out where it has
+// none.
+type fileStat struct {
+	Name       string     `json:"name"`
+	Size       int64      `json:"size"`
+	Mode       string     `json:"mode"`
+	ModeString string     `json:"modeString"`
+	IsDir      bool       `json:"isDir"`
+	IsSymlink  bool       `json:"isSymlink"`
+	LinkTarget string     `json:"linkTarget,omitempty"`
+	ModTime    time.Time  `json:"modTime"`
+	AccessTime *time.Time `json:"accessTime,omitempty"`
+	ChangeTime *time.Time `json:"changeTime,omitempty"`
+	UID        *uint32    `json:"uid,omitempty"`
+	GID        *uint32    `json:"gid,omitempty"`
+	Links      *uint64    `json:"links,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	HashAlgo   string     `json:"hashAlgorithm,omitempty"`
+}
+
+// newHash returns a hash.Hash for the algorithm name.
+func newHash(name string) (hash.Hash, error) {
+	switch name {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	case "xxhash":
+		return newXXHash64(), nil
+	default:
+		return nil, fmt.Errorf("Invalid hash algorithm: %s", name)
+	}
+}
+
+// hashFile returns the hex digest of the content of filePath.
+func hashFile(filePath string, h hash.Hash) (string, error) {
+	f, err := openFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// statFileHandler returns everything the filesystem knows about filePath,
+// which listFiles doesn't: its mode, timestamps and owner, and whether it is
+// a directory or symbolic link. A symbolic link is described itself, not
+// what it points to. hash=sha256 (or md5, sha1, sha512, crc32, xxhash) adds
+// a digest of the content of a regular file.
+func statFileHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Getting file info")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	var h hash.Hash
+	algorithm := r.FormValue("hash")
+	if algorithm != "" {
+		var err error
+		if h, err = newHash(algorithm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	stat := fileStat{
+		Name:       info.Name(),
+		Size:       info.Size(),
+		Mode:       fmt.Sprintf("%04o", info.Mode().Perm()),
+		ModeString: info.Mode().String(),
+		IsDir:      info.IsDir(),
+		IsSymlink:  info.Mode()&fs.ModeSymlink != 0,
+		ModTime:    info.ModTime(),
+	}
+	if stat.IsSymlink {
+		if stat.LinkTarget, err = os.Readlink(filePath); err == nil {
+			stat.LinkTarget = clientLinkTarget(r, stat.LinkTarget)
+		} else {
+			http.Error(w, fmt.Sprintf("Unable to read link %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	addSysStat(&stat, info)
+	if h != nil {
+		if !info.Mode().IsRegular() {
+			http.Error(w, "hash is only computed for regular files", http.StatusBadRequest)
+			return
+		}
+		if stat.Hash, err = hashFile(filePath, h); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		stat.HashAlgo = algorithm
+	}
+	writeJSON(w, "File info retrieved successfully", requestId, stat)
+}
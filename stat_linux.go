@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// addSysStat fills in the access and change times, the owner and the number
+// of hard links of a file from the Linux stat structure.
+func addSysStat(stat *fileStat, info os.FileInfo) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	atime := time.Unix(sys.Atim.Unix())
+	ctime := time.Unix(sys.Ctim.Unix())
+	stat.AccessTime = &atime
+	stat.ChangeTime = &ctime
+	stat.UID = &sys.Uid
+	stat.GID = &sys.Gid
+	links := uint64(sys.Nlink)
+	stat.Links = &links
+}
+
+// fileOwnerOf returns the owner and group of a file.
+func fileOwnerOf(info os.FileInfo) (uid, gid int, ok bool) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(sys.Uid), int(sys.Gid), true
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// formSymlinks parses the optional symlinks form value, which says whether
+// reads and listings follow symbolic links, the default, or report them as
+// links. It returns true for report.
+func formSymlinks(r *http.Request) (bool, error) {
+	switch value := r.FormValue("symlinks"); value {
+	case "", "follow":
+		return false, nil
+	case "report":
+		return true, nil
+	default:
+		return false, fmt.Errorf("Invalid symlinks value: %s", value)
+	}
+}
+
+// clientLinkTarget returns the target of a symbolic link as the client of r
+// sees paths: absolute targets inside its root are given relative to it,
+// like the paths the client sends.
+func clientLinkTarget(r *http.Request, target string) string {
+	if !filepath.IsAbs(target) {
+		return target
+	}
+	return clientPath(r, target)
+}
+
+// symlinkTarget checks the target of a new link at linkPath, as the client
+// of r gave it, and returns what to store in the link. Absolute targets are
+// resolved like any client path; relative ones are kept so the tree can be
+// moved, but must not lead out of the root either.
+func symlinkTarget(r *http.Request, linkPath string, target string) (string, error) {
+	var resolved string
+	if filepath.IsAbs(cleanPath(target)) {
+		var err error
+		if resolved, err = resolvePath(r, target); err != nil {
+			return "", err
+		}
+		target = resolved
+	} else {
+		resolved = filepath.Join(filepath.Dir(linkPath), target)
+		root, err := requestRoot(r)
+		if err != nil {
+			return "", err
+		}
+		if root != "" {
+			if !isWithin(root, resolved) {
+				return "", fmt.Errorf("%w: %s", errOutsideRoot, target)
+			}
+			if err := checkInsideRoot(root, resolved); err != nil {
+				return "", err
+			}
+		}
+	}
+	// Reading through the link reads the target, so the caller must be
+	// allowed to.
+	if err := checkPathScopeFor(r, opRead, resolved); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// createSymlink makes linkPath a symbolic link to target. An existing link
+// is only replaced with overwrite=true, and other files never are.
+func createSymlink(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	linkPath := r.FormValue("linkPath")
+	target := r.FormValue("target")
+	logrus.WithFields(logrus.Fields{
+		"linkPath":  linkPath,
+		"target":    target,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Creating symbolic link")
+
+	if linkPath == "" || target == "" {
+		http.Error(w, "linkPath and target are required", http.StatusBadRequest)
+		return
+	}
+	overwrite, err := formBool(r, "overwrite")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	linkPath, err = resolvePath(r, linkPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid linkPath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	if target, err = symlinkTarget(r, linkPath, target); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(linkPath)
+	defer unlock()
+	existing, err := os.Lstat(linkPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", linkPath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		if existing.Mode()&fs.ModeSymlink == 0 {
+			http.Error(w, "linkPath exists and is not a symbolic link", http.StatusConflict)
+			return
+		}
+		if !overwrite {
+			http.Error(w, "linkPath already exists; set overwrite=true to replace it", http.StatusConflict)
+			return
+		}
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		action := "create"
+		if existing != nil {
+			action = "replace"
+		}
+		writeJSON(w, "Dry run: link not created", requestId, dryRunReport(r, []dryRunEntry{
+			{Path: linkPath, Action: action},
+		}))
+		return
+	}
+
+	if err := ensureParentDir(linkPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// The link is made under a temporary name and renamed into place, so
+	// a replaced link never goes missing in between.
+	tmp := filepath.Join(filepath.Dir(linkPath), ".frw-link-"+requestId)
+	err = os.Symlink(target, tmp)
+	if err == nil {
+		if err = os.Rename(tmp, linkPath); err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create link: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		recordOperation(requestActor(r), requestId, "symlink", linkPath, false, "")
+	}
+	writeJSON(w, "Link created successfully", requestId, map[string]interface{}{
+		"linkTarget": clientLinkTarget(r, target),
+	})
+}
+
+// readLink returns the target of the symbolic link at filePath and the path
+// it finally leads to, or dangling=true if that doesn't exist.
+func readLink(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Reading symbolic link")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		http.Error(w, "filePath is not a symbolic link", http.StatusBadRequest)
+		return
+	}
+	target, err := os.Readlink(filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read link: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"linkTarget": clientLinkTarget(r, target),
+		"dangling":   false,
+	}
+	if resolved, err := filepath.EvalSymlinks(filePath); err == nil {
+		data["resolvedPath"] = clientLinkTarget(r, resolved)
+	} else {
+		data["dangling"] = true
+	}
+	writeJSON(w, "Link read successfully", requestId, data)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxTailBytes bounds what /tailFile returns at once, whatever lines or
+	// bytes ask for.
+	maxTailBytes = 16 << 20
+	// tailPollInterval is how often a followed file is checked for new
+	// data.
+	tailPollInterval = 250 * time.Millisecond
+	// tailKeepAlive is how long a follow stream may stay silent before a
+	// comment is sent so proxies don't close it.
+	tailKeepAlive = 15 * time.Second
+	// tailChunkSize is the most data sent in one event.
+	tailChunkSize = 64 << 10
+)
+
+// tailStart returns the offset of the last lines lines of the file f of
+// the given size, scanning backwards from the end. A newline ending the file
+// doesn't start another line. The scan stops after maxTailBytes.
+func tailStart(f contentFile, size int64, lines int) (int64, error) {
+	end := size
+	if end > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, end-1); err != nil {
+			return 0, err
+		}
+		if last[0] == '\n' {
+			end--
+		}
+	}
+	buf := make([]byte, 32<<10)
+	pos := end
+	for pos > 0 && size-pos < maxTailBytes {
+		n := int64(len(buf))
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] == '\n' {
+				if lines--; lines == 0 {
+					return pos + i + 1, nil
+				}
+			}
+		}
+	}
+	if size-pos > maxTailBytes {
+		return size - maxTailBytes, nil
+	}
+	return 0, nil
+}
+
+// tailFile returns the end of the file at filePath: its last lines lines,
+// 10 by default, or its last bytes bytes. With follow=true the connection
+// is kept open and the tail and everything appended after it are streamed
+// as Server-Sent Events, like tail -f.
+func tailFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Tailing file")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("lines") != "" && r.FormValue("bytes") != "" {
+		http.Error(w, "lines and bytes are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+	lines := 10
+	var tailBytes int
+	var err error
+	if r.FormValue("bytes") != "" {
+		if tailBytes, err = formPositiveInt(r, "bytes"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tailBytes > maxTailBytes {
+			tailBytes = maxTailBytes
+		}
+	} else if r.FormValue("lines") != "" {
+		if lines, err = formPositiveInt(r, "lines"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	follow, err := formBool(r, "follow")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	f, err := openFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if err := checkNotClientEncrypted(f); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "filePath is not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	size := info.Size()
+	var start int64
+	if tailBytes > 0 {
+		start = size - int64(tailBytes)
+		if start < 0 {
+			start = 0
+		}
+	} else if start, err = tailStart(f, size, lines); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if !follow {
+		data := make([]byte, size-start)
+		if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("Unable to read file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, "File tail read successfully", requestId, map[string]interface{}{
+			"fileContent": string(data),
+			"offset":      start,
+			"size":        size,
+		})
+		return
+	}
+
+	// A client reconnecting after a dropped stream carries on where the
+	// last event it got ended.
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if offset, err := strconv.ParseInt(id, 10, 64); err == nil && offset >= 0 && offset <= size {
+			start = offset
+		}
+	}
+	followFile(w, r, filePath, start, requestId)
+}
+
+// followFile streams the file at filePath from offset on as Server-Sent
+// Events until the client goes away. Each "append" event holds
+// new data, one data field per line, with the offset the data ends at as
+// its id. When the file is truncated or replaced, as writeFile does, a
+// "reset" event is sent and the new content follows from the start.
+func followFile(w http.ResponseWriter, r *http.Request, filePath string, offset int64, requestId string) {
+	f, err := openFile(filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to open file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer func() { f.Close() }()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Request-Id", requestId)
+	w.Header().Set("X-Server-Id", serverId)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	buf := make([]byte, tailChunkSize)
+	lastSent := time.Now()
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		info, err := f.Stat()
+		if err != nil {
+			return
+		}
+		// A replaced file keeps the old one open; switch to the new one.
+		if current, err := os.Stat(filePath); err == nil && !sameFile(info, current) {
+			if next, err := openFile(filePath); err == nil {
+				if checkNotClientEncrypted(next) != nil {
+					// Following stops rather than send ciphertext.
+					next.Close()
+					return
+				}
+				f.Close()
+				f = next
+				if info, err = f.Stat(); err != nil {
+					return
+				}
+				offset = 0
+				fmt.Fprintf(w, "event: reset\ndata:\n\n")
+			}
+		} else if info.Size() < offset {
+			offset = 0
+			fmt.Fprintf(w, "event: reset\ndata:\n\n")
+		}
+
+		for offset < info.Size() {
+			n, err := f.ReadAt(buf, offset)
+			if n > 0 {
+				offset += int64(n)
+				var event bytes.Buffer
+				fmt.Fprintf(&event, "event: append\nid: %d\n", offset)
+				for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+					event.WriteString("data: ")
+					event.Write(line)
+					event.WriteByte('\n')
+				}
+				event.WriteByte('\n')
+				if _, err := w.Write(event.Bytes()); err != nil {
+					return
+				}
+				lastSent = time.Now()
+			}
+			if err != nil {
+				break
+			}
+		}
+		if time.Since(lastSent) >= tailKeepAlive {
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			lastSent = time.Now()
+		}
+		rc.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
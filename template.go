@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxTemplateFiles bounds how many files one matrix may produce.
+const maxTemplateFiles = 100000
+
+// templateFuncs are available in templates on top of the text/template
+// builtins, mainly to derive numbers such as ports from an id.
+var templateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"sub": func(a, b int) int { return a - b },
+	"mul": func(a, b int) int { return a * b },
+	"pad": func(width int, n int) string { return fmt.Sprintf("%0*d", width, n) },
+}
+
+// parseMatrix reads a JSON object mapping each variable to its values: a
+// list of values, or a "from..to" string for a range of integers.
+func parseMatrix(s string) (map[string][]interface{}, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+	matrix := map[string][]interface{}{}
+	for name, value := range raw {
+		var list []interface{}
+		if err := json.Unmarshal(value, &list); err == nil {
+			matrix[name] = normalizeMatrixValues(list)
+			continue
+		}
+		var span string
+		if err := json.Unmarshal(value, &span); err != nil {
+			return nil, fmt.Errorf("%s: must be a list or a \"from..to\" range", name)
+		}
+		from, to, ok := strings.Cut(span, "..")
+		start, err1 := strconv.Atoi(from)
+		end, err2 := strconv.Atoi(to)
+		if !ok || err1 != nil || err2 != nil || end < start {
+			return nil, fmt.Errorf("%s: invalid range %q", name, span)
+		}
+		if end-start >= maxTemplateFiles {
+			return nil, fmt.Errorf("%s: range %q is too large", name, span)
+		}
+		for i := start; i <= end; i++ {
+			matrix[name] = append(matrix[name], i)
+		}
+	}
+	return matrix, nil
+}
+
+// normalizeMatrixValues turns whole JSON numbers into ints so templates can
+// do arithmetic on them.
+func normalizeMatrixValues(values []interface{}) []interface{} {
+	for i, v := range values {
+		if f, ok := v.(float64); ok && f == float64(int(f)) {
+			values[i] = int(f)
+		}
+	}
+	return values
+}
+
+// matrixCombinations returns every combination of the matrix values, in a
+// stable order with the last variable (alphabetically) varying fastest.
+func matrixCombinations(matrix map[string][]interface{}) ([]map[string]interface{}, error) {
+	names := make([]string, 0, len(matrix))
+	total := 1
+	for name, values := range matrix {
+		names = append(names, name)
+		total *= len(values)
+		if total > maxTemplateFiles {
+			return nil, fmt.Errorf("matrix produces more than %d files", maxTemplateFiles)
+		}
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]interface{}{{}}
+	for _, name := range names {
+		var next []map[string]interface{}
+		for _, combination := range combinations {
+			for _, value := range matrix[name] {
+				c := make(map[string]interface{}, len(combination)+1)
+				for k, v := range combination {
+					c[k] = v
+				}
+				c[name] = value
+				next = append(next, c)
+			}
+		}
+		combinations = next
+	}
+	return combinations, nil
+}
+
+// templateFile is one file rendered from a template.
+type templateFile struct {
+	filePath string
+	vars     map[string]interface{}
+}
+
+// generateFromTemplate renders the stored template at templatePath once for
+// every combination of the variables in matrix, writing each result to the
+// path outputPath renders to. Both are Go text/templates, e.g.
+// "fleet/host-{{.id}}.conf" with "port = {{add 8000 .id}}".
+func generateFromTemplate(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templatePath := r.FormValue("templatePath")
+	outputPath := r.FormValue("outputPath")
+	logrus.WithFields(logrus.Fields{
+		"templatePath": templatePath,
+		"outputPath":   outputPath,
+		"requestId":    requestId,
+		"serverId":     serverId,
+	}).Info("Generating files from template")
+
+	if templatePath == "" || outputPath == "" {
+		http.Error(w, "templatePath and outputPath are required", http.StatusBadRequest)
+		return
+	}
+	matrix, err := parseMatrix(r.FormValue("matrix"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid matrix: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	combinations, err := matrixCombinations(matrix)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid matrix: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	async, err := formBool(r, "async")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filePath, err := resolvePath(r, templatePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid templatePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	source, release, err := readFileContent(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Unable to read template: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+	if err := checkNotClientEncrypted(bytes.NewReader(source)); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read template: %s", err.Error()), clientKeyStatus(err))
+		return
+	}
+	contentTmpl, err := template.New("content").Funcs(templateFuncs).Option("missingkey=error").Parse(string(source))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid template: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	pathTmpl, err := template.New("path").Funcs(templateFuncs).Option("missingkey=error").Parse(outputPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid outputPath: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// Render every path up front so bad input fails before anything is
+	// written.
+	files := make([]templateFile, 0, len(combinations))
+	seen := map[string]bool{}
+	var buf bytes.Buffer
+	for _, vars := range combinations {
+		buf.Reset()
+		if err := pathTmpl.Execute(&buf, vars); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid outputPath: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		filePath, err := resolvePath(r, buf.String())
+		if err == nil {
+			err = checkPathScope(r, filePath)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid outputPath %s: %s", buf.String(), err.Error()), pathErrorStatus(err))
+			return
+		}
+		if buf.Len() == 0 {
+			http.Error(w, "outputPath rendered to an empty path", http.StatusBadRequest)
+			return
+		}
+		if seen[filePath] {
+			http.Error(w, fmt.Sprintf("outputPath must render to a different path for every combination, got %q twice", buf.String()), http.StatusBadRequest)
+			return
+		}
+		seen[filePath] = true
+		files = append(files, templateFile{filePath: filePath, vars: vars})
+	}
+
+	// Variables missing from the matrix show up with the first file already.
+	if err := contentTmpl.Execute(io.Discard, files[0].vars); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid template: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if async {
+		description := fmt.Sprintf("Render %s into %d files", templatePath, len(files))
+		j := startJob("generateFromTemplate", description, func(ctx context.Context, j *job) error {
+			return renderTemplateFiles(ctx, contentTmpl, files, j.pauseForMaintenance, j.setProgress)
+		})
+		writeJSON(w, "File generation started", requestId, map[string]interface{}{
+			"jobId": j.id,
+		})
+		return
+	}
+
+	err = renderTemplateFiles(r.Context(), contentTmpl, files, nil, func(done, total int64) {
+		setRequestProgress(r.Context(), "filesGenerated", done)
+		setRequestProgress(r.Context(), "filesTotal", total)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to generate files: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "Files generated successfully", requestId, map[string]interface{}{
+		"files": len(files),
+	})
+}
+
+// renderTemplateFiles writes every file rendered from tmpl. Like
+// generateFileSet, it calls pause and progress around each file and removes
+// the files written so far when ctx is cancelled.
+func renderTemplateFiles(ctx context.Context, tmpl *template.Template, files []templateFile, pause func(context.Context) error, progress func(done, total int64)) (err error) {
+	var created []string
+	defer func() {
+		if errors.Is(err, context.Canceled) {
+			for _, filePath := range created {
+				os.Remove(filePath)
+			}
+		}
+	}()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if pause != nil {
+			if err := pause(ctx); err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+		if err := tmpl.Execute(buf, file.vars); err != nil {
+			return err
+		}
+		if err := ensureParentDir(file.filePath); err != nil {
+			return err
+		}
+		created = append(created, file.filePath)
+		if err := retryFS("write", func() error {
+			_, err := storeFileFrom(file.filePath, bytes.NewReader(buf.Bytes()))
+			return err
+		}); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(int64(i+1), int64(len(files)))
+		}
+	}
+	return nil
+}
+
+// templateValue turns whole JSON numbers anywhere in v into ints, like
+// normalizeMatrixValues, so templates can do arithmetic on them.
+func templateValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == float64(int(v)) {
+			return int(v)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = templateValue(item)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = templateValue(item)
+		}
+	}
+	return v
+}
+
+// renderTemplate renders a Go text/template, stored at templatePath or
+// given inline as template, with the JSON object vars and writes the result
+// to filePath, e.g. to produce the config files of a test environment.
+func renderTemplate(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templatePath := r.FormValue("templatePath")
+	inline := r.FormValue("template")
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"templatePath": templatePath,
+		"inline":       inline != "",
+		"filePath":     filePath,
+		"requestId":    requestId,
+		"serverId":     serverId,
+	}).Info("Rendering template")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if (templatePath == "") == (inline == "") {
+		http.Error(w, "Exactly one of templatePath and template is required", http.StatusBadRequest)
+		return
+	}
+	vars := map[string]interface{}{}
+	if s := r.FormValue("vars"); s != "" {
+		if err := json.Unmarshal([]byte(s), &vars); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid vars: must be a JSON object: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		templateValue(vars)
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	validate, err := formBool(r, "validate")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+	check, err := contentCheck(r, filePath, validate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source := inline
+	if templatePath != "" {
+		resolved, err := resolvePath(r, templatePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid templatePath: %s", err.Error()), pathErrorStatus(err))
+			return
+		}
+		data, release, err := readFileContent(resolved)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "Template not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Unable to read template: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if err := checkNotClientEncrypted(bytes.NewReader(data)); err != nil {
+			release()
+			http.Error(w, fmt.Sprintf("Unable to read template: %s", err.Error()), clientKeyStatus(err))
+			return
+		}
+		source = string(data)
+		release()
+	}
+	tmpl, err := template.New("content").Funcs(templateFuncs).Option("missingkey=error").Parse(source)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid template: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	// The output is rendered in full first, so a template failing halfway
+	// writes nothing.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := tmpl.Execute(buf, vars); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid template: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err := checkFileSize(r, filePath, int64(buf.Len())); err != nil {
+		http.Error(w, fmt.Sprintf("Rendered file %s", err.Error()), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if check != nil {
+		if err := check(buf.Bytes()); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to render template: %s", err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if dryRun {
+		var entries []dryRunEntry
+		if info, err := statFile(filePath); err == nil {
+			entries = append(entries, dryRunEntry{Path: filePath, Action: "replace", Size: info.Size()})
+		}
+		report := dryRunReport(r, entries)
+		report["content"] = buf.String()
+		writeJSON(w, "Dry run: template not written", requestId, report)
+		return
+	}
+
+	if err := ensureParentDir(filePath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	err = retryFS("write", func() error {
+		scanned := scanUpload(bytes.NewReader(buf.Bytes()), filePath, requestActor(r))
+		defer scanned.Close()
+		_, err := storeFileFrom(filePath, scanned)
+		return err
+	})
+	if err != nil {
+		discardBackup(backup)
+		http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), scanStatus(err))
+		return
+	}
+	recordOperation(requestActor(r), requestId, "renderTemplate", filePath, existed, backup)
+	writeJSON(w, "Template rendered successfully", requestId, map[string]interface{}{
+		"size": buf.Len(),
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// TenantsConfig isolates tenants from each other. Each tenant's paths are
+// confined to its own directory below Dir, like rootDir confines them all.
+type TenantsConfig struct {
+	// Dir holds a directory per tenant, created on first use. Empty
+	// disables tenants.
+	Dir string `json:"dir"`
+}
+
+func (c TenantsConfig) enabled() bool {
+	return c.Dir != ""
+}
+
+// errTenantRequired is returned when resolving a path for a request that
+// isn't assigned to a tenant while tenants are enabled.
+var errTenantRequired = errors.New("a tenant is required")
+
+// validTenant matches tenant names, which become directory names.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var (
+	tenantRequests = newMetric("counter", "frw_tenant_requests_total",
+		"Requests served per tenant.", "tenant")
+	tenantBytesReceived = newMetric("counter", "frw_tenant_received_bytes_total",
+		"Request body bytes received per tenant.", "tenant")
+	tenantBytesSent = newMetric("counter", "frw_tenant_sent_bytes_total",
+		"Response body bytes sent per tenant.", "tenant")
+)
+
+// tenantDirs remembers the tenant directories already created.
+var tenantDirs sync.Map
+
+// tenantRoot returns the directory of tenant, creating it if needed.
+func tenantRoot(tenant string) (string, error) {
+	dir := filepath.Join(config.Tenants.Dir, tenant)
+	if _, ok := tenantDirs.Load(tenant); ok {
+		return dir, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tenantDirs.Store(tenant, true)
+	return dir, nil
+}
+
+// tenantKey is the context key of the tenant a request is assigned to.
+type tenantKey struct{}
+
+// requestTenant returns the tenant r is assigned to, or "".
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantWriter counts the response bytes sent for a tenant.
+type tenantWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *tenantWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom passes src through, so downloads keep using sendfile.
+func (w *tenantWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.bytes += n
+	return n, err
+}
+
+func (w *tenantWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *tenantWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// tenantReader counts the request body bytes received for a tenant.
+type tenantReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *tenantReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// assignTenant assigns each request to the tenant of its API key or token,
+// or else to the one named by its X-Tenant header. A caller bound to a
+// tenant can't name another one.
+func assignTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.Tenants.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenant := r.Header.Get("X-Tenant")
+		if p := requestPrincipal(r); p != nil && p.Tenant != "" {
+			if tenant != "" && tenant != p.Tenant {
+				http.Error(w, fmt.Sprintf("%s may only access tenant %s", p.Name, p.Tenant), http.StatusForbidden)
+				return
+			}
+			tenant = p.Tenant
+		}
+		if tenant == "" {
+			// Requests without a tenant fail as soon as they name a path.
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validTenant.MatchString(tenant) {
+			http.Error(w, fmt.Sprintf("Invalid tenant %q", tenant), http.StatusBadRequest)
+			return
+		}
+
+		tw := &tenantWriter{ResponseWriter: w}
+		body := &tenantReader{ReadCloser: r.Body}
+		r.Body = body
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+		tenantRequests.inc(tenant)
+		tenantBytesReceived.add(tenant, float64(body.bytes))
+		tenantBytesSent.add(tenant, float64(tw.bytes))
+	})
+}
+
+// tenantUsage is the usage of a tenant listed by /admin/tenants.
+type tenantUsage struct {
+	Tenant        string  `json:"tenant"`
+	Files         int64   `json:"files"`
+	StorageBytes  int64   `json:"storageBytes"`
+	Requests      float64 `json:"requests"`
+	BytesReceived float64 `json:"bytesReceived"`
+	BytesSent     float64 `json:"bytesSent"`
+}
+
+// listTenants reports the storage used by each tenant and the traffic it
+// has caused since the server started.
+func listTenants(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !config.Tenants.enabled() {
+		http.Error(w, "Tenants are not enabled", http.StatusNotFound)
+		return
+	}
+
+	entries, err := os.ReadDir(config.Tenants.Dir)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to list tenants: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	usage := []tenantUsage{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validTenant.MatchString(entry.Name()) {
+			continue
+		}
+		u := tenantUsage{
+			Tenant:        entry.Name(),
+			Requests:      tenantRequests.value(entry.Name()),
+			BytesReceived: tenantBytesReceived.value(entry.Name()),
+			BytesSent:     tenantBytesSent.value(entry.Name()),
+		}
+		var mu sync.Mutex
+		err := walkTree(r.Context(), filepath.Join(config.Tenants.Dir, entry.Name()), 0, func(relPath string, d fs.DirEntry) error {
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			mu.Lock()
+			u.Files++
+			u.StorageBytes += info.Size()
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to measure tenant %s: %s", entry.Name(), err.Error()), http.StatusInternalServerError)
+			return
+		}
+		usage = append(usage, u)
+	}
+	writeJSON(w, "Tenants listed successfully", requestId, usage)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tlsReloadInterval is how often the certificate and key files are checked
+// for changes.
+const tlsReloadInterval = 10 * time.Second
+
+// certReloader serves the certificate in config.TLSCert and config.TLSKey
+// and loads it again when either file changes, so certificates can be
+// rotated without a restart.
+type certReloader struct {
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// filesModTime returns the latest modification time of the certificate and
+// key files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{config.TLSCert, config.TLSKey} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// watch reloads the certificate whenever its files change. A pair that
+// fails to load, e.g. because only one of the files has been replaced yet,
+// is tried again on the next check while the old certificate stays in use.
+func (c *certReloader) watch() {
+	for range time.Tick(tlsReloadInterval) {
+		modTime, err := c.filesModTime()
+		c.mu.RLock()
+		changed := err == nil && !modTime.Equal(c.modTime)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		fields := logrus.Fields{
+			"tlsCert":  config.TLSCert,
+			"tlsKey":   config.TLSKey,
+			"serverId": serverId,
+		}
+		if err := c.load(); err != nil {
+			logrus.WithFields(fields).Warnf("Unable to reload TLS certificate: %s", err.Error())
+			continue
+		}
+		logrus.WithFields(fields).Info("Reloaded TLS certificate")
+	}
+}
+
+// setupTLS returns the TLS config to serve HTTPS with, or nil when no
+// certificate is configured.
+func setupTLS() (*tls.Config, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+	reloader := &certReloader{}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	go reloader.watch()
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if config.TLSClientCA != "" {
+		pem, err := os.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// clientCertName returns the common name of the verified client certificate
+// r was sent with, or "" if there is none.
+func clientCertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// formTime parses the optional RFC 3339 time form value name, returning def
+// when it is missing.
+func formTime(r *http.Request, name string, def time.Time) (time.Time, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s value", name)
+	}
+	return t, nil
+}
+
+// touchFile works like the touch utility: it creates filePath empty if it
+// is missing, unless noCreate=true, and sets its access and modification
+// times. Both are set to time, which defaults to now, unless atime or mtime
+// sets either on its own.
+func touchFile(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Touching file")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	// Giving only atime or mtime leaves the other time as it is; the zero
+	// time tells Chtimes to.
+	t, err := formTime(r, "time", time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("time") == "" && (r.FormValue("atime") != "" || r.FormValue("mtime") != "") {
+		t = time.Time{}
+	}
+	atime, err := formTime(r, "atime", t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mtime, err := formTime(r, "mtime", t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	noCreate, err := formBool(r, "noCreate")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(filePath)
+	defer unlock()
+	existed := true
+	if _, err := statFile(filePath); errors.Is(err, fs.ErrNotExist) {
+		existed = false
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !existed && noCreate {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		action := "touch"
+		if !existed {
+			action = "create"
+		}
+		writeJSON(w, "Dry run: file not touched", requestId, dryRunReport(r, []dryRunEntry{
+			{Path: filePath, Action: action},
+		}))
+		return
+	}
+
+	if !existed {
+		if err := ensureParentDir(filePath); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+		if err == nil {
+			err = f.Close()
+		}
+		if err == nil {
+			err = chownCreated(filePath)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to create file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		// Undoing the touch removes the file again. Only the times of an
+		// existing file change, which there is nothing to undo for.
+		recordOperation(requestActor(r), requestId, "touch", filePath, false, "")
+	}
+	if err := os.Chtimes(filePath, atime, mtime); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to set file times: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "File touched successfully", requestId, map[string]interface{}{
+		"created": !existed,
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxChunkSize bounds the body of a single chunk.
+	maxChunkSize = 64 << 20
+	// uploadExpiry is how long an upload may stay unfinished before its
+	// chunks are thrown away.
+	uploadExpiry = 24 * time.Hour
+)
+
+// chunkedUpload is a file being uploaded in checksummed chunks. Chunks are
+// kept in their own files until the upload is completed.
+type chunkedUpload struct {
+	mu       sync.Mutex
+	id       string
+	filePath string
+	// sha256 is the expected hex SHA-256 of the whole file.
+	sha256  string
+	dir     string
+	started time.Time
+	chunks  map[int]int64 // index to size
+}
+
+var uploads struct {
+	sync.Mutex
+	byId map[string]*chunkedUpload
+}
+
+func uploadDir() string {
+	if config.UploadDir != "" {
+		return config.UploadDir
+	}
+	return filepath.Join(os.TempDir(), "frw-uploads")
+}
+
+func findUpload(id string) *chunkedUpload {
+	uploads.Lock()
+	defer uploads.Unlock()
+	return uploads.byId[id]
+}
+
+// dropUpload forgets an upload and removes its chunks.
+func dropUpload(u *chunkedUpload) {
+	uploads.Lock()
+	delete(uploads.byId, u.id)
+	uploads.Unlock()
+	os.RemoveAll(u.dir)
+}
+
+// expireUploads drops uploads that were started too long ago.
+func expireUploads() {
+	uploads.Lock()
+	var expired []*chunkedUpload
+	for _, u := range uploads.byId {
+		if time.Since(u.started) > uploadExpiry {
+			expired = append(expired, u)
+		}
+	}
+	uploads.Unlock()
+	for _, u := range expired {
+		dropUpload(u)
+	}
+}
+
+func (u *chunkedUpload) status() map[string]interface{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	received := make([]int, 0, len(u.chunks))
+	var size int64
+	for index, chunkSize := range u.chunks {
+		received = append(received, index)
+		size += chunkSize
+	}
+	sort.Ints(received)
+	return map[string]interface{}{
+		"uploadId": u.id,
+		"filePath": u.filePath,
+		"received": received,
+		"bytes":    size,
+		"started":  u.started,
+	}
+}
+
+// startUpload begins a chunked upload to filePath. sha256 is the hash the
+// assembled file must have.
+func startUpload(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	checksum := strings.ToLower(r.FormValue("sha256"))
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Starting chunked upload")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	if !isSHA256(checksum) {
+		http.Error(w, "Invalid sha256 value", http.StatusBadRequest)
+		return
+	}
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	expireUploads()
+	u := &chunkedUpload{
+		id:       requestId,
+		filePath: filePath,
+		sha256:   checksum,
+		dir:      filepath.Join(uploadDir(), requestId),
+		started:  time.Now(),
+		chunks:   map[int]int64{},
+	}
+	if err := os.MkdirAll(u.dir, 0755); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create upload directory: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	uploads.Lock()
+	if uploads.byId == nil {
+		uploads.byId = map[string]*chunkedUpload{}
+	}
+	uploads.byId[u.id] = u
+	uploads.Unlock()
+	writeJSON(w, "Upload started successfully", requestId, u.status())
+}
+
+func isSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// uploadChunk stores the request body as chunk index of an upload. The
+// X-Chunk-Sha256 header must match the SHA-256 of the body; if it doesn't
+// the chunk is rejected with 422 so the client resends just that chunk.
+func uploadChunk(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	u := findUpload(query.Get("uploadId"))
+	if u == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	index, err := strconv.Atoi(query.Get("index"))
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid index value", http.StatusBadRequest)
+		return
+	}
+	checksum := strings.ToLower(r.Header.Get("X-Chunk-Sha256"))
+	if !isSHA256(checksum) {
+		http.Error(w, "Invalid X-Chunk-Sha256 header", http.StatusBadRequest)
+		return
+	}
+
+	// Write to a temporary file first so a failed or corrupt transfer never
+	// replaces a good copy of the chunk.
+	chunkPath := filepath.Join(u.dir, strconv.Itoa(index))
+	tmp, err := os.CreateTemp(u.dir, "incoming-")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to store chunk: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), http.MaxBytesReader(w, r.Body, maxChunkSize))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("Unable to store chunk: %s", err.Error()), status)
+		return
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != checksum {
+		logrus.WithFields(logrus.Fields{
+			"uploadId":  u.id,
+			"index":     index,
+			"requestId": requestId,
+			"serverId":  serverId,
+		}).Warn("Chunk checksum mismatch")
+		http.Error(w, fmt.Sprintf("Chunk checksum mismatch: got %s", got), http.StatusUnprocessableEntity)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	total := size
+	for i, chunkSize := range u.chunks {
+		if i != index {
+			total += chunkSize
+		}
+	}
+	if err := checkFileSize(r, u.filePath, total); err != nil {
+		http.Error(w, fmt.Sprintf("Upload %s", err.Error()), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := os.Rename(tmp.Name(), chunkPath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to store chunk: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	u.chunks[index] = size
+	writeJSON(w, "Chunk stored successfully", requestId, map[string]interface{}{
+		"uploadId": u.id,
+		"index":    index,
+		"size":     size,
+	})
+}
+
+// uploadStatus lists the chunks received so far.
+func uploadStatus(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := findUpload(r.FormValue("uploadId"))
+	if u == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, "Upload retrieved successfully", requestId, u.status())
+}
+
+var errUploadIncomplete = errors.New("upload incomplete")
+
+// completeUpload assembles chunks 0 to chunks-1 into the target file. The
+// result must match the SHA-256 given when the upload was started, otherwise
+// nothing is written and the chunks are kept so bad ones can be resent.
+func completeUpload(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := findUpload(r.FormValue("uploadId"))
+	if u == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	chunks, err := formPositiveInt(r, "chunks")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// The file is locked from the check of the preconditions until the
+	// assembled file replaces it. A failed check keeps the chunks, so the
+	// client can complete the upload once it has looked at the file.
+	unlock := lockWrites(u.filePath)
+	defer unlock()
+	if !preconditionsHold(w, r, u.filePath) {
+		return
+	}
+	size, err := u.assemble(chunks)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUploadIncomplete) {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Unable to complete upload: %s", err.Error()), status)
+		return
+	}
+	if size < 0 {
+		http.Error(w, "Unable to complete upload: file checksum mismatch", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := scanAssembled(u, requestActor(r)); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to complete upload: %s", err.Error()), scanStatus(err))
+		return
+	}
+
+	if err := ensureParentDir(u.filePath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	existed, backup, err := backupFile(u.filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if err := commitAssembled(u); err != nil {
+		discardBackup(backup)
+		http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	recordOperation(requestActor(r), requestId, "write", u.filePath, existed, backup)
+	dropUpload(u)
+	writeJSON(w, "Upload completed successfully", requestId, map[string]interface{}{
+		"filePath": u.filePath,
+		"size":     size,
+		"sha256":   u.sha256,
+	})
+}
+
+// assemble concatenates the chunks into the upload directory and returns the
+// size of the result, or -1 if it doesn't have the expected hash.
+func (u *chunkedUpload) assemble(chunks int) (int64, error) {
+	var missing []string
+	for i := 0; i < chunks; i++ {
+		if _, ok := u.chunks[i]; !ok {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("%w: missing chunks %s", errUploadIncomplete, strings.Join(missing, ","))
+	}
+
+	assembledPath := filepath.Join(u.dir, "assembled")
+	out, err := os.Create(assembledPath)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	hash := sha256.New()
+	dst := io.MultiWriter(out, hash)
+	var size int64
+	for i := 0; i < chunks; i++ {
+		n, err := copyChunk(dst, filepath.Join(u.dir, strconv.Itoa(i)))
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != u.sha256 {
+		os.Remove(assembledPath)
+		return -1, nil
+	}
+	return size, nil
+}
+
+// commitAssembled puts the assembled file of u in place. Files encrypted at
+// rest are stored anew, since the chunks were kept in the clear.
+func commitAssembled(u *chunkedUpload) error {
+	assembledPath := filepath.Join(u.dir, "assembled")
+	if !atRestEnabled() {
+		return movePath(assembledPath, u.filePath)
+	}
+	f, err := os.Open(assembledPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := storeFileFrom(u.filePath, f); err != nil {
+		return err
+	}
+	return os.Remove(assembledPath)
+}
+
+// scanAssembled scans the assembled file of u for viruses, if scanning is
+// enabled. An infected file is removed.
+func scanAssembled(u *chunkedUpload, actor string) error {
+	if !config.Antivirus.enabled() {
+		return nil
+	}
+	assembledPath := filepath.Join(u.dir, "assembled")
+	f, err := os.Open(assembledPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src := scanUpload(f, u.filePath, actor)
+	defer src.Close()
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		os.Remove(assembledPath)
+		return err
+	}
+	return nil
+}
+
+func copyChunk(dst io.Writer, chunkPath string) (int64, error) {
+	f, err := openFile(chunkPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(dst, f)
+}
+
+// abortUpload throws away an unfinished upload.
+func abortUpload(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := findUpload(r.FormValue("uploadId"))
+	if u == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	dropUpload(u)
+	writeJSON(w, "Upload aborted successfully", requestId, nil)
+}
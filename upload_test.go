@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompleteUploadConditional(t *testing.T) {
+	root := testRoot(t)
+	withConfig(t, func(c *Config) { c.RootDir = root; c.TrashDir = ""; c.UploadDir = t.TempDir() })
+	filePath := filepath.Join(root, "big.bin")
+	if err := os.WriteFile(filePath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := fileETag(info)
+
+	content := []byte("new content")
+	sum := sha256.Sum256(content)
+	w := postForm(startUpload, "/upload/start", url.Values{"filePath": {"big.bin"}, "sha256": {hex.EncodeToString(sum[:])}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("start: status %d: %s", w.Code, w.Body.String())
+	}
+	var started struct {
+		Data struct {
+			UploadId string `json:"uploadId"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	id := started.Data.UploadId
+
+	r := httptest.NewRequest("PUT", "/upload/chunk?uploadId="+id+"&index=0", bytes.NewReader(content))
+	r.Header.Set("X-Chunk-Sha256", hex.EncodeToString(sum[:]))
+	w = httptest.NewRecorder()
+	uploadChunk(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", w.Code, w.Body.String())
+	}
+
+	complete := func(ifMatch string) *httptest.ResponseRecorder {
+		form := url.Values{"uploadId": {id}, "chunks": {"1"}}
+		r := httptest.NewRequest("POST", "/upload/complete", bytes.NewReader([]byte(form.Encode())))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		completeUpload(w, r)
+		return w
+	}
+	if w := complete(`"0-0"`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale tag: status %d: %s", w.Code, w.Body.String())
+	}
+	if got, _ := os.ReadFile(filePath); string(got) != "old" {
+		t.Fatalf("file replaced despite the failed precondition: %q", got)
+	}
+	if w := complete(etag); w.Code != http.StatusOK {
+		t.Fatalf("current tag: status %d: %s", w.Code, w.Body.String())
+	}
+	if got, _ := os.ReadFile(filePath); !bytes.Equal(got, content) {
+		t.Errorf("file content %q", got)
+	}
+}
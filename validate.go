@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ContentSchema has the JSON and YAML files written below a path prefix
+// validated against a JSON Schema.
+type ContentSchema struct {
+	Prefix string `json:"prefix"`
+	// Schema is the path of the file holding the JSON Schema.
+	Schema string `json:"schema"`
+}
+
+// maxValidatedSize is the most content held in memory to be validated.
+const maxValidatedSize = 64 << 20
+
+// errInvalidContent is returned when content written with validation is
+// malformed or doesn't match its schema.
+var errInvalidContent = errors.New("Invalid content")
+
+// contentSchemas holds the schemas of config.ContentSchemas, loaded by
+// loadContentSchemas.
+var contentSchemas []*jsonSchema
+
+// loadContentSchemas reads the schemas config.ContentSchemas names.
+func loadContentSchemas() error {
+	contentSchemas = make([]*jsonSchema, len(config.ContentSchemas))
+	for i, cs := range config.ContentSchemas {
+		schema, err := loadJSONSchema(cs.Schema)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cs.Schema, err)
+		}
+		contentSchemas[i] = schema
+	}
+	return nil
+}
+
+// schemaFor returns the schema of the resolved path of r: that of the
+// longest matching prefix in config.ContentSchemas, or nil.
+func schemaFor(r *http.Request, resolved string) *jsonSchema {
+	var schema *jsonSchema
+	matched := -1
+	for i, cs := range config.ContentSchemas {
+		if len(cs.Prefix) > matched && withinAny(r, []string{cs.Prefix}, resolved) {
+			schema, matched = contentSchemas[i], len(cs.Prefix)
+		}
+	}
+	return schema
+}
+
+// contentFormat returns the format validation parses a file called name
+// as, going by its extension: json, yaml, xml or "".
+func contentFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".xml":
+		return "xml"
+	}
+	return ""
+}
+
+// contentCheck returns the check content written to the resolved path of r
+// has to pass, or nil if there is none. validate asks for the content to be
+// parsed; JSON and YAML files below a prefix with a schema are validated
+// against it whether asked or not.
+func contentCheck(r *http.Request, resolved string, validate bool) (func([]byte) error, error) {
+	format := contentFormat(resolved)
+	var schema *jsonSchema
+	if format == "json" || format == "yaml" {
+		schema = schemaFor(r, resolved)
+	}
+	switch {
+	case format == "" && validate:
+		return nil, errors.New("validate only applies to .json, .yaml, .yml and .xml files")
+	case !validate && schema == nil:
+		return nil, nil
+	}
+	return func(data []byte) error {
+		var err error
+		switch format {
+		case "json":
+			err = validateJSON(data, schema)
+		case "yaml":
+			err = validateYAML(data, schema)
+		case "xml":
+			err = validateXML(data)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidContent, err.Error())
+		}
+		return nil
+	}, nil
+}
+
+// validateJSON parses data as a JSON document and validates it against
+// schema, if not nil.
+func validateJSON(data []byte, schema *jsonSchema) error {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		offset := int64(len(data))
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// Offset counts the offending byte too.
+			offset = syntaxErr.Offset - 1
+		}
+		line, column := lineColumn(data, offset)
+		return fmt.Errorf("malformed JSON at line %d, column %d: %s", line, column, err.Error())
+	}
+	if schema != nil {
+		if err := schema.validate(doc); err != nil {
+			return fmt.Errorf("JSON doesn't match its schema %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// yamlLine finds the line yaml.v3 puts in its error messages.
+var yamlLine = regexp.MustCompile(`^line (\d+): `)
+
+// validateYAML parses data as a stream of YAML documents and validates each
+// against schema, if not nil.
+func validateYAML(data []byte, schema *jsonSchema) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for i := 1; ; i++ {
+		var node yaml.Node
+		err := dec.Decode(&node)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			var doc interface{}
+			if err = node.Decode(&doc); err == nil && schema != nil {
+				if err := schema.validate(jsonValue(doc)); err != nil {
+					return fmt.Errorf("YAML document %d doesn't match its schema %s", i, err.Error())
+				}
+				continue
+			}
+		}
+		if err != nil {
+			// yaml.v3 only tells the line, at the start of the message.
+			msg := strings.TrimPrefix(err.Error(), "yaml: ")
+			msg = strings.TrimSpace(strings.TrimPrefix(msg, "unmarshal errors:"))
+			if m := yamlLine.FindStringSubmatch(msg); m != nil {
+				return fmt.Errorf("malformed YAML at line %s: %s", m[1], msg[len(m[0]):])
+			}
+			return fmt.Errorf("malformed YAML: %s", msg)
+		}
+	}
+}
+
+// jsonValue converts a YAML document to the values JSON decodes to, so it
+// can be validated against a JSON Schema.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonValue(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+// validateXML checks that data is a well-formed XML document with a single
+// root element.
+func validateXML(data []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	// Any charset is fine; only the structure is checked.
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	depth, roots := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			line, column := dec.InputPos()
+			msg := err.Error()
+			var syntaxErr *xml.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				msg = syntaxErr.Msg
+			}
+			return fmt.Errorf("malformed XML at line %d, column %d: %s", line, column, msg)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if roots++; roots > 1 {
+					line, column := dec.InputPos()
+					return fmt.Errorf("malformed XML at line %d, column %d: element <%s> after the root element", line, column, tok.Name.Local)
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(tok)) > 0 {
+				line, column := dec.InputPos()
+				return fmt.Errorf("malformed XML at line %d, column %d: text outside the root element", line, column)
+			}
+		}
+	}
+	if roots == 0 {
+		return errors.New("malformed XML: no root element")
+	}
+	return nil
+}
+
+// lineColumn returns the line and column, both from 1, of the byte at
+// offset in data.
+func lineColumn(data []byte, offset int64) (int, int) {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// validatingReader passes the content of src through, holding on to it, and
+// fails with the error check returns instead of reaching EOF if the whole
+// of it doesn't pass, so it is never committed.
+type validatingReader struct {
+	src   io.Reader
+	check func([]byte) error
+	buf   bytes.Buffer
+}
+
+func (v *validatingReader) Read(p []byte) (int, error) {
+	n, err := v.src.Read(p)
+	v.buf.Write(p[:n])
+	if v.buf.Len() > maxValidatedSize {
+		return n, fmt.Errorf("%w to validate: over %d MiB", errTooLarge, maxValidatedSize>>20)
+	}
+	if err == io.EOF {
+		if cerr := v.check(v.buf.Bytes()); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
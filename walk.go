@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// walkTree walks the directory tree below root for the recursive endpoints.
+// Subdirectories are read concurrently by up to config.WalkWorkers goroutines,
+// so fn may be called from several goroutines at once and entries are not
+// reported in any particular order. fn receives the slash-separated path of
+// the entry relative to root. Returning filepath.SkipDir for a directory
+// skips its contents; any other error stops the walk and is returned.
+// maxDepth limits how many levels are descended, 0 means unlimited. Symbolic
+// links to directories are reported but not followed.
+func walkTree(ctx context.Context, root string, maxDepth int, fn func(relPath string, entry fs.DirEntry) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := config.WalkWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	tw := &treeWalker{
+		ctx:      ctx,
+		cancel:   cancel,
+		root:     root,
+		maxDepth: maxDepth,
+		fn:       fn,
+		sem:      make(chan struct{}, workers-1),
+	}
+	tw.walkDir("", 1)
+	tw.wg.Wait()
+
+	if tw.err != nil {
+		return tw.err
+	}
+	return ctx.Err()
+}
+
+type treeWalker struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	root     string
+	maxDepth int
+	fn       func(relPath string, entry fs.DirEntry) error
+	// sem bounds the number of extra goroutines. When it is full the caller
+	// walks the subdirectory itself instead of waiting for a free worker.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+func (tw *treeWalker) fail(err error) {
+	tw.errOnce.Do(func() {
+		tw.err = err
+		tw.cancel()
+	})
+}
+
+func (tw *treeWalker) walkDir(relDir string, depth int) {
+	if tw.ctx.Err() != nil {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Join(tw.root, filepath.FromSlash(relDir)))
+	if err != nil {
+		tw.fail(err)
+		return
+	}
+
+	for _, entry := range entries {
+		if tw.ctx.Err() != nil {
+			return
+		}
+		relPath := path.Join(relDir, entry.Name())
+		if err := tw.fn(relPath, entry); err != nil {
+			if entry.IsDir() && errors.Is(err, filepath.SkipDir) {
+				continue
+			}
+			tw.fail(err)
+			return
+		}
+		if !entry.IsDir() || (tw.maxDepth > 0 && depth >= tw.maxDepth) {
+			continue
+		}
+
+		select {
+		case tw.sem <- struct{}{}:
+			tw.wg.Add(1)
+			go func() {
+				defer tw.wg.Done()
+				defer func() { <-tw.sem }()
+				tw.walkDir(relPath, depth+1)
+			}()
+		default:
+			tw.walkDir(relPath, depth+1)
+		}
+	}
+}
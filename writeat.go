@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeAt overwrites the bytes of a file starting at offset with the content
+// of the request, leaving the rest of the file as it is, and returns the new
+// size. An offset past the end extends the file, the gap reading as zeros,
+// and a missing file is created, so resumable uploads can send any part in
+// any order. The content is given like for writeFile.
+func writeAt(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPatch && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if atRestEnabled() {
+		http.Error(w, errAtRestWriteAt.Error(), http.StatusNotImplemented)
+		return
+	}
+	// Parts written in place would be stored before the file could be
+	// scanned whole.
+	if config.Antivirus.enabled() {
+		http.Error(w, "Uploads are scanned for viruses and can't be written at an offset; use /upload/start", http.StatusNotImplemented)
+		return
+	}
+
+	filePath := r.FormValue("filePath")
+	offset, err := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset value", http.StatusBadRequest)
+		return
+	}
+	body, size, err := requestContentReader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+	logrus.WithFields(logrus.Fields{
+		"filePath":  filePath,
+		"offset":    offset,
+		"size":      size,
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Writing to file at offset")
+
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return
+	}
+	filePath, err = resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return
+	}
+
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if err := checkPathNotClientEncrypted(filePath); err != nil {
+		http.Error(w, err.Error(), clientKeyStatus(err))
+		return
+	}
+	var current int64
+	fileInfo, err := statFile(filePath)
+	if err == nil {
+		current = fileInfo.Size()
+	} else if !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Unable to get info for file %s: %s", filePath, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// The offset alone can make a file too large, even when the size of
+	// the content is unknown, which is then cut off at what the limit
+	// leaves room for.
+	if err := checkFileSize(r, filePath, max(current, offset+max(size, 0))); err != nil {
+		http.Error(w, fmt.Sprintf("File %s", err.Error()), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if limit := sizeLimit(r, filePath); limit > 0 {
+		body = http.MaxBytesReader(w, body, limit-offset)
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		var entries []dryRunEntry
+		if fileInfo != nil {
+			entries = append(entries, dryRunEntry{Path: filePath, Action: "writeAt", Size: current})
+		}
+		writeJSON(w, "Dry run: file not written", requestId, dryRunReport(r, entries))
+		return
+	}
+
+	if err := ensureParentDir(filePath); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create directories: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// Only the bytes the content overwrites are saved, so undoing can put
+	// them back and cut off what was added, without a copy of the file.
+	var saved *os.File
+	if fileInfo != nil && offset < current && config.TrashDir != "" {
+		if saved, err = createBackup(filePath); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to back up file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		defer saved.Close()
+	}
+	newSize, err := writeToAt(filePath, offset, body, current, saved)
+	if err == nil && fileInfo == nil {
+		err = chownCreated(filePath)
+	}
+	if err == nil && saved != nil {
+		err = saved.Close()
+	}
+	var backup string
+	if saved != nil {
+		backup = saved.Name()
+	}
+	if err != nil {
+		discardBackup(backup)
+		status := http.StatusInternalServerError
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("Unable to write to file: %s", err.Error()), status)
+		return
+	}
+	switch {
+	case fileInfo == nil:
+		recordOperation(requestActor(r), requestId, "writeAt", filePath, false, "")
+	case offset < current && saved == nil:
+		// Without a trash directory the overwritten bytes are lost.
+		recordOperation(requestActor(r), requestId, "writeAt", filePath, true, "")
+	default:
+		recordInPlace(requestActor(r), requestId, "writeAt", filePath, current, offset, backup)
+	}
+	writeJSON(w, "File written successfully", requestId, map[string]interface{}{
+		"size": newSize,
+	})
+}
+
+// writeToAt copies src into filePath starting at offset and returns the size
+// of the file afterwards. If saved isn't nil, the bytes overwritten among the
+// first size ones of the file are copied to it first.
+func writeToAt(filePath string, offset int64, src io.Reader, size int64, saved *os.File) (int64, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var dst io.Writer = io.NewOffsetWriter(f, offset)
+	if saved != nil {
+		dst = &savingWriter{f: f, pos: offset, end: size, saved: saved}
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), f.Close()
+}
+
+// savingWriter writes to f from pos, copying to saved the bytes it
+// overwrites before end.
+type savingWriter struct {
+	f     *os.File
+	pos   int64
+	end   int64
+	saved io.Writer
+	buf   []byte
+}
+
+func (w *savingWriter) Write(p []byte) (int, error) {
+	if w.pos < w.end {
+		n := min(int64(len(p)), w.end-w.pos)
+		if int64(cap(w.buf)) < n {
+			w.buf = make([]byte, n)
+		}
+		old := w.buf[:n]
+		if _, err := w.f.ReadAt(old, w.pos); err != nil {
+			return 0, err
+		}
+		if _, err := w.saved.Write(old); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.WriteAt(p, w.pos)
+	w.pos += int64(n)
+	return n, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteAtUndo(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  string
+		content string
+		want    string
+		saved   string
+	}{
+		{name: "overlapping the end", offset: "8", content: "ABCD", want: "01234567ABCD", saved: "89"},
+		{name: "inside", offset: "2", content: "AB", want: "01AB456789", saved: "23"},
+		{name: "at the end", offset: "10", content: "AB", want: "0123456789AB"},
+		{name: "past the end", offset: "12", content: "AB", want: "0123456789\x00\x00AB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, trashDir := withJournal(t)
+			root := testRoot(t)
+			withConfig(t, func(c *Config) { c.RootDir = root })
+			filePath := filepath.Join(root, "f.bin")
+			if err := os.WriteFile(filePath, []byte("0123456789"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			w := postForm(writeAt, "/writeAt?filePath=f.bin&offset="+tt.offset, url.Values{"fileContent": {tt.content}})
+			if w.Code != 200 {
+				t.Fatalf("writeAt: %d %s", w.Code, w.Body.String())
+			}
+			if got, _ := os.ReadFile(filePath); string(got) != tt.want {
+				t.Fatalf("file holds %q, want %q", got, tt.want)
+			}
+			files, _ := os.ReadDir(trashDir)
+			switch {
+			case tt.saved == "" && len(files) != 0:
+				t.Errorf("saved %d files for a write past the content", len(files))
+			case tt.saved != "" && len(files) != 1:
+				t.Errorf("saved %d files, want the overwritten bytes", len(files))
+			case tt.saved != "":
+				if saved, _ := os.ReadFile(filepath.Join(trashDir, files[0].Name())); string(saved) != tt.saved {
+					t.Errorf("saved %q, want %q", saved, tt.saved)
+				}
+			}
+
+			if w := postForm(undo, "/undo", url.Values{"filePath": {"f.bin"}}); w.Code != 200 {
+				t.Fatalf("undo: %d %s", w.Code, w.Body.String())
+			}
+			if got, _ := os.ReadFile(filePath); string(got) != "0123456789" {
+				t.Errorf("after undo the file holds %q", got)
+			}
+			if files, _ := os.ReadDir(trashDir); len(files) != 0 {
+				t.Errorf("%d saved files left after undo", len(files))
+			}
+		})
+	}
+}
+
+func TestWriteAtWithoutTrashNotUndoable(t *testing.T) {
+	withJournal(t)
+	root := testRoot(t)
+	withConfig(t, func(c *Config) {
+		c.RootDir = root
+		c.TrashDir = ""
+	})
+	if err := os.WriteFile(filepath.Join(root, "f.bin"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := postForm(writeAt, "/writeAt?filePath=f.bin&offset=0", url.Values{"fileContent": {"AB"}}); w.Code != 200 {
+		t.Fatalf("writeAt: %d %s", w.Code, w.Body.String())
+	}
+	if w := postForm(undo, "/undo", url.Values{"filePath": {"f.bin"}}); w.Code != 409 {
+		t.Errorf("undo of lost bytes: %d, want 409", w.Code)
+	}
+}
+
+func TestWriteAtSizeLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  string
+		content string
+		want    int
+	}{
+		{name: "inside the limit", offset: "90", content: "0123456789", want: 200},
+		{name: "offset past the limit", offset: "1000000000000", want: 413},
+		{name: "content past the limit", offset: "95", content: "0123456789", want: 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withJournal(t)
+			root := testRoot(t)
+			withConfig(t, func(c *Config) {
+				c.RootDir = root
+				c.MaxBodySize = 100
+			})
+
+			// A chunked body doesn't tell its size.
+			r := httptest.NewRequest("PATCH", "/writeAt?filePath=f.bin&offset="+tt.offset, strings.NewReader(tt.content))
+			r.Header.Set("Content-Type", "application/octet-stream")
+			r.ContentLength = -1
+			w := httptest.NewRecorder()
+			writeAt(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("writeAt: %d %s, want %d", w.Code, w.Body.String(), tt.want)
+			}
+			if info, err := os.Stat(filepath.Join(root, "f.bin")); err == nil && info.Size() > 100 {
+				t.Errorf("file grew to %d bytes, past the limit", info.Size())
+			}
+		})
+	}
+}
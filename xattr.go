@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// xattrPrefix is the namespace clients' attributes live in. The others hold
+// security labels and ACLs the server mustn't let clients touch.
+const xattrPrefix = "user."
+
+// maxXattrSize is the largest attribute value accepted. Attributes are meant
+// for small bits of metadata, and filesystems rarely take more.
+const maxXattrSize = 64 << 10
+
+// errXattrUnsupported is returned where the platform or filesystem has no
+// extended attributes.
+var errXattrUnsupported = errors.New("extended attributes are not supported here")
+
+// errXattrNotFound is returned for an attribute the file doesn't have.
+var errXattrNotFound = errors.New("attribute not found")
+
+// xattrErrorStatus returns the HTTP status code for an error from the
+// platform's attribute functions.
+func xattrErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errXattrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, errXattrNotFound), errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// formXattrName returns the required attribute name form value, which must
+// be in the user namespace.
+func formXattrName(r *http.Request) (string, error) {
+	name := r.FormValue("name")
+	if name == "" {
+		return "", errors.New("name is required")
+	}
+	if !strings.HasPrefix(name, xattrPrefix) || len(name) == len(xattrPrefix) {
+		return "", fmt.Errorf("Invalid name: attributes must be in the %s namespace", xattrPrefix)
+	}
+	return name, nil
+}
+
+// encodeXattr returns value as the client asked for it with encoding.
+func encodeXattr(value []byte, encoding string) string {
+	if encoding == "base64" {
+		return base64.StdEncoding.EncodeToString(value)
+	}
+	return string(value)
+}
+
+// xattrPath resolves the filePath form value of r for the attribute
+// handlers, writing the error response and returning "" if it fails.
+func xattrPath(w http.ResponseWriter, r *http.Request) string {
+	filePath := r.FormValue("filePath")
+	if filePath == "" {
+		http.Error(w, "filePath is required", http.StatusBadRequest)
+		return ""
+	}
+	filePath, err := resolvePath(r, filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filePath: %s", err.Error()), pathErrorStatus(err))
+		return ""
+	}
+	return filePath
+}
+
+// getXattrs returns the extended attribute name of filePath, or all of its
+// attributes in the user namespace without name. Values are text unless
+// encoding=base64 is asked for.
+func getXattrs(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"filePath":  r.FormValue("filePath"),
+		"name":      r.FormValue("name"),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Getting extended attributes")
+
+	encoding, err := formEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var names []string
+	if r.FormValue("name") != "" {
+		name, err := formXattrName(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names = []string{name}
+	}
+	filePath := xattrPath(w, r)
+	if filePath == "" {
+		return
+	}
+
+	if names == nil {
+		all, err := listXattr(filePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to list attributes: %s", err.Error()), xattrErrorStatus(err))
+			return
+		}
+		for _, name := range all {
+			if strings.HasPrefix(name, xattrPrefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+	attrs := make(map[string]string, len(names))
+	for _, name := range names {
+		value, err := getXattr(filePath, name)
+		if errors.Is(err, errXattrNotFound) && r.FormValue("name") == "" {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to get attribute %s: %s", name, err.Error()), xattrErrorStatus(err))
+			return
+		}
+		attrs[name] = encodeXattr(value, encoding)
+	}
+	writeJSON(w, "Attributes retrieved successfully", requestId, map[string]interface{}{
+		"attributes": attrs,
+	})
+}
+
+// setXattrHandler sets the extended attribute name of filePath to value,
+// which is text unless encoding=base64 is given.
+func setXattrHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"filePath":  r.FormValue("filePath"),
+		"name":      r.FormValue("name"),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Setting extended attribute")
+
+	name, err := formXattrName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoding, err := formEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value := []byte(r.FormValue("value"))
+	if encoding == "base64" {
+		if value, err = base64.StdEncoding.DecodeString(r.FormValue("value")); err != nil {
+			http.Error(w, "Invalid base64 value", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(value) > maxXattrSize {
+		http.Error(w, fmt.Sprintf("value exceeds %d bytes", maxXattrSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	filePath := xattrPath(w, r)
+	if filePath == "" {
+		return
+	}
+
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if err := setXattr(filePath, name, value); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to set attribute: %s", err.Error()), xattrErrorStatus(err))
+		return
+	}
+	writeJSON(w, "Attribute set successfully", requestId, nil)
+}
+
+// removeXattrHandler removes the extended attribute name from filePath.
+func removeXattrHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := generateUUID()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"filePath":  r.FormValue("filePath"),
+		"name":      r.FormValue("name"),
+		"requestId": requestId,
+		"serverId":  serverId,
+	}).Info("Removing extended attribute")
+
+	name, err := formXattrName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath := xattrPath(w, r)
+	if filePath == "" {
+		return
+	}
+
+	unlock := lockWrites(filePath)
+	defer unlock()
+	if err := removeXattr(filePath, name); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to remove attribute: %s", err.Error()), xattrErrorStatus(err))
+		return
+	}
+	writeJSON(w, "Attribute removed successfully", requestId, nil)
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrError translates the errors of the attribute system calls.
+func xattrError(err error) error {
+	switch {
+	case errors.Is(err, unix.ENODATA):
+		return errXattrNotFound
+	case errors.Is(err, unix.ENOTSUP):
+		return errXattrUnsupported
+	}
+	return err
+}
+
+// listXattr returns the names of the extended attributes of filePath.
+func listXattr(filePath string) ([]string, error) {
+	for {
+		size, err := unix.Listxattr(filePath, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := unix.Listxattr(filePath, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// An attribute was added in between.
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXattr returns the value of the extended attribute name of filePath.
+func getXattr(filePath string, name string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(filePath, name, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		buf := make([]byte, size)
+		n, err := unix.Getxattr(filePath, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		return buf[:n], nil
+	}
+}
+
+// setXattr sets the extended attribute name of filePath to value.
+func setXattr(filePath string, name string, value []byte) error {
+	return xattrError(unix.Setxattr(filePath, name, value, 0))
+}
+
+// removeXattr removes the extended attribute name of filePath.
+func removeXattr(filePath string, name string) error {
+	return xattrError(unix.Removexattr(filePath, name))
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+// listXattr fails where extended attributes aren't supported.
+func listXattr(filePath string) ([]string, error) {
+	return nil, errXattrUnsupported
+}
+
+// getXattr fails where extended attributes aren't supported.
+func getXattr(filePath string, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+// setXattr fails where extended attributes aren't supported.
+func setXattr(filePath string, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+// removeXattr fails where extended attributes aren't supported.
+func removeXattr(filePath string, name string) error {
+	return errXattrUnsupported
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH64 primes.
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is the XXH64 hash with seed 0, a fast non-cryptographic checksum
+// for spotting corruption in large files.
+type xxhash64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	buf            [32]byte
+	n              int
+}
+
+var _ hash.Hash64 = (*xxhash64)(nil)
+
+func newXXHash64() *xxhash64 {
+	h := &xxhash64{}
+	h.Reset()
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (h *xxhash64) Reset() {
+	var seed uint64
+	h.v1 = seed + xxPrime1 + xxPrime2
+	h.v2 = seed + xxPrime2
+	h.v3 = seed
+	h.v4 = seed - xxPrime1
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxhash64) Size() int { return 8 }
+
+func (h *xxhash64) BlockSize() int { return 32 }
+
+func (h *xxhash64) Write(p []byte) (int, error) {
+	written := len(p)
+	h.total += uint64(written)
+	if h.n+len(p) < 32 {
+		h.n += copy(h.buf[h.n:], p)
+		return written, nil
+	}
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		p = p[c:]
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for len(p) >= 32 {
+		h.stripe(p[:32])
+		p = p[32:]
+	}
+	h.n = copy(h.buf[:], p)
+	return written, nil
+}
+
+// stripe consumes 32 bytes into the four accumulators.
+func (h *xxhash64) stripe(b []byte) {
+	h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(b[0:8]))
+	h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(b[8:16]))
+	h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(b[16:24]))
+	h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (h *xxhash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) +
+			bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+		acc = xxMergeRound(acc, h.v1)
+		acc = xxMergeRound(acc, h.v2)
+		acc = xxMergeRound(acc, h.v3)
+		acc = xxMergeRound(acc, h.v4)
+	} else {
+		acc = xxPrime5
+	}
+	acc += h.total
+
+	b := h.buf[:h.n]
+	for ; len(b) >= 8; b = b[8:] {
+		acc ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		acc = bits.RotateLeft64(acc, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		acc ^= uint64(c) * xxPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxPrime1
+	}
+
+	acc ^= acc >> 33
+	acc *= xxPrime2
+	acc ^= acc >> 29
+	acc *= xxPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+func (h *xxhash64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}